@@ -1,12 +1,10 @@
 package main
 
 import (
-	"encoding/json"
 	"log"
 	"slices"
 
 	"github.com/maxence-charriere/go-app/v10/pkg/app"
-	shell "github.com/stateless-minds/go-ipfs-api"
 )
 
 // supplier is a component that holds cyber-gubi. A component is a
@@ -14,7 +12,7 @@ import (
 // embedding app.Compo into a struct.
 type associate struct {
 	app.Compo
-	sh               *shell.Shell
+	store            Store
 	loggedIn         bool
 	userID           string
 	associateName    string
@@ -24,8 +22,7 @@ type associate struct {
 }
 
 func (a *associate) OnMount(ctx app.Context) {
-	sh := shell.NewShell("localhost:5001")
-	a.sh = sh
+	a.store = newStore()
 
 	ctx.GetState("loggedIn", &a.loggedIn)
 	if !a.loggedIn {
@@ -51,7 +48,7 @@ func (a *associate) getAssociates() {
 
 	associateNames := []string{}
 
-	for name := range a.currentUser.Descriptor {
+	for _, name := range a.currentUser.faceNames() {
 		if name != a.associateName {
 			associateNames = append(associateNames, name)
 		}
@@ -77,7 +74,7 @@ func (a *associate) removeAssociate(ctx app.Context, e app.Event) {
 	e.PreventDefault()
 	name := ctx.JSSrc().Get("value").String()
 
-	for associate := range a.currentUser.Descriptor {
+	for _, associate := range a.currentUser.faceNames() {
 		if name == associate {
 			a.updateUser(ctx, name)
 		}
@@ -88,18 +85,15 @@ func (a *associate) removeAssociate(ctx app.Context, e app.Event) {
 func (a *associate) updateUser(ctx app.Context, name string) {
 	ctx.Async(func() {
 		user := a.currentUser
+		delete(user.Templates, name)
 		delete(user.Descriptor, name)
-		userJSON, err := json.Marshal(user)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		err = a.sh.OrbitDocsPutEnc(dbUser, userJSON)
+		err := a.store.PutUser(user)
 		if err != nil {
 			log.Fatal(err)
 		}
 
 		ctx.Dispatch(func(ctx app.Context) {
+			delete(a.currentUser.Templates, name)
 			delete(a.currentUser.Descriptor, name)
 			for i, associate := range a.associates {
 				if associate == name {
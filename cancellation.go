@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrSubscriptionPaused    = errors.New("subscription is paused")
+	ErrSubscriptionRunning   = errors.New("subscription is not paused")
+	ErrSubscriptionCancelled = errors.New("subscription is cancelled")
+	ErrSubscriptionInactive  = errors.New("subscription period is over")
+	ErrNoCharge              = errors.New("subscription has no settled charge to refund")
+)
+
+func (s Subscription) paused() bool {
+	return !s.PausedAt.IsZero()
+}
+
+func (s Subscription) cancelled() bool {
+	return !s.CancelledAt.IsZero()
+}
+
+// clock returns the time the subscription is at: the time it was paused, or
+// now while it runs.
+func (s Subscription) clock(now time.Time) time.Time {
+	if s.paused() {
+		return s.PausedAt
+	}
+	return now
+}
+
+// expired reports whether the subscription can be deleted at now. Paused
+// subscriptions are kept until they are resumed, and cancelled ones until
+// the business paid back the refund.
+func (s Subscription) expired(now time.Time) bool {
+	return !s.paused() && !s.active(now) && s.Refund == 0
+}
+
+// pauseSubscription stops the clock of a subscription. The time left is
+// given back on resume, and no renewal is charged meanwhile.
+func pauseSubscription(s Subscription, now time.Time) (Subscription, error) {
+	switch {
+	case s.paused():
+		return Subscription{}, ErrSubscriptionPaused
+	case s.cancelled():
+		return Subscription{}, ErrSubscriptionCancelled
+	case !now.Before(s.EndDate):
+		return Subscription{}, ErrSubscriptionInactive
+	}
+
+	s.PausedAt = now
+	return s, nil
+}
+
+// resumeSubscription starts the clock of a paused subscription again with
+// the time that was left when it was paused.
+func resumeSubscription(s Subscription, now time.Time) (Subscription, error) {
+	if !s.paused() {
+		return Subscription{}, ErrSubscriptionRunning
+	}
+
+	s.EndDate = now.Add(s.EndDate.Sub(s.PausedAt))
+	s.PausedAt = time.Time{}
+	return s, nil
+}
+
+// cancelSubscription stops the renewals of a subscription. Without a refund
+// it runs until its end date. With a refund it ends now, and the business
+// owes back the unused time, which it pays the next time it comes online as
+// only the business can sign the transfer.
+func cancelSubscription(s Subscription, refund bool, now time.Time) (Subscription, error) {
+	if s.cancelled() {
+		return Subscription{}, ErrSubscriptionCancelled
+	}
+
+	s.AutoRenew = false
+	s.CancelledAt = now
+
+	if refund {
+		s.PaidUntil = now.Add(s.EndDate.Sub(s.clock(now)))
+		s.EndDate = now
+		s.PausedAt = time.Time{}
+		s.Refund = s.refundOwed()
+	}
+
+	return s, nil
+}
+
+// refundOwed returns what the subscriber expects back for a subscription
+// cancelled with a refund: the unused time between the cancellation and the
+// end of the time paid for, and never more than the price. The business
+// pays back what the ledger shows it was paid instead, see
+// subscriptionRefund.
+func (s Subscription) refundOwed() Money {
+	if s.CancelledAt.IsZero() || s.PaidUntil.IsZero() {
+		return 0
+	}
+
+	paid := s
+	paid.EndDate = s.PaidUntil
+	return min(unusedShare(paid, s.CancelledAt), s.Price)
+}
+
+// settleCancellations pays back the refunds owed to the subscribers of the
+// plans of a business that cancelled, and returns the amount refunded. A
+// refund the balance does not cover yet is paid on a later run.
+func settleCancellations(store Store, l *ledger, merchantID string, now time.Time) (Money, error) {
+	plans, err := store.PlansBy(merchantID)
+	if err != nil {
+		return 0, err
+	}
+
+	subscriptions, err := store.Subscriptions()
+	if err != nil {
+		return 0, err
+	}
+
+	ownPlans := map[string]Plan{}
+	for _, p := range plans {
+		ownPlans[p.ID] = p
+	}
+
+	// a subscription can be stored by several peers
+	seen := map[string]bool{}
+
+	var refunded Money
+	for _, s := range subscriptions {
+		plan, sold := ownPlans[s.PlanID]
+		if !sold || s.Refund <= 0 || seen[s.ID] {
+			continue
+		}
+		seen[s.ID] = true
+
+		state, err := l.state()
+		if err != nil {
+			return 0, err
+		}
+
+		postings, chargeID, err := subscriptionRefund(state, s, plan, s.CancelledAt, s.PaidUntil)
+		if errors.Is(err, ErrNoCharge) {
+			// nothing was paid that could be given back, or the charge
+			// did not reach this peer yet
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+
+		if len(postings) > 0 {
+			err = payRefund(store, l, plan, s, chargeID, postings, now)
+			if errors.Is(err, ErrInsufficientFunds) {
+				continue
+			} else if err != nil {
+				return 0, err
+			}
+			refunded += postings[0].Amount
+		}
+
+		err = store.DeleteSubscription(s.ID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return refunded, nil
+}
+
+// lastCharge returns the settled entry of the last charge of a subscription
+// and the start of the interval it paid for: the due date of its last
+// renewal, or the time it was subscribed. Only a charge that moved money from
+// the subscriber to the business counts, whatever the subscription says.
+func lastCharge(state ledgerState, s Subscription, merchantID string) (JournalEntry, time.Time, bool) {
+	start, renewed := state.renewed[s.ID]
+	entry, ok := state.settled[renewalID(s.ID, start)]
+	if !renewed || !ok {
+		entry, ok = state.settled[subscribeTransactionID(s.ID)]
+		start = entry.Timestamp
+	}
+	if !ok || !entry.pays(s.UserID, merchantID) {
+		return JournalEntry{}, time.Time{}, false
+	}
+
+	return entry, start, true
+}
+
+// subscriptionRefund returns the postings that pay back the time between
+// from and until of the last charge of a subscription, and the transaction
+// of that charge, within the interval the charge paid for. The refund is
+// the same share of what the business and every country received.
+func subscriptionRefund(state ledgerState, s Subscription, plan Plan, from, until time.Time) ([]Posting, string, error) {
+	charge, start, ok := lastCharge(state, s, plan.CreatedBy)
+	if !ok {
+		return nil, "", ErrNoCharge
+	}
+
+	end := nextPeriod(plan.Interval, start)
+	if from.Before(start) {
+		from = start
+	}
+	if until.After(end) {
+		until = end
+	}
+	left, whole := until.Sub(from), end.Sub(start)
+	if left <= 0 {
+		return nil, charge.TransactionID, nil
+	}
+
+	return refundPostings(charge, s.UserID, plan.CreatedBy, int64(left), int64(whole)), charge.TransactionID, nil
+}
+
+// refundPostings pays a share of a charge back to the subscriber, taken from
+// the business and from the countries that collected tax on it, each
+// rounded down to the cent.
+func refundPostings(charge JournalEntry, subscriberID, merchantID string, num, den int64) []Posting {
+	var postings []Posting
+	var total Money
+	for _, p := range charge.Postings {
+		if p.Amount <= 0 || (p.AccountID != merchantID && !isCountryAccount(p.AccountID)) {
+			continue
+		}
+
+		amount := p.Amount.share(num, den)
+		if amount > 0 {
+			postings = append(postings, Posting{AccountID: p.AccountID, Amount: -amount})
+			total += amount
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	return append([]Posting{{AccountID: subscriberID, Amount: total}}, postings...)
+}
+
+// capRefund scales the postings of a refund down so that the business pays
+// at most most of it. The countries give back the same share.
+func capRefund(postings []Posting, merchantID string, most Money) []Posting {
+	var owed Money
+	for _, p := range postings {
+		if p.AccountID == merchantID {
+			owed = -p.Amount
+		}
+	}
+	if owed <= most {
+		return postings
+	}
+
+	var capped []Posting
+	var total Money
+	for _, p := range postings[1:] {
+		amount := (-p.Amount).share(int64(max(most, 0)), int64(owed))
+		if amount > 0 {
+			capped = append(capped, Posting{AccountID: p.AccountID, Amount: -amount})
+			total += amount
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	return append([]Posting{{AccountID: postings[0].AccountID, Amount: total}}, capped...)
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// ceremonyTimeout is how long a begun registration or login can be finished.
+const ceremonyTimeout = 5 * time.Minute
+
+// relyingPartyID is the relying party the credentials are scoped to.
+const relyingPartyID = "localhost"
+
+var (
+	ErrUnknownSession = errors.New("unknown or expired webauthn session")
+	ErrNoPublicKey    = errors.New("no verifiable credential, register this device again")
+	ErrClonedKey      = errors.New("the authenticator may have been cloned, login refused")
+	ErrSigningKey     = errors.New("invalid signing key")
+	ErrUserExists     = errors.New("user already registered")
+)
+
+// ceremonyUser identifies the user of a ceremony.
+type ceremonyUser struct {
+	ID          string    `json:"user_id"`
+	Name        string    `json:"name"`
+	DisplayName string    `json:"display_name"`
+	SigningKey  []byte    `json:"signing_key"` // Key of the device, registered by the assertion of the login
+	Face        []float32 `json:"face"`        // Descriptor of the face of an individual, checked against the enrolled individuals
+}
+
+// registrationStart holds the options passed to navigator.credentials.create.
+type registrationStart struct {
+	Session string                      `json:"session"`
+	Options protocol.CredentialCreation `json:"options"`
+}
+
+// registrationFinish holds the credential the server verified, which the
+// first key of the user registers.
+type registrationFinish struct {
+	CredentialID []byte `json:"credential_id"`
+	PublicKey    []byte `json:"public_key"`
+}
+
+// loginStart holds the options passed to navigator.credentials.get. The
+// challenge is the hash of the registration of the signing key with Nonce,
+// so the assertion signs that registration.
+type loginStart struct {
+	Session string                       `json:"session"`
+	Options protocol.CredentialAssertion `json:"options"`
+	Nonce   []byte                       `json:"nonce"`
+}
+
+// ceremonySession is the state kept between the begin and finish steps of a
+// ceremony. It is bound to a random session ID and used once.
+type ceremonySession struct {
+	user    User
+	data    webauthn.SessionData
+	face    []float32
+	expires time.Time
+}
+
+// ceremonyServer is the relying party. It issues the challenges and verifies
+// the attestations and assertions of the authenticators, so a login only
+// succeeds with a signature of the private key registered for the user. It
+// runs next to the client, so the other peers do not take its word for a
+// login: the assertion signs the registration of the key of the device, and
+// every peer verifies it against the credentials registered to the user.
+type ceremonyServer struct {
+	webAuthn *webauthn.WebAuthn
+	store    Store
+	mu       sync.Mutex
+	sessions map[string]ceremonySession
+	// faces is the index of the faces of the individuals, which a new
+	// individual is checked against. facesMu serializes the registrations
+	// of individuals, so two of the same face can not both pass.
+	faces   *faceDeduper
+	facesMu sync.Mutex
+}
+
+func newWebAuthn() (*webauthn.WebAuthn, error) {
+	return webauthn.New(&webauthn.Config{
+		RPDisplayName: "cyber-gubi",                      // Display Name for your site
+		RPID:          relyingPartyID,                    // Generally the FQDN for your site
+		RPOrigins:     []string{"http://localhost:8000"}, // Allowed origins for WebAuthn requests
+	})
+}
+
+func newCeremonyServer(store Store) (*ceremonyServer, error) {
+	w, err := newWebAuthn()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ceremonyServer{
+		webAuthn: w,
+		store:    store,
+		sessions: map[string]ceremonySession{},
+		faces:    newFaceDeduper(store),
+	}, nil
+}
+
+// handle registers the ceremony endpoints.
+func (s *ceremonyServer) handle(mux *http.ServeMux) {
+	mux.HandleFunc("POST /webauthn/register/begin", s.beginRegistration)
+	mux.HandleFunc("POST /webauthn/register/finish", s.finishRegistration)
+	mux.HandleFunc("POST /webauthn/login/begin", s.beginLogin)
+	mux.HandleFunc("POST /webauthn/login/finish", s.finishLogin)
+}
+
+func (s *ceremonyServer) beginRegistration(w http.ResponseWriter, r *http.Request) {
+	var cu ceremonyUser
+	err := json.NewDecoder(r.Body).Decode(&cu)
+	if err != nil || len(cu.ID) == 0 {
+		http.Error(w, "invalid user", http.StatusBadRequest)
+		return
+	}
+
+	_, err = s.store.User(cu.ID)
+	if err == nil {
+		http.Error(w, ErrUserExists.Error(), http.StatusConflict)
+		return
+	} else if !errors.Is(err, ErrNotFound) {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// individuals are pseudonymous, a registration without a name is one
+	// and must show a face that has no wallet yet
+	if len(cu.Name) == 0 {
+		s.facesMu.Lock()
+		passed := s.checkFace(w, cu.Face)
+		s.facesMu.Unlock()
+		if !passed {
+			return
+		}
+	}
+
+	user := User{
+		ID:          []byte(cu.ID),
+		Name:        cu.Name,
+		DisplayName: cu.DisplayName,
+	}
+
+	options, data, err := s.webAuthn.BeginRegistration(&user,
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			AuthenticatorAttachment: protocol.Platform,
+			ResidentKey:             protocol.ResidentKeyRequirementRequired,
+			UserVerification:        protocol.VerificationRequired,
+		}),
+	)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, registrationStart{
+		Session: s.startSession(ceremonySession{user: user, data: *data, face: cu.Face}),
+		Options: *options,
+	})
+}
+
+// checkFace answers with a conflict when the face already has a wallet, or
+// with a bad request when there is no face, and reports whether the face
+// passed. It is called with facesMu held.
+func (s *ceremonyServer) checkFace(w http.ResponseWriter, face []float32) bool {
+	if len(face) == 0 {
+		http.Error(w, "no face to register", http.StatusBadRequest)
+		return false
+	}
+
+	err := s.faces.check(face)
+	if errors.Is(err, ErrDuplicateFace) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return false
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	return true
+}
+
+func (s *ceremonyServer) finishRegistration(w http.ResponseWriter, r *http.Request) {
+	session, err := s.takeSession(r.URL.Query().Get("session"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	credential, err := s.webAuthn.FinishRegistration(&session.user, session.data, r)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "registration could not be verified", http.StatusUnauthorized)
+		return
+	}
+
+	// the face is checked again and enrolled with the user, as another
+	// individual of the same face may have registered while the ceremony ran
+	individual := len(session.user.Name) == 0
+	if individual {
+		s.facesMu.Lock()
+		defer s.facesMu.Unlock()
+
+		if !s.checkFace(w, session.face) {
+			return
+		}
+	}
+
+	// the ID may have been taken while the ceremony ran
+	_, err = s.store.User(string(session.user.ID))
+	if err == nil {
+		http.Error(w, ErrUserExists.Error(), http.StatusConflict)
+		return
+	} else if !errors.Is(err, ErrNotFound) {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// only the verified credential and the face of an individual are
+	// stored, the client adds the business details and the faces of the
+	// associates to the record
+	user := session.user
+	user.AddCredential(*credential)
+	user.RegisteredAt = time.Now().UTC()
+	if individual {
+		user.enrollFace("user", session.face)
+	}
+
+	err = s.store.PutUser(user)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, registrationFinish{
+		CredentialID: credential.ID,
+		PublicKey:    credential.PublicKey,
+	})
+}
+
+func (s *ceremonyServer) beginLogin(w http.ResponseWriter, r *http.Request) {
+	var cu ceremonyUser
+	err := json.NewDecoder(r.Body).Decode(&cu)
+	if err != nil || len(cu.ID) == 0 {
+		http.Error(w, "invalid user", http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.store.User(cu.ID)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(cu.SigningKey) != ed25519.PublicKeySize {
+		http.Error(w, ErrSigningKey.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !hasPublicKey(user) {
+		http.Error(w, ErrNoPublicKey.Error(), http.StatusConflict)
+		return
+	}
+
+	options, data, err := s.webAuthn.BeginLogin(&user, webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// the authenticator signs the registration of the key of the device
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	registration := KeyRegistration{
+		UserID:    cu.ID,
+		Kind:      KeySigning,
+		PublicKey: cu.SigningKey,
+		Nonce:     nonce,
+	}
+	options.Response.Challenge = registration.challenge()
+	data.Challenge = base64.RawURLEncoding.EncodeToString(registration.challenge())
+
+	writeJSON(w, loginStart{
+		Session: s.startSession(ceremonySession{user: user, data: *data}),
+		Options: *options,
+		Nonce:   nonce,
+	})
+}
+
+func (s *ceremonyServer) finishLogin(w http.ResponseWriter, r *http.Request) {
+	session, err := s.takeSession(r.URL.Query().Get("session"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	credential, err := s.webAuthn.FinishLogin(&session.user, session.data, r)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "login could not be verified", http.StatusUnauthorized)
+		return
+	}
+
+	if credential.Authenticator.CloneWarning {
+		log.Println(ErrClonedKey, string(session.user.ID))
+		http.Error(w, ErrClonedKey.Error(), http.StatusForbidden)
+		return
+	}
+
+	// reload the user, it may have changed since the login began
+	user, err := s.store.User(string(session.user.ID))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// keep the sign count for the clone detection of the next login
+	user.UpdateCredential(*credential)
+
+	err = s.store.PutUser(user)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// startSession keeps the state of a ceremony under a new random session ID.
+func (s *ceremonyServer) startSession(session ceremonySession) string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	id := base64.RawURLEncoding.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for sid, session := range s.sessions {
+		if now.After(session.expires) {
+			delete(s.sessions, sid)
+		}
+	}
+
+	session.expires = now.Add(ceremonyTimeout)
+	s.sessions[id] = session
+
+	return id
+}
+
+// takeSession removes and returns a session, so that each challenge can be
+// answered only once.
+func (s *ceremonyServer) takeSession(id string) (ceremonySession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	delete(s.sessions, id)
+	if !ok || time.Now().After(session.expires) {
+		return ceremonySession{}, ErrUnknownSession
+	}
+
+	return session, nil
+}
+
+// hasPublicKey reports whether the user has a credential that can be
+// verified. Users registered before the ceremonies were verified only have
+// the credential ID.
+func hasPublicKey(user User) bool {
+	for _, c := range user.CredentialIDs {
+		if len(c.PublicKey) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println(err)
+	}
+}
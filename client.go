@@ -1,12 +1,11 @@
 package main
 
 import (
-	"encoding/json"
 	"log"
-	"strconv"
+	"sort"
+	"time"
 
 	"github.com/maxence-charriere/go-app/v10/pkg/app"
-	shell "github.com/stateless-minds/go-ipfs-api"
 )
 
 // client is a component that holds cyber-gubi. A component is a
@@ -14,61 +13,112 @@ import (
 // embedding app.Compo into a struct.
 type client struct {
 	app.Compo
-	sh            *shell.Shell
+	store         Store
 	loggedIn      bool
+	userID        string
 	businessName  string
 	userBalance   UserBalance
-	plan          Plan
+	plans         map[string]Plan
 	subscriptions []Subscription
-	totalIncome   int
+	renewals      []Renewal
+	totalIncome   Money
 }
 
 func (c *client) OnMount(ctx app.Context) {
-	sh := shell.NewShell("localhost:5001")
-	c.sh = sh
+	c.store = newStore()
 
 	ctx.GetState("loggedIn", &c.loggedIn)
 	if !c.loggedIn {
 		ctx.Navigate("/auth")
 	}
 
+	ctx.GetState("userID", &c.userID)
 	ctx.GetState("businessName", &c.businessName)
 
 	ctx.GetState("balance", &c.userBalance)
 
-	ctx.GetState("plan", &c.plan)
-
 	c.getSubscriptions(ctx)
+	c.getRenewals(ctx)
 }
 
 func (c *client) getSubscriptions(ctx app.Context) {
 	ctx.Async(func() {
-		subs, err := c.sh.OrbitDocsQuery(dbSubscription, "all", "")
+		// the subscribers renew their subscriptions on their own devices, so
+		// only those that were not renewed in time are let go of here
+		err := c.store.DeleteExpiredSubscriptions()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		plans, err := c.store.PlansBy(c.userID)
 		if err != nil {
 			log.Fatal(err)
 		}
 
+		ownPlans := map[string]Plan{}
+		for _, p := range plans {
+			ownPlans[p.ID] = p
+		}
+
+		all, err := c.store.Subscriptions()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// only the subscriptions to the plans of the business, counted
+		// once however many peers stored them
+		seen := map[string]bool{}
 		subscriptions := []Subscription{}
-		var totalIncome int
 
-		if len(subs) != 0 {
-			err = json.Unmarshal(subs, &subscriptions) // Unmarshal the byte slice directly
-			if err != nil {
-				log.Fatal(err)
+		var totalIncome Money
+
+		now := time.Now()
+		for _, sub := range all {
+			if _, sold := ownPlans[sub.PlanID]; !sold || seen[sub.ID] {
+				continue
 			}
+			seen[sub.ID] = true
+			subscriptions = append(subscriptions, sub)
 
-			for _, sub := range subscriptions {
-				totalIncome += sub.Price
+			if sub.active(now) {
+				totalIncome += sub.monthly()
 			}
 		}
 
 		ctx.Dispatch(func(ctx app.Context) {
+			c.plans = ownPlans
 			c.subscriptions = subscriptions
 			c.totalIncome = totalIncome
 		})
 	})
 }
 
+// getRenewals loads the charges of the renewals of the subscriptions sold by
+// the business.
+func (c *client) getRenewals(ctx app.Context) {
+	ctx.Async(func() {
+		all, err := c.store.Renewals(c.userID)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		renewals := []Renewal{}
+		for _, r := range all {
+			if r.MerchantID == c.userID {
+				renewals = append(renewals, r)
+			}
+		}
+
+		sort.Slice(renewals, func(a, b int) bool {
+			return renewals[a].LastAttempt.After(renewals[b].LastAttempt)
+		})
+
+		ctx.Dispatch(func(ctx app.Context) {
+			c.renewals = renewals
+		})
+	})
+}
+
 // The Render method is where the component appearance is defined. Here, a
 // client is displayed.
 func (c *client) Render() app.UI {
@@ -82,7 +132,7 @@ func (c *client) Render() app.UI {
 						app.Span().Text("Balance"),
 					),
 					app.Div().Class("summary-balance").Body(
-						app.Span().Text(strconv.Itoa(c.userBalance.Balance/100)+" GUBI"),
+						app.Span().Text(c.userBalance.Balance.gubi()),
 					),
 				),
 			),
@@ -96,8 +146,8 @@ func (c *client) Render() app.UI {
 					),
 					app.Div().Class("lower-row").Body(
 						app.Div().Class("card-item").Body(
-							app.Span().Class("span-header").Text("Recurring Income"),
-							app.Span().Class("span-body").Text(strconv.Itoa(c.totalIncome/100)+" GUBI"),
+							app.Span().Class("span-header").Text("Recurring Income per Month"),
+							app.Span().Class("span-body").Text(c.totalIncome.gubi()),
 						),
 					),
 				),
@@ -113,18 +163,47 @@ func (c *client) Render() app.UI {
 							app.Div().Class("s-details").Body(
 								app.Div().Class("c-title").Body(
 									app.Span().Text("User ID: "+c.subscriptions[i].UserID),
+									app.Span().Text(c.plans[c.subscriptions[i].PlanID].Tier),
 								),
 								app.Div().Class("s-time").Body(
 									app.Span().Text(c.subscriptions[i].StartDate.Format("2006-01-02 15:04")),
 									app.Span().Text(c.subscriptions[i].EndDate.Format("2006-01-02 15:04")),
+									app.If(c.subscriptions[i].paused(), func() app.UI {
+										return app.Span().Text("Paused")
+									}).ElseIf(c.subscriptions[i].Refund > 0, func() app.UI {
+										return app.Span().Text("Cancelled, refund of " + c.subscriptions[i].refundOwed().gubi() + " due")
+									}).ElseIf(c.subscriptions[i].cancelled(), func() app.UI {
+										return app.Span().Text("Cancelled")
+									}),
 								),
 							),
 							app.Div().Class("s-price").Body(
-								app.Span().Text(strconv.Itoa(c.subscriptions[i].Price/100)+" GUBI"),
+								app.Span().Text(c.subscriptions[i].Price.gubi()),
 							),
 						)
 					}),
 				),
+				app.If(len(c.renewals) > 0, func() app.UI {
+					return app.Div().Class("subscriptions c-sub").Body(
+						app.Span().Class("s-desc").Text("Renewals"),
+						app.Range(c.renewals).Slice(func(i int) app.UI {
+							return app.Div().Class("subscription").Body(
+								app.Div().Class("s-details").Body(
+									app.Div().Class("c-title").Body(
+										app.Span().Text("User ID: "+c.renewals[i].UserID),
+									),
+									app.Div().Class("s-time").Body(
+										app.Span().Text(c.renewals[i].Due.Format("2006-01-02 15:04")),
+										app.Span().Text(c.renewals[i].State),
+									),
+								),
+								app.Div().Class("s-price").Body(
+									app.Span().Text(c.renewals[i].Price.gubi()),
+								),
+							).Style("pointer-events", "none")
+						}),
+					)
+				}),
 			),
 		),
 	)
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const dbTombstone = "tombstone"
+
+var ErrAccountClosed = errors.New("account is closed")
+
+// Tombstone is the signed record left behind by a deleted account. It is
+// signed with a key registered to the account, and it tells the other peers
+// that the ID no longer receives payments.
+type Tombstone struct {
+	ID                string    `mapstructure:"_id" json:"_id" validate:"uuid_rfc4122"`                                 // User id of the deleted account
+	BurnTransactionID string    `mapstructure:"burn_transaction_id" json:"burn_transaction_id" validate:"uuid_rfc4122"` // Transaction that burned the balance, empty when there was nothing left
+	Burned            Money     `mapstructure:"burned" json:"burned" validate:"uuid_rfc4122"`                           // Cents burned
+	Refunded          Money     `mapstructure:"refunded" json:"refunded" validate:"uuid_rfc4122"`                       // Cents refunded to the subscribers of the account
+	Timestamp         time.Time `mapstructure:"timestamp" json:"timestamp" validate:"uuid_rfc4122"`                     // Time of the deletion
+	PublicKey         []byte    `mapstructure:"public_key" json:"public_key" validate:"uuid_rfc4122"`                   // Key of the account
+	Signature         []byte    `mapstructure:"signature" json:"signature" validate:"uuid_rfc4122"`                     // Signature over the content
+}
+
+func newTombstone(userID, burnID string, burned, refunded Money, key ed25519.PrivateKey) Tombstone {
+	t := Tombstone{
+		ID:                userID,
+		BurnTransactionID: burnID,
+		Burned:            burned,
+		Refunded:          refunded,
+		Timestamp:         time.Now().UTC(),
+		PublicKey:         key.Public().(ed25519.PublicKey),
+	}
+	t.Signature = ed25519.Sign(key, t.content())
+
+	return t
+}
+
+// content returns the canonical bytes that are signed.
+func (t Tombstone) content() []byte {
+	b, _ := json.Marshal(struct {
+		ID                string `json:"id"`
+		BurnTransactionID string `json:"burn_transaction_id"`
+		Burned            Money  `json:"burned"`
+		Refunded          Money  `json:"refunded"`
+		Timestamp         string `json:"timestamp"`
+		PublicKey         []byte `json:"public_key"`
+	}{
+		ID:                t.ID,
+		BurnTransactionID: t.BurnTransactionID,
+		Burned:            t.Burned,
+		Refunded:          t.Refunded,
+		Timestamp:         t.Timestamp.UTC().Format(time.RFC3339Nano),
+		PublicKey:         t.PublicKey,
+	})
+	return b
+}
+
+// verify checks that the tombstone is signed by the key it carries and that
+// the key is registered to the account. The registrations outlive the
+// account for that.
+func (t Tombstone) verify(ring keyring) error {
+	if len(t.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(t.PublicKey, t.content(), t.Signature) {
+		return ErrInvalidSignature
+	}
+
+	if !ring.signs(t.ID, t.PublicKey) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// closed reports whether the account was deleted. Tombstones that do not
+// verify are ignored.
+func closed(store Store, userID string) (bool, error) {
+	t, err := store.Tombstone(userID)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	ring, err := loadKeyring(store)
+	if err != nil {
+		return false, err
+	}
+
+	return t.verify(ring) == nil, nil
+}
+
+// burnTransactionID returns the ID of the transaction that burns the balance
+// of a deleted account. It is derived from the user ID, so a deletion that
+// is resumed after a failure burns only once.
+func burnTransactionID(userID string) string {
+	return "burn:" + userID
+}
+
+// refundTransactionID returns the ID of the transaction that settles a
+// subscription to a deleted business.
+func refundTransactionID(subscriptionID string) string {
+	return "refund:" + subscriptionID
+}
+
+// unusedShare returns the part of the price of a subscription that covers
+// the time left after now, rounded down to the cent. The price pays for the
+// billing interval that ends at the end date, however many times it was
+// renewed.
+func unusedShare(s Subscription, now time.Time) Money {
+	start := s.EndDate.AddDate(0, -1, 0)
+	if intervalOf(s.Interval) == IntervalYear {
+		start = s.EndDate.AddDate(-1, 0, 0)
+	}
+	if start.Before(s.StartDate) {
+		start = s.StartDate
+	}
+
+	total := s.EndDate.Sub(start)
+	left := s.EndDate.Sub(now)
+	if total <= 0 || left <= 0 {
+		return 0
+	}
+	if left > total {
+		left = total
+	}
+
+	return s.Price.share(int64(left), int64(total))
+}
+
+// closeAccount deletes an account the way the other peers can verify. The
+// subscriptions the user holds are cancelled, the subscriptions to the plans
+// of a business are settled with a refund of the unused time, the plans and
+// the face templates of the associates are removed, the money locked in
+// escrows is paid back, what is left of the balance is burned, and a
+// tombstone signed with the key of the account is stored last. Every step
+// can be run again, so a deletion that fails half way is completed by the
+// next attempt. An account cannot be deleted while orders it paid in escrow
+// can still be delivered, as the ledger pays the money back only after their
+// deadline.
+func closeAccount(store Store, l *ledger, userID string, now time.Time) (Tombstone, error) {
+	var refunded Money
+
+	escrows, err := store.Escrows(userID)
+	if err != nil {
+		return Tombstone{}, err
+	}
+
+	state, err := l.state()
+	if err != nil {
+		return Tombstone{}, err
+	}
+
+	for _, e := range escrows {
+		if e.BuyerID != userID || e.status(state) != EscrowLocked || now.After(e.Deadline) {
+			continue
+		}
+
+		deleted, err := closed(store, e.SellerID)
+		if err != nil {
+			return Tombstone{}, err
+		}
+		if !deleted {
+			return Tombstone{}, ErrEscrowOpen
+		}
+	}
+
+	plans, err := store.PlansBy(userID)
+	if err != nil {
+		return Tombstone{}, err
+	}
+
+	subscriptions, err := store.Subscriptions()
+	if err != nil {
+		return Tombstone{}, err
+	}
+
+	ownPlans := map[string]Plan{}
+	for _, p := range plans {
+		ownPlans[p.ID] = p
+	}
+
+	for _, s := range subscriptions {
+		plan, sold := ownPlans[s.PlanID]
+
+		switch {
+		case s.UserID == userID:
+			// the subscriber leaves, the time paid for is forfeited
+		case sold:
+			amount, err := settleSubscription(store, l, plan, s, now)
+			if err != nil {
+				return Tombstone{}, err
+			}
+			refunded += amount
+		default:
+			continue
+		}
+
+		err = store.DeleteSubscription(s.ID)
+		if err != nil {
+			return Tombstone{}, err
+		}
+	}
+
+	for _, p := range plans {
+		err = store.DeletePlan(p.ID)
+		if err != nil {
+			return Tombstone{}, err
+		}
+	}
+
+	// the orders that can no longer be delivered are called off
+	state, err = l.state()
+	if err != nil {
+		return Tombstone{}, err
+	}
+
+	for _, e := range escrows {
+		if e.BuyerID == userID && e.status(state) == EscrowLocked {
+			err = refundEscrow(l, e)
+			if err != nil {
+				return Tombstone{}, err
+			}
+		}
+	}
+
+	burned, err := burnBalance(store, l, userID, now)
+	if err != nil {
+		return Tombstone{}, err
+	}
+
+	var burnID string
+	if burned > 0 {
+		burnID = burnTransactionID(userID)
+	}
+
+	// a resumed deletion keeps the tombstone of the first attempt
+	ring, err := loadKeyring(store)
+	if err != nil {
+		return Tombstone{}, err
+	}
+
+	tombstone, err := store.Tombstone(userID)
+	if errors.Is(err, ErrNotFound) || (err == nil && tombstone.verify(ring) != nil) {
+		tombstone = newTombstone(userID, burnID, burned, refunded, l.key)
+
+		err = store.PutTombstone(tombstone)
+	}
+	if err != nil {
+		return Tombstone{}, err
+	}
+
+	// the user document holds the credentials and the face templates of the
+	// owner and of the associates. The key registrations are kept, so that
+	// the tombstone and the past journal entries of the account still verify.
+	user, err := store.User(userID)
+	if err == nil {
+		err = store.PutUser(User{
+			ID:  user.ID,
+			VAT: user.VAT,
+		})
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return Tombstone{}, err
+	}
+
+	err = store.DeleteBalance(userID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return Tombstone{}, err
+	}
+
+	return tombstone, nil
+}
+
+// settleSubscription refunds the subscriber of a deleted business for the
+// time left, or the refund owed on cancellation, as far as the balance of
+// the business allows, and returns the amount refunded. A subscription
+// without a settled charge is not refunded.
+func settleSubscription(store Store, l *ledger, plan Plan, s Subscription, now time.Time) (Money, error) {
+	from, until := s.CancelledAt, s.PaidUntil
+	if s.PaidUntil.IsZero() {
+		from, until = s.clock(now), s.EndDate
+	}
+
+	state, err := l.state()
+	if err != nil {
+		return 0, err
+	}
+
+	postings, chargeID, err := subscriptionRefund(state, s, plan, from, until)
+	if errors.Is(err, ErrNoCharge) || len(postings) == 0 {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	// the business pays back only what its balance covers
+	postings = capRefund(postings, plan.CreatedBy, state.balances[plan.CreatedBy])
+	if len(postings) == 0 {
+		return 0, nil
+	}
+
+	err = payRefund(store, l, plan, s, chargeID, postings, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return postings[0].Amount, nil
+}
+
+// payRefund posts the postings that pay a share of the last charge of a
+// subscription back to the subscriber, as the reversal of that charge. A
+// refund that is paid again is settled only once.
+func payRefund(store Store, l *ledger, plan Plan, s Subscription, chargeID string, postings []Posting, now time.Time) error {
+	transaction := Transaction{
+		ID:         refundTransactionID(s.ID),
+		SenderID:   plan.CreatedBy,
+		ReceiverID: s.UserID,
+		TotalCost:  postings[0].Amount,
+		Timestamp:  now,
+		Date:       periodOf(now),
+		Processed:  true,
+	}
+
+	_, err := l.postReversal(transaction.ID, chargeID, postings)
+	if err != nil {
+		return err
+	}
+
+	return store.PutTransaction(transaction)
+}
+
+// burnBalance takes what is left on the account out of circulation and
+// records the burn as a transaction to the burn account. When the balance
+// was already burned by an earlier attempt, the amount burned then is
+// returned.
+func burnBalance(store Store, l *ledger, userID string, now time.Time) (Money, error) {
+	txID := burnTransactionID(userID)
+
+	state, err := l.state()
+	if err != nil {
+		return 0, err
+	}
+
+	if entry, ok := state.settled[txID]; ok {
+		for _, p := range entry.Postings {
+			if p.AccountID == accountBurn {
+				return p.Amount, nil
+			}
+		}
+	}
+
+	balance := state.balances[userID]
+	if balance <= 0 {
+		return 0, nil
+	}
+
+	_, err = l.transfer(txID, userID, accountBurn, balance)
+	if err != nil {
+		return 0, err
+	}
+
+	err = store.PutTransaction(Transaction{
+		ID:         txID,
+		SenderID:   userID,
+		ReceiverID: accountBurn,
+		TotalCost:  balance,
+		Timestamp:  now,
+		Date:       periodOf(now),
+		Processed:  true,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return balance, nil
+}
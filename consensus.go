@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dbIncomeProposal = "income_proposal"
+
+// maxCarryOver is how many periods back the income of a period nobody
+// proposed for is looked up.
+const maxCarryOver = 12
+
+// IncomeProposal is the signed vote of a peer for the income of a period.
+// Peers that index the same transactions compute the same income, so their
+// proposals share a candidate and attest each other. Proposals are made
+// before the period starts and count only when signed by the key of an
+// individual wallet.
+type IncomeProposal struct {
+	ID        string    `mapstructure:"_id" json:"_id" validate:"uuid_rfc4122"`               // Hash of the signed content
+	Period    string    `mapstructure:"period" json:"period" validate:"uuid_rfc4122"`         // Period the income is proposed for
+	Candidate string    `mapstructure:"candidate" json:"candidate" validate:"uuid_rfc4122"`   // Hash of the income and of the input set
+	InputHash string    `mapstructure:"input_hash" json:"input_hash" validate:"uuid_rfc4122"` // Hash of the transactions indexed
+	Income    Income    `mapstructure:"income" json:"income" validate:"uuid_rfc4122"`         // Income computed by the peer
+	Timestamp time.Time `mapstructure:"timestamp" json:"timestamp" validate:"uuid_rfc4122"`   // Time of the proposal
+	PublicKey []byte    `mapstructure:"public_key" json:"public_key" validate:"uuid_rfc4122"` // Key of the peer
+	Signature []byte    `mapstructure:"signature" json:"signature" validate:"uuid_rfc4122"`   // Signature over the content
+}
+
+// inputHash returns the hash of the transactions an income was indexed from.
+// Only the fields the indexer reads are hashed, in the order of the IDs.
+func inputHash(transactions []Transaction) string {
+	sorted := append([]Transaction{}, transactions...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	h := sha256.New()
+	for _, t := range sorted {
+		b, _ := json.Marshal(struct {
+			ID               string           `json:"id"`
+			ProductsServices []ProductService `json:"products_services"`
+		}{t.ID, t.ProductsServices})
+		h.Write(b)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// candidateOf returns the hash that identifies an income and its input set.
+func candidateOf(income Income, inputHash string) string {
+	b, _ := json.Marshal(income)
+	hash := sha256.Sum256(append(b, inputHash...))
+	return hex.EncodeToString(hash[:])
+}
+
+func newIncomeProposal(income Income, inputHash string, key ed25519.PrivateKey) IncomeProposal {
+	p := IncomeProposal{
+		Period:    income.Period,
+		Candidate: candidateOf(income, inputHash),
+		InputHash: inputHash,
+		Income:    income,
+		Timestamp: time.Now().UTC(),
+		PublicKey: key.Public().(ed25519.PublicKey),
+	}
+
+	content := p.content()
+	hash := sha256.Sum256(content)
+	p.ID = hex.EncodeToString(hash[:])
+	p.Signature = ed25519.Sign(key, content)
+
+	return p
+}
+
+// content returns the canonical bytes that are hashed and signed.
+func (p IncomeProposal) content() []byte {
+	b, _ := json.Marshal(struct {
+		Period    string `json:"period"`
+		Candidate string `json:"candidate"`
+		Timestamp string `json:"timestamp"`
+		PublicKey []byte `json:"public_key"`
+	}{
+		Period:    p.Period,
+		Candidate: p.Candidate,
+		Timestamp: p.Timestamp.UTC().Format(time.RFC3339Nano),
+		PublicKey: p.PublicKey,
+	})
+	return b
+}
+
+// verify checks that the proposal is signed, untampered and that its
+// candidate matches the income it carries.
+func (p IncomeProposal) verify() error {
+	if len(p.PublicKey) != ed25519.PublicKeySize {
+		return ErrInvalidSignature
+	}
+
+	content := p.content()
+	hash := sha256.Sum256(content)
+	if p.ID != hex.EncodeToString(hash[:]) || !ed25519.Verify(p.PublicKey, content, p.Signature) {
+		return ErrInvalidSignature
+	}
+
+	if p.Period != p.Income.Period || p.Candidate != candidateOf(p.Income, p.InputHash) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// canonicalIncome picks the income of a period from the proposals. Only the
+// keys in voters, which maps the keys of the individual wallets to their
+// user, take part, and every wallet counts once whichever of its keys
+// proposed. A wallet that proposed different candidates loses its vote, and
+// proposals made once the period started are ignored. The candidate attested
+// by the most wallets wins, then the one indexed from the most transactions,
+// then the lowest candidate hash, so every peer holding the same proposals
+// picks the same income.
+func canonicalIncome(proposals []IncomeProposal, voters map[string]string) (Income, bool) {
+	candidates := map[string]string{}
+	incomes := map[string]Income{}
+	for _, p := range proposals {
+		userID, ok := voters[string(p.PublicKey)]
+		if !ok || p.verify() != nil {
+			continue
+		}
+
+		start, err := periodStart(p.Period)
+		if err != nil || !p.Timestamp.Before(start) {
+			continue
+		}
+
+		if candidate, voted := candidates[userID]; voted && candidate != p.Candidate {
+			candidates[userID] = ""
+		} else if !voted {
+			candidates[userID] = p.Candidate
+		}
+		incomes[p.Candidate] = p.Income
+	}
+
+	votes := map[string]int{}
+	for _, candidate := range candidates {
+		if len(candidate) > 0 {
+			votes[candidate]++
+		}
+	}
+
+	var best string
+	for candidate := range votes {
+		if len(best) == 0 || betterCandidate(candidate, best, votes, incomes) {
+			best = candidate
+		}
+	}
+
+	if len(best) == 0 {
+		return Income{}, false
+	}
+
+	return incomes[best], true
+}
+
+func betterCandidate(a, b string, votes map[string]int, incomes map[string]Income) bool {
+	if votes[a] != votes[b] {
+		return votes[a] > votes[b]
+	}
+	if incomes[a].Transactions != incomes[b].Transactions {
+		return incomes[a].Transactions > incomes[b].Transactions
+	}
+	return a < b
+}
+
+// periodStart returns the first moment of a period, in UTC.
+func periodStart(period string) (time.Time, error) {
+	year, month, _ := strings.Cut(period, "/")
+
+	y, err := strconv.Atoi(year)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	m, err := strconv.Atoi(month)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Date(y, time.Month(m), 1, 0, 0, 0, 0, time.UTC), nil
+}
+
+// finalizedIncome returns the income of a period once it is final. Proposals
+// are made during the last days of the month before, so a period is final as
+// soon as it starts. Periods indexed before proposals existed keep their
+// plain Income record, the one with the lowest ID if there are several. A
+// period nobody proposed an income for in time keeps the income of the last
+// of the maxCarryOver periods before it that was decided, so no month goes
+// without income because no peer was online at the end of the month before.
+func finalizedIncome(store Store, period string, now time.Time) (Income, bool, error) {
+	start, err := periodStart(period)
+	if err != nil {
+		return Income{}, false, err
+	}
+
+	if now.Before(start) {
+		return Income{}, false, nil
+	}
+
+	voters, err := incomeVoters(store)
+	if err != nil {
+		return Income{}, false, err
+	}
+
+	incomes, err := store.Incomes()
+	if err != nil {
+		return Income{}, false, err
+	}
+
+	for i := 0; i <= maxCarryOver; i++ {
+		income, ok, err := decidedIncome(store, periodOf(start.AddDate(0, -i, 0)), voters, incomes)
+		if err != nil {
+			return Income{}, false, err
+		}
+		if ok {
+			income.Period = period
+			return income, true, nil
+		}
+	}
+
+	return Income{}, false, nil
+}
+
+// decidedIncome returns the income the proposals for a period agree on, or
+// else its plain Income record.
+func decidedIncome(store Store, period string, voters map[string]string, incomes []Income) (Income, bool, error) {
+	proposals, err := store.IncomeProposals(period)
+	if err != nil {
+		return Income{}, false, err
+	}
+
+	if income, ok := canonicalIncome(proposals, voters); ok {
+		return income, true, nil
+	}
+
+	var legacy Income
+	for _, inc := range incomes {
+		if inc.Period == period && (len(legacy.ID) == 0 || inc.ID < legacy.ID) {
+			legacy = inc
+		}
+	}
+
+	return legacy, len(legacy.ID) > 0, nil
+}
+
+// incomeVoters maps the keys registered to individual wallets to their user.
+// Businesses and keys no registration leads to do not vote.
+func incomeVoters(store Store) (map[string]string, error) {
+	users, err := store.Users()
+	if err != nil {
+		return nil, err
+	}
+
+	ring, err := loadKeyring(store)
+	if err != nil {
+		return nil, err
+	}
+
+	voters := map[string]string{}
+	for _, u := range users {
+		if len(u.VAT) > 0 {
+			continue
+		}
+		for _, key := range ring.signing[string(u.ID)] {
+			voters[string(key)] = string(u.ID)
+		}
+	}
+
+	return voters, nil
+}
+
+// proposed reports whether the key already proposed an income for a period.
+func proposed(store Store, period string, publicKey []byte) (bool, error) {
+	proposals, err := store.IncomeProposals(period)
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range proposals {
+		if bytes.Equal(p.PublicKey, publicKey) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
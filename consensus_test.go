@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// testProposal signs a proposal of income made at the given time.
+func testProposal(key ed25519.PrivateKey, income Income, inputHash string, at time.Time) IncomeProposal {
+	p := IncomeProposal{
+		Period:    income.Period,
+		Candidate: candidateOf(income, inputHash),
+		InputHash: inputHash,
+		Income:    income,
+		Timestamp: at,
+		PublicKey: key.Public().(ed25519.PublicKey),
+	}
+
+	content := p.content()
+	hash := sha256.Sum256(content)
+	p.ID = hex.EncodeToString(hash[:])
+	p.Signature = ed25519.Sign(key, content)
+
+	return p
+}
+
+func TestCanonicalIncome(t *testing.T) {
+	alice, aliceLaptop, bob, carol, business := testKey("alice"), testKey("alice laptop"), testKey("bob"), testKey("carol"), testKey("business")
+	voters := map[string]string{
+		string(alice.Public().(ed25519.PublicKey)):       "alice",
+		string(aliceLaptop.Public().(ed25519.PublicKey)): "alice",
+		string(bob.Public().(ed25519.PublicKey)):         "bob",
+		string(carol.Public().(ed25519.PublicKey)):       "carol",
+	}
+
+	before := time.Date(2024, 1, 30, 0, 0, 0, 0, time.UTC)
+	late := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	low := Income{ID: "2024/2", Amount: 100000, Period: "2024/2", Transactions: 10}
+	high := Income{ID: "2024/2", Amount: 110000, Period: "2024/2", Transactions: 12}
+
+	tampered := testProposal(carol, high, "h", before)
+	tampered.Income.Amount = 999999
+
+	tests := []struct {
+		name      string
+		proposals []IncomeProposal
+		want      Money
+		ok        bool
+	}{
+		{
+			name: "no proposal",
+		},
+		{
+			name:      "majority",
+			proposals: []IncomeProposal{testProposal(alice, low, "h", before), testProposal(bob, low, "h", before), testProposal(carol, high, "h", before)},
+			want:      100000,
+			ok:        true,
+		},
+		{
+			name:      "a wallet votes once with all its keys",
+			proposals: []IncomeProposal{testProposal(alice, high, "h", before), testProposal(aliceLaptop, high, "h", before), testProposal(bob, low, "h", before), testProposal(carol, low, "h", before)},
+			want:      100000,
+			ok:        true,
+		},
+		{
+			name:      "a wallet that votes twice loses its vote",
+			proposals: []IncomeProposal{testProposal(alice, high, "h", before), testProposal(aliceLaptop, low, "h", before), testProposal(bob, high, "h", before), testProposal(carol, low, "h", before)},
+			want:      110000,
+			ok:        true,
+		},
+		{
+			name:      "businesses do not vote",
+			proposals: []IncomeProposal{testProposal(business, high, "h", before), testProposal(bob, low, "h", before)},
+			want:      100000,
+			ok:        true,
+		},
+		{
+			name:      "proposals made once the period started are ignored",
+			proposals: []IncomeProposal{testProposal(alice, high, "h", late), testProposal(bob, high, "h", late), testProposal(carol, low, "h", before)},
+			want:      100000,
+			ok:        true,
+		},
+		{
+			name:      "tampered proposals are ignored",
+			proposals: []IncomeProposal{tampered, testProposal(bob, low, "h", before)},
+			want:      100000,
+			ok:        true,
+		},
+		{
+			name:      "a tie goes to the most transactions",
+			proposals: []IncomeProposal{testProposal(alice, low, "h", before), testProposal(bob, high, "h", before)},
+			want:      110000,
+			ok:        true,
+		},
+		{
+			name:      "only late proposals",
+			proposals: []IncomeProposal{testProposal(alice, high, "h", late)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			income, ok := canonicalIncome(tt.proposals, voters)
+			if ok != tt.ok || income.Amount != tt.want {
+				t.Errorf("canonicalIncome() = %v, %v, want %v, %v", income.Amount, ok, tt.want, tt.ok)
+			}
+
+			// the order the proposals arrived in does not matter
+			reversed := make([]IncomeProposal, len(tt.proposals))
+			for i, p := range tt.proposals {
+				reversed[len(reversed)-1-i] = p
+			}
+			if again, _ := canonicalIncome(reversed, voters); again.Amount != income.Amount {
+				t.Errorf("canonicalIncome() of the reversed proposals = %v, want %v", again.Amount, income.Amount)
+			}
+		})
+	}
+}
+
+func TestFinalizedIncome(t *testing.T) {
+	alice := testKey("alice")
+	aliceID := userIDOf(alice.Public().(ed25519.PublicKey))
+
+	store := newMemoryStore()
+	if err := store.PutUser(User{ID: []byte(aliceID)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutKeyRegistration(newKeyRegistration(aliceID, KeySigning, nil, alice.Public().(ed25519.PublicKey), alice)); err != nil {
+		t.Fatal(err)
+	}
+	for _, income := range []Income{
+		{ID: "b", Amount: 90000, Period: "2023/6"},
+		{ID: "a", Amount: 80000, Period: "2023/6"},
+		{ID: "c", Amount: 95000, Period: "2023/9"},
+	} {
+		if err := store.PutIncome(income); err != nil {
+			t.Fatal(err)
+		}
+	}
+	voted := Income{ID: "2024/1", Amount: 120000, Period: "2024/1"}
+	if err := store.PutIncome(Income{ID: "d", Amount: 1, Period: "2024/1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutIncomeProposal(testProposal(alice, voted, "h", time.Date(2023, 12, 30, 0, 0, 0, 0, time.UTC))); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2025, 3, 15, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		period string
+		want   Money
+		ok     bool
+	}{
+		{"lowest ID of the plain records", "2023/6", 80000, true},
+		{"carried over", "2023/8", 80000, true},
+		{"proposals win over plain records", "2024/1", 120000, true},
+		{"carried over from a vote", "2024/3", 120000, true},
+		{"not started", "2025/4", 0, false},
+		{"nothing decided before", "2022/1", 0, false},
+		{"beyond the carry over", "2025/2", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			income, ok, err := finalizedIncome(store, tt.period, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.ok || income.Amount != tt.want {
+				t.Errorf("finalizedIncome() = %v, %v, want %v, %v", income.Amount, ok, tt.want, tt.ok)
+			}
+			if ok && income.Period != tt.period {
+				t.Errorf("finalizedIncome() period = %v, want %v", income.Period, tt.period)
+			}
+		})
+	}
+}
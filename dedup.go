@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+// faceMatchDistance is the Euclidean distance under which two descriptors
+// are taken for the same face, as recommended for face-api.js descriptors.
+const faceMatchDistance = 0.6
+
+var ErrDuplicateFace = errors.New("this face already has a wallet")
+
+// euclideanDistance returns the distance between two descriptors.
+func euclideanDistance(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return math.Inf(1)
+	}
+
+	var sum float64
+	for i := range a {
+		d := float64(a[i]) - float64(b[i])
+		sum += d * d
+	}
+
+	return math.Sqrt(sum)
+}
+
+type faceEntry struct {
+	userID   string
+	template FaceTemplate
+}
+
+// faceIndex holds the templates of the enrolled faces. Every template is
+// projected under its own salt, so the templates share no metric that a
+// tree or a pivot table could be built on, and a search goes through all of
+// them. It gives up on a template as soon as the part of the distance
+// measured so far rules it out, so another face costs a few values of the
+// projection rather than all of them.
+type faceIndex struct {
+	entries []faceEntry
+}
+
+func newFaceIndex() *faceIndex {
+	return &faceIndex{}
+}
+
+func (x *faceIndex) add(userID string, template FaceTemplate) {
+	x.entries = append(x.entries, faceEntry{
+		userID:   userID,
+		template: template,
+	})
+}
+
+// nearest returns the user with the closest template within radius.
+func (x *faceIndex) nearest(descriptor []float32, radius float64) (string, float64, bool) {
+	found, best, _ := x.search(descriptor, radius)
+	return found, best, len(found) > 0
+}
+
+// search returns the user with the closest template within radius, the
+// distance to it or radius when there is none, and the number of values of
+// the projections it computed.
+func (x *faceIndex) search(descriptor []float32, radius float64) (string, float64, int) {
+	var found string
+	best := radius
+	projected := 0
+	for _, e := range x.entries {
+		d, n, ok := e.template.distanceWithin(descriptor, best)
+		projected += n
+		if ok {
+			best = d
+			found = e.userID
+		}
+	}
+
+	return found, best, projected
+}
+
+// faceDeduper makes sure that a person can hold only one individual wallet.
+// It indexes the faces of the enrolled individuals and keeps the index in
+// sync with the store as new users show up. Business associates are not
+// checked, as the owner of a business has an individual wallet of their own.
+type faceDeduper struct {
+	store   Store
+	index   *faceIndex
+	indexed map[string]bool
+}
+
+func newFaceDeduper(store Store) *faceDeduper {
+	return &faceDeduper{
+		store:   store,
+		index:   newFaceIndex(),
+		indexed: map[string]bool{},
+	}
+}
+
+// sync adds the individuals enrolled since the last sync to the index.
+func (f *faceDeduper) sync() error {
+	users, err := f.store.Users()
+	if err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		id := string(u.ID)
+		if f.indexed[id] || len(u.VAT) > 0 {
+			continue
+		}
+
+		template, ok := u.Templates["user"]
+		if !ok {
+			legacy, ok := u.Descriptor["user"]
+			if !ok {
+				continue
+			}
+			// users enrolled before templates are indexed in memory only
+			template = newFaceTemplate(legacy)
+		}
+
+		f.index.add(id, template)
+		f.indexed[id] = true
+	}
+
+	return nil
+}
+
+// check returns ErrDuplicateFace when the descriptor matches the face of an
+// enrolled individual.
+func (f *faceDeduper) check(descriptor []float32) error {
+	err := f.sync()
+	if err != nil {
+		return err
+	}
+
+	_, _, found := f.index.nearest(descriptor, faceMatchDistance)
+	if found {
+		return ErrDuplicateFace
+	}
+
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"testing"
+)
+
+// syntheticFace returns a random descriptor in the range of face-api
+// descriptors.
+func syntheticFace(r *rand.Rand) []float32 {
+	d := make([]float32, 128)
+	for i := range d {
+		d[i] = float32(r.NormFloat64() * 0.1)
+	}
+	return d
+}
+
+// nearby returns a copy of the descriptor moved by distance in a random
+// direction.
+func nearby(r *rand.Rand, descriptor []float32, distance float64) []float32 {
+	direction := syntheticFace(r)
+	norm := euclideanDistance(direction, make([]float32, len(direction)))
+
+	moved := make([]float32, len(descriptor))
+	for i := range descriptor {
+		moved[i] = descriptor[i] + float32(float64(direction[i])/norm*distance)
+	}
+	return moved
+}
+
+func TestEuclideanDistance(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []float32
+		want float64
+	}{
+		{"empty", []float32{}, []float32{}, 0},
+		{"same", []float32{0.1, -0.2, 0.3}, []float32{0.1, -0.2, 0.3}, 0},
+		{"pythagoras", []float32{0, 0}, []float32{3, 4}, 5},
+		{"negative", []float32{-1, -1}, []float32{1, 1}, math.Sqrt(8)},
+		{"length mismatch", []float32{1, 2}, []float32{1}, math.Inf(1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := euclideanDistance(tt.a, tt.b)
+			if math.Abs(got-tt.want) > 1e-6 && !(math.IsInf(got, 1) && math.IsInf(tt.want, 1)) {
+				t.Errorf("euclideanDistance() = %v, want %v", got, tt.want)
+			}
+			if back := euclideanDistance(tt.b, tt.a); back != got {
+				t.Errorf("euclideanDistance() is not symmetric: %v and %v", got, back)
+			}
+		})
+	}
+}
+
+func TestFaceIndexNearest(t *testing.T) {
+	r := rand.New(rand.NewPCG(7, 11))
+
+	faces := make([][]float32, 300)
+	index := newFaceIndex()
+	for i := range faces {
+		faces[i] = syntheticFace(r)
+		index.add(strconv.Itoa(i), newFaceTemplate(faces[i]))
+	}
+
+	// maxWork is the largest share of the projections of all the templates
+	// the search may compute
+	tests := []struct {
+		name    string
+		query   []float32
+		radius  float64
+		maxWork float64
+	}{
+		{"enrolled face", faces[0], faceMatchDistance, 0.05},
+		{"same face, other light", nearby(r, faces[42], 0.1), faceMatchDistance, 0.1},
+		{"same face, far off", nearby(r, faces[99], 0.45), faceMatchDistance, 0.2},
+		{"stranger", syntheticFace(r), faceMatchDistance, 0.25},
+		{"wide radius", syntheticFace(r), 2, 0.8},
+		{"no radius", faces[7], 0, 0.02},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// brute force over every template
+			var want string
+			best := tt.radius
+			for _, e := range index.entries {
+				if d := e.template.distance(tt.query); d < best {
+					best, want = d, e.userID
+				}
+			}
+
+			got, distance, found := index.nearest(tt.query, tt.radius)
+			if got != want || found != (len(want) > 0) {
+				t.Fatalf("nearest() = %q, %v, want %q", got, found, want)
+			}
+			if found && distance != best {
+				t.Errorf("nearest() distance = %v, want %v", distance, best)
+			}
+
+			// the templates ruled out early are not projected in full
+			_, _, projected := index.search(tt.query, tt.radius)
+			if work := float64(projected) / float64(len(faces)*templateDims); work > tt.maxWork {
+				t.Errorf("search() projected %d values, %.2f of all, want at most %.2f", projected, work, tt.maxWork)
+			}
+		})
+	}
+}
+
+func TestFaceIndexNearestOutdated(t *testing.T) {
+	r := rand.New(rand.NewPCG(3, 5))
+
+	face := syntheticFace(r)
+	template := newFaceTemplate(face)
+	if template.outdated() {
+		t.Fatalf("outdated() = true for a new template")
+	}
+
+	// templates of the pivot index still match until they are enrolled
+	// again
+	template.Pivots = make([]float32, 8)
+	if !template.outdated() {
+		t.Fatalf("outdated() = false for a template with pivot distances")
+	}
+
+	index := newFaceIndex()
+	index.add("legacy", template)
+
+	got, _, found := index.nearest(nearby(r, face, 0.1), faceMatchDistance)
+	if !found || got != "legacy" {
+		t.Errorf("nearest() = %q, %v, want the template with pivots", got, found)
+	}
+}
+
+func TestFaceDeduperCheck(t *testing.T) {
+	r := rand.New(rand.NewPCG(13, 17))
+
+	individual := syntheticFace(r)
+	legacy := syntheticFace(r)
+	associate := syntheticFace(r)
+
+	store := newMemoryStore()
+	u := User{ID: []byte("individual")}
+	u.enrollFace("user", individual)
+	store.PutUser(u)
+	store.PutUser(User{ID: []byte("legacy"), Descriptor: map[string][]float32{"user": legacy}})
+	b := User{ID: []byte("business"), VAT: "BG123456789"}
+	b.enrollFace("associate", associate)
+	store.PutUser(b)
+
+	tests := []struct {
+		name       string
+		descriptor []float32
+		want       error
+	}{
+		{"enrolled individual", nearby(r, individual, 0.2), ErrDuplicateFace},
+		{"individual enrolled before templates", nearby(r, legacy, 0.2), ErrDuplicateFace},
+		{"business associate", nearby(r, associate, 0.1), nil},
+		{"new face", syntheticFace(r), nil},
+	}
+
+	deduper := newFaceDeduper(store)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := deduper.check(tt.descriptor); err != tt.want {
+				t.Errorf("check() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// individuals enrolled after the first check are found too
+	late := syntheticFace(r)
+	u = User{ID: []byte("late")}
+	u.enrollFace("user", late)
+	store.PutUser(u)
+
+	if err := deduper.check(nearby(r, late, 0.2)); err != ErrDuplicateFace {
+		t.Errorf("check() = %v after a new enrollment, want %v", err, ErrDuplicateFace)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/maxence-charriere/go-app/v10/pkg/app"
+)
+
+// economy is a component that displays the statistics of the economy. A
+// component is a customizable, independent, and reusable UI element. It is
+// created by embedding app.Compo into a struct.
+type economy struct {
+	app.Compo
+	loggedIn  bool
+	stats     EconomyStats
+	countries []string
+}
+
+func (e *economy) OnMount(ctx app.Context) {
+	ctx.GetState("loggedIn", &e.loggedIn)
+	if !e.loggedIn {
+		ctx.Navigate("/auth")
+	}
+
+	e.getStats(ctx)
+}
+
+func (e *economy) getStats(ctx app.Context) {
+	ctx.Async(func() {
+		u := app.Window().URL()
+		u.Path = "/api/economy"
+
+		r, err := http.Get(u.String())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer r.Body.Close()
+
+		var stats EconomyStats
+
+		err = json.NewDecoder(r.Body).Decode(&stats)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx.Dispatch(func(ctx app.Context) {
+			e.stats = stats
+			e.countries = sortedCountries(stats.Taxes)
+		})
+	})
+}
+
+// The Render method is where the component appearance is defined. Here, the
+// economy is displayed.
+func (e *economy) Render() app.UI {
+	return app.Div().Class("container").Body(
+		app.Div().Class("mobile").Body(
+			app.Div().Class("header").Body(
+				newNav(),
+				app.Div().Class("header-summary").Body(
+					app.Span().Class("logo").Text("cyber-gubi"),
+					app.Div().Class("summary-text").Body(
+						app.Span().Text("Money Supply"),
+					),
+					app.Div().Class("summary-balance").Body(
+						app.Span().Text(e.stats.Supply.gubi()),
+					),
+				),
+			),
+			app.Div().ID("content").Body(
+				app.Div().Class("card").Body(
+					app.Div().Class("upper-row").Body(
+						app.Div().Class("card-item").Body(
+							app.Span().Class("span-header").Text("Wallets"),
+							app.Span().Class("span-body").Text(strconv.Itoa(e.stats.Wallets)),
+						),
+						app.Div().Class("card-item").Body(
+							app.Span().Class("span-header").Text("Active"),
+							app.Span().Class("span-body").Text(strconv.Itoa(e.stats.ActiveWallets)),
+						),
+					),
+					app.Div().Class("lower-row").Body(
+						app.Div().Class("card-item").Body(
+							app.Span().Class("span-header").Text("Velocity"),
+							app.Span().Class("span-body").Text(strconv.FormatFloat(e.stats.Velocity, 'f', 2, 64)),
+						),
+					),
+				),
+				app.Div().Class("transactions").Body(
+					app.Span().Class("t-desc").Text("Monthly Emissions and Burns"),
+					app.If(len(e.stats.Months) == 0, func() app.UI {
+						return app.Div().Class("transaction").Body(
+							app.Span().Class("empty").Text("No statistics yet"),
+						).Style("pointer-events", "none")
+					}),
+					app.Range(e.stats.Months).Slice(func(i int) app.UI {
+						return app.Div().Class("transaction").Body(
+							app.Div().Class("t-details").Body(
+								app.Div().Class("t-title").Body(
+									app.Span().Text(e.stats.Months[i].Period),
+								),
+								app.Div().Class("t-time").Body(
+									app.Span().Text("Burned "+e.stats.Months[i].Burns.gubi()),
+								),
+							),
+							app.Div().Class("t-price").Body(
+								app.Span().Text(e.stats.Months[i].Emissions.signed()),
+							),
+						)
+					}),
+				),
+				app.Div().Class("transactions").Body(
+					app.Span().Class("t-desc").Text("Tax Collected"),
+					app.If(len(e.countries) == 0, func() app.UI {
+						return app.Div().Class("transaction").Body(
+							app.Span().Class("empty").Text("No taxes yet"),
+						).Style("pointer-events", "none")
+					}),
+					app.Range(e.countries).Slice(func(i int) app.UI {
+						return app.Div().Class("transaction").Body(
+							app.Div().Class("t-details").Body(
+								app.Div().Class("t-title").Body(
+									app.Span().Text(e.countries[i]),
+								),
+							),
+							app.Div().Class("t-price").Body(
+								app.Span().Text(e.stats.Taxes[e.countries[i]].gubi()),
+							),
+						)
+					}),
+				),
+			),
+		),
+	)
+}
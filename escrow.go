@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dbEscrow = "escrow"
+
+// escrowPeriod is how long the buyer has to confirm the delivery when the
+// order does not say otherwise.
+const escrowPeriod = 14 * 24 * time.Hour
+
+// States of an escrow.
+const (
+	EscrowLocked   = "locked"
+	EscrowReleased = "released"
+	EscrowRefunded = "refunded"
+)
+
+var (
+	ErrEscrowBuyer    = errors.New("escrow belongs to another buyer")
+	ErrEscrowUnlocked = errors.New("escrow holds no money")
+	ErrEscrowExpired  = errors.New("escrow deadline passed")
+	ErrEscrowTerms    = errors.New("the terms of the escrow do not allow this payment")
+	ErrEscrowOpen     = errors.New("orders in escrow are still open, confirm the delivery or wait for the deadline")
+)
+
+// Escrow holds the payment of an order until the buyer confirms the
+// delivery. The money of the buyer is locked on an escrow account of its
+// own, which only the key of the buyer can move money out of. It is paid to
+// the seller as the sale recorded in Transaction on release, or paid back
+// to the buyer once the deadline passed. The terms are part of the account
+// ID, so the ledger enforces them on every peer.
+type Escrow struct {
+	ID          string      `mapstructure:"_id" json:"_id" validate:"uuid_rfc4122"`                 // Unique identifier for the escrow, also the ID of the sale
+	BuyerID     string      `mapstructure:"buyer_id" json:"buyer_id" validate:"uuid_rfc4122"`       // User id of the buyer
+	SellerID    string      `mapstructure:"seller_id" json:"seller_id" validate:"uuid_rfc4122"`     // User id of the seller
+	Transaction Transaction `mapstructure:"transaction" json:"transaction" validate:"uuid_rfc4122"` // Sale paid on release
+	Deadline    time.Time   `mapstructure:"deadline" json:"deadline" validate:"uuid_rfc4122"`       // Time after which the money goes back to the buyer
+	CreatedAt   time.Time   `mapstructure:"created_at" json:"created_at" validate:"uuid_rfc4122"`   // Time the money was locked
+}
+
+// escrowAccount returns the ledger account that holds the money of an
+// escrow. The buyer, the seller and the deadline are part of the account
+// ID, so the ledger knows whose key may move it and where the money may go
+// without looking the escrow up.
+func escrowAccount(buyerID, sellerID string, deadline time.Time, escrowID string) string {
+	return "escrow:" + buyerID + ":" + sellerID + ":" + strconv.FormatInt(deadline.Unix(), 10) + ":" + escrowID
+}
+
+// escrowTerms are the parties and the deadline of an escrow account.
+type escrowTerms struct {
+	buyerID  string
+	sellerID string
+	deadline time.Time
+}
+
+// parseEscrowAccount returns the terms of an escrow account.
+func parseEscrowAccount(accountID string) (escrowTerms, bool) {
+	rest, ok := strings.CutPrefix(accountID, "escrow:")
+	if !ok {
+		return escrowTerms{}, false
+	}
+
+	parts := strings.SplitN(rest, ":", 4)
+	if len(parts) != 4 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return escrowTerms{}, false
+	}
+
+	deadline, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return escrowTerms{}, false
+	}
+
+	return escrowTerms{
+		buyerID:  parts[0],
+		sellerID: parts[1],
+		deadline: time.Unix(deadline, 0),
+	}, true
+}
+
+// allows reports whether an entry of the given time may pay the money of the
+// escrow to an account: to the seller and the countries taxing the sale at
+// any time, back to the buyer once the deadline passed or the seller
+// deleted their account.
+func (t escrowTerms) allows(accountID string, at time.Time, sellerClosed bool) bool {
+	switch {
+	case accountID == t.sellerID, isCountryAccount(accountID):
+		return true
+	case accountID == t.buyerID:
+		return at.After(t.deadline) || sellerClosed
+	default:
+		return false
+	}
+}
+
+// lockTransactionID returns the ID of the transaction that locks the money
+// of an escrow.
+func lockTransactionID(escrowID string) string {
+	return "escrow:" + escrowID
+}
+
+// unlockTransactionID returns the ID of the transaction that pays the money
+// of an escrow back to the buyer.
+func unlockTransactionID(escrowID string) string {
+	return "unlock:" + escrowID
+}
+
+func (e Escrow) account() string {
+	return escrowAccount(e.BuyerID, e.SellerID, e.Deadline, e.ID)
+}
+
+// status returns the state of the escrow in the ledger, or an empty string
+// when its money was never locked.
+func (e Escrow) status(state ledgerState) string {
+	switch {
+	case hasEntry(state, e.ID):
+		return EscrowReleased
+	case hasEntry(state, unlockTransactionID(e.ID)):
+		return EscrowRefunded
+	case hasEntry(state, lockTransactionID(e.ID)):
+		return EscrowLocked
+	default:
+		return ""
+	}
+}
+
+func hasEntry(state ledgerState, transactionID string) bool {
+	_, ok := state.settled[transactionID]
+	return ok
+}
+
+// lockEscrow moves the price of the sale from the buyer to a new escrow
+// account. The sale is recorded once the escrow is released.
+func lockEscrow(store Store, l *ledger, sale Transaction, deadline time.Time) (Escrow, error) {
+	escrow := Escrow{
+		ID:          sale.ID,
+		BuyerID:     sale.SenderID,
+		SellerID:    sale.ReceiverID,
+		Transaction: sale,
+		Deadline:    deadline.Truncate(time.Second), // as precise as the account
+		CreatedAt:   time.Now(),
+	}
+
+	// a lock that is submitted again is settled only once
+	_, err := l.transfer(lockTransactionID(escrow.ID), escrow.BuyerID, escrow.account(), sale.TotalCost)
+	if err != nil {
+		return Escrow{}, err
+	}
+
+	err = store.PutEscrow(escrow)
+	if err != nil {
+		return Escrow{}, err
+	}
+
+	return escrow, nil
+}
+
+// releaseEscrow pays the locked money to the seller on delivery, with the
+// taxes of the sale, and records the sale.
+func releaseEscrow(store Store, l *ledger, escrow Escrow, buyerID string, now time.Time) (Transaction, error) {
+	if escrow.BuyerID != buyerID {
+		return Transaction{}, ErrEscrowBuyer
+	}
+
+	state, err := l.state()
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	// a release that is submitted again is settled only once
+	status := escrow.status(state)
+	if status != EscrowLocked && status != EscrowReleased {
+		return Transaction{}, ErrEscrowUnlocked
+	}
+	if status == EscrowLocked && now.After(escrow.Deadline) {
+		return Transaction{}, ErrEscrowExpired
+	}
+
+	deleted, err := closed(store, escrow.SellerID)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if deleted {
+		return Transaction{}, ErrAccountClosed
+	}
+
+	sale := escrow.Transaction
+	sale.Timestamp = now
+	sale.Date = periodOf(now)
+
+	net := Sale{Items: sale.ProductsServices}.net()
+	postings := salePostings(escrow.account(), escrow.SellerID, net, sale.Taxes)
+
+	intent, err := submitPayment(store, l, newPaymentIntent(sale, postings))
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	return intent.Transaction, nil
+}
+
+// refundEscrow pays the locked money back to the buyer. The ledger refuses
+// it before the deadline unless the seller deleted their account.
+func refundEscrow(l *ledger, escrow Escrow) error {
+	_, err := l.transfer(unlockTransactionID(escrow.ID), escrow.account(), escrow.BuyerID, escrow.Transaction.TotalCost)
+	return err
+}
+
+// settleEscrows refunds the escrows of a buyer whose deadline passed, or
+// whose seller deleted their account, and returns the amount refunded. It
+// runs whenever the buyer opens the wallet.
+func settleEscrows(store Store, l *ledger, buyerID string, now time.Time) (Money, error) {
+	escrows, err := store.Escrows(buyerID)
+	if err != nil {
+		return 0, err
+	}
+
+	state, err := l.state()
+	if err != nil {
+		return 0, err
+	}
+
+	// an escrow can be stored by several peers
+	seen := map[string]bool{}
+
+	var refunded Money
+	for _, e := range escrows {
+		if e.BuyerID != buyerID || seen[e.ID] || e.status(state) != EscrowLocked {
+			continue
+		}
+		seen[e.ID] = true
+
+		deleted, err := closed(store, e.SellerID)
+		if err != nil {
+			return 0, err
+		}
+		if !now.After(e.Deadline) && !deleted {
+			continue
+		}
+
+		err = refundEscrow(l, e)
+		if err != nil {
+			return 0, err
+		}
+		refunded += e.Transaction.TotalCost
+	}
+
+	return refunded, nil
+}
+
+// lockedFunds returns the money of the user locked in escrows.
+func lockedFunds(state ledgerState, escrows []Escrow, userID string) Money {
+	// an escrow can be stored by several peers
+	seen := map[string]bool{}
+
+	var locked Money
+	for _, e := range escrows {
+		if e.BuyerID == userID && !seen[e.ID] {
+			seen[e.ID] = true
+			locked += state.balances[e.account()]
+		}
+	}
+	return locked
+}
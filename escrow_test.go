@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testUser stores a user registered with its first signing key and returns
+// its ID. Users with a VAT number are businesses.
+func testUser(t *testing.T, store Store, key ed25519.PrivateKey, vat string) string {
+	t.Helper()
+
+	public := key.Public().(ed25519.PublicKey)
+	userID := userIDOf(public)
+
+	if err := store.PutUser(User{ID: []byte(userID), VAT: vat, Country: "DE"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutKeyRegistration(newKeyRegistration(userID, KeySigning, nil, public, key)); err != nil {
+		t.Fatal(err)
+	}
+
+	return userID
+}
+
+// testIncome credits an income of 1000 GUBI to an individual.
+func testIncome(t *testing.T, store Store, key ed25519.PrivateKey, userID string) {
+	t.Helper()
+
+	if err := store.PutIncome(Income{ID: "2024/1", Amount: 100000, Period: "2024/1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newLedger(store, key).transfer(incomeTransactionID(userID, "2024/1"), accountEmission, userID, 100000); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEscrow(t *testing.T) {
+	buyerKey, sellerKey := testKey("buyer"), testKey("seller")
+
+	release := func(store Store, l *ledger, e Escrow) error {
+		_, err := releaseEscrow(store, l, e, e.BuyerID, time.Now())
+		return err
+	}
+	refund := func(store Store, l *ledger, e Escrow) error {
+		return refundEscrow(l, e)
+	}
+
+	tests := []struct {
+		name         string
+		deadline     time.Duration
+		sellerClosed bool
+		actions      []func(store Store, l *ledger, e Escrow) error
+		wantErr      error
+		buyer        Money
+		seller       Money
+		status       string
+	}{
+		{
+			name:     "locked",
+			deadline: time.Hour,
+			buyer:    98810,
+			status:   EscrowLocked,
+		},
+		{
+			name:     "released",
+			deadline: time.Hour,
+			actions:  []func(Store, *ledger, Escrow) error{release},
+			buyer:    98810,
+			seller:   1000,
+			status:   EscrowReleased,
+		},
+		{
+			name:     "released twice",
+			deadline: time.Hour,
+			actions:  []func(Store, *ledger, Escrow) error{release, release},
+			buyer:    98810,
+			seller:   1000,
+			status:   EscrowReleased,
+		},
+		{
+			name:     "released by another buyer",
+			deadline: time.Hour,
+			actions: []func(Store, *ledger, Escrow) error{func(store Store, l *ledger, e Escrow) error {
+				_, err := releaseEscrow(store, l, e, "mallory", time.Now())
+				return err
+			}},
+			wantErr: ErrEscrowBuyer,
+			buyer:   98810,
+			status:  EscrowLocked,
+		},
+		{
+			name:     "released after the deadline",
+			deadline: -time.Hour,
+			actions:  []func(Store, *ledger, Escrow) error{release},
+			wantErr:  ErrEscrowExpired,
+			buyer:    98810,
+			status:   EscrowLocked,
+		},
+		{
+			name:         "released once the seller closed",
+			deadline:     time.Hour,
+			sellerClosed: true,
+			actions:      []func(Store, *ledger, Escrow) error{release},
+			wantErr:      ErrAccountClosed,
+			buyer:        98810,
+			status:       EscrowLocked,
+		},
+		{
+			name:     "refunded before the deadline",
+			deadline: time.Hour,
+			actions:  []func(Store, *ledger, Escrow) error{refund},
+			wantErr:  ErrEscrowTerms,
+			buyer:    98810,
+			status:   EscrowLocked,
+		},
+		{
+			name:     "refunded after the deadline",
+			deadline: -time.Hour,
+			actions:  []func(Store, *ledger, Escrow) error{refund},
+			buyer:    100000,
+			status:   EscrowRefunded,
+		},
+		{
+			name:         "refunded once the seller closed",
+			deadline:     time.Hour,
+			sellerClosed: true,
+			actions:      []func(Store, *ledger, Escrow) error{refund},
+			buyer:        100000,
+			status:       EscrowRefunded,
+		},
+		{
+			name:     "released after a refund",
+			deadline: -time.Hour,
+			actions:  []func(Store, *ledger, Escrow) error{refund, release},
+			wantErr:  ErrEscrowUnlocked,
+			buyer:    100000,
+			status:   EscrowRefunded,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryStore()
+			buyerID := testUser(t, store, buyerKey, "")
+			sellerID := testUser(t, store, sellerKey, "DE1")
+			testIncome(t, store, buyerKey, buyerID)
+
+			sale := Transaction{
+				ID:               "order",
+				SenderID:         buyerID,
+				ReceiverID:       sellerID,
+				ProductsServices: []ProductService{{ID: "p", Name: "chair", Price: 1000, Amount: 1}},
+				Taxes:            []TaxLine{{CountryCode: "DE", Type: "vat", Amount: 190}},
+				TotalCost:        1190,
+			}
+
+			l := newLedger(store, buyerKey)
+			escrow, err := lockEscrow(store, l, sale, time.Now().Add(tt.deadline))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.sellerClosed {
+				if err := store.PutTombstone(newTombstone(sellerID, "", 0, 0, sellerKey)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, action := range tt.actions {
+				err = action(store, newLedger(store, buyerKey), escrow)
+				if err != nil {
+					break
+				}
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+
+			state, err := newLedger(store, buyerKey).state()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := state.balances[buyerID]; got != tt.buyer {
+				t.Errorf("buyer balance = %v, want %v", got, tt.buyer)
+			}
+			if got := state.balances[sellerID]; got != tt.seller {
+				t.Errorf("seller balance = %v, want %v", got, tt.seller)
+			}
+			if got := escrow.status(state); got != tt.status {
+				t.Errorf("status = %q, want %q", got, tt.status)
+			}
+		})
+	}
+}
+
+func TestSettleEscrows(t *testing.T) {
+	buyerKey, sellerKey := testKey("buyer"), testKey("seller")
+
+	store := newMemoryStore()
+	buyerID := testUser(t, store, buyerKey, "")
+	sellerID := testUser(t, store, sellerKey, "DE1")
+	testIncome(t, store, buyerKey, buyerID)
+
+	l := newLedger(store, buyerKey)
+	for _, order := range []struct {
+		id       string
+		deadline time.Duration
+	}{
+		{"open", time.Hour},
+		{"expired", -time.Hour},
+		{"released", -time.Hour},
+	} {
+		sale := Transaction{ID: order.id, SenderID: buyerID, ReceiverID: sellerID, TotalCost: 300}
+		if _, err := lockEscrow(store, l, sale, time.Now().Add(order.deadline)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the buyer confirmed this one before its deadline
+	released, err := store.Escrow("released")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.transfer(released.ID, released.account(), sellerID, 300); err != nil {
+		t.Fatal(err)
+	}
+
+	refunded, err := settleEscrows(store, l, buyerID, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refunded != 300 {
+		t.Errorf("settleEscrows() = %v, want only the expired escrow", refunded)
+	}
+
+	again, err := settleEscrows(store, l, buyerID, time.Now())
+	if err != nil || again != 0 {
+		t.Errorf("settleEscrows() again = %v, %v, want nothing", again, err)
+	}
+
+	state, err := l.state()
+	if err != nil {
+		t.Fatal(err)
+	}
+	escrows, err := store.Escrows(buyerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked := lockedFunds(state, escrows, buyerID); locked != 300 {
+		t.Errorf("lockedFunds() = %v, want the open escrow", locked)
+	}
+}
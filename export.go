@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maxence-charriere/go-app/v10/pkg/app"
+)
+
+// ExportedUser is the part of the User record that is handed out in an
+// export. Credentials and face templates are left out, as they are the
+// secrets the account is protected with.
+type ExportedUser struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	DisplayName string   `json:"display_name"`
+	VAT         string   `json:"vat,omitempty"`
+	Country     string   `json:"country"`
+	Region      string   `json:"region,omitempty"`
+	Faces       []string `json:"faces"`       // Names of the enrolled faces
+	Credentials int      `json:"credentials"` // Number of registered passkeys
+}
+
+// DataExport is everything stored under a user ID, in a form that can be
+// carried to another service as required by Article 20 of the GDPR.
+type DataExport struct {
+	ExportedAt     time.Time       `json:"exported_at"`
+	User           ExportedUser    `json:"user"`
+	Balance        Money           `json:"balance"` // Balance of the account in the ledger, in cents
+	Transactions   []Transaction   `json:"transactions"`
+	Plans          []Plan          `json:"plans"`
+	Subscriptions  []Subscription  `json:"subscriptions"`
+	Escrows        []Escrow        `json:"escrows"`
+	Renewals       []Renewal       `json:"renewals"`
+	Mandates       []Mandate       `json:"mandates"`        // Mandates the user gave or was given
+	Invoices       []Invoice       `json:"invoices"`        // Invoices the user issued or paid
+	PaymentIntents []PaymentIntent `json:"payment_intents"` // Payments the user submitted
+	Journal        []JournalEntry  `json:"journal"`         // Settled entries that the user made or that move money of the user
+	Incomes        []Income        `json:"incomes"`         // Income of every period the user was credited for
+	Tombstone      *Tombstone      `json:"tombstone,omitempty"`
+}
+
+// exportData gathers the data of a user from the store, and the balance
+// and the entries of the user from the ledger.
+func exportData(store Store, l *ledger, userID string, now time.Time) (DataExport, error) {
+	user, err := store.User(userID)
+	if err != nil {
+		return DataExport{}, err
+	}
+
+	state, err := l.state()
+	if err != nil {
+		return DataExport{}, err
+	}
+
+	all, err := store.Transactions(userID)
+	if err != nil {
+		return DataExport{}, err
+	}
+
+	// a transaction can be stored by several peers
+	seen := map[string]bool{}
+	transactions := []Transaction{}
+	for _, t := range all {
+		if seen[t.ID] {
+			continue
+		}
+		seen[t.ID] = true
+		transactions = append(transactions, t)
+	}
+	sort.Slice(transactions, func(i, j int) bool {
+		return transactions[i].Timestamp.Before(transactions[j].Timestamp)
+	})
+
+	plans, err := store.PlansBy(userID)
+	if err != nil {
+		return DataExport{}, err
+	}
+
+	subscriptions, err := store.SubscriptionsBy(userID)
+	if err != nil {
+		return DataExport{}, err
+	}
+
+	escrows, err := store.Escrows(userID)
+	if err != nil {
+		return DataExport{}, err
+	}
+
+	renewals, err := store.Renewals(userID)
+	if err != nil {
+		return DataExport{}, err
+	}
+
+	mandates := []Mandate{}
+	allMandates, err := store.Mandates()
+	if err != nil {
+		return DataExport{}, err
+	}
+	for _, m := range allMandates {
+		if m.SubscriberID == userID || m.MerchantID == userID {
+			mandates = append(mandates, m)
+		}
+	}
+
+	intents, err := store.PaymentIntents(userID)
+	if err != nil {
+		return DataExport{}, err
+	}
+
+	invoices, err := store.InvoicesBy(userID)
+	if err != nil {
+		return DataExport{}, err
+	}
+	for _, intent := range intents {
+		invoiceID, ok := strings.CutPrefix(intent.ID, invoiceTransactionID(""))
+		if !ok {
+			continue
+		}
+
+		inv, err := store.Invoice(invoiceID)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return DataExport{}, err
+		}
+		invoices = append(invoices, inv)
+	}
+
+	journal := []JournalEntry{}
+	incomes := []Income{}
+	for _, e := range state.settled {
+		if e.Author != userID && !slices.ContainsFunc(e.Postings, func(p Posting) bool {
+			return accountOwner(p.AccountID) == userID
+		}) {
+			continue
+		}
+		journal = append(journal, e)
+
+		period, ok := strings.CutPrefix(e.TransactionID, incomeTransactionID(userID, ""))
+		if !ok {
+			continue
+		}
+
+		income, ok, err := finalizedIncome(store, period, now)
+		if err != nil {
+			return DataExport{}, err
+		}
+		if ok {
+			incomes = append(incomes, income)
+		}
+	}
+	sort.Slice(journal, func(i, j int) bool {
+		if !journal[i].Timestamp.Equal(journal[j].Timestamp) {
+			return journal[i].Timestamp.Before(journal[j].Timestamp)
+		}
+		return journal[i].ID < journal[j].ID
+	})
+	sort.Slice(incomes, func(i, j int) bool {
+		return incomes[i].Period < incomes[j].Period
+	})
+
+	var tombstone *Tombstone
+	t, err := store.Tombstone(userID)
+	if err == nil {
+		tombstone = &t
+	} else if !errors.Is(err, ErrNotFound) {
+		return DataExport{}, err
+	}
+
+	return DataExport{
+		ExportedAt: now,
+		User: ExportedUser{
+			ID:          string(user.ID),
+			Name:        user.Name,
+			DisplayName: user.DisplayName,
+			VAT:         user.VAT,
+			Country:     user.Country,
+			Region:      user.Region,
+			Faces:       user.faceNames(),
+			Credentials: len(user.CredentialIDs),
+		},
+		Balance:        state.balances[userID],
+		Transactions:   transactions,
+		Plans:          plans,
+		Subscriptions:  subscriptions,
+		Escrows:        escrows,
+		Renewals:       renewals,
+		Mandates:       mandates,
+		Invoices:       invoices,
+		PaymentIntents: intents,
+		Journal:        journal,
+		Incomes:        incomes,
+		Tombstone:      tombstone,
+	}, nil
+}
+
+// transactionsCSV writes the transactions of an export as CSV, one row per
+// product or service, or one row for transactions without any.
+func transactionsCSV(userID string, transactions []Transaction) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	err := w.Write([]string{"id", "timestamp", "period", "direction", "counterparty", "item", "price", "quantity", "tax", "total"})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range transactions {
+		direction, counterparty := "in", t.SenderID
+		if t.SenderID == userID {
+			direction, counterparty = "out", t.ReceiverID
+		}
+
+		var tax Money
+		for _, line := range t.Taxes {
+			tax += line.Amount
+		}
+
+		items := t.ProductsServices
+		if len(items) == 0 {
+			items = []ProductService{{}}
+		}
+
+		for _, ps := range items {
+			err = w.Write([]string{
+				t.ID,
+				t.Timestamp.UTC().Format(time.RFC3339),
+				t.Date,
+				direction,
+				counterparty,
+				ps.Name,
+				ps.Price.String(),
+				strconv.Itoa(ps.Amount),
+				tax.String(),
+				t.TotalCost.String(),
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	w.Flush()
+
+	return buf.Bytes(), w.Error()
+}
+
+// downloadRevokeDelay is the time the object URL of a download is kept.
+const downloadRevokeDelay = time.Minute
+
+// download makes the browser save data as a file.
+func download(name, mimeType string, data []byte) {
+	array := app.Window().Get("Uint8Array").New(len(data))
+	app.CopyBytesToJS(array, data)
+
+	parts := app.Window().Get("Array").New(array)
+	options := map[string]any{"type": mimeType}
+	blob := app.Window().Get("Blob").New(parts, options)
+
+	url := app.Window().Get("URL").Call("createObjectURL", blob)
+
+	a := app.Window().Get("document").Call("createElement", "a")
+	a.Set("href", url)
+	a.Set("download", name)
+	a.Call("click")
+
+	// the browser reads the blob after click returns, so the URL is
+	// revoked only once the download had time to start
+	var revoke app.Func
+	revoke = app.FuncOf(func(this app.Value, args []app.Value) interface{} {
+		app.Window().Get("URL").Call("revokeObjectURL", url)
+		revoke.Release()
+		return nil
+	})
+	app.Window().Call("setTimeout", revoke, downloadRevokeDelay.Milliseconds())
+}
+
+// exportJSON returns the export as indented JSON.
+func (d DataExport) exportJSON() ([]byte, error) {
+	return json.MarshalIndent(d, "", "  ")
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"math"
+	mathRand "math/rand/v2"
+)
+
+// Face templates are made by projecting a descriptor on templateDims random
+// directions and rounding the result to steps of templateStep.
+const (
+	templateDims = 64
+	templateStep = 1.0 / 128
+	templateMax  = 127
+)
+
+// FaceTemplate is a template of a face descriptor: its projection on
+// templateDims random directions seeded by the salt, quantized. It is not a
+// secret. Every peer needs the salt to compare a live face with the
+// template, so the salt is stored with it, and the template gives away 64
+// coarse linear measurements of the 128 values of the descriptor. They do
+// not pin the descriptor down on their own, but they narrow it a lot, and
+// two templates of the same face under different salts together come close
+// to it. Enrolling again replaces the template under a new salt, so a
+// template that leaked stops matching, but it does not undo the leak.
+type FaceTemplate struct {
+	Salt   []byte    `mapstructure:"salt" json:"salt" validate:"uuid_rfc4122"`                   // Seeds the projection
+	Values []int8    `mapstructure:"values" json:"values" validate:"uuid_rfc4122"`               // Quantized projection of the descriptor
+	Pivots []float32 `mapstructure:"salted_pivots" json:"salted_pivots" validate:"uuid_rfc4122"` // Exact distances to the pivots of an earlier index, which give the descriptor away, dropped on the next login
+}
+
+// newFaceTemplate makes a template of the descriptor under a new salt.
+func newFaceTemplate(descriptor []float32) FaceTemplate {
+	salt := make([]byte, 32)
+	rand.Read(salt)
+
+	return FaceTemplate{
+		Salt:   salt,
+		Values: project(descriptor, salt),
+	}
+}
+
+// project maps the descriptor with the random sign matrix seeded by salt.
+// Such a projection keeps Euclidean distances on average, so templates made
+// under the same salt can be compared with the threshold of the descriptors.
+func project(descriptor []float32, salt []byte) []int8 {
+	p := newProjector(descriptor, salt)
+
+	values := make([]int8, templateDims)
+	for i := range values {
+		values[i] = p.next()
+	}
+
+	return values
+}
+
+// projector computes the projection of a descriptor one value at a time, so
+// a comparison can stop before the whole projection is made.
+type projector struct {
+	r          *mathRand.ChaCha8
+	descriptor []float32
+}
+
+func newProjector(descriptor []float32, salt []byte) projector {
+	return projector{
+		r:          mathRand.NewChaCha8(sha256.Sum256(salt)),
+		descriptor: descriptor,
+	}
+}
+
+// next returns the next quantized value of the projection.
+func (p projector) next() int8 {
+	var v float64
+	var bits uint64
+	for j, d := range p.descriptor {
+		if j%64 == 0 {
+			bits = p.r.Uint64()
+		}
+		if bits&1 == 1 {
+			v += float64(d)
+		} else {
+			v -= float64(d)
+		}
+		bits >>= 1
+	}
+
+	q := math.Round(v / math.Sqrt(templateDims) / templateStep)
+	return int8(math.Max(-templateMax, math.Min(templateMax, q)))
+}
+
+// outdated reports whether the template still carries the distances to the
+// pivots of an earlier index. Such a template is enrolled again on the next
+// login.
+func (t FaceTemplate) outdated() bool {
+	return len(t.Pivots) > 0
+}
+
+// distance returns the distance between a live descriptor and the template.
+func (t FaceTemplate) distance(descriptor []float32) float64 {
+	values := project(descriptor, t.Salt)
+	if len(values) != len(t.Values) {
+		return math.Inf(1)
+	}
+
+	var sum float64
+	for i := range values {
+		d := float64(values[i]) - float64(t.Values[i])
+		sum += d * d
+	}
+
+	return math.Sqrt(sum) * templateStep
+}
+
+// distanceWithin returns the distance between a live descriptor and the
+// template when it is below radius, and how many values of the projection
+// it took to tell. The descriptor is projected one value at a time, and the
+// comparison stops as soon as the distance so far reaches radius, which
+// skips most of the projection for another face.
+func (t FaceTemplate) distanceWithin(descriptor []float32, radius float64) (float64, int, bool) {
+	if len(t.Values) != templateDims {
+		return math.Inf(1), 0, false
+	}
+
+	p := newProjector(descriptor, t.Salt)
+	limit := math.Pow(radius/templateStep, 2)
+
+	var sum float64
+	for i, value := range t.Values {
+		d := float64(p.next()) - float64(value)
+		sum += d * d
+		if sum >= limit {
+			return math.Inf(1), i + 1, false
+		}
+	}
+
+	return math.Sqrt(sum) * templateStep, len(t.Values), true
+}
+
+// faceNames returns the names of the faces enrolled for the user.
+func (u User) faceNames() []string {
+	names := []string{}
+	for name := range u.Templates {
+		names = append(names, name)
+	}
+	for name := range u.Descriptor {
+		if _, ok := u.Templates[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// matchFace returns the enrolled face of the user closest to a live
+// descriptor, if any is within faceMatchDistance.
+func (u User) matchFace(descriptor []float32) (string, bool) {
+	var found string
+	best := faceMatchDistance
+
+	for name, t := range u.Templates {
+		if d := t.distance(descriptor); d < best {
+			best, found = d, name
+		}
+	}
+	for name, legacy := range u.Descriptor {
+		if d := euclideanDistance(descriptor, legacy); d < best {
+			best, found = d, name
+		}
+	}
+
+	return found, len(found) > 0
+}
+
+// enrollFace replaces the template of a face with one under a new salt.
+// Raw descriptors of users enrolled before templates are dropped.
+func (u *User) enrollFace(name string, descriptor []float32) {
+	if u.Templates == nil {
+		u.Templates = map[string]FaceTemplate{}
+	}
+	u.Templates[name] = newFaceTemplate(descriptor)
+	delete(u.Descriptor, name)
+}
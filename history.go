@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// transactionPageSize is the number of transactions shown at once.
+const transactionPageSize = 20
+
+// Directions of a transaction seen from the user.
+const (
+	directionPurchase = "purchase"
+	directionSale     = "sale"
+	directionIncome   = "income"
+	directionRefund   = "refund"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// TransactionQuery selects transactions of a user. Zero values do not
+// filter.
+type TransactionQuery struct {
+	UserID       string
+	From         time.Time // Earliest timestamp, inclusive
+	To           time.Time // Latest timestamp, exclusive
+	Direction    string    // directionPurchase, directionSale, directionIncome or directionRefund
+	Counterparty string    // User ID on the other side
+	Search       string    // Part of the name of a product or service, case insensitive
+	MinAmount    Money     // Minimum total cost in cents
+	MaxAmount    Money     // Maximum total cost in cents
+	Cursor       string    // Next of the previous page
+	Limit        int       // Page size, transactionPageSize when 0
+}
+
+// TransactionPage is a page of transactions, newest first.
+type TransactionPage struct {
+	Transactions []Transaction
+	Next         string // Cursor of the next page, empty on the last one
+}
+
+// direction returns how the user took part in the transaction.
+func (t Transaction) direction(userID string) string {
+	switch {
+	case len(t.RefundOf) > 0:
+		return directionRefund
+	case t.SenderID == accountEmission:
+		return directionIncome
+	case t.SenderID == userID:
+		return directionPurchase
+	default:
+		return directionSale
+	}
+}
+
+// counterparty returns the other side of the transaction.
+func (t Transaction) counterparty(userID string) string {
+	if t.SenderID == userID {
+		return t.ReceiverID
+	}
+	return t.SenderID
+}
+
+// matches reports whether the transaction passes the filters of the query.
+func (q TransactionQuery) matches(t Transaction) bool {
+	if !q.From.IsZero() && t.Timestamp.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !t.Timestamp.Before(q.To) {
+		return false
+	}
+	if len(q.Direction) > 0 && t.direction(q.UserID) != q.Direction {
+		return false
+	}
+	if len(q.Counterparty) > 0 && t.counterparty(q.UserID) != q.Counterparty {
+		return false
+	}
+	if q.MinAmount > 0 && t.TotalCost < q.MinAmount {
+		return false
+	}
+	if q.MaxAmount > 0 && t.TotalCost > q.MaxAmount {
+		return false
+	}
+
+	if len(q.Search) > 0 {
+		search := strings.ToLower(q.Search)
+		for _, ps := range t.ProductsServices {
+			if strings.Contains(strings.ToLower(ps.Name), search) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// transactionCursor encodes the position after a transaction. Transactions
+// are ordered by timestamp then ID, so the cursor stays valid when new
+// transactions come in.
+func transactionCursor(t Transaction) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(t.Timestamp.UTC().Format(time.RFC3339Nano) + "|" + t.ID))
+}
+
+func parseTransactionCursor(cursor string) (time.Time, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+
+	ts, id, ok := strings.Cut(string(b), "|")
+	if !ok {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+
+	return t, id, nil
+}
+
+// newerThan reports whether a comes before b, newest first.
+func newerThan(a, b Transaction) bool {
+	if a.Timestamp.Equal(b.Timestamp) {
+		return a.ID > b.ID
+	}
+	return a.Timestamp.After(b.Timestamp)
+}
+
+// queryTransactions returns a page of the transactions of a user that match
+// the query.
+func queryTransactions(store Store, q TransactionQuery) (TransactionPage, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = transactionPageSize
+	}
+
+	var after Transaction
+	if len(q.Cursor) > 0 {
+		ts, id, err := parseTransactionCursor(q.Cursor)
+		if err != nil {
+			return TransactionPage{}, err
+		}
+		after = Transaction{ID: id, Timestamp: ts}
+	}
+
+	all, err := store.Transactions(q.UserID)
+	if err != nil {
+		return TransactionPage{}, err
+	}
+
+	// a transaction can be stored by several peers
+	seen := map[string]bool{}
+	transactions := []Transaction{}
+	for _, t := range all {
+		if seen[t.ID] || !q.matches(t) {
+			continue
+		}
+		if len(q.Cursor) > 0 && !newerThan(after, t) {
+			continue
+		}
+		seen[t.ID] = true
+		transactions = append(transactions, t)
+	}
+
+	sort.Slice(transactions, func(i, j int) bool {
+		return newerThan(transactions[i], transactions[j])
+	})
+
+	page := TransactionPage{Transactions: transactions}
+	if len(transactions) > limit {
+		page.Transactions = transactions[:limit]
+		page.Next = transactionCursor(page.Transactions[limit-1])
+	}
+
+	return page, nil
+}
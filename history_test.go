@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestQueryTransactionsPages(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	want := []string{}
+	for i := range 7 {
+		want = append([]string{"t" + strconv.Itoa(i)}, want...)
+	}
+
+	tests := []struct {
+		name  string
+		limit int
+		pages int
+	}{
+		{"one page", 10, 1},
+		{"exact pages", 7, 1},
+		{"pages across equal timestamps", 3, 3},
+		{"one by one", 1, 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryStore()
+			for i := range 7 {
+				// pairs of transactions share a timestamp, which the ID
+				// orders
+				tx := Transaction{
+					ID:         "t" + strconv.Itoa(i),
+					SenderID:   "alice",
+					ReceiverID: "bob",
+					Timestamp:  t0.Add(time.Duration(i/2) * time.Minute),
+				}
+				if err := store.PutTransaction(tx); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got := []string{}
+			q := TransactionQuery{UserID: "alice", Limit: tt.limit}
+			pages := 0
+			for {
+				page, err := queryTransactions(store, q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				pages++
+				for _, tx := range page.Transactions {
+					got = append(got, tx.ID)
+				}
+				if len(page.Next) == 0 {
+					break
+				}
+				q.Cursor = page.Next
+
+				// a transaction that comes in meanwhile does not shift the
+				// pages
+				late := Transaction{ID: "late" + strconv.Itoa(pages), SenderID: "alice", ReceiverID: "bob", Timestamp: time.Now()}
+				if err := store.PutTransaction(late); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if !slices.Equal(got, want) {
+				t.Errorf("pages hold %v, want %v", got, want)
+			}
+			if pages != tt.pages {
+				t.Errorf("%v pages, want %v", pages, tt.pages)
+			}
+		})
+	}
+}
+
+func TestQueryTransactionsFilters(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	store := newMemoryStore()
+	for _, tx := range []Transaction{
+		{ID: "income", SenderID: accountEmission, ReceiverID: "alice", TotalCost: 100000, Timestamp: t0},
+		{ID: "bread", SenderID: "alice", ReceiverID: "bob", TotalCost: 500, Timestamp: t0.Add(time.Hour), ProductsServices: []ProductService{{Name: "Rye Bread"}}},
+		{ID: "milk", SenderID: "alice", ReceiverID: "carol", TotalCost: 150, Timestamp: t0.Add(2 * time.Hour), ProductsServices: []ProductService{{Name: "Milk"}}},
+		{ID: "refund", SenderID: "bob", ReceiverID: "alice", RefundOf: "bread", TotalCost: 500, Timestamp: t0.Add(3 * time.Hour)},
+		{ID: "sale", SenderID: "carol", ReceiverID: "alice", TotalCost: 2000, Timestamp: t0.Add(4 * time.Hour), ProductsServices: []ProductService{{Name: "Bike"}}},
+		{ID: "other", SenderID: "bob", ReceiverID: "carol", TotalCost: 100, Timestamp: t0.Add(5 * time.Hour)},
+	} {
+		if err := store.PutTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query TransactionQuery
+		want  []string
+	}{
+		{"all, newest first", TransactionQuery{}, []string{"sale", "refund", "milk", "bread", "income"}},
+		{"purchases", TransactionQuery{Direction: directionPurchase}, []string{"milk", "bread"}},
+		{"sales", TransactionQuery{Direction: directionSale}, []string{"sale"}},
+		{"income", TransactionQuery{Direction: directionIncome}, []string{"income"}},
+		{"refunds", TransactionQuery{Direction: directionRefund}, []string{"refund"}},
+		{"counterparty", TransactionQuery{Counterparty: "carol"}, []string{"sale", "milk"}},
+		{"search ignores case", TransactionQuery{Search: "bread"}, []string{"bread"}},
+		{"from inclusive, to exclusive", TransactionQuery{From: t0.Add(time.Hour), To: t0.Add(3 * time.Hour)}, []string{"milk", "bread"}},
+		{"amount range", TransactionQuery{MinAmount: 150, MaxAmount: 500}, []string{"refund", "milk", "bread"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.query.UserID = "alice"
+			page, err := queryTransactions(store, tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := []string{}
+			for _, tx := range page.Transactions {
+				got = append(got, tx.ID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("queryTransactions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTransactionCursor(t *testing.T) {
+	tx := Transaction{ID: "t1", Timestamp: time.Date(2024, 1, 1, 12, 30, 0, 123, time.UTC)}
+
+	tests := []struct {
+		name    string
+		cursor  string
+		wantErr error
+	}{
+		{"round trip", transactionCursor(tx), nil},
+		{"not base64", "%%%", ErrInvalidCursor},
+		{"no separator", "dDE", ErrInvalidCursor},
+		{"bad time", "bm90IGEgdGltZXx0MQ", ErrInvalidCursor},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, id, err := parseTransactionCursor(tt.cursor)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseTransactionCursor() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (id != tx.ID || !ts.Equal(tx.Timestamp)) {
+				t.Errorf("parseTransactionCursor() = %v, %v, want %v, %v", ts, id, tx.Timestamp, tx.ID)
+			}
+		})
+	}
+
+	if _, err := queryTransactions(newMemoryStore(), TransactionQuery{UserID: "alice", Cursor: "%%%"}); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("queryTransactions() with a bad cursor = %v, want ErrInvalidCursor", err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"time"
+)
+
+// incomeCatchUpMonths is how many months back a user who did not log in is
+// paid the income missed, unless the caller of entitlements asks for
+// another window. The statistics must be kept with the same window.
+const incomeCatchUpMonths = 12
+
+// incomeTransactionID returns the ID of the credit of a period to a user.
+// It is derived from both, so a period can never be credited twice.
+func incomeTransactionID(userID, period string) string {
+	return "income:" + userID + ":" + period
+}
+
+// missedPeriods returns the periods after lastReceived up to the one of now,
+// oldest first and at most window of them. A user who never received income
+// is owed the periods since the one of registration, or the current period
+// only when the time of registration is unknown.
+func missedPeriods(lastReceived string, registered, now time.Time, window int) []string {
+	current := periodOf(now)
+
+	start, err := periodStart(lastReceived)
+	if err == nil {
+		start = start.AddDate(0, 1, 0)
+	} else if registered.IsZero() {
+		return []string{current}
+	} else {
+		start, _ = periodStart(periodOf(registered))
+	}
+
+	periods := []string{}
+	for t := start; periodOf(t) != current && t.Before(now); t = t.AddDate(0, 1, 0) {
+		periods = append(periods, periodOf(t))
+	}
+	if lastReceived != current {
+		periods = append(periods, current)
+	}
+
+	if len(periods) > window {
+		periods = periods[len(periods)-window:]
+	}
+
+	return periods
+}
+
+// entitlements returns the finalized incomes owed to a user who last
+// received income in lastReceived, for at most window months back, oldest
+// first, and the period up to which every income was finalized. A period not finalized yet is owed again on
+// the next login, so the user has received income only up to the period
+// before it.
+func entitlements(store Store, lastReceived string, registered, now time.Time, window int) ([]Income, string, error) {
+	incomes := []Income{}
+	through := lastReceived
+	contiguous := true
+	for _, period := range missedPeriods(lastReceived, registered, now, window) {
+		income, finalized, err := finalizedIncome(store, period, now)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if !finalized {
+			contiguous = false
+			continue
+		}
+
+		incomes = append(incomes, income)
+		if contiguous {
+			through = period
+		}
+	}
+
+	return incomes, through, nil
+}
+
+// emit issues new GUBI to a user and records it as a transaction sent by the
+// emission account, so that the history of the wallet explains where the
+// money came from and the supply can be audited. The journal entry is posted
+// first, and both are keyed by transactionID so a retry does neither twice.
+func emit(store Store, l *ledger, transactionID, userID, period string, amount Money) error {
+	// a retried credit keeps the time of the entry
+	entry, err := l.transfer(transactionID, accountEmission, userID, amount)
+	if err != nil {
+		return err
+	}
+
+	return store.PutTransaction(Transaction{
+		ID:         transactionID,
+		SenderID:   accountEmission,
+		ReceiverID: userID,
+		TotalCost:  amount,
+		Timestamp:  entry.Timestamp,
+		Date:       period,
+		Processed:  true, // nothing was sold
+	})
+}
+
+// recordedSupply returns the money supply according to the system-issued
+// transactions: everything emitted minus everything burned.
+func recordedSupply(store Store) (Money, error) {
+	var supply Money
+
+	emissions, err := store.Transactions(accountEmission)
+	if err != nil {
+		return 0, err
+	}
+	for _, t := range emissions {
+		if t.SenderID == accountEmission {
+			supply += t.TotalCost
+		}
+	}
+
+	burns, err := store.Transactions(accountBurn)
+	if err != nil {
+		return 0, err
+	}
+	for _, t := range burns {
+		if t.ReceiverID == accountBurn {
+			supply -= t.TotalCost
+		}
+	}
+
+	return supply, nil
+}
+
+// reconcileSupply returns the money supply according to the journal and to
+// the transactions. Both are equal unless GUBI was issued or burned without
+// being recorded.
+func reconcileSupply(store Store, l *ledger) (Money, Money, error) {
+	journal, err := l.supply()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	recorded, err := recordedSupply(store)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return journal, recorded, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultIncome is the income in cents when there is no earlier one to index.
+const defaultIncome = 100000
+
+// PriceIndexItem is what was sold of one product or service in a period.
+type PriceIndexItem struct {
+	Name     string `mapstructure:"name" json:"name" validate:"uuid_rfc4122"`         // Lower case name of the product or service
+	Quantity int    `mapstructure:"quantity" json:"quantity" validate:"uuid_rfc4122"` // Units sold
+	Spend    Money  `mapstructure:"spend" json:"spend" validate:"uuid_rfc4122"`       // Cents spent on it
+	Relative int    `mapstructure:"relative" json:"relative" validate:"uuid_rfc4122"` // Unit price relative to the previous period in millionths, 0 when not sold then
+}
+
+// periodOf returns the period of a time in the format of Transaction.Date.
+// Periods are months in UTC, so that every peer agrees on them whatever its
+// time zone.
+func periodOf(t time.Time) string {
+	t = t.UTC()
+	return strconv.Itoa(t.Year()) + "/" + strconv.Itoa(int(t.Month()))
+}
+
+// nextPeriodOf returns the period following the one of a time.
+func nextPeriodOf(t time.Time) string {
+	t = t.UTC()
+	return periodOf(time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC))
+}
+
+// priceItems sums up the products and services sold in the transactions,
+// sorted by name.
+func priceItems(transactions []Transaction) []PriceIndexItem {
+	byName := map[string]*PriceIndexItem{}
+	for _, t := range transactions {
+		for _, ps := range t.ProductsServices {
+			if ps.Price <= 0 || ps.Amount <= 0 {
+				continue
+			}
+
+			name := strings.ToLower(strings.TrimSpace(ps.Name))
+			item, ok := byName[name]
+			if !ok {
+				item = &PriceIndexItem{Name: name}
+				byName[name] = item
+			}
+			item.Quantity += ps.Amount
+			item.Spend += ps.Price.times(ps.Amount)
+		}
+	}
+
+	items := make([]PriceIndexItem, 0, len(byName))
+	for _, item := range byName {
+		items = append(items, *item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Name < items[j].Name
+	})
+
+	return items
+}
+
+// indexIncome computes the income of the next period from the income of the
+// current one and the transactions made during it. The unit price of every
+// product is compared with the one of the previous period, kept in the
+// breakdown of the current income, and the price relatives are averaged with
+// the spend of this period as weights. The arithmetic is exact until the
+// index is rounded to millionths, and the items are sorted by name, so every
+// peer holding the same transactions gets the same income. Transactions that
+// were not processed yet are returned marked as processed.
+func indexIncome(current Income, transactions []Transaction, next string) (Income, []Transaction) {
+	items := priceItems(transactions)
+
+	previous := map[string]PriceIndexItem{}
+	for _, item := range current.Items {
+		previous[item.Name] = item
+	}
+
+	num := new(big.Rat)
+	den := new(big.Rat)
+	for i, item := range items {
+		old, ok := previous[item.Name]
+		if !ok || old.Quantity <= 0 || old.Spend <= 0 {
+			continue
+		}
+
+		// (spend / quantity) / (old spend / old quantity)
+		relative := new(big.Rat).SetFrac(
+			new(big.Int).Mul(big.NewInt(int64(item.Spend)), big.NewInt(int64(old.Quantity))),
+			new(big.Int).Mul(big.NewInt(int64(old.Spend)), big.NewInt(int64(item.Quantity))),
+		)
+		items[i].Relative = int(roundRat(relative, rateScale))
+
+		weight := new(big.Rat).SetInt64(int64(item.Spend))
+		num.Add(num, new(big.Rat).Mul(weight, relative))
+		den.Add(den, weight)
+	}
+
+	index := int64(rateScale)
+	if den.Sign() > 0 {
+		index = roundRat(new(big.Rat).Quo(num, den), rateScale)
+	}
+
+	income := Income{
+		ID:           next,
+		Amount:       Money(roundRat(new(big.Rat).SetFrac64(int64(current.Amount)*index, rateScale), 1)),
+		Period:       next,
+		BasePeriod:   current.Period,
+		BaseAmount:   current.Amount,
+		Index:        int(index),
+		Transactions: len(transactions),
+		Items:        items,
+	}
+
+	processed := []Transaction{}
+	for _, t := range transactions {
+		if !t.Processed {
+			t.Processed = true
+			processed = append(processed, t)
+		}
+	}
+
+	return income, processed
+}
+
+// roundRat returns r times scale rounded half away from zero.
+func roundRat(r *big.Rat, scale int64) int64 {
+	n := new(big.Int).Mul(r.Num(), big.NewInt(scale))
+	d := r.Denom()
+
+	neg := n.Sign() < 0
+	n.Abs(n)
+
+	// (2n + d) / 2d
+	q := new(big.Int).Div(
+		new(big.Int).Add(new(big.Int).Lsh(n, 1), d),
+		new(big.Int).Lsh(d, 1),
+	)
+	if neg {
+		q.Neg(q)
+	}
+
+	return q.Int64()
+}
+
+// runInflationIndexer indexes the transactions of the period of now and
+// proposes the income of the next period signed with key.
+func runInflationIndexer(store Store, key ed25519.PrivateKey, now time.Time) (IncomeProposal, error) {
+	period := periodOf(now)
+
+	current, ok, err := finalizedIncome(store, period, now)
+	if err != nil {
+		return IncomeProposal{}, err
+	}
+	if !ok {
+		current = Income{Amount: defaultIncome, Period: period}
+	}
+
+	all, err := store.TransactionsIn(period)
+	if err != nil {
+		return IncomeProposal{}, err
+	}
+
+	// only sales are indexed, not the income credited, the balances burned
+	// or the refunds made during the period
+	transactions := []Transaction{}
+	for _, t := range all {
+		if t.SenderID != accountEmission && t.ReceiverID != accountBurn && len(t.RefundOf) == 0 {
+			transactions = append(transactions, t)
+		}
+	}
+
+	// the order of the transactions must not matter
+	sort.Slice(transactions, func(i, j int) bool {
+		return transactions[i].ID < transactions[j].ID
+	})
+
+	income, processed := indexIncome(current, transactions, nextPeriodOf(now))
+
+	for _, t := range processed {
+		err = store.PutTransaction(t)
+		if err != nil {
+			return IncomeProposal{}, err
+		}
+	}
+
+	proposal := newIncomeProposal(income, inputHash(transactions), key)
+
+	err = store.PutIncomeProposal(proposal)
+	if err != nil {
+		return IncomeProposal{}, err
+	}
+
+	return proposal, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestIndexIncome(t *testing.T) {
+	sale := func(id, name string, price Money, amount int) Transaction {
+		return Transaction{ID: id, ProductsServices: []ProductService{{Name: name, Price: price, Amount: amount}}}
+	}
+
+	current := Income{
+		Amount: 100000,
+		Period: "2024/1",
+		Items: []PriceIndexItem{
+			{Name: "bread", Quantity: 10, Spend: 2000},
+			{Name: "milk", Quantity: 3, Spend: 300},
+		},
+	}
+
+	tests := []struct {
+		name         string
+		current      Income
+		transactions []Transaction
+		wantIndex    int
+		wantAmount   Money
+	}{
+		{
+			name:       "nothing sold",
+			current:    current,
+			wantIndex:  1000000,
+			wantAmount: 100000,
+		},
+		{
+			name:         "first period has no prices to compare",
+			current:      Income{Amount: 100000, Period: "2024/1"},
+			transactions: []Transaction{sale("t1", "bread", 200, 1)},
+			wantIndex:    1000000,
+			wantAmount:   100000,
+		},
+		{
+			name:         "same prices",
+			current:      current,
+			transactions: []Transaction{sale("t1", "bread", 200, 5), sale("t2", "milk", 100, 1)},
+			wantIndex:    1000000,
+			wantAmount:   100000,
+		},
+		{
+			name:         "price doubled",
+			current:      current,
+			transactions: []Transaction{sale("t1", "bread", 400, 1)},
+			wantIndex:    2000000,
+			wantAmount:   200000,
+		},
+		{
+			name:         "weighted by spend",
+			current:      current,
+			transactions: []Transaction{sale("t1", "bread", 400, 1), sale("t2", "milk", 100, 12)},
+			// (400 * 2 + 1200 * 1) / 1600
+			wantIndex:  1250000,
+			wantAmount: 125000,
+		},
+		{
+			name:         "names ignore case and spaces",
+			current:      current,
+			transactions: []Transaction{sale("t1", " Bread", 300, 1), sale("t2", "BREAD ", 300, 1)},
+			wantIndex:    1500000,
+			wantAmount:   150000,
+		},
+		{
+			name:         "new products do not move the index",
+			current:      current,
+			transactions: []Transaction{sale("t1", "bread", 200, 1), sale("t2", "cheese", 5000, 1)},
+			wantIndex:    1000000,
+			wantAmount:   100000,
+		},
+		{
+			name:         "free and returned items are left out",
+			current:      current,
+			transactions: []Transaction{sale("t1", "bread", 200, 1), sale("t2", "milk", 0, 1), sale("t3", "milk", 500, -1)},
+			wantIndex:    1000000,
+			wantAmount:   100000,
+		},
+		{
+			name:         "rounded to millionths",
+			current:      current,
+			transactions: []Transaction{sale("t1", "milk", 100, 2), sale("t2", "milk", 101, 1)},
+			// 301 / 300
+			wantIndex:  1003333,
+			wantAmount: 100333,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			income, processed := indexIncome(tt.current, tt.transactions, "2024/2")
+			if income.Index != tt.wantIndex || income.Amount != tt.wantAmount {
+				t.Errorf("indexIncome() = index %v amount %v, want %v %v", income.Index, income.Amount, tt.wantIndex, tt.wantAmount)
+			}
+			if income.Period != "2024/2" || income.BasePeriod != tt.current.Period || income.BaseAmount != tt.current.Amount {
+				t.Errorf("indexIncome() periods = %v from %v %v", income.Period, income.BasePeriod, income.BaseAmount)
+			}
+			if len(processed) != len(tt.transactions) {
+				t.Errorf("indexIncome() processed %v transactions, want %v", len(processed), len(tt.transactions))
+			}
+		})
+	}
+}
+
+func TestRunInflationIndexerIsDeterministic(t *testing.T) {
+	now := time.Date(2024, 1, 28, 12, 0, 0, 0, time.UTC)
+	transactions := []Transaction{
+		{ID: "t1", SenderID: "alice", ReceiverID: "bob", Date: "2024/1", ProductsServices: []ProductService{{Name: "bread", Price: 220, Amount: 3}}},
+		{ID: "t2", SenderID: "carol", ReceiverID: "bob", Date: "2024/1", ProductsServices: []ProductService{{Name: "milk", Price: 90, Amount: 7}}},
+		{ID: "t3", SenderID: "alice", ReceiverID: "dave", Date: "2024/1", ProductsServices: []ProductService{{Name: "Bread", Price: 250, Amount: 1}}},
+		// neither income, burns nor refunds are sales
+		{ID: "t4", SenderID: accountEmission, ReceiverID: "alice", Date: "2024/1", ProductsServices: []ProductService{{Name: "bread", Price: 9999, Amount: 1}}},
+		{ID: "t5", SenderID: "bob", ReceiverID: accountBurn, Date: "2024/1", ProductsServices: []ProductService{{Name: "bread", Price: 9999, Amount: 1}}},
+		{ID: "t6", SenderID: "bob", ReceiverID: "alice", RefundOf: "t1", Date: "2024/1", ProductsServices: []ProductService{{Name: "bread", Price: 9999, Amount: 1}}},
+		// another period
+		{ID: "t7", SenderID: "alice", ReceiverID: "bob", Date: "2023/12", ProductsServices: []ProductService{{Name: "bread", Price: 9999, Amount: 1}}},
+	}
+	base := Income{
+		ID:     "i1",
+		Amount: 100000,
+		Period: "2024/1",
+		Items:  []PriceIndexItem{{Name: "bread", Quantity: 4, Spend: 800}, {Name: "milk", Quantity: 1, Spend: 100}},
+	}
+
+	run := func(order []int) IncomeProposal {
+		store := newMemoryStore()
+		if err := store.PutIncome(base); err != nil {
+			t.Fatal(err)
+		}
+		for _, i := range order {
+			if err := store.PutTransaction(transactions[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		proposal, err := runInflationIndexer(store, testKey("peer"), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := store.TransactionsIn("2024/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tx := range stored {
+			if sale := slices.Contains([]string{"t1", "t2", "t3"}, tx.ID); tx.Processed != sale {
+				t.Errorf("transaction %s processed = %v, want %v", tx.ID, tx.Processed, sale)
+			}
+		}
+
+		return proposal
+	}
+
+	want := run([]int{0, 1, 2, 3, 4, 5, 6})
+	if want.Period != "2024/2" || want.Income.Transactions != 3 {
+		t.Fatalf("proposal for %v from %v transactions, want 2024/2 from 3", want.Period, want.Income.Transactions)
+	}
+	// bread 910 / 4 against 200, milk 90 against 100, weighted by the
+	// spend of 910 and 630
+	if want.Income.Index != 1040341 || want.Income.Amount != 104034 {
+		t.Errorf("index = %v, amount = %v, want 1040341 and 104034", want.Income.Index, want.Income.Amount)
+	}
+
+	for _, order := range [][]int{{6, 5, 4, 3, 2, 1, 0}, {2, 0, 5, 1, 6, 3, 4}} {
+		got := run(order)
+		if got.Candidate != want.Candidate || got.InputHash != want.InputHash {
+			t.Errorf("order %v: candidate %v, want %v", order, got.Candidate, want.Candidate)
+		}
+	}
+}
+
+func TestPeriodOf(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*60*60)
+	losAngeles := time.FixedZone("PST", -8*60*60)
+
+	tests := []struct {
+		name string
+		at   time.Time
+		want string
+		next string
+	}{
+		{"utc", time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC), "2024/3", "2024/4"},
+		{"local new month still the old one in UTC", time.Date(2024, 4, 1, 3, 0, 0, 0, tokyo), "2024/3", "2024/4"},
+		{"local old month already the new one in UTC", time.Date(2024, 3, 31, 20, 0, 0, 0, losAngeles), "2024/4", "2024/5"},
+		{"end of year", time.Date(2024, 12, 31, 23, 59, 0, 0, time.UTC), "2024/12", "2025/1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := periodOf(tt.at); got != tt.want {
+				t.Errorf("periodOf() = %v, want %v", got, tt.want)
+			}
+			if got := nextPeriodOf(tt.at); got != tt.next {
+				t.Errorf("nextPeriodOf() = %v, want %v", got, tt.next)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+const dbPaymentIntent = "payment_intent"
+
+// States of a payment intent.
+const (
+	IntentPending   = "pending"
+	IntentCommitted = "committed"
+	IntentFailed    = "failed"
+)
+
+// intentStuckAfter is how long an intent may stay pending before the wallet
+// reports it as stuck.
+const intentStuckAfter = time.Minute
+
+// PaymentIntent records a payment before any money moves. Its ID is chosen
+// by the payer and reused as the transaction ID, so submitting the same
+// intent twice settles the transaction only once.
+type PaymentIntent struct {
+	ID          string        `mapstructure:"_id" json:"_id" validate:"uuid_rfc4122"`                 // Unique identifier for the intent and its transaction
+	SenderID    string        `mapstructure:"sender_id" json:"sender_id" validate:"uuid_rfc4122"`     // Payer user id
+	ReceiverID  string        `mapstructure:"receiver_id" json:"receiver_id" validate:"uuid_rfc4122"` // Receiver user id
+	Transaction Transaction   `mapstructure:"transaction" json:"transaction" validate:"uuid_rfc4122"` // Transaction stored once committed
+	Splits      []Transaction `mapstructure:"splits" json:"splits" validate:"uuid_rfc4122"`           // Transactions of a split payment, stored instead
+	Postings    []Posting     `mapstructure:"postings" json:"postings" validate:"uuid_rfc4122"`       // Postings of the journal entry
+	Reverses    string        `mapstructure:"reverses" json:"reverses" validate:"uuid_rfc4122"`       // Journal transaction a refund pays back
+	State       string        `mapstructure:"state" json:"state" validate:"uuid_rfc4122"`             // pending, committed or failed
+	Error       string        `mapstructure:"error" json:"error" validate:"uuid_rfc4122"`             // Reason of the last failure
+	CreatedAt   time.Time     `mapstructure:"created_at" json:"created_at" validate:"uuid_rfc4122"`   // Time the intent was first submitted
+	UpdatedAt   time.Time     `mapstructure:"updated_at" json:"updated_at" validate:"uuid_rfc4122"`   // Time of the last state change
+}
+
+// newPaymentIntent creates the intent of a transaction settled by the
+// given postings.
+func newPaymentIntent(transaction Transaction, postings []Posting) PaymentIntent {
+	return PaymentIntent{
+		ID:          transaction.ID,
+		SenderID:    transaction.SenderID,
+		ReceiverID:  transaction.ReceiverID,
+		Transaction: transaction,
+		Postings:    postings,
+	}
+}
+
+// newSplitIntent creates the intent of a payment to several receivers, one
+// transaction each, settled by the given postings at once.
+func newSplitIntent(groupID string, transactions []Transaction, postings []Posting) PaymentIntent {
+	intent := PaymentIntent{
+		ID:       groupID,
+		Splits:   transactions,
+		Postings: postings,
+	}
+	if len(transactions) > 0 {
+		intent.SenderID = transactions[0].SenderID
+	}
+	return intent
+}
+
+// transactions returns the transactions the intent records.
+func (i PaymentIntent) transactions() []Transaction {
+	if len(i.Splits) > 0 {
+		return i.Splits
+	}
+	return []Transaction{i.Transaction}
+}
+
+// stuck reports whether the intent has been pending for too long.
+func (i PaymentIntent) stuck() bool {
+	return i.State == IntentPending && time.Since(i.UpdatedAt) > intentStuckAfter
+}
+
+// change returns what the intent moves into an account, negative when the
+// money moves out of it.
+func (i PaymentIntent) change(accountID string) Money {
+	var change Money
+	for _, p := range i.Postings {
+		if p.AccountID == accountID {
+			change += p.Amount
+		}
+	}
+	return change
+}
+
+// submitPayment runs an intent at most once. A committed intent is returned
+// as is. A pending or failed one is retried with the content recorded the
+// first time it was submitted, and the ledger makes sure that its journal
+// entry is applied only once even if an earlier attempt got as far as
+// posting it.
+func submitPayment(store Store, l *ledger, intent PaymentIntent) (PaymentIntent, error) {
+	existing, err := store.PaymentIntent(intent.ID)
+	if err == nil {
+		if existing.State == IntentCommitted {
+			return existing, nil
+		}
+		intent = existing
+	} else if errors.Is(err, ErrNotFound) {
+		intent.State = IntentPending
+		intent.CreatedAt = time.Now()
+		intent.UpdatedAt = intent.CreatedAt
+		err = store.PutPaymentIntent(intent)
+		if err != nil {
+			return intent, err
+		}
+	} else {
+		return intent, err
+	}
+
+	_, err = l.postReversal(intent.ID, intent.Reverses, intent.Postings)
+	if errors.Is(err, ErrInsufficientFunds) || errors.Is(err, ErrUnbalancedEntry) || errors.Is(err, ErrSystemDebit) {
+		intent.State = IntentFailed
+		intent.Error = err.Error()
+		intent.UpdatedAt = time.Now()
+		putErr := store.PutPaymentIntent(intent)
+		if putErr != nil {
+			return intent, putErr
+		}
+		return intent, err
+	} else if err != nil {
+		// leave the intent pending so that it can be retried
+		return intent, err
+	}
+
+	for _, t := range intent.transactions() {
+		err = store.PutTransaction(t)
+		if err != nil {
+			return intent, err
+		}
+	}
+
+	intent.State = IntentCommitted
+	intent.Error = ""
+	intent.UpdatedAt = time.Now()
+	err = store.PutPaymentIntent(intent)
+	if err != nil {
+		return intent, err
+	}
+
+	return intent, nil
+}
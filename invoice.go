@@ -0,0 +1,462 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/maxence-charriere/go-app/v10/pkg/app"
+)
+
+const dbInvoice = "invoice"
+
+// invoiceValidity is how long an invoice can be paid when the merchant does
+// not say otherwise.
+const invoiceValidity = 24 * time.Hour
+
+// States of an invoice.
+const (
+	InvoiceOpen    = "open"
+	InvoicePaid    = "paid"
+	InvoiceExpired = "expired"
+)
+
+var (
+	ErrInvoiceExpired = errors.New("invoice expired")
+	ErrInvoicePaid    = errors.New("invoice already paid")
+	ErrInvoiceBuyer   = errors.New("invoice issued to another buyer")
+	ErrInvoiceTaxes   = errors.New("invoice taxes do not match the rates in force")
+)
+
+// Invoice is a payment request signed by a merchant. The merchant sets the
+// bill, and the payer only approves it, so the items, the taxes and the
+// total of the transaction are the ones the merchant signed.
+type Invoice struct {
+	ID           string           `mapstructure:"_id" json:"_id" validate:"uuid_rfc4122"`                     // Unique identifier for the invoice
+	MerchantID   string           `mapstructure:"merchant_id" json:"merchant_id" validate:"uuid_rfc4122"`     // User id of the merchant to pay
+	BuyerID      string           `mapstructure:"buyer_id" json:"buyer_id" validate:"uuid_rfc4122"`           // User id of the only payer allowed, empty for anyone
+	BuyerType    string           `mapstructure:"buyer_type" json:"buyer_type" validate:"uuid_rfc4122"`       // Entity type the taxes were computed for
+	BuyerCountry string           `mapstructure:"buyer_country" json:"buyer_country" validate:"uuid_rfc4122"` // Country of the buyer, empty for anyone
+	BuyerRegion  string           `mapstructure:"buyer_region" json:"buyer_region" validate:"uuid_rfc4122"`   // Region of the buyer
+	Items        []ProductService `mapstructure:"items" json:"items" validate:"uuid_rfc4122"`                 // Line items
+	Taxes        []TaxLine        `mapstructure:"taxes" json:"taxes" validate:"uuid_rfc4122"`                 // Taxes due on the items
+	Total        Money            `mapstructure:"total" json:"total" validate:"uuid_rfc4122"`                 // Amount the payer is charged
+	CreatedAt    time.Time        `mapstructure:"created_at" json:"created_at" validate:"uuid_rfc4122"`       // Time of issue, which picks the tax rates
+	ExpiresAt    time.Time        `mapstructure:"expires_at" json:"expires_at" validate:"uuid_rfc4122"`       // Time after which the invoice cannot be paid
+	PublicKey    []byte           `mapstructure:"public_key" json:"public_key" validate:"uuid_rfc4122"`       // Key of the merchant
+	Signature    []byte           `mapstructure:"signature" json:"signature" validate:"uuid_rfc4122"`         // Signature over the content
+}
+
+// newInvoice prices the items for the buyer, an individual in the country
+// of the merchant when anyone may pay, and signs the invoice with key.
+func newInvoice(engine *taxEngine, merchant, buyer User, items []ProductService, validity time.Duration, key ed25519.PrivateKey) Invoice {
+	now := time.Now().UTC()
+
+	inv := Invoice{
+		ID:           uuid.NewString(),
+		MerchantID:   string(merchant.ID),
+		BuyerID:      string(buyer.ID),
+		BuyerType:    entityOf(buyer),
+		BuyerCountry: buyer.Country,
+		BuyerRegion:  buyer.Region,
+		Items:        items,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(validity),
+		PublicKey:    key.Public().(ed25519.PublicKey),
+	}
+
+	sale := inv.sale(merchant)
+	inv.Taxes = engine.taxLines(sale)
+	inv.Total = saleTotal(sale.net(), inv.Taxes)
+	inv.Signature = ed25519.Sign(key, inv.content())
+
+	return inv
+}
+
+// sale returns the sale the invoice bills.
+func (inv Invoice) sale(merchant User) Sale {
+	sale := newSale(User{}, merchant, inv.Items, inv.CreatedAt)
+	sale.BuyerType = inv.BuyerType
+	sale.BuyerCountry = inv.BuyerCountry
+	sale.BuyerRegion = inv.BuyerRegion
+
+	return sale
+}
+
+// content returns the canonical bytes that are signed.
+func (inv Invoice) content() []byte {
+	b, _ := json.Marshal(struct {
+		ID           string           `json:"id"`
+		MerchantID   string           `json:"merchant_id"`
+		BuyerID      string           `json:"buyer_id"`
+		BuyerType    string           `json:"buyer_type"`
+		BuyerCountry string           `json:"buyer_country,omitempty"`
+		BuyerRegion  string           `json:"buyer_region,omitempty"`
+		Items        []ProductService `json:"items"`
+		Taxes        []TaxLine        `json:"taxes"`
+		Total        Money            `json:"total"`
+		CreatedAt    string           `json:"created_at"`
+		ExpiresAt    string           `json:"expires_at"`
+		PublicKey    []byte           `json:"public_key"`
+	}{
+		ID:           inv.ID,
+		MerchantID:   inv.MerchantID,
+		BuyerID:      inv.BuyerID,
+		BuyerType:    inv.BuyerType,
+		BuyerCountry: inv.BuyerCountry,
+		BuyerRegion:  inv.BuyerRegion,
+		Items:        inv.Items,
+		Taxes:        inv.Taxes,
+		Total:        inv.Total,
+		CreatedAt:    inv.CreatedAt.UTC().Format(time.RFC3339Nano),
+		ExpiresAt:    inv.ExpiresAt.UTC().Format(time.RFC3339Nano),
+		PublicKey:    inv.PublicKey,
+	})
+	return b
+}
+
+// verify checks that the invoice is signed with the key of the merchant.
+func (inv Invoice) verify(store Store) error {
+	if len(inv.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(inv.PublicKey, inv.content(), inv.Signature) {
+		return ErrInvalidSignature
+	}
+
+	ring, err := loadKeyring(store)
+	if err != nil {
+		return err
+	}
+
+	if !ring.signs(inv.MerchantID, inv.PublicKey) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// invoiceTransactionID returns the ID of the transaction that pays an
+// invoice. It is derived from the invoice, so an invoice is paid only once.
+func invoiceTransactionID(invoiceID string) string {
+	return "invoice:" + invoiceID
+}
+
+// invoiceStatus returns whether the invoice is open, paid or expired. It is
+// paid once the journal holds the entry of its transaction.
+func invoiceStatus(state ledgerState, inv Invoice, now time.Time) string {
+	if hasEntry(state, invoiceTransactionID(inv.ID)) {
+		return InvoicePaid
+	}
+
+	if now.After(inv.ExpiresAt) {
+		return InvoiceExpired
+	}
+
+	return InvoiceOpen
+}
+
+// invoicePayment checks that the payer can pay the invoice and returns the
+// transaction and the postings that pay it.
+func invoicePayment(store Store, l *ledger, inv Invoice, payerID, payerType string, now time.Time) (Transaction, []Posting, error) {
+	err := inv.verify(store)
+	if err != nil {
+		return Transaction{}, nil, err
+	}
+
+	if len(inv.BuyerID) > 0 && inv.BuyerID != payerID || inv.BuyerType != payerType {
+		return Transaction{}, nil, ErrInvoiceBuyer
+	}
+
+	deleted, err := closed(store, inv.MerchantID)
+	if err != nil {
+		return Transaction{}, nil, err
+	}
+	if deleted {
+		return Transaction{}, nil, ErrAccountClosed
+	}
+
+	txID := invoiceTransactionID(inv.ID)
+
+	state, err := l.state()
+	if err != nil {
+		return Transaction{}, nil, err
+	}
+	if hasEntry(state, txID) {
+		return Transaction{}, nil, ErrInvoicePaid
+	}
+
+	// another payer may have started paying it first
+	intent, err := store.PaymentIntent(txID)
+	if err == nil && intent.SenderID != payerID {
+		return Transaction{}, nil, ErrInvoicePaid
+	} else if err != nil && !errors.Is(err, ErrNotFound) {
+		return Transaction{}, nil, err
+	}
+	started := err == nil
+
+	// a payment already started is retried even after the invoice expired
+	if !started && now.After(inv.ExpiresAt) {
+		return Transaction{}, nil, ErrInvoiceExpired
+	}
+
+	merchant, err := store.User(inv.MerchantID)
+	if err != nil {
+		return Transaction{}, nil, err
+	}
+
+	engine, err := newTaxEngine(store)
+	if err != nil {
+		return Transaction{}, nil, err
+	}
+
+	sale := inv.sale(merchant)
+	taxes := engine.taxLines(sale)
+	if !sameTaxes(taxes, inv.Taxes) || saleTotal(sale.net(), taxes) != inv.Total {
+		return Transaction{}, nil, ErrInvoiceTaxes
+	}
+
+	transaction := Transaction{
+		ID:               txID,
+		SenderID:         payerID,
+		ReceiverID:       inv.MerchantID,
+		InvoiceID:        inv.ID,
+		ProductsServices: inv.Items,
+		Taxes:            inv.Taxes,
+		TotalCost:        inv.Total,
+		Timestamp:        now,
+		Date:             periodOf(now),
+	}
+
+	return transaction, salePostings(payerID, inv.MerchantID, sale.net(), inv.Taxes), nil
+}
+
+// sameTaxes reports whether two sets of tax lines are equal.
+func sameTaxes(a, b []TaxLine) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// invoices is a component where merchants bill their customers. A component
+// is a customizable, independent, and reusable UI element. It is created by
+// embedding app.Compo into a struct.
+type invoices struct {
+	app.Compo
+	store       Store
+	ledger      *ledger
+	loggedIn    bool
+	userID      string
+	userBalance UserBalance
+	buyerID     string
+	validity    int
+	items       []ProductService
+	invoices    []Invoice
+	statuses    map[string]string
+}
+
+func (i *invoices) OnMount(ctx app.Context) {
+	i.store = newStore()
+	i.ledger = newLedger(i.store, signingKey(ctx))
+	i.items = make([]ProductService, 1)
+	i.validity = int(invoiceValidity / time.Hour)
+
+	ctx.GetState("loggedIn", &i.loggedIn)
+	if !i.loggedIn {
+		ctx.Navigate("/auth")
+	}
+
+	ctx.GetState("userID", &i.userID)
+	ctx.GetState("balance", &i.userBalance)
+
+	i.getInvoices(ctx)
+}
+
+func (i *invoices) getInvoices(ctx app.Context) {
+	ctx.Async(func() {
+		invoices, err := i.store.InvoicesBy(i.userID)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		sort.Slice(invoices, func(a, b int) bool {
+			return invoices[a].CreatedAt.After(invoices[b].CreatedAt)
+		})
+
+		state, err := i.ledger.state()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		statuses := map[string]string{}
+		for _, inv := range invoices {
+			statuses[inv.ID] = invoiceStatus(state, inv, time.Now())
+		}
+
+		ctx.Dispatch(func(ctx app.Context) {
+			i.invoices = invoices
+			i.statuses = statuses
+		})
+	})
+}
+
+func (i *invoices) addItem(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+	i.items = append(i.items, ProductService{})
+}
+
+func (i *invoices) removeItem(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+	i.items = i.items[:len(i.items)-1]
+}
+
+func (i *invoices) createInvoice(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+
+	valid := app.Window().GetElementByID("invoice-form").Call("reportValidity").Bool()
+	if !valid {
+		return
+	}
+
+	items := []ProductService{}
+	for _, item := range i.items {
+		item.ID = uuid.NewString()
+		items = append(items, item)
+	}
+	buyerID := i.buyerID
+	validity := time.Duration(i.validity) * time.Hour
+	if validity <= 0 {
+		validity = invoiceValidity
+	}
+	key := signingKey(ctx)
+
+	ctx.Async(func() {
+		merchant, err := i.store.User(i.userID)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var buyer User
+		if len(buyerID) > 0 {
+			buyer, err = i.store.User(buyerID)
+			if errors.Is(err, ErrNotFound) {
+				ctx.Dispatch(func(ctx app.Context) {
+					ctx.Notifications().New(app.Notification{
+						Title: "Error",
+						Body:  "There is no user with this ID.",
+					})
+				})
+				return
+			} else if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		engine, err := newTaxEngine(i.store)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		inv := newInvoice(engine, merchant, buyer, items, validity, key)
+
+		err = i.store.PutInvoice(inv)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx.Dispatch(func(ctx app.Context) {
+			i.items = make([]ProductService, 1)
+			app.Window().GetElementByID("invoice-form").Call("reset")
+			ctx.Notifications().New(app.Notification{
+				Title: "Success",
+				Body:  "Invoice " + inv.ID + " created.",
+			})
+			i.getInvoices(ctx)
+		})
+	})
+}
+
+// The Render method is where the component appearance is defined. Here, the
+// invoices of the merchant are displayed.
+func (i *invoices) Render() app.UI {
+	return app.Div().Class("container").Body(
+		app.Div().Class("mobile").Body(
+			app.Div().Class("header").Body(
+				newNav(),
+				app.Div().Class("header-summary").Body(
+					app.Span().Class("logo").Text("cyber-gubi"),
+					app.Div().Class("summary-text").Body(
+						app.Span().Text("Balance"),
+					),
+					app.Div().Class("summary-balance").Body(
+						app.Span().Text(i.userBalance.Balance.gubi()),
+					),
+				),
+			),
+			app.Div().ID("content").Body(
+				app.Div().Class("card").Body(
+					app.Div().Class("upper-row").Body(
+						app.Div().Class("card-item").Body(
+							app.Span().Class("span-header").Text("New Invoice"),
+							app.Form().ID("invoice-form").Body(
+								app.Range(i.items).Slice(func(n int) app.UI {
+									return app.Div().Body(
+										app.Input().Class("product").Type("text").Name("item-name").Placeholder("Item name").Required(true).OnChange(i.ValueTo(&i.items[n].Name)),
+										app.Input().Class("product").Type("number").Min(0.01).Step(0.01).Name("item-price").Placeholder("Single price").Required(true).OnChange(moneyTo(&i.items[n].Price)),
+										app.Input().Class("product").Type("number").Min(1).Step(1).Name("item-amount").Placeholder("Quantity").Required(true).OnChange(i.ValueTo(&i.items[n].Amount)),
+									)
+								}),
+								app.Div().Class("menu-btn menu-add-item").Body(
+									app.Button().Class("submit").Text("+").OnClick(i.addItem),
+									app.If(len(i.items) > 1, func() app.UI {
+										return app.Button().Class("submit").Text("-").OnClick(i.removeItem)
+									}),
+								),
+								app.Input().Class("product").Type("text").Name("buyer-id").Placeholder("Buyer ID, empty for anyone").OnChange(i.ValueTo(&i.buyerID)),
+								app.Input().Class("product").Type("number").Min(1).Step(1).Name("validity").Placeholder("Valid for hours ("+strconv.Itoa(i.validity)+")").OnChange(i.ValueTo(&i.validity)),
+								app.Div().Class("drawer drawer-pay").Body(
+									app.Div().Class("menu-btn").Body(
+										app.Button().Class("submit").Type("submit").Text("Issue").OnClick(i.createInvoice),
+									),
+								),
+							),
+						),
+					),
+				),
+				app.Div().Class("transactions").Body(
+					app.Span().Class("t-desc").Text("Invoices"),
+					app.If(len(i.invoices) == 0, func() app.UI {
+						return app.Div().Class("transaction").Body(
+							app.Span().Class("empty").Text("No invoices yet"),
+						).Style("pointer-events", "none")
+					}),
+					app.Range(i.invoices).Slice(func(n int) app.UI {
+						return app.Div().Class("transaction").Body(
+							app.Div().Class("t-details").Body(
+								app.Div().Class("t-title").Body(
+									app.Span().Text("Invoice ID: "+i.invoices[n].ID),
+								),
+								app.Div().Class("t-time").Body(
+									app.Span().Text(i.statuses[i.invoices[n].ID]+" until "+i.invoices[n].ExpiresAt.Local().Format("2006-01-02 15:04")),
+								),
+							),
+							app.Div().Class("t-price").Body(
+								app.Span().Text(i.invoices[n].Total.gubi()),
+							),
+						)
+					}),
+				),
+			),
+		),
+	)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/google/uuid"
+)
+
+const dbKeyRegistration = "key_registration"
+
+// Kinds of keys a user registers.
+const (
+	// KeySigning is a key the journal entries and the other signed records
+	// of the user are signed with, one per device.
+	KeySigning = "signing"
+	// KeyCredential is the public key of a WebAuthn credential of the user.
+	KeyCredential = "credential"
+)
+
+var ErrUntrustedKey = errors.New("the key is not registered to the user")
+
+// keyNamespace derives the IDs of the users from their first signing key.
+var keyNamespace = uuid.MustParse("5351ab63-c174-499e-9cdb-56f4cde07163")
+
+// KeyRegistration adds a key to a user. The user record can be written by
+// any peer, so the keys it lists prove nothing. A registration counts only
+// when it is signed by a signing key already registered to the user, or is
+// the first signing key of the user, the one the user ID is derived from.
+// A device that logs in with a credential of the user registers its key
+// with the assertion of the login instead, as the ceremony server makes the
+// challenge of the login the hash of the registration. Every peer follows
+// these chains itself, so neither a peer nor a ceremony server can add a key
+// to another user.
+type KeyRegistration struct {
+	ID                string `mapstructure:"_id" json:"_id" validate:"uuid_rfc4122"`                               // Hash of the registration
+	UserID            string `mapstructure:"user_id" json:"user_id" validate:"uuid_rfc4122"`                       // User the key is registered to
+	Kind              string `mapstructure:"kind" json:"kind" validate:"uuid_rfc4122"`                             // signing or credential
+	CredentialID      []byte `mapstructure:"credential_id" json:"credential_id" validate:"uuid_rfc4122"`           // ID of the credential, empty for signing keys
+	PublicKey         []byte `mapstructure:"public_key" json:"public_key" validate:"uuid_rfc4122"`                 // Key registered, COSE encoded for credentials
+	Nonce             []byte `mapstructure:"nonce" json:"nonce" validate:"uuid_rfc4122"`                           // Random bytes of the ceremony server, so every login has its own challenge
+	SignerKey         []byte `mapstructure:"signer_key" json:"signer_key" validate:"uuid_rfc4122"`                 // Signing key of the user that signs the registration
+	SignerCredential  []byte `mapstructure:"signer_credential" json:"signer_credential" validate:"uuid_rfc4122"`   // Credential of the user whose assertion signs the registration instead
+	AuthenticatorData []byte `mapstructure:"authenticator_data" json:"authenticator_data" validate:"uuid_rfc4122"` // Authenticator data of the assertion
+	ClientDataJSON    []byte `mapstructure:"client_data_json" json:"client_data_json" validate:"uuid_rfc4122"`     // Client data of the assertion, holding the challenge
+	Signature         []byte `mapstructure:"signature" json:"signature" validate:"uuid_rfc4122"`                   // Signature over the content, or of the assertion
+}
+
+// userIDOf returns the ID of the user whose first signing key is key.
+func userIDOf(key ed25519.PublicKey) string {
+	return uuid.NewSHA1(keyNamespace, key).String()
+}
+
+func newKeyRegistration(userID, kind string, credentialID, publicKey []byte, signer ed25519.PrivateKey) KeyRegistration {
+	r := KeyRegistration{
+		UserID:       userID,
+		Kind:         kind,
+		CredentialID: credentialID,
+		PublicKey:    publicKey,
+		SignerKey:    signer.Public().(ed25519.PublicKey),
+	}
+	r.Signature = ed25519.Sign(signer, r.content())
+	r.ID = r.hash()
+
+	return r
+}
+
+// content returns the canonical bytes that are signed.
+func (r KeyRegistration) content() []byte {
+	b, _ := json.Marshal(struct {
+		UserID       string `json:"user_id"`
+		Kind         string `json:"kind"`
+		CredentialID []byte `json:"credential_id"`
+		PublicKey    []byte `json:"public_key"`
+		Nonce        []byte `json:"nonce"`
+	}{
+		UserID:       r.UserID,
+		Kind:         r.Kind,
+		CredentialID: r.CredentialID,
+		PublicKey:    r.PublicKey,
+		Nonce:        r.Nonce,
+	})
+	return b
+}
+
+// challenge returns the challenge of the login whose assertion signs the
+// registration.
+func (r KeyRegistration) challenge() []byte {
+	hash := sha256.Sum256(r.content())
+	return hash[:]
+}
+
+// hash returns the ID of the registration. The signature is hashed too, so
+// that no peer can overwrite a registration with one that does not verify.
+func (r KeyRegistration) hash() string {
+	b, _ := json.Marshal(struct {
+		Content           []byte `json:"content"`
+		SignerKey         []byte `json:"signer_key"`
+		SignerCredential  []byte `json:"signer_credential"`
+		AuthenticatorData []byte `json:"authenticator_data"`
+		ClientDataJSON    []byte `json:"client_data_json"`
+		Signature         []byte `json:"signature"`
+	}{r.content(), r.SignerKey, r.SignerCredential, r.AuthenticatorData, r.ClientDataJSON, r.Signature})
+
+	hash := sha256.Sum256(b)
+	return hex.EncodeToString(hash[:])
+}
+
+// verify checks that the registration is signed by a key or a credential
+// the keyring trusts for the user, or that it is the first signing key of
+// the user.
+func (r KeyRegistration) verify(ring keyring) error {
+	if r.ID != r.hash() {
+		return ErrInvalidSignature
+	}
+
+	switch {
+	case r.Kind == KeySigning && len(r.PublicKey) == ed25519.PublicKeySize:
+	case r.Kind == KeyCredential && len(r.CredentialID) > 0 && len(r.PublicKey) > 0:
+	default:
+		return ErrInvalidSignature
+	}
+
+	if len(r.SignerCredential) > 0 {
+		return r.verifyAssertion(ring)
+	}
+
+	if len(r.SignerKey) != ed25519.PublicKeySize || !ed25519.Verify(r.SignerKey, r.content(), r.Signature) {
+		return ErrInvalidSignature
+	}
+
+	root := r.Kind == KeySigning && bytes.Equal(r.SignerKey, r.PublicKey) && r.UserID == userIDOf(r.PublicKey)
+	if !root && !ring.signs(r.UserID, r.SignerKey) {
+		return ErrUntrustedKey
+	}
+
+	return nil
+}
+
+// verifyAssertion checks that the registration is signed by the assertion
+// of a login with a credential of the user: the authenticator verified the
+// user and signed the challenge derived from the registration for the
+// relying party.
+func (r KeyRegistration) verifyAssertion(ring keyring) error {
+	key, ok := ring.credentials[r.UserID][string(r.SignerCredential)]
+	if !ok {
+		return ErrUntrustedKey
+	}
+
+	var client protocol.CollectedClientData
+	err := json.Unmarshal(r.ClientDataJSON, &client)
+	if err != nil || client.Type != protocol.AssertCeremony || client.Challenge != base64.RawURLEncoding.EncodeToString(r.challenge()) {
+		return ErrInvalidSignature
+	}
+
+	var data protocol.AuthenticatorData
+	rpIDHash := sha256.Sum256([]byte(relyingPartyID))
+	if data.Unmarshal(r.AuthenticatorData) != nil || !bytes.Equal(data.RPIDHash, rpIDHash[:]) || !data.Flags.HasUserVerified() {
+		return ErrInvalidSignature
+	}
+
+	pub, err := webauthncose.ParsePublicKey(key)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	clientHash := sha256.Sum256(r.ClientDataJSON)
+	signed := append(slices.Clone(r.AuthenticatorData), clientHash[:]...)
+	if ok, err := webauthncose.VerifySignature(pub, signed, r.Signature); err != nil || !ok {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// keyring holds the keys the registrations lead to.
+type keyring struct {
+	// signing maps every user to its signing keys.
+	signing map[string][][]byte
+	// credentials maps every user to its credentials by ID.
+	credentials map[string]map[string][]byte
+}
+
+// signs reports whether key is a signing key of the user.
+func (k keyring) signs(userID string, key []byte) bool {
+	return slices.ContainsFunc(k.signing[userID], func(s []byte) bool {
+		return bytes.Equal(s, key)
+	})
+}
+
+// trustedKeys follows the registrations from the first signing key of every
+// user and returns the keys they lead to. Registrations are checked again
+// until none is added, so their order does not matter. Users registered
+// before their ID was derived from a key have no first key, and none of
+// their keys count.
+func trustedKeys(registrations []KeyRegistration) keyring {
+	ring := keyring{
+		signing:     map[string][][]byte{},
+		credentials: map[string]map[string][]byte{},
+	}
+
+	added := map[string]bool{}
+	for grown := true; grown; {
+		grown = false
+		for _, r := range registrations {
+			if added[r.ID] || r.verify(ring) != nil {
+				continue
+			}
+			added[r.ID] = true
+			grown = true
+
+			switch r.Kind {
+			case KeySigning:
+				if !ring.signs(r.UserID, r.PublicKey) {
+					ring.signing[r.UserID] = append(ring.signing[r.UserID], r.PublicKey)
+				}
+			case KeyCredential:
+				if ring.credentials[r.UserID] == nil {
+					ring.credentials[r.UserID] = map[string][]byte{}
+				}
+				ring.credentials[r.UserID][string(r.CredentialID)] = r.PublicKey
+			}
+		}
+	}
+
+	return ring
+}
+
+// loadKeyring returns the keys the registrations in the store lead to.
+func loadKeyring(store Store) (keyring, error) {
+	registrations, err := store.KeyRegistrations()
+	if err != nil {
+		return keyring{}, err
+	}
+
+	return trustedKeys(registrations), nil
+}
@@ -0,0 +1,845 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maxence-charriere/go-app/v10/pkg/app"
+)
+
+const dbJournal = "journal"
+
+// System accounts are not owned by any user.
+const (
+	// accountEmission is the source of every basic income credit. It is the
+	// only account allowed to go negative, so its balance is the negated
+	// money supply.
+	accountEmission = "emission"
+	// accountBurn receives the GUBI taken out of circulation.
+	accountBurn = "burn"
+)
+
+var (
+	ErrUnbalancedEntry   = errors.New("postings do not sum to zero")
+	ErrInvalidSignature  = errors.New("invalid journal entry signature")
+	ErrInsufficientFunds = errors.New("not enough funds")
+	ErrUnauthorizedKey   = errors.New("this device is not registered for the account, log in again")
+	ErrForkedChain       = errors.New("two entries of the account claim the same sequence, its journal is frozen")
+	ErrSystemDebit       = errors.New("the entry takes money out of a system account it may not")
+)
+
+// Posting moves Amount cents into an account, or out of it when negative.
+type Posting struct {
+	AccountID string `mapstructure:"account_id" json:"account_id" validate:"uuid_rfc4122"` // Account the amount is posted to
+	Amount    Money  `mapstructure:"amount" json:"amount" validate:"uuid_rfc4122"`         // Amount in cents, negative for debits
+}
+
+// JournalEntry is an append-only record of money moving between accounts.
+// Its postings always sum to zero, so no entry can create or destroy GUBI
+// except through the system accounts. The ID is the hash of the signed
+// content, which makes entries immutable and lets peers merge journals by
+// plain set union. The entries of an author form a chain numbered by
+// Sequence, which fixes the order they are applied in whatever their
+// timestamps say.
+type JournalEntry struct {
+	ID            string    `mapstructure:"_id" json:"_id" validate:"uuid_rfc4122"`                       // Hash of the signed content
+	TransactionID string    `mapstructure:"transaction_id" json:"transaction_id" validate:"uuid_rfc4122"` // Transaction the entry settles
+	Author        string    `mapstructure:"author" json:"author" validate:"uuid_rfc4122"`                 // Account whose chain the entry extends
+	Sequence      uint64    `mapstructure:"sequence" json:"sequence" validate:"uuid_rfc4122"`             // Position in the chain of the author, from 1
+	Reverses      string    `mapstructure:"reverses" json:"reverses" validate:"uuid_rfc4122"`             // Transaction the entry pays back, for refunds
+	Postings      []Posting `mapstructure:"postings" json:"postings" validate:"uuid_rfc4122"`             // Debit and credit pairs
+	Timestamp     time.Time `mapstructure:"timestamp" json:"timestamp" validate:"uuid_rfc4122"`           // Time the entry was made
+	PublicKey     []byte    `mapstructure:"public_key" json:"public_key" validate:"uuid_rfc4122"`         // Key of the author
+	Signature     []byte    `mapstructure:"signature" json:"signature" validate:"uuid_rfc4122"`           // Signature over the content
+}
+
+// isSystemAccount reports whether the account is not owned by any user.
+func isSystemAccount(accountID string) bool {
+	return accountID == accountEmission || accountID == accountBurn || isCountryAccount(accountID)
+}
+
+// newJournalEntry creates the entry at the given sequence of the chain of
+// author for the postings signed with key.
+func newJournalEntry(transactionID, author string, sequence uint64, reverses string, postings []Posting, key ed25519.PrivateKey) (JournalEntry, error) {
+	entry := JournalEntry{
+		TransactionID: transactionID,
+		Author:        author,
+		Sequence:      sequence,
+		Reverses:      reverses,
+		Postings:      postings,
+		Timestamp:     time.Now().UTC(),
+		PublicKey:     key.Public().(ed25519.PublicKey),
+	}
+
+	if !entry.balanced() {
+		return JournalEntry{}, ErrUnbalancedEntry
+	}
+
+	content := entry.content()
+	hash := sha256.Sum256(content)
+	entry.ID = hex.EncodeToString(hash[:])
+	entry.Signature = ed25519.Sign(key, content)
+
+	return entry, nil
+}
+
+// content returns the canonical bytes that are hashed and signed.
+func (e JournalEntry) content() []byte {
+	b, _ := json.Marshal(struct {
+		TransactionID string    `json:"transaction_id"`
+		Author        string    `json:"author"`
+		Sequence      uint64    `json:"sequence"`
+		Reverses      string    `json:"reverses"`
+		Postings      []Posting `json:"postings"`
+		Timestamp     string    `json:"timestamp"`
+		PublicKey     []byte    `json:"public_key"`
+	}{
+		TransactionID: e.TransactionID,
+		Author:        e.Author,
+		Sequence:      e.Sequence,
+		Reverses:      e.Reverses,
+		Postings:      e.Postings,
+		Timestamp:     e.Timestamp.UTC().Format(time.RFC3339Nano),
+		PublicKey:     e.PublicKey,
+	})
+	return b
+}
+
+func (e JournalEntry) balanced() bool {
+	if len(e.Postings) < 2 {
+		return false
+	}
+
+	var sum Money
+	for _, p := range e.Postings {
+		if p.Amount == 0 {
+			return false
+		}
+		sum += p.Amount
+	}
+
+	return sum == 0
+}
+
+// pays reports whether the entry moves money from one account to another.
+func (e JournalEntry) pays(from, to string) bool {
+	debited, credited := false, false
+	for _, p := range e.Postings {
+		debited = debited || (p.AccountID == from && p.Amount < 0)
+		credited = credited || (p.AccountID == to && p.Amount > 0)
+	}
+	return debited && credited
+}
+
+// taxCollected returns what the entry credited to a country account for the
+// sales of seller. A country posting belongs to the sale of the user credited
+// last before it, as the postings of every sale list the seller before its
+// taxes.
+func (e JournalEntry) taxCollected(seller, country string) Money {
+	var owner string
+	var tax Money
+	for _, p := range e.Postings {
+		switch {
+		case p.Amount <= 0:
+		case !isSystemAccount(p.AccountID):
+			owner = p.AccountID
+		case p.AccountID == country && owner == seller:
+			tax += p.Amount
+		}
+	}
+	return tax
+}
+
+// verify checks that the entry is balanced, untampered and signed by the
+// key it carries.
+func (e JournalEntry) verify() error {
+	if !e.balanced() {
+		return ErrUnbalancedEntry
+	}
+
+	if len(e.PublicKey) != ed25519.PublicKeySize {
+		return ErrInvalidSignature
+	}
+
+	content := e.content()
+	hash := sha256.Sum256(content)
+	if e.ID != hex.EncodeToString(hash[:]) || !ed25519.Verify(e.PublicKey, content, e.Signature) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// replay computes the account balances from a journal. The entries of an
+// author are applied in the order of their sequence, and the chains of the
+// authors are merged by the timestamp, then the ID, of their next entry, so
+// every peer holding the same set of entries gets the same balances whatever
+// order they were received in. A backdated entry cannot jump ahead of the
+// earlier entries of its author, and an entry waits until the one before it
+// in the chain has arrived. When two entries claim the same place in a chain,
+// the author tried to rewrite its history and the chain is frozen from there.
+//
+// An entry is skipped as a whole when it is invalid, when it debits a user
+// account it was not signed for, when it charges a renewal the mandate of
+// the subscriber does not allow, when it debits a system account the rules
+// do not allow it to, when it moves money of an account made after the
+// account was deleted, when its transaction was already settled by an
+// earlier entry, or when it would take any account but the emission account
+// below zero. A skipped entry still takes its place in the chain. A conflicting
+// concurrent spend or a resubmitted payment is therefore dropped on every
+// peer alike.
+func replay(entries []JournalEntry, rules ledgerRules) ledgerState {
+	state := ledgerState{
+		balances:  map[string]Money{},
+		settled:   map[string]JournalEntry{},
+		reversed:  map[string]Money{},
+		rules:     rules,
+		sequences: map[string]uint64{},
+		forks:     map[string]uint64{},
+		renewed:   map[string]time.Time{},
+	}
+
+	seen := map[string]bool{}
+	chains := map[string]map[uint64]JournalEntry{}
+	for _, e := range entries {
+		if seen[e.ID] || e.Sequence == 0 || e.verify() != nil || !authorized(e, rules) {
+			continue
+		}
+		seen[e.ID] = true
+
+		chain, ok := chains[e.Author]
+		if !ok {
+			chain = map[uint64]JournalEntry{}
+			chains[e.Author] = chain
+		}
+
+		if _, ok := chain[e.Sequence]; ok {
+			if fork, ok := state.forks[e.Author]; !ok || e.Sequence < fork {
+				state.forks[e.Author] = e.Sequence
+			}
+		}
+		chain[e.Sequence] = e
+		state.sequences[e.Author] = max(state.sequences[e.Author], e.Sequence)
+	}
+
+	// an account is closed once both its tombstone and the last entry of its
+	// chain were made, so that a backdated tombstone cannot undo the
+	// payments the account received and spent
+	state.rules.closed = maps.Clone(rules.closed)
+	for accountID, at := range state.rules.closed {
+		if last, ok := chains[accountID][state.sequences[accountID]]; ok && last.Timestamp.After(at) {
+			state.rules.closed[accountID] = last.Timestamp
+		}
+	}
+
+	// the next entry of every chain, until a chain has a gap or a fork
+	heads := []JournalEntry{}
+	next := func(author string, sequence uint64) {
+		if fork, ok := state.forks[author]; ok && sequence >= fork {
+			return
+		}
+		if e, ok := chains[author][sequence]; ok && !e.Timestamp.After(rules.now) {
+			heads = append(heads, e)
+		}
+	}
+	for author := range chains {
+		next(author, 1)
+	}
+
+	for len(heads) > 0 {
+		i := 0
+		for j, h := range heads {
+			if h.Timestamp.Before(heads[i].Timestamp) || (h.Timestamp.Equal(heads[i].Timestamp) && h.ID < heads[i].ID) {
+				i = j
+			}
+		}
+		e := heads[i]
+		heads = slices.Delete(heads, i, i+1)
+
+		state.apply(e)
+		next(e.Author, e.Sequence+1)
+	}
+
+	return state
+}
+
+// apply moves the money of an entry unless its transaction is settled
+// already, it debits a system account it may not, it touches a deleted
+// account or an account would be overdrawn.
+func (s ledgerState) apply(e JournalEntry) {
+	if _, ok := s.settled[e.TransactionID]; ok {
+		return
+	}
+
+	if !s.systemDebitsAllowed(e) || !s.escrowDebitsAllowed(e) || !s.mandateDebitsAllowed(e) || !s.closedAccountsUntouched(e) {
+		return
+	}
+
+	next := map[string]Money{}
+	for _, p := range e.Postings {
+		if _, ok := next[p.AccountID]; !ok {
+			next[p.AccountID] = s.balances[p.AccountID]
+		}
+		next[p.AccountID] += p.Amount
+	}
+
+	for accountID, balance := range next {
+		if balance < 0 && accountID != accountEmission {
+			return
+		}
+	}
+
+	for accountID, balance := range next {
+		s.balances[accountID] = balance
+	}
+	for _, p := range e.Postings {
+		if p.Amount < 0 && isCountryAccount(p.AccountID) {
+			s.reversed[e.Reverses+" "+e.Author+" "+p.AccountID] -= p.Amount
+		}
+	}
+	if subscriptionID, due, ok := parseRenewalID(e.TransactionID); ok && due.After(s.renewed[subscriptionID]) {
+		s.renewed[subscriptionID] = due
+	}
+	s.settled[e.TransactionID] = e
+}
+
+// systemDebitsAllowed reports whether the entry takes money out of the
+// system accounts only the way the rules allow. The emission account pays
+// the finalized income of a period once to each individual, as the credit of
+// the income transaction of the author and nothing else. A country account
+// pays back at most the tax it received for the sales of the author in the
+// settled transaction the entry reverses. Nothing ever leaves the burn
+// account.
+func (s ledgerState) systemDebitsAllowed(e JournalEntry) bool {
+	for _, p := range e.Postings {
+		if p.Amount >= 0 {
+			continue
+		}
+
+		switch {
+		case p.AccountID == accountBurn:
+			return false
+		case p.AccountID == accountEmission:
+			period, ok := strings.CutPrefix(e.TransactionID, incomeTransactionID(e.Author, ""))
+			income, finalized := s.rules.incomes[period]
+			if !ok || !finalized || !s.rules.individuals[e.Author] || len(e.Postings) != 2 || p.Amount != -income {
+				return false
+			}
+			for _, credit := range e.Postings {
+				if credit.Amount > 0 && credit.AccountID != e.Author {
+					return false
+				}
+			}
+		case isCountryAccount(p.AccountID):
+			original, ok := s.settled[e.Reverses]
+			if !ok {
+				return false
+			}
+
+			received := original.taxCollected(e.Author, p.AccountID)
+			if received == 0 || s.reversed[e.Reverses+" "+e.Author+" "+p.AccountID]-p.Amount > received {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// closedAccountsUntouched reports whether the entry moves no money in or out
+// of a user account, or an escrow account of its buyer, after the account
+// was deleted.
+func (s ledgerState) closedAccountsUntouched(e JournalEntry) bool {
+	for _, p := range e.Postings {
+		if closedAt, ok := s.rules.closed[accountOwner(p.AccountID)]; ok && e.Timestamp.After(closedAt) {
+			return false
+		}
+	}
+	return true
+}
+
+// escrowDebitsAllowed reports whether the money the entry takes out of
+// escrow accounts goes only where the terms of the escrows allow.
+func (s ledgerState) escrowDebitsAllowed(e JournalEntry) bool {
+	for _, p := range e.Postings {
+		terms, ok := parseEscrowAccount(p.AccountID)
+		if !ok || p.Amount >= 0 {
+			continue
+		}
+
+		for _, credit := range e.Postings {
+			_, sellerClosed := s.rules.closed[terms.sellerID]
+			if credit.Amount > 0 && !terms.allows(credit.AccountID, e.Timestamp, sellerClosed) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// mandateDebitsAllowed reports whether an entry that debits the account of
+// another user than its author charges a renewal the way the mandate of the
+// subscriber allows: not before the first renewal it covers nor before the
+// renewal is due, for no more than its maximum, to the merchant and the
+// countries only, and once an interval.
+func (s ledgerState) mandateDebitsAllowed(e JournalEntry) bool {
+	var charged Money
+	for _, p := range e.Postings {
+		if p.Amount < 0 && !isSystemAccount(p.AccountID) && accountOwner(p.AccountID) != e.Author {
+			charged -= p.Amount
+		}
+	}
+	if charged == 0 {
+		return true
+	}
+
+	m, ok := s.rules.mandate(e)
+	if !ok {
+		return false
+	}
+
+	subscriptionID, due, _ := parseRenewalID(e.TransactionID)
+	if due.Before(m.From) || due.After(e.Timestamp) || charged > m.MaxAmount {
+		return false
+	}
+
+	if last, ok := s.renewed[subscriptionID]; ok && due.Before(nextPeriod(m.Interval, last)) {
+		return false
+	}
+
+	for _, p := range e.Postings {
+		if p.Amount > 0 && p.AccountID != e.Author && !isCountryAccount(p.AccountID) {
+			return false
+		}
+	}
+	return true
+}
+
+// ledgerRules is what replay checks the journal against besides the
+// entries themselves.
+type ledgerRules struct {
+	// keys maps every account to the keys allowed to sign its entries.
+	keys map[string][][]byte
+	// incomes maps the finalized periods credited in the journal to their
+	// income.
+	incomes map[string]Money
+	// individuals is the set of accounts entitled to the income.
+	individuals map[string]bool
+	// closed maps every deleted account to the time it was closed, which
+	// replay moves to the last entry of its chain when that came later.
+	closed map[string]time.Time
+	// mandates maps every subscription to the mandates of its subscriber,
+	// oldest first.
+	mandates map[string][]Mandate
+	// now is the time of the replay. Entries dated later wait, so that no
+	// entry can claim that a deadline passed before it did.
+	now time.Time
+}
+
+// ledgerState is the result of replaying a journal.
+type ledgerState struct {
+	balances map[string]Money
+	// settled maps every transaction to the entry that settled it.
+	settled map[string]JournalEntry
+	// reversed maps a transaction, a seller and a country account to the
+	// tax the country paid back of the sales of the seller.
+	reversed map[string]Money
+	rules    ledgerRules
+	// sequences maps every author to the last sequence of its chain.
+	sequences map[string]uint64
+	// forks maps the authors whose chain forked to the sequence it forked
+	// at.
+	forks map[string]uint64
+	// renewed maps every subscription to the due date of its last renewal
+	// charged.
+	renewed map[string]time.Time
+}
+
+// clone returns a copy of the state that can be changed without changing s.
+// The rules are shared but for the incomes, which posting adds to.
+func (s ledgerState) clone() ledgerState {
+	c := s
+	c.balances = maps.Clone(s.balances)
+	c.settled = maps.Clone(s.settled)
+	c.reversed = maps.Clone(s.reversed)
+	c.sequences = maps.Clone(s.sequences)
+	c.forks = maps.Clone(s.forks)
+	c.renewed = maps.Clone(s.renewed)
+	c.rules.incomes = maps.Clone(s.rules.incomes)
+	return c
+}
+
+// mandate returns the mandate in force when an entry was made for the
+// renewal it charges, if it lets the author of the entry charge it.
+func (r ledgerRules) mandate(e JournalEntry) (Mandate, bool) {
+	subscriptionID, _, ok := parseRenewalID(e.TransactionID)
+	if !ok {
+		return Mandate{}, false
+	}
+
+	m, ok := mandateAt(r.mandates[subscriptionID], e.Timestamp)
+	if !ok || m.Revoked || m.MerchantID != e.Author {
+		return Mandate{}, false
+	}
+
+	return m, true
+}
+
+// author returns the account whose chain an entry with the postings extends:
+// the owner of the user accounts it debits or, when it debits none, the
+// account the key is registered to.
+func (s ledgerState) author(postings []Posting, key []byte) (string, bool) {
+	for _, p := range postings {
+		if p.Amount < 0 && !isSystemAccount(p.AccountID) {
+			return accountOwner(p.AccountID), true
+		}
+	}
+
+	owners := []string{}
+	for accountID, keys := range s.rules.keys {
+		if slices.ContainsFunc(keys, func(k []byte) bool { return bytes.Equal(k, key) }) {
+			owners = append(owners, accountID)
+		}
+	}
+	if len(owners) == 0 {
+		return "", false
+	}
+
+	return slices.Min(owners), true
+}
+
+// accountOwner returns the user owning an account. Escrow accounts are owned
+// by their buyer.
+func accountOwner(accountID string) string {
+	if terms, ok := parseEscrowAccount(accountID); ok {
+		return terms.buyerID
+	}
+	return accountID
+}
+
+// authorized reports whether the entry was signed with a key registered to
+// its author and debits no user account but those of the author, or that of
+// a subscriber whose mandate lets the author charge the renewal.
+func authorized(e JournalEntry, rules ledgerRules) bool {
+	if !slices.ContainsFunc(rules.keys[e.Author], func(key []byte) bool {
+		return bytes.Equal(key, e.PublicKey)
+	}) {
+		return false
+	}
+
+	for _, p := range e.Postings {
+		if p.Amount >= 0 || isSystemAccount(p.AccountID) || accountOwner(p.AccountID) == e.Author {
+			continue
+		}
+		if m, ok := rules.mandate(e); !ok || m.SubscriberID != p.AccountID {
+			return false
+		}
+	}
+	return true
+}
+
+// ledgerStateTTL is how long the state of a replay is reused while the
+// journal holds no entry it did not cover. The keys, tombstones and mandates
+// it was replayed against are read again after that.
+const ledgerStateTTL = 10 * time.Second
+
+// ledger posts journal entries and derives balances from the journal.
+type ledger struct {
+	store Store
+	key   ed25519.PrivateKey
+
+	mu sync.Mutex
+	// cached is the state of the last replay with the entries posted since
+	// applied, covered the entries it holds and replayedAt the time of the
+	// replay.
+	cached     *ledgerState
+	covered    map[string]bool
+	replayedAt time.Time
+}
+
+func newLedger(store Store, key ed25519.PrivateKey) *ledger {
+	return &ledger{store: store, key: key}
+}
+
+// state returns the state of the journal. The whole journal is replayed
+// only when it holds entries the last replay did not cover, or that replay
+// is older than ledgerStateTTL.
+func (l *ledger) state() (ledgerState, error) {
+	entries, err := l.store.Journal()
+	if err != nil {
+		return ledgerState{}, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	fresh := l.cached != nil && time.Since(l.replayedAt) < ledgerStateTTL
+	for _, e := range entries {
+		fresh = fresh && l.covered[e.ID]
+	}
+
+	if !fresh {
+		state, err := l.replay(entries)
+		if err != nil {
+			return ledgerState{}, err
+		}
+
+		l.cached = &state
+		l.covered = map[string]bool{}
+		for _, e := range entries {
+			l.covered[e.ID] = true
+		}
+		l.replayedAt = time.Now()
+	}
+
+	return l.cached.clone(), nil
+}
+
+// replay replays the whole journal against the keys, tombstones, mandates
+// and incomes in the store.
+func (l *ledger) replay(entries []JournalEntry) (ledgerState, error) {
+	users, err := l.store.Users()
+	if err != nil {
+		return ledgerState{}, err
+	}
+
+	ring, err := loadKeyring(l.store)
+	if err != nil {
+		return ledgerState{}, err
+	}
+
+	// a key counts for a user once a registration the peers can follow
+	// leads to it
+	rules := ledgerRules{
+		keys:        ring.signing,
+		incomes:     map[string]Money{},
+		individuals: map[string]bool{},
+		closed:      map[string]time.Time{},
+		now:         time.Now(),
+	}
+	for _, u := range users {
+		rules.individuals[string(u.ID)] = len(u.VAT) == 0
+	}
+
+	tombstones, err := l.store.Tombstones()
+	if err != nil {
+		return ledgerState{}, err
+	}
+
+	// the keys of deleted accounts stay registered, so that their past
+	// entries still replay
+	for _, t := range tombstones {
+		if t.verify(ring) == nil {
+			rules.closed[t.ID] = t.Timestamp
+		}
+	}
+
+	rules.mandates, err = mandates(l.store, rules.keys)
+	if err != nil {
+		return ledgerState{}, err
+	}
+
+	err = l.loadIncomes(rules, entries)
+	if err != nil {
+		return ledgerState{}, err
+	}
+
+	return replay(entries, rules), nil
+}
+
+// loadIncomes adds the finalized income of the periods the entries credit to
+// the rules. Only those periods are looked up.
+func (l *ledger) loadIncomes(rules ledgerRules, entries []JournalEntry) error {
+	now := time.Now()
+	for _, e := range entries {
+		period, ok := strings.CutPrefix(e.TransactionID, incomeTransactionID(e.Author, ""))
+		if _, done := rules.incomes[period]; !ok || done {
+			continue
+		}
+
+		income, finalized, err := finalizedIncome(l.store, period, now)
+		if err != nil {
+			return err
+		}
+		if finalized {
+			rules.incomes[period] = income.Amount
+		}
+	}
+
+	return nil
+}
+
+func (l *ledger) balances() (map[string]Money, error) {
+	state, err := l.state()
+	if err != nil {
+		return nil, err
+	}
+
+	return state.balances, nil
+}
+
+// balance returns the balance of an account in cents.
+func (l *ledger) balance(accountID string) (Money, error) {
+	balances, err := l.balances()
+	if err != nil {
+		return 0, err
+	}
+
+	return balances[accountID], nil
+}
+
+// supply returns the GUBI in circulation, which is what was emitted less
+// what was burned.
+func (l *ledger) supply() (Money, error) {
+	balances, err := l.balances()
+	if err != nil {
+		return 0, err
+	}
+
+	return -balances[accountEmission] - balances[accountBurn], nil
+}
+
+// post signs and appends an entry at the end of the chain of its author
+// after checking that the key of this device is registered for every account
+// it debits and that no account is overdrawn, as replay would skip the entry
+// otherwise. The entry is a single document, so either all of its postings
+// are applied or none. Posting a transaction that is already settled returns
+// the settling entry and moves no money.
+func (l *ledger) post(transactionID string, postings []Posting) (JournalEntry, error) {
+	return l.postReversal(transactionID, "", postings)
+}
+
+// postReversal posts an entry that pays back the transaction it reverses.
+// Only such an entry may take back the tax a country received.
+func (l *ledger) postReversal(transactionID, reverses string, postings []Posting) (JournalEntry, error) {
+	state, err := l.state()
+	if err != nil {
+		return JournalEntry{}, err
+	}
+
+	if settled, ok := state.settled[transactionID]; ok {
+		return settled, nil
+	}
+
+	author, ok := state.author(postings, l.key.Public().(ed25519.PublicKey))
+	if !ok {
+		return JournalEntry{}, ErrUnauthorizedKey
+	}
+
+	return l.postAs(state, transactionID, author, reverses, postings)
+}
+
+// postMandated posts the charge of a renewal that a merchant makes under
+// the mandate of the subscriber, in the chain of the merchant. Posting a
+// transaction that is already settled returns the settling entry.
+func (l *ledger) postMandated(transactionID, merchantID string, postings []Posting) (JournalEntry, error) {
+	state, err := l.state()
+	if err != nil {
+		return JournalEntry{}, err
+	}
+
+	if settled, ok := state.settled[transactionID]; ok {
+		return settled, nil
+	}
+
+	return l.postAs(state, transactionID, merchantID, "", postings)
+}
+
+// postAs signs the entry at the end of the chain of author and appends it
+// once the checks of replay pass against state.
+func (l *ledger) postAs(state ledgerState, transactionID, author, reverses string, postings []Posting) (JournalEntry, error) {
+	if _, ok := state.forks[author]; ok {
+		return JournalEntry{}, ErrForkedChain
+	}
+
+	entry, err := newJournalEntry(transactionID, author, state.sequences[author]+1, reverses, postings, l.key)
+	if err != nil {
+		return JournalEntry{}, err
+	}
+
+	if !authorized(entry, state.rules) {
+		return JournalEntry{}, ErrUnauthorizedKey
+	}
+
+	if !state.mandateDebitsAllowed(entry) {
+		return JournalEntry{}, ErrMandate
+	}
+
+	err = l.loadIncomes(state.rules, []JournalEntry{entry})
+	if err != nil {
+		return JournalEntry{}, err
+	}
+
+	if !state.systemDebitsAllowed(entry) {
+		return JournalEntry{}, ErrSystemDebit
+	}
+
+	if !state.escrowDebitsAllowed(entry) {
+		return JournalEntry{}, ErrEscrowTerms
+	}
+
+	if !state.closedAccountsUntouched(entry) {
+		return JournalEntry{}, ErrAccountClosed
+	}
+
+	next := map[string]Money{}
+	for _, p := range postings {
+		if _, ok := next[p.AccountID]; !ok {
+			next[p.AccountID] = state.balances[p.AccountID]
+		}
+		next[p.AccountID] += p.Amount
+		if next[p.AccountID] < 0 && p.AccountID != accountEmission {
+			return JournalEntry{}, ErrInsufficientFunds
+		}
+	}
+
+	err = l.store.PutJournalEntry(entry)
+	if err != nil {
+		return JournalEntry{}, err
+	}
+
+	// the next state need not replay the entry
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.cached != nil && !l.covered[entry.ID] {
+		maps.Copy(l.cached.rules.incomes, state.rules.incomes)
+		l.cached.apply(entry)
+		l.cached.sequences[author] = max(l.cached.sequences[author], entry.Sequence)
+		l.covered[entry.ID] = true
+	}
+
+	return entry, nil
+}
+
+// transfer moves amount cents from one account to another.
+func (l *ledger) transfer(transactionID, from, to string, amount Money) (JournalEntry, error) {
+	return l.post(transactionID, []Posting{
+		{AccountID: from, Amount: -amount},
+		{AccountID: to, Amount: amount},
+	})
+}
+
+// signingKey returns the key this device signs journal entries with. It is
+// generated on first use and kept in the local storage of the browser.
+func signingKey(ctx app.Context) ed25519.PrivateKey {
+	var seed []byte
+	ctx.LocalStorage().Get("signingKey", &seed)
+
+	if len(seed) != ed25519.SeedSize {
+		seed = make([]byte, ed25519.SeedSize)
+		rand.Read(seed)
+		ctx.LocalStorage().Set("signingKey", seed)
+	}
+
+	return ed25519.NewKeyFromSeed(seed)
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testKey returns a signing key derived from a name, so that tests get the
+// same keys on every run.
+func testKey(name string) ed25519.PrivateKey {
+	seed := sha256.Sum256([]byte(name))
+	return ed25519.NewKeyFromSeed(seed[:])
+}
+
+// testEntry signs an entry of the chain of author made at the given time.
+func testEntry(key ed25519.PrivateKey, transactionID, author string, sequence uint64, reverses string, at time.Time, postings ...Posting) JournalEntry {
+	e := JournalEntry{
+		TransactionID: transactionID,
+		Author:        author,
+		Sequence:      sequence,
+		Reverses:      reverses,
+		Postings:      postings,
+		Timestamp:     at,
+		PublicKey:     key.Public().(ed25519.PublicKey),
+	}
+
+	content := e.content()
+	hash := sha256.Sum256(content)
+	e.ID = hex.EncodeToString(hash[:])
+	e.Signature = ed25519.Sign(key, content)
+
+	return e
+}
+
+func TestReplay(t *testing.T) {
+	alice, bob, carol := testKey("alice"), testKey("bob"), testKey("carol")
+	t0 := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return t0.Add(time.Duration(minutes) * time.Minute) }
+
+	rules := ledgerRules{
+		keys: map[string][][]byte{
+			"alice": {alice.Public().(ed25519.PublicKey)},
+			"bob":   {bob.Public().(ed25519.PublicKey)},
+			"carol": {carol.Public().(ed25519.PublicKey)},
+		},
+		incomes:     map[string]Money{"2024/1": 1000},
+		individuals: map[string]bool{"alice": true, "carol": true},
+		closed:      map[string]time.Time{},
+		mandates:    map[string][]Mandate{},
+		now:         at(1000),
+	}
+
+	de := countryAccount("DE")
+	income := testEntry(alice, incomeTransactionID("alice", "2024/1"), "alice", 1, "", at(0),
+		Posting{accountEmission, -1000}, Posting{"alice", 1000})
+	sale := testEntry(alice, "t1", "alice", 2, "", at(1),
+		Posting{"alice", -119}, Posting{"bob", 100}, Posting{de, 19})
+
+	tests := []struct {
+		name    string
+		entries []JournalEntry
+		want    map[string]Money
+		forks   map[string]uint64
+	}{
+		{
+			name:    "income",
+			entries: []JournalEntry{income},
+			want:    map[string]Money{"alice": 1000, accountEmission: -1000},
+		},
+		{
+			name: "income paid twice",
+			entries: []JournalEntry{income, testEntry(alice, incomeTransactionID("alice", "2024/1"), "alice", 2, "", at(1),
+				Posting{accountEmission, -1000}, Posting{"alice", 1000})},
+			want: map[string]Money{"alice": 1000},
+		},
+		{
+			name: "income of another amount",
+			entries: []JournalEntry{testEntry(alice, incomeTransactionID("alice", "2024/1"), "alice", 1, "", at(0),
+				Posting{accountEmission, -2000}, Posting{"alice", 2000})},
+			want: map[string]Money{"alice": 0, accountEmission: 0},
+		},
+		{
+			name: "income of a period not finalized",
+			entries: []JournalEntry{testEntry(alice, incomeTransactionID("alice", "2024/2"), "alice", 1, "", at(0),
+				Posting{accountEmission, -1000}, Posting{"alice", 1000})},
+			want: map[string]Money{"alice": 0},
+		},
+		{
+			name: "income of a business",
+			entries: []JournalEntry{testEntry(bob, incomeTransactionID("bob", "2024/1"), "bob", 1, "", at(0),
+				Posting{accountEmission, -1000}, Posting{"bob", 1000})},
+			want: map[string]Money{"bob": 0},
+		},
+		{
+			name: "income credited to someone else",
+			entries: []JournalEntry{testEntry(alice, incomeTransactionID("alice", "2024/1"), "alice", 1, "", at(0),
+				Posting{accountEmission, -1000}, Posting{"bob", 1000})},
+			want: map[string]Money{"bob": 0},
+		},
+		{
+			name:    "payment with tax",
+			entries: []JournalEntry{income, sale},
+			want:    map[string]Money{"alice": 881, "bob": 100, de: 19},
+		},
+		{
+			name:    "received out of order",
+			entries: []JournalEntry{sale, income},
+			want:    map[string]Money{"alice": 881, "bob": 100},
+		},
+		{
+			name: "overdraft",
+			entries: []JournalEntry{income, testEntry(alice, "t1", "alice", 2, "", at(1),
+				Posting{"alice", -1001}, Posting{"bob", 1001})},
+			want: map[string]Money{"alice": 1000, "bob": 0},
+		},
+		{
+			name: "backdated entry waits for its chain",
+			entries: []JournalEntry{income, testEntry(alice, "t1", "alice", 2, "", t0.Add(-time.Hour),
+				Posting{"alice", -100}, Posting{"bob", 100})},
+			want: map[string]Money{"alice": 900, "bob": 100},
+		},
+		{
+			name: "entry after a gap",
+			entries: []JournalEntry{income, testEntry(alice, "t1", "alice", 3, "", at(1),
+				Posting{"alice", -100}, Posting{"bob", 100})},
+			want: map[string]Money{"alice": 1000, "bob": 0},
+		},
+		{
+			name: "entry dated after the replay",
+			entries: []JournalEntry{income, testEntry(alice, "t1", "alice", 2, "", at(2000),
+				Posting{"alice", -100}, Posting{"bob", 100})},
+			want: map[string]Money{"alice": 1000, "bob": 0},
+		},
+		{
+			name: "fork",
+			entries: []JournalEntry{
+				income,
+				testEntry(alice, "t1", "alice", 2, "", at(1), Posting{"alice", -600}, Posting{"bob", 600}),
+				testEntry(alice, "t2", "alice", 2, "", at(1), Posting{"alice", -600}, Posting{"carol", 600}),
+				testEntry(alice, "t3", "alice", 3, "", at(2), Posting{"alice", -100}, Posting{"carol", 100}),
+			},
+			want:  map[string]Money{"alice": 1000, "bob": 0, "carol": 0},
+			forks: map[string]uint64{"alice": 2},
+		},
+		{
+			name: "key of another account",
+			entries: []JournalEntry{income, testEntry(bob, "t1", "alice", 2, "", at(1),
+				Posting{"alice", -100}, Posting{"bob", 100})},
+			want: map[string]Money{"alice": 1000, "bob": 0},
+		},
+		{
+			name: "debit of another account",
+			entries: []JournalEntry{income, testEntry(bob, "t1", "bob", 1, "", at(1),
+				Posting{"alice", -100}, Posting{"bob", 100})},
+			want: map[string]Money{"alice": 1000, "bob": 0},
+		},
+		{
+			name: "burn",
+			entries: []JournalEntry{
+				income,
+				testEntry(alice, "t1", "alice", 2, "", at(1), Posting{"alice", -100}, Posting{accountBurn, 100}),
+				testEntry(alice, "t2", "alice", 3, "", at(2), Posting{accountBurn, -100}, Posting{"alice", 100}),
+			},
+			want: map[string]Money{"alice": 900, accountBurn: 100},
+		},
+		{
+			name: "tax paid back by the seller",
+			entries: []JournalEntry{income, sale, testEntry(bob, "r1", "bob", 1, "t1", at(2),
+				Posting{"bob", -100}, Posting{de, -19}, Posting{"alice", 119})},
+			want: map[string]Money{"alice": 1000, "bob": 0, de: 0},
+		},
+		{
+			name: "more tax paid back than received",
+			entries: []JournalEntry{income, sale, testEntry(bob, "r1", "bob", 1, "t1", at(2),
+				Posting{"bob", -100}, Posting{de, -20}, Posting{"alice", 120})},
+			want: map[string]Money{"alice": 881, "bob": 100, de: 19},
+		},
+		{
+			name: "tax paid back twice",
+			entries: []JournalEntry{
+				income, sale,
+				testEntry(bob, "r1", "bob", 1, "t1", at(2), Posting{"bob", -50}, Posting{de, -10}, Posting{"alice", 60}),
+				testEntry(bob, "r2", "bob", 2, "t1", at(3), Posting{"bob", -50}, Posting{de, -10}, Posting{"alice", 60}),
+			},
+			want: map[string]Money{"alice": 941, "bob": 50, de: 9},
+		},
+		{
+			name: "tax paid back by someone else than the seller",
+			entries: []JournalEntry{income, sale, testEntry(carol, "r1", "carol", 1, "t1", at(2),
+				Posting{de, -19}, Posting{"carol", 19})},
+			want: map[string]Money{"carol": 0, de: 19},
+		},
+		{
+			name: "tax of a split sale paid back by one seller",
+			entries: []JournalEntry{
+				income,
+				testEntry(alice, "g1", "alice", 2, "", at(1),
+					Posting{"alice", -238}, Posting{"bob", 100}, Posting{de, 19}, Posting{"carol", 100}, Posting{de, 19}),
+				testEntry(bob, "r1", "bob", 1, "g1", at(2), Posting{"bob", -100}, Posting{de, -19}, Posting{"alice", 119}),
+			},
+			want: map[string]Money{"alice": 881, "bob": 0, "carol": 100, de: 19},
+		},
+		{
+			name: "tax of another seller of a split sale paid back",
+			entries: []JournalEntry{
+				income,
+				testEntry(alice, "g1", "alice", 2, "", at(1),
+					Posting{"alice", -238}, Posting{"bob", 100}, Posting{de, 19}, Posting{"carol", 100}, Posting{de, 19}),
+				testEntry(bob, "r1", "bob", 1, "g1", at(2), Posting{"bob", -100}, Posting{de, -38}, Posting{"alice", 138}),
+			},
+			want: map[string]Money{"alice": 762, "bob": 100, "carol": 100, de: 38},
+		},
+		{
+			name: "tax paid back without a settled sale",
+			entries: []JournalEntry{income, testEntry(bob, "r1", "bob", 1, "t1", at(2),
+				Posting{de, -19}, Posting{"bob", 19})},
+			want: map[string]Money{"bob": 0, de: 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := replay(tt.entries, rules)
+
+			for accountID, want := range tt.want {
+				if got := state.balances[accountID]; got != want {
+					t.Errorf("balance of %s = %v, want %v", accountID, got, want)
+				}
+			}
+			for author, want := range tt.forks {
+				if got := state.forks[author]; got != want {
+					t.Errorf("fork of %s = %v, want %v", author, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayIsOrderIndependent(t *testing.T) {
+	alice, bob := testKey("alice"), testKey("bob")
+	t0 := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	rules := ledgerRules{
+		keys: map[string][][]byte{
+			"alice": {alice.Public().(ed25519.PublicKey)},
+			"bob":   {bob.Public().(ed25519.PublicKey)},
+		},
+		incomes:     map[string]Money{"2024/1": 1000},
+		individuals: map[string]bool{"alice": true, "bob": true},
+		now:         t0.Add(time.Hour),
+	}
+
+	// both spend their last 600 on carol at the same time, only the entry
+	// with the lower ID goes through
+	entries := []JournalEntry{
+		testEntry(alice, incomeTransactionID("alice", "2024/1"), "alice", 1, "", t0, Posting{accountEmission, -1000}, Posting{"alice", 1000}),
+		testEntry(bob, incomeTransactionID("bob", "2024/1"), "bob", 1, "", t0, Posting{accountEmission, -1000}, Posting{"bob", 1000}),
+		testEntry(alice, "t1", "alice", 2, "", t0.Add(time.Minute), Posting{"alice", -600}, Posting{"bob", 600}),
+		testEntry(bob, "t2", "bob", 2, "", t0.Add(time.Minute), Posting{"bob", -1600}, Posting{"carol", 1600}),
+	}
+
+	want := replay(entries, rules).balances
+	for i := range entries {
+		rotated := append(append([]JournalEntry{}, entries[i:]...), entries[:i]...)
+		got := replay(rotated, rules).balances
+		for accountID := range want {
+			if got[accountID] != want[accountID] {
+				t.Errorf("rotation %d: balance of %s = %v, want %v", i, accountID, got[accountID], want[accountID])
+			}
+		}
+	}
+}
+
+func TestLedgerPost(t *testing.T) {
+	alice, device, bob := testKey("alice"), testKey("alice device"), testKey("bob")
+	aliceID := userIDOf(alice.Public().(ed25519.PublicKey))
+	bobID := userIDOf(bob.Public().(ed25519.PublicKey))
+
+	store := newMemoryStore()
+	for _, u := range []User{{ID: []byte(aliceID)}, {ID: []byte(bobID), VAT: "DE123"}} {
+		if err := store.PutUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, r := range []KeyRegistration{
+		newKeyRegistration(aliceID, KeySigning, nil, alice.Public().(ed25519.PublicKey), alice),
+		newKeyRegistration(aliceID, KeySigning, nil, device.Public().(ed25519.PublicKey), alice),
+		newKeyRegistration(bobID, KeySigning, nil, bob.Public().(ed25519.PublicKey), bob),
+		// a registration bob signs for alice does not count
+		newKeyRegistration(aliceID, KeySigning, nil, testKey("evil").Public().(ed25519.PublicKey), bob),
+	} {
+		if err := store.PutKeyRegistration(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.PutIncome(Income{ID: "i1", Amount: 1000, Period: "2024/1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	l := newLedger(store, alice)
+	_, err := l.transfer(incomeTransactionID(aliceID, "2024/1"), accountEmission, aliceID, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		key     ed25519.PrivateKey
+		id      string
+		from    string
+		amount  Money
+		wantErr error
+		want    Money
+	}{
+		{"payment", alice, "t1", aliceID, 300, nil, 700},
+		{"resubmitted", alice, "t1", aliceID, 300, nil, 700},
+		{"registered device", device, "t2", aliceID, 200, nil, 500},
+		{"overdraft", alice, "t3", aliceID, 501, ErrInsufficientFunds, 500},
+		{"account of another user", bob, "t4", aliceID, 100, ErrUnauthorizedKey, 500},
+		{"key signed by another user", testKey("evil"), "t5", aliceID, 100, ErrUnauthorizedKey, 500},
+		{"income of a period to come", alice, incomeTransactionID(aliceID, nextPeriodOf(time.Now())), accountEmission, 1000, ErrSystemDebit, 500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			to := bobID
+			if tt.from == accountEmission {
+				to = aliceID
+			}
+
+			_, err := newLedger(store, tt.key).transfer(tt.id, tt.from, to, tt.amount)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("transfer() = %v, want %v", err, tt.wantErr)
+			}
+
+			got, err := newLedger(store, alice).balance(aliceID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("balance = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayClosedAccounts(t *testing.T) {
+	alice, bob := testKey("alice"), testKey("bob")
+	t0 := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return t0.Add(time.Duration(minutes) * time.Minute) }
+
+	income := testEntry(alice, incomeTransactionID("alice", "2024/1"), "alice", 1, "", at(0),
+		Posting{accountEmission, -1000}, Posting{"alice", 1000})
+	escrow := escrowAccount("bob", "alice", at(100), "order")
+
+	tests := []struct {
+		name     string
+		closedAt time.Time
+		entries  []JournalEntry
+		want     map[string]Money
+	}{
+		{
+			name:     "paid before the closure",
+			closedAt: at(5),
+			entries:  []JournalEntry{income, testEntry(alice, "t1", "alice", 2, "", at(4), Posting{"alice", -100}, Posting{"bob", 100})},
+			want:     map[string]Money{"alice": 900, "bob": 100},
+		},
+		{
+			name:     "paid after the closure",
+			closedAt: at(5),
+			entries:  []JournalEntry{income, testEntry(alice, "t1", "alice", 2, "", at(6), Posting{"alice", -100}, Posting{"bob", 100})},
+			want:     map[string]Money{"alice": 1000, "bob": 0},
+		},
+		{
+			name:     "locked in an escrow after the closure",
+			closedAt: at(5),
+			entries:  []JournalEntry{income, testEntry(alice, "t1", "alice", 2, "", at(6), Posting{"alice", -100}, Posting{escrow, 100})},
+			want:     map[string]Money{"alice": 1000, escrow: 0},
+		},
+		{
+			name:     "tombstone dated before the last entry of the account",
+			closedAt: at(1),
+			entries: []JournalEntry{
+				income,
+				testEntry(alice, "t1", "alice", 2, "", at(6), Posting{"alice", -100}, Posting{"bob", 100}),
+				testEntry(alice, "t2", "alice", 3, "", at(7), Posting{"alice", -50}, Posting{"bob", 50}),
+				testEntry(bob, "t3", "bob", 1, "", at(8), Posting{"bob", -100}, Posting{accountBurn, 100}),
+				testEntry(alice, "t4", "alice", 4, "", at(9), Posting{"alice", -10}, Posting{"bob", 10}),
+			},
+			want: map[string]Money{"alice": 850, "bob": 50, accountBurn: 100},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := ledgerRules{
+				keys: map[string][][]byte{
+					"alice": {alice.Public().(ed25519.PublicKey)},
+					"bob":   {bob.Public().(ed25519.PublicKey)},
+				},
+				incomes:     map[string]Money{"2024/1": 1000},
+				individuals: map[string]bool{"alice": true},
+				closed:      map[string]time.Time{"bob": tt.closedAt},
+				now:         at(1000),
+			}
+
+			state := replay(tt.entries, rules)
+			for accountID, want := range tt.want {
+				if got := state.balances[accountID]; got != want {
+					t.Errorf("balance of %s = %v, want %v", accountID, got, want)
+				}
+			}
+		})
+	}
+}
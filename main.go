@@ -31,6 +31,9 @@ func main() {
 	app.Route("/wallet", func() app.Composer { return &wallet{} })
 	app.Route("/payment", func() app.Composer { return &payment{} })
 	app.Route("/subscriptions", func() app.Composer { return &subscription{} })
+	app.Route("/economy", func() app.Composer { return &economy{} })
+	app.Route("/invoices", func() app.Composer { return &invoices{} })
+	app.Route("/receive", func() app.Composer { return &receive{} })
 	// business only
 	app.Route("/plan", func() app.Composer { return &plan{} })
 	app.Route("/associates", func() app.Composer { return &associate{} })
@@ -70,7 +73,9 @@ func main() {
 		},
 		RawHeaders: []string{
 			`
-			<script src="https://cdn.jsdelivr.net/npm/@vladmandic/face-api/dist/face-api.js"></script>`,
+			<script src="https://cdn.jsdelivr.net/npm/@vladmandic/face-api/dist/face-api.js"></script>
+			<script src="https://cdn.jsdelivr.net/npm/jsqr@1.4.0/dist/jsQR.js"></script>
+			<script src="https://cdn.jsdelivr.net/npm/qrcode-generator@1.4.4/qrcode.js"></script>`,
 		},
 	})
 
@@ -85,7 +90,9 @@ func main() {
 		},
 		RawHeaders: []string{
 			`
-			<script src="https://cdn.jsdelivr.net/npm/@vladmandic/face-api/dist/face-api.js"></script>`,
+			<script src="https://cdn.jsdelivr.net/npm/@vladmandic/face-api/dist/face-api.js"></script>
+			<script src="https://cdn.jsdelivr.net/npm/jsqr@1.4.0/dist/jsQR.js"></script>
+			<script src="https://cdn.jsdelivr.net/npm/qrcode-generator@1.4.4/qrcode.js"></script>`,
 		},
 	})
 
@@ -113,6 +120,30 @@ func main() {
 		},
 	})
 
+	http.Handle("/economy", &app.Handler{
+		Name:        "Cyber GUBI",
+		Description: "An unconditional universal basic income",
+		Styles: []string{
+			"/web/app.css", // Loads app.css file.
+		},
+	})
+
+	http.Handle("/invoices", &app.Handler{
+		Name:        "Cyber GUBI",
+		Description: "An unconditional universal basic income",
+		Styles: []string{
+			"/web/app.css", // Loads app.css file.
+		},
+	})
+
+	http.Handle("/receive", &app.Handler{
+		Name:        "Cyber GUBI",
+		Description: "An unconditional universal basic income",
+		Styles: []string{
+			"/web/app.css", // Loads app.css file.
+		},
+	})
+
 	http.Handle("/plan", &app.Handler{
 		Name:        "Cyber GUBI",
 		Description: "An unconditional universal basic income",
@@ -169,6 +200,18 @@ func main() {
 		},
 	})
 
+	// The WebAuthn ceremonies are verified by the server, which holds the
+	// challenges and checks the signatures of the authenticators.
+	ceremonies, err := newCeremonyServer(newStore())
+	if err != nil {
+		log.Fatal(err)
+	}
+	ceremonies.handle(http.DefaultServeMux)
+
+	// The statistics of the economy are computed by the server, which keeps
+	// the figures of the months that are over.
+	newStatsService(newStore(), incomeCatchUpMonths).handle(http.DefaultServeMux)
+
 	if err := http.ListenAndServe(":8000", nil); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const dbMandate = "mandate"
+
+var ErrMandate = errors.New("the mandate of the subscriber does not allow this charge")
+
+// Mandate is a standing authorization signed by a subscriber. It lets the
+// merchant charge the renewals of an auto-renewing subscription when the
+// subscriber does not come online, once an interval from From on and for
+// at most MaxAmount each. The subscriber signs a new mandate whenever the
+// subscription changes, a revoked one when it stops renewing, and a charge
+// is checked against the last mandate signed before it.
+type Mandate struct {
+	ID             string    `mapstructure:"_id" json:"_id" validate:"uuid_rfc4122"`                         // Unique identifier for the mandate
+	SubscriptionID string    `mapstructure:"subscription_id" json:"subscription_id" validate:"uuid_rfc4122"` // Subscription the renewals of which may be charged
+	SubscriberID   string    `mapstructure:"subscriber_id" json:"subscriber_id" validate:"uuid_rfc4122"`     // User id of the subscriber who pays
+	MerchantID     string    `mapstructure:"merchant_id" json:"merchant_id" validate:"uuid_rfc4122"`         // User id of the business allowed to charge
+	Interval       string    `mapstructure:"interval" json:"interval" validate:"uuid_rfc4122"`               // Billing interval, month or year
+	From           time.Time `mapstructure:"from" json:"from" validate:"uuid_rfc4122"`                       // Due date of the first renewal that may be charged
+	MaxAmount      Money     `mapstructure:"max_amount" json:"max_amount" validate:"uuid_rfc4122"`           // Most a renewal may cost, taxes included
+	Revoked        bool      `mapstructure:"revoked" json:"revoked" validate:"uuid_rfc4122"`                 // No renewal may be charged anymore
+	SignedAt       time.Time `mapstructure:"signed_at" json:"signed_at" validate:"uuid_rfc4122"`             // Time of signing
+	PublicKey      []byte    `mapstructure:"public_key" json:"public_key" validate:"uuid_rfc4122"`           // Key of the subscriber
+	Signature      []byte    `mapstructure:"signature" json:"signature" validate:"uuid_rfc4122"`             // Signature over the content
+}
+
+func newMandate(s Subscription, merchantID string, maxAmount Money, key ed25519.PrivateKey) Mandate {
+	m := Mandate{
+		ID:             uuid.NewString(),
+		SubscriptionID: s.ID,
+		SubscriberID:   s.UserID,
+		MerchantID:     merchantID,
+		Interval:       intervalOf(s.Interval),
+		From:           s.EndDate.UTC(),
+		MaxAmount:      maxAmount,
+		Revoked:        !s.AutoRenew || s.paused() || s.cancelled(),
+		SignedAt:       time.Now().UTC(),
+		PublicKey:      key.Public().(ed25519.PublicKey),
+	}
+	m.Signature = ed25519.Sign(key, m.content())
+
+	return m
+}
+
+// content returns the canonical bytes that are signed.
+func (m Mandate) content() []byte {
+	b, _ := json.Marshal(struct {
+		ID             string `json:"id"`
+		SubscriptionID string `json:"subscription_id"`
+		SubscriberID   string `json:"subscriber_id"`
+		MerchantID     string `json:"merchant_id"`
+		Interval       string `json:"interval"`
+		From           string `json:"from"`
+		MaxAmount      Money  `json:"max_amount"`
+		Revoked        bool   `json:"revoked"`
+		SignedAt       string `json:"signed_at"`
+		PublicKey      []byte `json:"public_key"`
+	}{
+		ID:             m.ID,
+		SubscriptionID: m.SubscriptionID,
+		SubscriberID:   m.SubscriberID,
+		MerchantID:     m.MerchantID,
+		Interval:       m.Interval,
+		From:           m.From.UTC().Format(time.RFC3339Nano),
+		MaxAmount:      m.MaxAmount,
+		Revoked:        m.Revoked,
+		SignedAt:       m.SignedAt.UTC().Format(time.RFC3339Nano),
+		PublicKey:      m.PublicKey,
+	})
+	return b
+}
+
+// verify checks that the mandate is signed by the key it carries and that
+// the key is registered to the subscriber.
+func (m Mandate) verify(keys map[string][][]byte) error {
+	if len(m.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(m.PublicKey, m.content(), m.Signature) {
+		return ErrInvalidSignature
+	}
+
+	if !slices.ContainsFunc(keys[m.SubscriberID], func(key []byte) bool {
+		return bytes.Equal(key, m.PublicKey)
+	}) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// mandates maps every subscription to its mandates that verify, oldest
+// first.
+func mandates(store Store, keys map[string][][]byte) (map[string][]Mandate, error) {
+	all, err := store.Mandates()
+	if err != nil {
+		return nil, err
+	}
+
+	bySubscription := map[string][]Mandate{}
+	for _, m := range all {
+		if m.verify(keys) == nil {
+			bySubscription[m.SubscriptionID] = append(bySubscription[m.SubscriptionID], m)
+		}
+	}
+
+	for _, ms := range bySubscription {
+		slices.SortFunc(ms, func(a, b Mandate) int {
+			if c := a.SignedAt.Compare(b.SignedAt); c != 0 {
+				return c
+			}
+			return strings.Compare(a.ID, b.ID)
+		})
+	}
+
+	return bySubscription, nil
+}
+
+// mandateAt returns the last of the mandates signed by t.
+func mandateAt(ms []Mandate, t time.Time) (Mandate, bool) {
+	var found Mandate
+	ok := false
+	for _, m := range ms {
+		if m.SignedAt.After(t) {
+			break
+		}
+		found, ok = m, true
+	}
+	return found, ok
+}
+
+// parseRenewalID returns the subscription and the due date of the renewal
+// a transaction charges.
+func parseRenewalID(transactionID string) (string, time.Time, bool) {
+	rest, ok := strings.CutPrefix(transactionID, "renewal:")
+	i := strings.LastIndex(rest, ":")
+	if !ok || i < 0 {
+		return "", time.Time{}, false
+	}
+
+	unix, err := strconv.ParseInt(rest[i+1:], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+
+	return rest[:i], time.Unix(unix, 0), true
+}
+
+// putSubscription stores a subscription of this device's user together with
+// the mandate that lets the merchant charge its renewals, or that revokes it
+// when the subscription does not renew.
+func putSubscription(store Store, l *ledger, s Subscription) error {
+	plans, err := store.Plans()
+	if err != nil {
+		return err
+	}
+
+	i := slices.IndexFunc(plans, func(p Plan) bool { return p.ID == s.PlanID })
+	if i < 0 {
+		// the plan was withdrawn, nothing renews anymore
+		return store.PutSubscription(s)
+	}
+	plan := plans[i]
+
+	sale, taxes, err := planSale(store, s.UserID, plan, s.Price, s.EndDate)
+	if err != nil {
+		return err
+	}
+
+	err = store.PutMandate(newMandate(s, plan.CreatedBy, saleTotal(sale.net(), taxes), l.key))
+	if err != nil {
+		return err
+	}
+
+	return store.PutSubscription(s)
+}
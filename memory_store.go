@@ -0,0 +1,635 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// memoryStore is a Store that keeps every document in memory. It behaves
+// like a single peer with an empty network and is used to run the business
+// logic without an IPFS node.
+type memoryStore struct {
+	mu             sync.Mutex
+	users          map[string]User
+	ownUserID      string
+	devices        map[string]UserDevice
+	balances       map[string]UserBalance
+	transactions   map[string]Transaction
+	intents        map[string]PaymentIntent
+	journal        map[string]JournalEntry
+	plans          map[string]Plan
+	subscriptions  map[string]Subscription
+	renewals       map[string]Renewal
+	mandates       map[string]Mandate
+	registrations  map[string]KeyRegistration
+	incomes        map[string]Income
+	proposals      map[string]IncomeProposal
+	countryWallets map[string]CountryWallet
+	invoices       map[string]Invoice
+	escrows        map[string]Escrow
+	tombstones     map[string]Tombstone
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:          map[string]User{},
+		devices:        map[string]UserDevice{},
+		balances:       map[string]UserBalance{},
+		transactions:   map[string]Transaction{},
+		intents:        map[string]PaymentIntent{},
+		journal:        map[string]JournalEntry{},
+		plans:          map[string]Plan{},
+		subscriptions:  map[string]Subscription{},
+		renewals:       map[string]Renewal{},
+		mandates:       map[string]Mandate{},
+		registrations:  map[string]KeyRegistration{},
+		incomes:        map[string]Income{},
+		proposals:      map[string]IncomeProposal{},
+		countryWallets: map[string]CountryWallet{},
+		invoices:       map[string]Invoice{},
+		escrows:        map[string]Escrow{},
+		tombstones:     map[string]Tombstone{},
+	}
+}
+
+func (m *memoryStore) OwnUser() (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[m.ownUserID]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+
+	return user, nil
+}
+
+func (m *memoryStore) User(id string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+
+	return user, nil
+}
+
+func (m *memoryStore) Users() ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return values(m.users), nil
+}
+
+// PutUser stores the user. The first user stored becomes the own user, as
+// only one user can be registered per device.
+func (m *memoryStore) PutUser(user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.ownUserID) == 0 {
+		m.ownUserID = string(user.ID)
+	}
+	m.users[string(user.ID)] = user
+
+	return nil
+}
+
+func (m *memoryStore) DeleteUser(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.users, id)
+	if m.ownUserID == id {
+		m.ownUserID = ""
+	}
+
+	return nil
+}
+
+func (m *memoryStore) Device(address string) (UserDevice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	device, ok := m.devices[address]
+	if !ok {
+		return UserDevice{}, ErrNotFound
+	}
+
+	return device, nil
+}
+
+func (m *memoryStore) PutDevice(device UserDevice) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.devices[device.Address] = device
+
+	return nil
+}
+
+func (m *memoryStore) Balance(userID string) (UserBalance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	balance, ok := m.balances[userID]
+	if !ok {
+		return UserBalance{}, ErrNotFound
+	}
+
+	return balance, nil
+}
+
+func (m *memoryStore) Balances() ([]UserBalance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return values(m.balances), nil
+}
+
+func (m *memoryStore) PutBalance(balance UserBalance) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.balances[balance.ID] = balance
+
+	return nil
+}
+
+func (m *memoryStore) DeleteBalance(userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.balances, userID)
+
+	return nil
+}
+
+func (m *memoryStore) Transactions(userID string) ([]Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	transactions := []Transaction{}
+	for _, t := range m.transactions {
+		if t.SenderID == userID || t.ReceiverID == userID {
+			transactions = append(transactions, t)
+		}
+	}
+
+	return transactions, nil
+}
+
+func (m *memoryStore) TransactionsIn(period string) ([]Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	transactions := []Transaction{}
+	for _, t := range m.transactions {
+		if t.Date == period {
+			transactions = append(transactions, t)
+		}
+	}
+
+	return transactions, nil
+}
+
+func (m *memoryStore) PutTransaction(transaction Transaction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.transactions[transaction.ID] = transaction
+
+	return nil
+}
+
+func (m *memoryStore) PaymentIntent(id string) (PaymentIntent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	intent, ok := m.intents[id]
+	if !ok {
+		return PaymentIntent{}, ErrNotFound
+	}
+
+	return intent, nil
+}
+
+func (m *memoryStore) PaymentIntents(senderID string) ([]PaymentIntent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	intents := []PaymentIntent{}
+	for _, i := range m.intents {
+		if i.SenderID == senderID {
+			intents = append(intents, i)
+		}
+	}
+
+	return intents, nil
+}
+
+func (m *memoryStore) PutPaymentIntent(intent PaymentIntent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.intents[intent.ID] = intent
+
+	return nil
+}
+
+func (m *memoryStore) Journal() ([]JournalEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return values(m.journal), nil
+}
+
+func (m *memoryStore) PutJournalEntry(entry JournalEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.journal[entry.ID] = entry
+
+	return nil
+}
+
+func (m *memoryStore) Plans() ([]Plan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return values(m.plans), nil
+}
+
+func (m *memoryStore) PlansBy(userID string) ([]Plan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	plans := []Plan{}
+	for _, p := range m.plans {
+		if p.CreatedBy == userID {
+			plans = append(plans, p)
+		}
+	}
+
+	return plans, nil
+}
+
+func (m *memoryStore) PutPlan(plan Plan) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.plans[plan.ID] = plan
+
+	return nil
+}
+
+func (m *memoryStore) DeletePlan(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.plans, id)
+
+	return nil
+}
+
+func (m *memoryStore) Subscriptions() ([]Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return values(m.subscriptions), nil
+}
+
+func (m *memoryStore) SubscriptionsBy(userID string) ([]Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	subscriptions := []Subscription{}
+	for _, s := range m.subscriptions {
+		if s.UserID == userID {
+			subscriptions = append(subscriptions, s)
+		}
+	}
+
+	return subscriptions, nil
+}
+
+func (m *memoryStore) PutSubscription(subscription Subscription) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.subscriptions[subscription.ID] = subscription
+
+	return nil
+}
+
+func (m *memoryStore) DeleteSubscription(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.subscriptions, id)
+
+	return nil
+}
+
+func (m *memoryStore) DeleteExpiredSubscriptions() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for id, s := range m.subscriptions {
+		if s.expired(now) {
+			delete(m.subscriptions, id)
+		}
+	}
+
+	return nil
+}
+
+func (m *memoryStore) Renewal(id string) (Renewal, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	renewal, ok := m.renewals[id]
+	if !ok {
+		return Renewal{}, ErrNotFound
+	}
+
+	return renewal, nil
+}
+
+func (m *memoryStore) Renewals(userID string) ([]Renewal, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	renewals := []Renewal{}
+	for _, r := range m.renewals {
+		if r.UserID == userID || r.MerchantID == userID {
+			renewals = append(renewals, r)
+		}
+	}
+
+	return renewals, nil
+}
+
+func (m *memoryStore) PutRenewal(renewal Renewal) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.renewals[renewal.ID] = renewal
+
+	return nil
+}
+
+func (m *memoryStore) Mandates() ([]Mandate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return values(m.mandates), nil
+}
+
+func (m *memoryStore) PutMandate(mandate Mandate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.mandates[mandate.ID] = mandate
+
+	return nil
+}
+
+func (m *memoryStore) KeyRegistrations() ([]KeyRegistration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return values(m.registrations), nil
+}
+
+func (m *memoryStore) PutKeyRegistration(registration KeyRegistration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.registrations[registration.ID] = registration
+
+	return nil
+}
+
+func (m *memoryStore) Incomes() ([]Income, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return values(m.incomes), nil
+}
+
+func (m *memoryStore) PutIncome(income Income) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.incomes[income.ID] = income
+
+	return nil
+}
+
+func (m *memoryStore) IncomeProposals(period string) ([]IncomeProposal, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	proposals := []IncomeProposal{}
+	for _, p := range m.proposals {
+		if p.Period == period {
+			proposals = append(proposals, p)
+		}
+	}
+
+	return proposals, nil
+}
+
+func (m *memoryStore) PutIncomeProposal(proposal IncomeProposal) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.proposals[proposal.ID] = proposal
+
+	return nil
+}
+
+func (m *memoryStore) CountryWallet(countryCode string) (CountryWallet, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, w := range m.countryWallets {
+		if w.CountryCode == countryCode {
+			return w, nil
+		}
+	}
+
+	return CountryWallet{}, ErrNotFound
+}
+
+func (m *memoryStore) CountryWallets() ([]CountryWallet, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return values(m.countryWallets), nil
+}
+
+func (m *memoryStore) PutCountryWallet(wallet CountryWallet) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.countryWallets[wallet.ID] = wallet
+
+	return nil
+}
+
+func (m *memoryStore) Invoice(id string) (Invoice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	invoice, ok := m.invoices[id]
+	if !ok {
+		return Invoice{}, ErrNotFound
+	}
+
+	return invoice, nil
+}
+
+func (m *memoryStore) InvoicesBy(merchantID string) ([]Invoice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	invoices := []Invoice{}
+	for _, inv := range m.invoices {
+		if inv.MerchantID == merchantID {
+			invoices = append(invoices, inv)
+		}
+	}
+
+	return invoices, nil
+}
+
+func (m *memoryStore) PutInvoice(invoice Invoice) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.invoices[invoice.ID] = invoice
+
+	return nil
+}
+
+func (m *memoryStore) Escrow(id string) (Escrow, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	escrow, ok := m.escrows[id]
+	if !ok {
+		return Escrow{}, ErrNotFound
+	}
+
+	return escrow, nil
+}
+
+func (m *memoryStore) Escrows(userID string) ([]Escrow, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	escrows := []Escrow{}
+	for _, e := range m.escrows {
+		if e.BuyerID == userID || e.SellerID == userID {
+			escrows = append(escrows, e)
+		}
+	}
+
+	return escrows, nil
+}
+
+func (m *memoryStore) PutEscrow(escrow Escrow) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.escrows[escrow.ID] = escrow
+
+	return nil
+}
+
+func (m *memoryStore) Tombstone(userID string) (Tombstone, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tombstone, ok := m.tombstones[userID]
+	if !ok {
+		return Tombstone{}, ErrNotFound
+	}
+
+	return tombstone, nil
+}
+
+func (m *memoryStore) Tombstones() ([]Tombstone, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return values(m.tombstones), nil
+}
+
+func (m *memoryStore) PutTombstone(tombstone Tombstone) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tombstones[tombstone.ID] = tombstone
+
+	return nil
+}
+
+func (m *memoryStore) Purge(db string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch db {
+	case dbUser:
+		m.users = map[string]User{}
+		m.ownUserID = ""
+	case dbUserDevice:
+		m.devices = map[string]UserDevice{}
+	case dbUserBalance:
+		m.balances = map[string]UserBalance{}
+	case dbTransaction:
+		m.transactions = map[string]Transaction{}
+	case dbPaymentIntent:
+		m.intents = map[string]PaymentIntent{}
+	case dbJournal:
+		m.journal = map[string]JournalEntry{}
+	case dbPlan:
+		m.plans = map[string]Plan{}
+	case dbSubscription:
+		m.subscriptions = map[string]Subscription{}
+	case dbRenewal:
+		m.renewals = map[string]Renewal{}
+	case dbMandate:
+		m.mandates = map[string]Mandate{}
+	case dbKeyRegistration:
+		m.registrations = map[string]KeyRegistration{}
+	case dbIncome:
+		m.incomes = map[string]Income{}
+	case dbIncomeProposal:
+		m.proposals = map[string]IncomeProposal{}
+	case dbCountryWallet:
+		m.countryWallets = map[string]CountryWallet{}
+	case dbInvoice:
+		m.invoices = map[string]Invoice{}
+	case dbEscrow:
+		m.escrows = map[string]Escrow{}
+	case dbTombstone:
+		m.tombstones = map[string]Tombstone{}
+	}
+
+	return nil
+}
+
+// values returns the documents of a collection as a slice.
+func values[T any](docs map[string]T) []T {
+	s := make([]T, 0, len(docs))
+	for _, d := range docs {
+		s = append(s, d)
+	}
+	return s
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreNotFound(t *testing.T) {
+	store := newMemoryStore()
+
+	tests := []struct {
+		name string
+		get  func() error
+	}{
+		{"own user", func() error { _, err := store.OwnUser(); return err }},
+		{"user", func() error { _, err := store.User("u1"); return err }},
+		{"device", func() error { _, err := store.Device("a1"); return err }},
+		{"balance", func() error { _, err := store.Balance("u1"); return err }},
+		{"payment intent", func() error { _, err := store.PaymentIntent("p1"); return err }},
+		{"renewal", func() error { _, err := store.Renewal("r1"); return err }},
+		{"country wallet", func() error { _, err := store.CountryWallet("DE"); return err }},
+		{"invoice", func() error { _, err := store.Invoice("i1"); return err }},
+		{"escrow", func() error { _, err := store.Escrow("e1"); return err }},
+		{"tombstone", func() error { _, err := store.Tombstone("u1"); return err }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.get(); !errors.Is(err, ErrNotFound) {
+				t.Errorf("got %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreOwnUser(t *testing.T) {
+	store := newMemoryStore()
+	for _, id := range []string{"u1", "u2"} {
+		if err := store.PutUser(User{ID: []byte(id)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	own, err := store.OwnUser()
+	if err != nil || string(own.ID) != "u1" {
+		t.Fatalf("OwnUser() = %q, %v, want the first user stored", own.ID, err)
+	}
+
+	if err := store.DeleteUser("u1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.OwnUser(); !errors.Is(err, ErrNotFound) {
+		t.Errorf("OwnUser() after deletion = %v, want ErrNotFound", err)
+	}
+	if _, err := store.User("u2"); err != nil {
+		t.Errorf("User() of another user = %v", err)
+	}
+}
+
+func TestMemoryStoreTransactions(t *testing.T) {
+	store := newMemoryStore()
+	for _, tx := range []Transaction{
+		{ID: "t1", SenderID: "alice", ReceiverID: "bob", Date: "24/01"},
+		{ID: "t2", SenderID: "bob", ReceiverID: "carol", Date: "24/01"},
+		{ID: "t3", SenderID: "carol", ReceiverID: "alice", Date: "24/02"},
+		// stored again by another peer
+		{ID: "t3", SenderID: "carol", ReceiverID: "alice", Date: "24/02"},
+	} {
+		if err := store.PutTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		get  func() ([]Transaction, error)
+		want []string
+	}{
+		{"sender or receiver", func() ([]Transaction, error) { return store.Transactions("alice") }, []string{"t1", "t3"}},
+		{"receiver only", func() ([]Transaction, error) { return store.Transactions("carol") }, []string{"t2", "t3"}},
+		{"unknown user", func() ([]Transaction, error) { return store.Transactions("dave") }, []string{}},
+		{"period", func() ([]Transaction, error) { return store.TransactionsIn("24/01") }, []string{"t1", "t2"}},
+		{"empty period", func() ([]Transaction, error) { return store.TransactionsIn("24/03") }, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transactions, err := tt.get()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := []string{}
+			for _, tx := range transactions {
+				got = append(got, tx.ID)
+			}
+			slices.Sort(got)
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreDeleteExpiredSubscriptions(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name         string
+		subscription Subscription
+		kept         bool
+	}{
+		{"running", Subscription{EndDate: now.Add(time.Hour)}, true},
+		{"ended", Subscription{EndDate: now.Add(-time.Hour)}, false},
+		{"in grace", Subscription{EndDate: now.Add(-time.Hour), AutoRenew: true}, true},
+		{"paused", Subscription{EndDate: now.Add(-time.Hour), PausedAt: now.Add(-2 * time.Hour)}, true},
+		{"refund owed", Subscription{EndDate: now.Add(-time.Hour), Refund: 100}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryStore()
+			tt.subscription.ID = "s1"
+			if err := store.PutSubscription(tt.subscription); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := store.DeleteExpiredSubscriptions(); err != nil {
+				t.Fatal(err)
+			}
+
+			subscriptions, err := store.Subscriptions()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kept := len(subscriptions) == 1; kept != tt.kept {
+				t.Errorf("kept = %v, want %v", kept, tt.kept)
+			}
+		})
+	}
+}
+
+func TestMemoryStorePurge(t *testing.T) {
+	store := newMemoryStore()
+	if err := store.PutEscrow(Escrow{ID: "e1", BuyerID: "alice", SellerID: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutInvoice(Invoice{ID: "i1", MerchantID: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Purge(dbEscrow); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Escrow("e1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Escrow() after purge = %v, want ErrNotFound", err)
+	}
+	if _, err := store.Invoice("i1"); err != nil {
+		t.Errorf("Invoice() of another database = %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/maxence-charriere/go-app/v10/pkg/app"
+)
+
+// moneyScale is the number of cents in one GUBI.
+const moneyScale = 100
+
+var ErrInvalidAmount = errors.New("invalid amount")
+
+// Money is an amount of GUBI in cents. Amounts are whole cents everywhere,
+// so sums are exact, and only taxes and shares of an amount are rounded: a
+// tax rounds half away from zero, as in TaxRate.of, and a share rounds down,
+// so that nothing is ever paid back beyond what was paid.
+type Money int
+
+// parseMoney reads an amount written in GUBI, such as "12", "12.5" or
+// "-0.99". A comma is accepted as the decimal separator. More than two
+// decimals is an error rather than a silent rounding.
+func parseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "GUBI"))
+	s = strings.Replace(s, ",", ".", 1)
+
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "-"), "+")
+
+	whole, frac, _ := strings.Cut(s, ".")
+	if len(whole) == 0 && len(frac) == 0 || len(frac) > 2 {
+		return 0, ErrInvalidAmount
+	}
+
+	for len(frac) < 2 {
+		frac += "0"
+	}
+
+	var units int
+	if len(whole) > 0 {
+		u, err := strconv.ParseUint(whole, 10, 31)
+		if err != nil {
+			return 0, ErrInvalidAmount
+		}
+		units = int(u)
+	}
+
+	c, err := strconv.ParseUint(frac, 10, 8)
+	if err != nil {
+		return 0, ErrInvalidAmount
+	}
+
+	m := Money(units*moneyScale + int(c))
+	if neg {
+		m = -m
+	}
+
+	return m, nil
+}
+
+// String returns the amount in GUBI with two decimals.
+func (m Money) String() string {
+	sign := ""
+	if m < 0 {
+		sign = "-"
+		m = -m
+	}
+
+	c := strconv.Itoa(int(m % moneyScale))
+	if len(c) < 2 {
+		c = "0" + c
+	}
+
+	return sign + strconv.Itoa(int(m/moneyScale)) + "." + c
+}
+
+// gubi returns the amount for display, as in "12.99 GUBI".
+func (m Money) gubi() string {
+	return m.String() + " GUBI"
+}
+
+// signed returns the amount for display with an explicit sign.
+func (m Money) signed() string {
+	if m > 0 {
+		return "+" + m.gubi()
+	}
+	return m.gubi()
+}
+
+// times returns the amount multiplied by a quantity.
+func (m Money) times(quantity int) Money {
+	return m * Money(quantity)
+}
+
+// share returns num/den of the amount, rounded down. The product is taken
+// without overflow, as num and den can be durations in nanoseconds.
+func (m Money) share(num, den int64) Money {
+	if den <= 0 {
+		return 0
+	}
+
+	var p big.Int
+	p.Mul(big.NewInt(int64(m)), big.NewInt(num))
+	return Money(p.Quo(&p, big.NewInt(den)).Int64())
+}
+
+// moneyTo returns an event handler that parses the value of an input into
+// an amount. A value that does not parse is reported on the input, so that
+// reportValidity blocks the form.
+func moneyTo(m *Money) app.EventHandler {
+	return func(ctx app.Context, e app.Event) {
+		amount, err := parseMoney(ctx.JSSrc().Get("value").String())
+		if err != nil {
+			ctx.JSSrc().Call("setCustomValidity", "Enter an amount with up to two decimals")
+			return
+		}
+
+		ctx.JSSrc().Call("setCustomValidity", "")
+		*m = amount
+	}
+}
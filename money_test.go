@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Money
+		wantErr error
+	}{
+		{"12", 1200, nil},
+		{"12.5", 1250, nil},
+		{"12.05", 1205, nil},
+		{"0.99", 99, nil},
+		{".5", 50, nil},
+		{"1.", 100, nil},
+		{"-0.99", -99, nil},
+		{"+3", 300, nil},
+		{"1,5", 150, nil},
+		{" 12.99 GUBI ", 1299, nil},
+		{"0", 0, nil},
+		{"", 0, ErrInvalidAmount},
+		{".", 0, ErrInvalidAmount},
+		{"1.999", 0, ErrInvalidAmount},
+		{"1.2.3", 0, ErrInvalidAmount},
+		{"1.-5", 0, ErrInvalidAmount},
+		{"abc", 0, ErrInvalidAmount},
+		{"1e3", 0, ErrInvalidAmount},
+		{"99999999999", 0, ErrInvalidAmount},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseMoney(tt.in)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseMoney() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseMoney() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		m      Money
+		want   string
+		signed string
+	}{
+		{0, "0.00", "0.00 GUBI"},
+		{5, "0.05", "+0.05 GUBI"},
+		{99, "0.99", "+0.99 GUBI"},
+		{1200, "12.00", "+12.00 GUBI"},
+		{1205, "12.05", "+12.05 GUBI"},
+		{-5, "-0.05", "-0.05 GUBI"},
+		{-1299, "-12.99", "-12.99 GUBI"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := tt.m.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+			if got := tt.m.signed(); got != tt.signed {
+				t.Errorf("signed() = %q, want %q", got, tt.signed)
+			}
+			if back, err := parseMoney(tt.m.String()); err != nil || back != tt.m {
+				t.Errorf("parseMoney(String()) = %d, %v, want %d", back, err, tt.m)
+			}
+		})
+	}
+}
+
+func TestMoneyShare(t *testing.T) {
+	month := int64(30 * 24 * time.Hour)
+
+	tests := []struct {
+		name     string
+		m        Money
+		num, den int64
+		want     Money
+	}{
+		{"half", 1000, 1, 2, 500},
+		{"rounded down", 1000, 1, 3, 333},
+		{"two thirds rounded down", 1000, 2, 3, 666},
+		{"all", 999, 7, 7, 999},
+		{"nothing", 999, 0, 7, 0},
+		{"no denominator", 999, 1, 0, 0},
+		{"durations in nanoseconds", 3000, month / 3, month, 1000},
+		{"large product", math.MaxInt32, month, month, math.MaxInt32},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.m.share(tt.num, tt.den); got != tt.want {
+				t.Errorf("share() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,16 +1,16 @@
 package main
 
 import (
-	"encoding/base64"
+	"errors"
 	"log"
+	"time"
 
 	"github.com/maxence-charriere/go-app/v10/pkg/app"
-	shell "github.com/stateless-minds/go-ipfs-api"
 )
 
 type nav struct {
 	app.Compo
-	sh            *shell.Shell
+	store         Store
 	loggedIn      bool
 	termsAccepted bool
 	isBusiness    bool
@@ -18,7 +18,6 @@ type nav struct {
 	vat           string
 	entity        string
 	userID        string
-	plan          Plan
 }
 
 func newNav() *nav {
@@ -30,15 +29,13 @@ func (n *nav) OnMount(ctx app.Context) {
 	if n.loggedIn {
 		ctx.GetState("userID", &n.userID)
 		ctx.GetState("isBusiness", &n.isBusiness)
-		sh := shell.NewShell("localhost:5001")
-		n.sh = sh
+		n.store = newStore()
 	}
 
 	ctx.ObserveState("termsAccepted", &n.termsAccepted)
 	ctx.ObserveState("entity", &n.entity)
 	// ctx.ObserveState("businessName", &n.businessName)
 	// ctx.ObserveState("vat", &n.vat)
-	ctx.ObserveState("plan", &n.plan)
 }
 
 func (n *nav) doOverlay(ctx app.Context, e app.Event) {
@@ -58,24 +55,60 @@ func (n *nav) acceptTermsBusiness(ctx app.Context, e app.Event) {
 
 func (n *nav) deleteAccount(ctx app.Context, e app.Event) {
 	e.PreventDefault()
-	n.deleteUser()
-	n.deleteBalance()
-	// delete subscriptions
-	if n.isBusiness {
-		n.deletePlan()
-		// delete clients
-		// delete suppliers
+
+	// subscriptions are settled, plans and faces removed and the balance
+	// burned before the tombstone is left
+	_, err := closeAccount(n.store, newLedger(n.store, signingKey(ctx)), n.userID, time.Now())
+	if errors.Is(err, ErrEscrowOpen) {
+		ctx.Notifications().New(app.Notification{
+			Title: "Error",
+			Body:  "Confirm the delivery of your orders in escrow, or wait for their deadline, before deleting your account.",
+		})
+		return
+	} else if err != nil {
+		log.Fatal(err)
 	}
+
+	ctx.DelState("loggedIn")
 	ctx.DelState("termsAccepted")
 	ctx.Reload()
+}
+
+// downloadData saves everything stored under the user ID as a JSON archive
+// and the transactions as CSV.
+func (n *nav) downloadData(ctx app.Context, e app.Event) {
+	e.PreventDefault()
 
+	ctx.Async(func() {
+		export, err := exportData(n.store, newLedger(n.store, nil), n.userID, time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		archive, err := export.exportJSON()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		transactions, err := transactionsCSV(n.userID, export.Transactions)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx.Dispatch(func(ctx app.Context) {
+			download("cyber-gubi-"+n.userID+".json", "application/json", archive)
+			download("cyber-gubi-"+n.userID+"-transactions.csv", "text/csv", transactions)
+		})
+	})
 }
 
-func (n *nav) deletePlan() {
-	err := n.sh.OrbitDocsDelete(dbPlan, n.plan.ID)
-	if err != nil {
-		log.Fatal(err)
-	}
+// reenrollFace sends the user to log in again with the face, which is then
+// enrolled under a new template that revokes the old one.
+func (n *nav) reenrollFace(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+	ctx.SetState("reenroll", true).Persist()
+	ctx.DelState("loggedIn")
+	ctx.Navigate("/auth")
 }
 
 func (n *nav) registerIndividual(ctx app.Context, e app.Event) {
@@ -102,21 +135,6 @@ func (n *nav) submitVAT(ctx app.Context, e app.Event) {
 	}
 }
 
-func (n *nav) deleteUser() {
-	userId := base64.StdEncoding.EncodeToString([]byte(n.userID))
-	err := n.sh.OrbitDocsDelete(dbUser, string(userId))
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-func (n *nav) deleteBalance() {
-	err := n.sh.OrbitDocsDelete(dbUserBalance, n.userID)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
 func (n *nav) Render() app.UI {
 	return app.Nav().Body(
 		app.Div().Class("navbar").Body(
@@ -240,9 +258,18 @@ func (n *nav) Render() app.UI {
 							app.Li().Body(
 								app.A().Href("/payment").Text("Payment"),
 							),
+							app.Li().Body(
+								app.A().Href("/invoices").Text("Invoices"),
+							),
+							app.Li().Body(
+								app.A().Href("/receive").Text("Receive"),
+							),
 							app.Li().Body(
 								app.A().Href("/subscriptions").Text("Subscriptions"),
 							),
+							app.Li().Body(
+								app.A().Href("/economy").Text("Economy"),
+							),
 							app.Li().Body(
 								app.A().Href("/terms").Text("Terms of Use"),
 							),
@@ -252,6 +279,12 @@ func (n *nav) Render() app.UI {
 							app.Li().Body(
 								app.A().Href("/cookie").Text("Cookie"),
 							),
+							app.Li().Body(
+								app.A().Text("Download My Data").OnClick(n.downloadData),
+							),
+							app.Li().Body(
+								app.A().Text("Re-enroll Face").OnClick(n.reenrollFace),
+							),
 							app.Li().Body(
 								app.A().Text("Delete Account").OnClick(n.deleteAccount),
 							),
@@ -270,15 +303,15 @@ func (n *nav) Render() app.UI {
 							app.Li().Body(
 								app.A().Href("/payment").Text("Payment"),
 							),
-							app.If(n.plan == Plan{}, func() app.UI {
-								return app.Li().Body(
-									app.A().Href("/plan").Text("Create Plan"),
-								)
-							}).Else(func() app.UI {
-								return app.Li().Body(
-									app.A().Href("/plan").Text("Edit Plan"),
-								)
-							}),
+							app.Li().Body(
+								app.A().Href("/invoices").Text("Invoices"),
+							),
+							app.Li().Body(
+								app.A().Href("/receive").Text("Receive"),
+							),
+							app.Li().Body(
+								app.A().Href("/plan").Text("Plans"),
+							),
 							app.Li().Body(
 								app.A().Href("/associates").Text("Associates"),
 							),
@@ -288,6 +321,9 @@ func (n *nav) Render() app.UI {
 							app.Li().Body(
 								app.A().Href("/suppliers").Text("Suppliers"),
 							),
+							app.Li().Body(
+								app.A().Href("/economy").Text("Economy"),
+							),
 							app.Li().Body(
 								app.A().Href("/terms-business").Text("Terms of Use"),
 							),
@@ -297,6 +333,12 @@ func (n *nav) Render() app.UI {
 							app.Li().Body(
 								app.A().Href("/cookie-business").Text("Cookie"),
 							),
+							app.Li().Body(
+								app.A().Text("Download My Data").OnClick(n.downloadData),
+							),
+							app.Li().Body(
+								app.A().Text("Re-enroll Face").OnClick(n.reenrollFace),
+							),
 							app.Li().Body(
 								app.A().Text("Delete Account").OnClick(n.deleteAccount),
 							),
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	shell "github.com/stateless-minds/go-ipfs-api"
+)
+
+// orbitStore is the Store backed by the OrbitDB document stores of the local
+// IPFS node.
+type orbitStore struct {
+	sh *shell.Shell
+}
+
+func newOrbitStore(sh *shell.Shell) *orbitStore {
+	return &orbitStore{sh: sh}
+}
+
+// query runs a document query and unmarshals the result into v. An empty
+// result leaves v untouched.
+func (o *orbitStore) query(db, key, value string, v interface{}) error {
+	b, err := o.sh.OrbitDocsQuery(db, key, value)
+	if err != nil {
+		return err
+	}
+
+	if len(b) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(b, v) // Unmarshal the byte slice directly
+}
+
+func (o *orbitStore) put(db string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return o.sh.OrbitDocsPut(db, b)
+}
+
+// queryUsers runs a query on the encrypted user store.
+func (o *orbitStore) queryUsers(key, value string) ([]User, error) {
+	res, err := o.sh.OrbitDocsQueryEnc(dbUser, key, value)
+	if err != nil {
+		return nil, err
+	}
+
+	users := []User{}
+
+	if len(res) == 0 {
+		return users, nil
+	}
+
+	err = json.Unmarshal([]byte(sanitizeEncJSON(string(res))), &users)
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// sanitizeEncJSON turns the escaped documents returned by the encrypted
+// queries back into plain JSON.
+func sanitizeEncJSON(res string) string {
+	res = strings.ReplaceAll(res, "\\", "")
+	res = strings.ReplaceAll(res, `""`, `"`)
+	res = strings.ReplaceAll(res, `"[`, `[`)
+	res = strings.ReplaceAll(res, `:",`, `:"",`)
+	res = strings.ReplaceAll(res, `]"`, `]`)
+	res = strings.ReplaceAll(res, `"{`, `{`)
+	res = strings.ReplaceAll(res, `}"`, `}`)
+	return res
+}
+
+// userKey returns the document key of a user, which is the base64 form of
+// the ID bytes.
+func userKey(id string) string {
+	return base64.StdEncoding.EncodeToString([]byte(id))
+}
+
+func (o *orbitStore) OwnUser() (User, error) {
+	users, err := o.queryUsers("own", "")
+	if err != nil {
+		return User{}, err
+	}
+
+	if len(users) == 0 {
+		return User{}, ErrNotFound
+	}
+
+	return users[0], nil
+}
+
+func (o *orbitStore) User(id string) (User, error) {
+	users := []User{}
+
+	err := o.query(dbUser, "_id", userKey(id), &users)
+	if err != nil {
+		return User{}, err
+	}
+
+	if len(users) == 0 {
+		return User{}, ErrNotFound
+	}
+
+	return users[0], nil
+}
+
+func (o *orbitStore) Users() ([]User, error) {
+	return o.queryUsers("all", "")
+}
+
+func (o *orbitStore) PutUser(user User) error {
+	userJSON, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	return o.sh.OrbitDocsPutEnc(dbUser, userJSON)
+}
+
+func (o *orbitStore) DeleteUser(id string) error {
+	return o.sh.OrbitDocsDelete(dbUser, userKey(id))
+}
+
+func (o *orbitStore) Device(address string) (UserDevice, error) {
+	d, err := o.sh.OrbitDocsGet(dbUserDevice, address)
+	if err != nil {
+		return UserDevice{}, err
+	}
+
+	devices := []UserDevice{}
+
+	if len(d) != 0 {
+		err = json.Unmarshal([]byte(d), &devices)
+		if err != nil {
+			return UserDevice{}, err
+		}
+	}
+
+	if len(devices) == 0 {
+		return UserDevice{}, ErrNotFound
+	}
+
+	return devices[0], nil
+}
+
+func (o *orbitStore) PutDevice(device UserDevice) error {
+	return o.put(dbUserDevice, device)
+}
+
+func (o *orbitStore) Balance(userID string) (UserBalance, error) {
+	userBalances := []UserBalance{}
+
+	err := o.query(dbUserBalance, "_id", userID, &userBalances)
+	if err != nil {
+		return UserBalance{}, err
+	}
+
+	if len(userBalances) == 0 {
+		return UserBalance{}, ErrNotFound
+	}
+
+	return userBalances[0], nil
+}
+
+func (o *orbitStore) Balances() ([]UserBalance, error) {
+	userBalances := []UserBalance{}
+	err := o.query(dbUserBalance, "all", "", &userBalances)
+	return userBalances, err
+}
+
+func (o *orbitStore) PutBalance(balance UserBalance) error {
+	return o.put(dbUserBalance, balance)
+}
+
+func (o *orbitStore) DeleteBalance(userID string) error {
+	return o.sh.OrbitDocsDelete(dbUserBalance, userID)
+}
+
+func (o *orbitStore) Transactions(userID string) ([]Transaction, error) {
+	transactions := []Transaction{}
+	err := o.query(dbTransaction, "sender_id,receiver_id", userID, &transactions)
+	return transactions, err
+}
+
+func (o *orbitStore) TransactionsIn(period string) ([]Transaction, error) {
+	transactions := []Transaction{}
+	err := o.query(dbTransaction, "date", period, &transactions)
+	return transactions, err
+}
+
+func (o *orbitStore) PutTransaction(transaction Transaction) error {
+	return o.put(dbTransaction, transaction)
+}
+
+func (o *orbitStore) PaymentIntent(id string) (PaymentIntent, error) {
+	intents := []PaymentIntent{}
+
+	err := o.query(dbPaymentIntent, "_id", id, &intents)
+	if err != nil {
+		return PaymentIntent{}, err
+	}
+
+	if len(intents) == 0 {
+		return PaymentIntent{}, ErrNotFound
+	}
+
+	return intents[0], nil
+}
+
+func (o *orbitStore) PaymentIntents(senderID string) ([]PaymentIntent, error) {
+	intents := []PaymentIntent{}
+	err := o.query(dbPaymentIntent, "sender_id", senderID, &intents)
+	return intents, err
+}
+
+func (o *orbitStore) PutPaymentIntent(intent PaymentIntent) error {
+	return o.put(dbPaymentIntent, intent)
+}
+
+func (o *orbitStore) Journal() ([]JournalEntry, error) {
+	entries := []JournalEntry{}
+	err := o.query(dbJournal, "all", "", &entries)
+	return entries, err
+}
+
+func (o *orbitStore) PutJournalEntry(entry JournalEntry) error {
+	return o.put(dbJournal, entry)
+}
+
+func (o *orbitStore) Plans() ([]Plan, error) {
+	plans := []Plan{}
+	err := o.query(dbPlan, "all", "", &plans)
+	return plans, err
+}
+
+func (o *orbitStore) PlansBy(userID string) ([]Plan, error) {
+	plans := []Plan{}
+	err := o.query(dbPlan, "created_by", userID, &plans)
+	return plans, err
+}
+
+func (o *orbitStore) PutPlan(plan Plan) error {
+	return o.put(dbPlan, plan)
+}
+
+func (o *orbitStore) DeletePlan(id string) error {
+	return o.sh.OrbitDocsDelete(dbPlan, id)
+}
+
+func (o *orbitStore) Subscriptions() ([]Subscription, error) {
+	subscriptions := []Subscription{}
+	err := o.query(dbSubscription, "all", "", &subscriptions)
+	return subscriptions, err
+}
+
+func (o *orbitStore) SubscriptionsBy(userID string) ([]Subscription, error) {
+	subscriptions := []Subscription{}
+	err := o.query(dbSubscription, "user_id", userID, &subscriptions)
+	return subscriptions, err
+}
+
+func (o *orbitStore) PutSubscription(subscription Subscription) error {
+	return o.put(dbSubscription, subscription)
+}
+
+func (o *orbitStore) DeleteSubscription(id string) error {
+	return o.sh.OrbitDocsDelete(dbSubscription, id)
+}
+
+func (o *orbitStore) DeleteExpiredSubscriptions() error {
+	subscriptions, err := o.Subscriptions()
+	if err != nil {
+		return err
+	}
+
+	// auto-renewing subscriptions are kept during their grace period
+	now := time.Now()
+	for _, s := range subscriptions {
+		if s.expired(now) {
+			err = o.DeleteSubscription(s.ID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (o *orbitStore) Renewal(id string) (Renewal, error) {
+	renewals := []Renewal{}
+
+	err := o.query(dbRenewal, "_id", id, &renewals)
+	if err != nil {
+		return Renewal{}, err
+	}
+
+	if len(renewals) == 0 {
+		return Renewal{}, ErrNotFound
+	}
+
+	return renewals[0], nil
+}
+
+func (o *orbitStore) Renewals(userID string) ([]Renewal, error) {
+	renewals := []Renewal{}
+	err := o.query(dbRenewal, "user_id,merchant_id", userID, &renewals)
+	return renewals, err
+}
+
+func (o *orbitStore) PutRenewal(renewal Renewal) error {
+	return o.put(dbRenewal, renewal)
+}
+
+func (o *orbitStore) Mandates() ([]Mandate, error) {
+	mandates := []Mandate{}
+	err := o.query(dbMandate, "all", "", &mandates)
+	return mandates, err
+}
+
+func (o *orbitStore) PutMandate(mandate Mandate) error {
+	return o.put(dbMandate, mandate)
+}
+
+func (o *orbitStore) KeyRegistrations() ([]KeyRegistration, error) {
+	registrations := []KeyRegistration{}
+	err := o.query(dbKeyRegistration, "all", "", &registrations)
+	return registrations, err
+}
+
+func (o *orbitStore) PutKeyRegistration(registration KeyRegistration) error {
+	return o.put(dbKeyRegistration, registration)
+}
+
+func (o *orbitStore) Incomes() ([]Income, error) {
+	income := []Income{}
+	err := o.query(dbIncome, "all", "", &income)
+	return income, err
+}
+
+func (o *orbitStore) PutIncome(income Income) error {
+	return o.put(dbIncome, income)
+}
+
+func (o *orbitStore) IncomeProposals(period string) ([]IncomeProposal, error) {
+	proposals := []IncomeProposal{}
+	err := o.query(dbIncomeProposal, "period", period, &proposals)
+	return proposals, err
+}
+
+func (o *orbitStore) PutIncomeProposal(proposal IncomeProposal) error {
+	return o.put(dbIncomeProposal, proposal)
+}
+
+func (o *orbitStore) CountryWallet(countryCode string) (CountryWallet, error) {
+	wallets := []CountryWallet{}
+
+	err := o.query(dbCountryWallet, "country_code", countryCode, &wallets)
+	if err != nil {
+		return CountryWallet{}, err
+	}
+
+	if len(wallets) == 0 {
+		return CountryWallet{}, ErrNotFound
+	}
+
+	return wallets[0], nil
+}
+
+func (o *orbitStore) CountryWallets() ([]CountryWallet, error) {
+	wallets := []CountryWallet{}
+	err := o.query(dbCountryWallet, "all", "", &wallets)
+	return wallets, err
+}
+
+func (o *orbitStore) PutCountryWallet(wallet CountryWallet) error {
+	return o.put(dbCountryWallet, wallet)
+}
+
+func (o *orbitStore) Invoice(id string) (Invoice, error) {
+	invoices := []Invoice{}
+
+	err := o.query(dbInvoice, "_id", id, &invoices)
+	if err != nil {
+		return Invoice{}, err
+	}
+
+	if len(invoices) == 0 {
+		return Invoice{}, ErrNotFound
+	}
+
+	return invoices[0], nil
+}
+
+func (o *orbitStore) InvoicesBy(merchantID string) ([]Invoice, error) {
+	invoices := []Invoice{}
+	err := o.query(dbInvoice, "merchant_id", merchantID, &invoices)
+	return invoices, err
+}
+
+func (o *orbitStore) PutInvoice(invoice Invoice) error {
+	return o.put(dbInvoice, invoice)
+}
+
+func (o *orbitStore) Escrow(id string) (Escrow, error) {
+	escrows := []Escrow{}
+
+	err := o.query(dbEscrow, "_id", id, &escrows)
+	if err != nil {
+		return Escrow{}, err
+	}
+
+	if len(escrows) == 0 {
+		return Escrow{}, ErrNotFound
+	}
+
+	return escrows[0], nil
+}
+
+func (o *orbitStore) Escrows(userID string) ([]Escrow, error) {
+	escrows := []Escrow{}
+	err := o.query(dbEscrow, "buyer_id,seller_id", userID, &escrows)
+	return escrows, err
+}
+
+func (o *orbitStore) PutEscrow(escrow Escrow) error {
+	return o.put(dbEscrow, escrow)
+}
+
+func (o *orbitStore) Tombstone(userID string) (Tombstone, error) {
+	tombstones := []Tombstone{}
+
+	err := o.query(dbTombstone, "_id", userID, &tombstones)
+	if err != nil {
+		return Tombstone{}, err
+	}
+
+	if len(tombstones) == 0 {
+		return Tombstone{}, ErrNotFound
+	}
+
+	return tombstones[0], nil
+}
+
+func (o *orbitStore) Tombstones() ([]Tombstone, error) {
+	tombstones := []Tombstone{}
+	err := o.query(dbTombstone, "all", "", &tombstones)
+	return tombstones, err
+}
+
+func (o *orbitStore) PutTombstone(tombstone Tombstone) error {
+	return o.put(dbTombstone, tombstone)
+}
+
+func (o *orbitStore) Purge(db string) error {
+	return o.sh.OrbitDocsDelete(db, "all")
+}
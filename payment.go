@@ -1,14 +1,14 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"log"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/maxence-charriere/go-app/v10/pkg/app"
-	shell "github.com/stateless-minds/go-ipfs-api"
 )
 
 const dbTransaction = "transaction"
@@ -18,7 +18,8 @@ const dbTransaction = "transaction"
 // embedding app.Compo into a struct.
 type payment struct {
 	app.Compo
-	sh            *shell.Shell
+	store         Store
+	ledger        *ledger
 	loggedIn      bool
 	isBusiness    bool
 	userID        string
@@ -31,23 +32,42 @@ type payment struct {
 	products      []ProductService
 	services      []ProductService
 	activeTab     string
+	intentID      string
+	invoiceID     string
+	invoice       Invoice
+	scanning      bool
+	escrow        bool
+	escrowDays    int
+	splitID       string
+	splitLines    []SplitLine
+	receipt       Receipt
 }
 
 type Subscription struct {
-	ID        string    `mapstructure:"_id" json:"_id" validate:"uuid_rfc4122"`               // Unique identifier for the transaction
-	PlanID    string    `mapstructure:"plan_id" json:"plan_id" validate:"uuid_rfc4122"`       // Plan id
-	UserID    string    `mapstructure:"user_id" json:"user_id" validate:"uuid_rfc4122"`       // User id
-	Price     int       `mapstructure:"price" json:"price" validate:"uuid_rfc4122"`           // Price
-	StartDate time.Time `mapstructure:"start_date" json:"start_date" validate:"uuid_rfc4122"` // Start date of subscription
-	EndDate   time.Time `mapstructure:"end_date" json:"end_date" validate:"uuid_rfc4122"`     // End date of subscription
+	ID          string    `mapstructure:"_id" json:"_id" validate:"uuid_rfc4122"`                   // Unique identifier for the transaction
+	PlanID      string    `mapstructure:"plan_id" json:"plan_id" validate:"uuid_rfc4122"`           // Plan id
+	UserID      string    `mapstructure:"user_id" json:"user_id" validate:"uuid_rfc4122"`           // User id
+	Price       Money     `mapstructure:"price" json:"price" validate:"uuid_rfc4122"`               // Price
+	StartDate   time.Time `mapstructure:"start_date" json:"start_date" validate:"uuid_rfc4122"`     // Start date of subscription
+	EndDate     time.Time `mapstructure:"end_date" json:"end_date" validate:"uuid_rfc4122"`         // End date of subscription
+	Interval    string    `mapstructure:"interval" json:"interval" validate:"uuid_rfc4122"`         // Billing interval of the plan, month or year
+	AutoRenew   bool      `mapstructure:"auto_renew" json:"auto_renew" validate:"uuid_rfc4122"`     // Charged again every interval until turned off
+	PausedAt    time.Time `mapstructure:"paused_at" json:"paused_at" validate:"uuid_rfc4122"`       // Time the subscription was paused, zero while it runs
+	CancelledAt time.Time `mapstructure:"cancelled_at" json:"cancelled_at" validate:"uuid_rfc4122"` // Time the subscriber cancelled, zero until then
+	Refund      Money     `mapstructure:"refund" json:"refund" validate:"uuid_rfc4122"`             // Unused time the business owes back on cancellation
+	PaidUntil   time.Time `mapstructure:"paid_until" json:"paid_until" validate:"uuid_rfc4122"`     // End of the time paid for when cancelled with a refund, moved by the pause
 }
 
 type Transaction struct {
 	ID               string `mapstructure:"_id" json:"_id" validate:"uuid_rfc4122"`                 // Unique identifier for the transaction
 	SenderID         string `mapstructure:"sender_id" json:"sender_id" validate:"uuid_rfc4122"`     // Sender user id
 	ReceiverID       string `mapstructure:"receiver_id" json:"receiver_id" validate:"uuid_rfc4122"` // Recipient user id
+	InvoiceID        string `mapstructure:"invoice_id" json:"invoice_id" validate:"uuid_rfc4122"`   // Invoice the transaction pays, if any
+	RefundOf         string `mapstructure:"refund_of" json:"refund_of" validate:"uuid_rfc4122"`     // Transaction the refund pays back, if any
+	GroupID          string `mapstructure:"group_id" json:"group_id" validate:"uuid_rfc4122"`       // Split payment the transaction is part of, if any
 	ProductsServices []ProductService
-	TotalCost        int       `mapstructure:"total_cost" json:"total_cost" validate:"uuid_rfc4122"` // Total cost of transaction
+	Taxes            []TaxLine `mapstructure:"taxes" json:"taxes" validate:"uuid_rfc4122"`           // Taxes collected on the transaction
+	TotalCost        Money     `mapstructure:"total_cost" json:"total_cost" validate:"uuid_rfc4122"` // Total cost of transaction
 	Timestamp        time.Time `mapstructure:"timestamp" json:"timestamp" validate:"uuid_rfc4122"`   // Timestamp of the transaction
 	Date             string    `mapstructure:"date" json:"date" validate:"uuid_rfc4122"`             // Date of the transaction in the format YY/MM
 	Processed        bool      `mapstructure:"processed" json:"processed" validate:"uuid_rfc4122"`   // Flag if it was already processed by inflation indexer
@@ -56,29 +76,13 @@ type Transaction struct {
 type ProductService struct {
 	ID     string `mapstructure:"product_id" json:"product_id" validate:"uuid_rfc4122"` // Unique identifier for the product
 	Name   string `mapstructure:"name" json:"name" validate:"uuid_rfc4122"`
-	Price  int    `mapstructure:"price" json:"price" validate:"uuid_rfc4122"`
+	Price  Money  `mapstructure:"price" json:"price" validate:"uuid_rfc4122"`
 	Amount int    `mapstructure:"amount" json:"amount" validate:"uuid_rfc4122"`
 }
 
-// Struct for individual state data
-type State struct {
-	Rate float64 `json:"rate"`
-	Type string  `json:"type"`
-}
-
-// Struct for country data, including nested states
-type Country struct {
-	Type   string           `json:"type"`
-	Rate   float64          `json:"rate"`
-	States map[string]State `json:"states,omitempty"` // Use a map for dynamic state keys
-}
-
-// Top-level struct to hold country data
-type TaxData map[string]Country
-
 func (p *payment) OnMount(ctx app.Context) {
-	sh := shell.NewShell("localhost:5001")
-	p.sh = sh
+	p.store = newStore()
+	p.ledger = newLedger(p.store, signingKey(ctx))
 
 	// set default number of product inputs
 	p.productsIndex = []int{1}
@@ -87,6 +91,10 @@ func (p *payment) OnMount(ctx app.Context) {
 	p.servicesIndex = []int{1}
 	p.services = make([]ProductService, 1)
 	p.activeTab = "product"
+	p.intentID = uuid.NewString()
+	p.escrowDays = int(escrowPeriod / (24 * time.Hour))
+	p.splitLines = make([]SplitLine, 2)
+	p.splitID = uuid.NewString()
 
 	ctx.GetState("loggedIn", &p.loggedIn)
 	if !p.loggedIn {
@@ -97,51 +105,42 @@ func (p *payment) OnMount(ctx app.Context) {
 	ctx.GetState("balance", &p.userBalance)
 	ctx.GetState("country: ", &p.country)
 	ctx.GetState("region: ", &p.region)
-	ctx.GetState("isBusiness: ", &p.isBusiness)
-
-	log.Println("p.isBusiness", p.isBusiness)
+	ctx.GetState("isBusiness", &p.isBusiness)
 
 	p.getBalances(ctx)
-}
 
-func (p *payment) getBalance(userID string) (balance UserBalance, err error) {
-	b, err := p.sh.OrbitDocsQuery(dbUserBalance, "_id", userID)
-	if err != nil {
-		return UserBalance{}, err
-	}
+	// the QR code scanner in web/script.js hands decoded payment requests
+	// over here
+	app.Window().Set("paymentScanned", app.FuncOf(func(this app.Value, args []app.Value) interface{} {
+		if len(args) > 0 {
+			uri := args[0].String()
+			ctx.Dispatch(func(ctx app.Context) {
+				p.prefill(ctx, uri)
+			})
+		}
+		return nil
+	}))
 
-	if len(b) == 0 {
-		return UserBalance{}, err
+	// invoices can be opened from a link
+	p.invoiceID = app.Window().URL().Query().Get("invoice")
+	if len(p.invoiceID) > 0 {
+		p.getInvoice(ctx)
 	}
+}
 
-	userBalances := []UserBalance{}
-
-	err = json.Unmarshal(b, &userBalances) // Unmarshal the byte slice directly
-	if err != nil {
-		return UserBalance{}, err
+func (p *payment) OnDismount() {
+	if p.scanning {
+		app.Window().Call("stopScan")
 	}
-
-	return userBalances[0], nil
 }
 
 func (p *payment) getUser(userID string) (user User, err error) {
-	b, err := p.sh.OrbitDocsQuery(dbUser, "_id", userID)
-	if err != nil {
-		return User{}, err
+	user, err = p.store.User(userID)
+	if errors.Is(err, ErrNotFound) {
+		return User{}, nil
 	}
 
-	if len(b) == 0 {
-		return User{}, err
-	}
-
-	u := []User{}
-
-	err = json.Unmarshal(b, &u) // Unmarshal the byte slice directly
-	if err != nil {
-		return User{}, err
-	}
-
-	return u[0], nil
+	return user, err
 }
 
 func removeSelfFromUserResults(userBalances []UserBalance, userID string) []UserBalance {
@@ -155,18 +154,7 @@ func removeSelfFromUserResults(userBalances []UserBalance, userID string) []User
 
 func (p *payment) getBalances(ctx app.Context) {
 	ctx.Async(func() {
-		b, err := p.sh.OrbitDocsQuery(dbUserBalance, "all", "")
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		if len(b) == 0 {
-			log.Fatal(err)
-		}
-
-		userBalances := []UserBalance{}
-
-		err = json.Unmarshal(b, &userBalances) // Unmarshal the byte slice directly
+		userBalances, err := p.store.Balances()
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -180,39 +168,10 @@ func (p *payment) getBalances(ctx app.Context) {
 	})
 }
 
-func (p *payment) updateBalance(userID string, balance, income int, date string) error {
-	userBalance := UserBalance{
-		ID:           userID,
-		Balance:      balance,
-		Income:       income,
-		LastReceived: date,
-	}
-
-	userBalanceJSON, err := json.Marshal(userBalance)
-	if err != nil {
-		return err
-	}
-
-	err = p.sh.OrbitDocsPut(dbUserBalance, userBalanceJSON)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (p *payment) storeTransaction(transaction Transaction) error {
-	transactionJSON, err := json.Marshal(transaction)
-	if err != nil {
-		return err
-	}
-
-	err = p.sh.OrbitDocsPut(dbTransaction, transactionJSON)
-	if err != nil {
-		return err
-	}
-
-	return nil
+// newIntent starts a new payment intent whenever the payment form changes.
+// Until then submitting the form again retries the same intent.
+func (p *payment) newIntent(ctx app.Context, e app.Event) {
+	p.intentID = uuid.NewString()
 }
 
 func (p *payment) showProduct(ctx app.Context, e app.Event) {
@@ -281,29 +240,38 @@ func (p *payment) doPayment(ctx app.Context, e app.Event) {
 		tabActive := app.Window().Get("document").Call("getElementsByClassName", "tab-active").Index(0).Get("value").String()
 		receiverID := app.Window().GetElementByID("receiver-id").Get("value").String()
 		transaction := Transaction{}
-		transaction.ID = uuid.NewString()
+		if len(p.intentID) == 0 {
+			ctx.Notifications().New(app.Notification{
+				Title: "Error",
+				Body:  "This payment was already made.",
+			})
+			return
+		}
+
+		transaction.ID = p.intentID
 		transaction.SenderID = p.userID
 		transaction.ReceiverID = receiverID
 		transaction.Timestamp = time.Now()
 		transaction.Date = strconv.Itoa(time.Now().Year()) + "/" + strconv.Itoa(int(time.Now().Month()))
+		productsServices := p.services
 		if tabActive == "product" {
-			for i, pr := range p.products {
-				p.products[i].ID = uuid.NewString()
-				p.products[i].Price = pr.Price * 100
-			}
-			transaction.ProductsServices = p.products
-		} else {
-			for i, sr := range p.services {
-				p.services[i].ID = uuid.NewString()
-				p.services[i].Price = sr.Price * 100
-			}
-			transaction.ProductsServices = p.services
+			productsServices = p.products
+		}
+		for _, ps := range productsServices {
+			ps.ID = uuid.NewString()
+			transaction.ProductsServices = append(transaction.ProductsServices, ps)
 		}
 
-		var totalCost int
-
-		for _, ps := range transaction.ProductsServices {
-			totalCost += ps.Price * ps.Amount
+		deleted, err := closed(p.store, receiverID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if deleted {
+			ctx.Notifications().New(app.Notification{
+				Title: "Error",
+				Body:  "The receiver deleted their account.",
+			})
+			return
 		}
 
 		user, err := p.getUser(receiverID)
@@ -311,107 +279,352 @@ func (p *payment) doPayment(ctx app.Context, e app.Event) {
 			log.Fatal(err)
 		}
 
-		if p.isBusiness {
-			// B2B
-			if len(user.VAT) > 0 {
-				data := getSalesTaxJSON()
-
-				// Unmarshal the JSON data into the struct
-				var obj TaxData
-				err := json.Unmarshal([]byte(data), &obj)
-				if err != nil {
-					log.Fatal("Error unmarshaling JSON:", err)
-				}
+		buyer, err := p.getUser(p.userID)
+		if err != nil {
+			log.Fatal(err)
+		}
 
-				for countryCode, taxCountry := range obj {
-					if countryCode == user.Country {
-						if countryCode != "US" && countryCode != "CA" && countryCode != "ES" {
-							vatTax := totalCost * int(taxCountry.Rate)
-							log.Println("vat tax: ", vatTax)
-							// debit vat tax to country of p.user
-							totalCost = totalCost + vatTax
-							log.Println("totalCost: ", totalCost)
-						} else {
-							for stateName, state := range taxCountry.States {
-								if p.region == stateName {
-									stateTax := totalCost * int(state.Rate)
-									log.Println("state tax: ", stateTax)
-									// debit stateTax to country of p.user
-								}
-							}
-						}
-					}
-				}
-			} else {
-				// B2C
-				// debit income tax to country of p.user
-			}
-		} else {
-			// C2B
-			if len(user.VAT) > 0 {
-				// debit vat tax to country of p.user
-			} else {
-				// C2C
-				// debit income tax to country of seller
-			}
+		sale := newSale(buyer, user, transaction.ProductsServices, transaction.Timestamp)
 
+		engine, err := newTaxEngine(p.store)
+		if err != nil {
+			log.Fatal(err)
 		}
 
-		return
-
-		transaction.TotalCost = totalCost
+		transaction.Taxes = engine.taxLines(sale)
+		transaction.TotalCost = saleTotal(sale.net(), transaction.Taxes)
+		postings := salePostings(p.userID, receiverID, sale.net(), transaction.Taxes)
 
-		if p.userBalance.Balance-totalCost < 0 {
+		// move the money, a resubmitted intent is settled only once. In
+		// escrow the money waits on an escrow account until the delivery.
+		if p.escrow {
+			deadline := transaction.Timestamp.AddDate(0, 0, max(p.escrowDays, 1))
+			_, err = lockEscrow(p.store, p.ledger, transaction, deadline)
+		} else {
+			_, err = submitPayment(p.store, p.ledger, newPaymentIntent(transaction, postings))
+		}
+		if errors.Is(err, ErrInsufficientFunds) {
 			ctx.Notifications().New(app.Notification{
 				Title: "Error",
 				Body:  "Not enough funds.",
 			})
 			return
+		} else if errors.Is(err, ErrUnauthorizedKey) {
+			ctx.Notifications().New(app.Notification{
+				Title: "Error",
+				Body:  "This device is not registered for your wallet. Log in again.",
+			})
+			return
+		} else if err != nil {
+			log.Println(err)
+			ctx.Notifications().New(app.Notification{
+				Title: "Error",
+				Body:  "Payment is pending. Submit it again to retry.",
+			})
+			return
+		}
+
+		p.intentID = ""
+		p.userBalance.Balance = p.userBalance.Balance - transaction.TotalCost
+		ctx.Update()
+
+		if p.escrow {
+			ctx.Notifications().New(app.Notification{
+				Title: "Success",
+				Body:  "Payment locked in escrow until you confirm the delivery.",
+			})
+			return
 		}
-		// update sender balance
-		err = p.updateBalance(p.userID, p.userBalance.Balance-totalCost, p.userBalance.Income, p.userBalance.LastReceived)
+
+		err = syncCountryWallets(p.store, p.ledger, transaction.Taxes)
 		if err != nil {
-			log.Fatal(err)
+			log.Println(err)
 		}
-		// get receiver balance
-		receiverBalance, err := p.getBalance(transaction.ReceiverID)
+
+		ctx.Notifications().New(app.Notification{
+			Title: "Success",
+			Body:  "Payment successful!",
+		})
+	}
+}
+
+// newSplitIntent starts a new split payment whenever the split form
+// changes. Until then submitting the form again retries the same payment.
+func (p *payment) newSplitIntent(ctx app.Context, e app.Event) {
+	p.splitID = uuid.NewString()
+}
+
+func (p *payment) addSplitLine(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+	p.splitLines = append(p.splitLines, SplitLine{})
+}
+
+func (p *payment) removeSplitLine(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+	p.splitLines = p.splitLines[:len(p.splitLines)-1]
+}
+
+// doSplit pays the lines of the split form to their receivers at once.
+func (p *payment) doSplit(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+
+	valid := app.Window().GetElementByID("split-form").Call("reportValidity").Bool()
+	if !valid {
+		return
+	}
+
+	if len(p.splitID) == 0 {
+		ctx.Notifications().New(app.Notification{
+			Title: "Error",
+			Body:  "This payment was already made.",
+		})
+		return
+	}
+
+	groupID := p.splitID
+	lines := []SplitLine{}
+	for _, line := range p.splitLines {
+		line.Item.ID = uuid.NewString()
+		lines = append(lines, line)
+	}
+	ctx.Async(func() {
+		engine, err := newTaxEngine(p.store)
 		if err != nil {
 			log.Fatal(err)
 		}
-		// update receiver balance
-		err = p.updateBalance(transaction.ReceiverID, receiverBalance.Balance+totalCost, receiverBalance.Income, receiverBalance.LastReceived)
-		if err != nil {
-			// rollback sender balance
-			err := p.updateBalance(p.userID, p.userBalance.Balance+totalCost, p.userBalance.Income, p.userBalance.LastReceived)
-			if err != nil {
-				log.Fatal(err)
-			}
-			return
+
+		var intent PaymentIntent
+		transactions, postings, err := splitPayment(p.store, engine, groupID, p.userID, lines, time.Now())
+		if err == nil {
+			// a resubmitted intent is settled only once
+			intent, err = submitPayment(p.store, p.ledger, newSplitIntent(groupID, transactions, postings))
 		}
-		// store transaction
-		err = p.storeTransaction(transaction)
-		if err != nil {
-			// rollback sender balance
-			err = p.updateBalance(p.userID, p.userBalance.Balance+totalCost, p.userBalance.Income, p.userBalance.LastReceived)
-			if err != nil {
-				log.Fatal(err)
-			}
-			// rollback receiver balance
-			err = p.updateBalance(transaction.ReceiverID, receiverBalance.Balance-totalCost, receiverBalance.Income, receiverBalance.LastReceived)
-			if err != nil {
-				log.Fatal(err)
+		if err == nil {
+			for _, t := range intent.transactions() {
+				syncErr := syncCountryWallets(p.store, p.ledger, t.Taxes)
+				if syncErr != nil {
+					log.Println(syncErr)
+				}
 			}
-			return
 		}
 
-		p.userBalance.Balance = p.userBalance.Balance - totalCost
-		ctx.Update()
+		ctx.Dispatch(func(ctx app.Context) {
+			var body string
+			switch {
+			case err == nil:
+				p.receipt = newReceipt(groupID, intent.transactions())
+				p.userBalance.Balance = p.userBalance.Balance + intent.change(p.userID)
+				p.splitID = ""
+				p.splitLines = make([]SplitLine, 2)
+				app.Window().GetElementByID("split-form").Call("reset")
+				ctx.Notifications().New(app.Notification{
+					Title: "Success",
+					Body:  "Payment successful!",
+				})
+				return
+			case errors.Is(err, ErrInsufficientFunds):
+				body = "Not enough funds."
+			case errors.Is(err, ErrUnauthorizedKey):
+				body = "This device is not registered for your wallet. Log in again."
+			case errors.Is(err, ErrForkedChain):
+				body = "Your wallet is frozen, it signed two conflicting payments."
+			case errors.Is(err, ErrAccountClosed):
+				body = "A receiver deleted their account."
+			default:
+				log.Println(err)
+				body = "Payment is pending. Submit it again to retry."
+			}
 
+			ctx.Notifications().New(app.Notification{
+				Title: "Error",
+				Body:  body,
+			})
+		})
+	})
+}
+
+func (p *payment) closeReceipt(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+	p.receipt = Receipt{}
+}
+
+func (p *payment) toggleEscrow(ctx app.Context, e app.Event) {
+	p.escrow = ctx.JSSrc().Get("checked").Bool()
+}
+
+func (p *payment) startScan(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+	p.scanning = true
+	// the video element is there once the scanner is rendered
+	ctx.Defer(func(ctx app.Context) {
+		app.Window().Call("startScan")
+	})
+}
+
+func (p *payment) stopScan(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+	p.scanning = false
+	app.Window().Call("stopScan")
+}
+
+// pasteRequest reads a payment request pasted as text, for when there is no
+// camera.
+func (p *payment) pasteRequest(ctx app.Context, e app.Event) {
+	if p.scanning {
+		app.Window().Call("stopScan")
+	}
+	p.prefill(ctx, ctx.JSSrc().Get("value").String())
+}
+
+// prefill fills the payment form from a payment request. The payer still
+// checks the form and pays it.
+func (p *payment) prefill(ctx app.Context, uri string) {
+	p.scanning = false
+
+	req, err := parsePaymentRequest(uri)
+	if err != nil {
 		ctx.Notifications().New(app.Notification{
-			Title: "Success",
-			Body:  "Payment successful!",
+			Title: "Error",
+			Body:  "This is not a payment request.",
+		})
+		return
+	}
+
+	if len(req.InvoiceID) > 0 {
+		p.invoiceID = req.InvoiceID
+		p.getInvoice(ctx)
+		return
+	}
+
+	known := false
+	for _, ub := range p.userBalances {
+		if ub.ID == req.ReceiverID {
+			known = true
+			break
+		}
+	}
+	if !known {
+		ctx.Notifications().New(app.Notification{
+			Title: "Error",
+			Body:  "The receiver of this payment request has no wallet.",
 		})
+		return
+	}
+
+	p.intentID = uuid.NewString()
+	if req.Amount > 0 {
+		p.productsIndex = []int{1}
+		p.products = []ProductService{{Name: "In-store purchase", Price: req.Amount, Amount: 1}}
+	}
+
+	// the form inputs are not bound to the fields, so they are set once
+	// rendered
+	ctx.Defer(func(ctx app.Context) {
+		app.Window().GetElementByID("receiver-id").Set("value", req.ReceiverID)
+		if req.Amount > 0 {
+			app.Window().GetElementByID("tab-product").Call("click")
+			app.Window().GetElementByID("product-name-0").Set("value", p.products[0].Name)
+			app.Window().GetElementByID("product-price-0").Set("value", p.products[0].Price.String())
+			app.Window().GetElementByID("product-amount-0").Set("value", p.products[0].Amount)
+		}
+	})
+}
+
+func (p *payment) openInvoice(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+	p.getInvoice(ctx)
+}
+
+// getInvoice loads the invoice whose ID was entered.
+func (p *payment) getInvoice(ctx app.Context) {
+	id := strings.TrimSpace(p.invoiceID)
+	if len(id) == 0 {
+		return
+	}
+
+	ctx.Async(func() {
+		inv, err := p.store.Invoice(id)
+		if errors.Is(err, ErrNotFound) {
+			ctx.Dispatch(func(ctx app.Context) {
+				ctx.Notifications().New(app.Notification{
+					Title: "Error",
+					Body:  "There is no invoice with this ID.",
+				})
+			})
+			return
+		} else if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx.Dispatch(func(ctx app.Context) {
+			p.invoice = inv
+		})
+	})
+}
+
+// approveInvoice pays the invoice that was opened. The invoice sets the
+// receiver, the items, the taxes and the total.
+func (p *payment) approveInvoice(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+
+	inv := p.invoice
+	payerType := entityIndividual
+	if p.isBusiness {
+		payerType = entityBusiness
 	}
+
+	ctx.Async(func() {
+		transaction, postings, err := invoicePayment(p.store, p.ledger, inv, p.userID, payerType, time.Now())
+		if err == nil {
+			// a resubmitted intent is settled only once
+			_, err = submitPayment(p.store, p.ledger, newPaymentIntent(transaction, postings))
+		}
+		if err == nil {
+			syncErr := syncCountryWallets(p.store, p.ledger, transaction.Taxes)
+			if syncErr != nil {
+				log.Println(syncErr)
+			}
+		}
+
+		ctx.Dispatch(func(ctx app.Context) {
+			var body string
+			switch {
+			case err == nil:
+				p.userBalance.Balance = p.userBalance.Balance - transaction.TotalCost
+				p.invoice = Invoice{}
+				p.invoiceID = ""
+				ctx.Notifications().New(app.Notification{
+					Title: "Success",
+					Body:  "Invoice paid!",
+				})
+				return
+			case errors.Is(err, ErrInsufficientFunds):
+				body = "Not enough funds."
+			case errors.Is(err, ErrUnauthorizedKey):
+				body = "This device is not registered for your wallet. Log in again."
+			case errors.Is(err, ErrForkedChain):
+				body = "Your wallet is frozen, it signed two conflicting payments."
+			case errors.Is(err, ErrInvoicePaid):
+				body = "This invoice was already paid."
+			case errors.Is(err, ErrInvoiceExpired):
+				body = "This invoice expired."
+			case errors.Is(err, ErrInvoiceBuyer):
+				body = "This invoice was issued to someone else."
+			case errors.Is(err, ErrAccountClosed):
+				body = "The merchant deleted their account."
+			case errors.Is(err, ErrInvalidSignature), errors.Is(err, ErrInvoiceTaxes):
+				body = "This invoice is not valid."
+			default:
+				log.Println(err)
+				body = "Payment is pending. Approve it again to retry."
+			}
+
+			ctx.Notifications().New(app.Notification{
+				Title: "Error",
+				Body:  body,
+			})
+		})
+	})
 }
 
 // The Render method is where the component appearance is defined. Here, a
@@ -427,16 +640,37 @@ func (p *payment) Render() app.UI {
 						app.Span().Text("Balance"),
 					),
 					app.Div().Class("summary-balance").Body(
-						app.Span().Text(strconv.Itoa(p.userBalance.Balance/100)+" GUBI"),
+						app.Span().Text(p.userBalance.Balance.gubi()),
 					),
 				),
 			),
 			app.Div().ID("content").Body(
+				app.Div().Class("card").Body(
+					app.Div().Class("upper-row").Body(
+						app.Div().Class("card-item").Body(
+							app.Span().Class("span-header").Text("Scan to Pay"),
+							app.If(p.scanning, func() app.UI {
+								return app.Div().Class("scanner").Body(
+									app.Video().ID("scan-video").AutoPlay(true).Muted(true),
+									app.Canvas().ID("scan-canvas").Hidden(true),
+									app.Input().ID("payment-request").Class("product").Type("text").Name("payment-request").Placeholder("Or paste a gubi:pay link").OnChange(p.pasteRequest),
+									app.Div().Class("menu-btn").Body(
+										app.Button().Class("submit").Text("Cancel").OnClick(p.stopScan),
+									),
+								)
+							}).Else(func() app.UI {
+								return app.Div().Class("menu-btn").Body(
+									app.Button().Class("submit").Text("Scan QR").OnClick(p.startScan),
+								)
+							}),
+						),
+					),
+				),
 				app.Div().Class("card").Body(
 					app.Div().Class("upper-row").Body(
 						app.Div().Class("card-item").Body(
 							app.Span().Class("span-header").Text("Make Payment"),
-							app.Form().ID("pay-form").Body(
+							app.Form().ID("pay-form").OnInput(p.newIntent).Body(
 								app.Label().For("receiver-id").Text("Receiver ID:"),
 								app.Select().ID("receiver-id").Name("receiver-id").Body(
 									app.Range(p.userBalances).Slice(func(i int) app.UI {
@@ -470,7 +704,7 @@ func (p *payment) Render() app.UI {
 										app.Range(p.productsIndex).Slice(func(i int) app.UI {
 											return app.Div().Body(
 												app.Input().ID("product-name-"+strconv.Itoa(i)).Class("product").Type("text").Name("product-name").Placeholder("Product name").Required(true).OnChange(p.ValueTo(&p.products[i].Name)),
-												app.Input().ID("product-price-"+strconv.Itoa(i)).Class("product").Type("number").Min(1).Name("product-price").Placeholder("Single price").Required(true).OnChange(p.ValueTo(&p.products[i].Price)),
+												app.Input().ID("product-price-"+strconv.Itoa(i)).Class("product").Type("number").Min(0.01).Step(0.01).Name("product-price").Placeholder("Single price").Required(true).OnChange(moneyTo(&p.products[i].Price)),
 												app.Input().ID("product-amount-"+strconv.Itoa(i)).Class("product").Type("number").Min(1).Name("product-amount").Step(1).Placeholder("Number of products").Required(true).OnChange(p.ValueTo(&p.products[i].Amount)),
 											)
 										}),
@@ -483,7 +717,7 @@ func (p *payment) Render() app.UI {
 										app.Range(p.servicesIndex).Slice(func(i int) app.UI {
 											return app.Div().Body(
 												app.Input().ID("service-name").Class("service").Type("text").Name("service-name").Placeholder("Service name").OnChange(p.ValueTo(&p.services[i].Name)),
-												app.Input().ID("service-price").Class("service").Type("number").Min(1).Name("service-price").Placeholder("Price per hour").OnChange(p.ValueTo(&p.services[i].Price)),
+												app.Input().ID("service-price").Class("service").Type("number").Min(0.01).Step(0.01).Name("service-price").Placeholder("Price per hour").OnChange(moneyTo(&p.services[i].Price)),
 												app.Input().ID("service-amount").Class("service").Type("number").Min(1).Name("service-amount").Step(1).Placeholder("Number of hours").OnChange(p.ValueTo(&p.services[i].Amount)),
 											)
 										}),
@@ -503,6 +737,13 @@ func (p *payment) Render() app.UI {
 										}),
 									)
 								}),
+								app.Div().Class("escrow").Body(
+									app.Input().ID("escrow").Type("checkbox").Name("escrow").Checked(p.escrow).OnChange(p.toggleEscrow),
+									app.Label().For("escrow").Text("Hold in escrow until delivery"),
+									app.If(p.escrow, func() app.UI {
+										return app.Input().ID("escrow-days").Class("product").Type("number").Min(1).Step(1).Name("escrow-days").Placeholder("Days to confirm delivery").Value(p.escrowDays).Required(true).OnChange(p.ValueTo(&p.escrowDays))
+									}),
+								),
 								app.Div().Class("drawer drawer-pay").Body(
 									app.Div().Class("menu-btn").Body(
 										app.Button().Class("submit").Type("submit").Text("Pay").OnClick(p.doPayment),
@@ -512,6 +753,139 @@ func (p *payment) Render() app.UI {
 						),
 					),
 				),
+				app.Div().Class("card").Body(
+					app.Div().Class("upper-row").Body(
+						app.Div().Class("card-item").Body(
+							app.Span().Class("span-header").Text("Split Payment"),
+							app.Form().ID("split-form").OnInput(p.newSplitIntent).Body(
+								app.Range(p.splitLines).Slice(func(i int) app.UI {
+									return app.Div().Body(
+										app.Select().Class("product").Name("split-receiver").Required(true).OnChange(p.ValueTo(&p.splitLines[i].ReceiverID)).Body(
+											app.Option().Value("").Text("Receiver ID"),
+											app.Range(p.userBalances).Slice(func(n int) app.UI {
+												return app.Option().Value(p.userBalances[n].ID).Text(p.userBalances[n].ID)
+											}),
+										),
+										app.Input().Class("product").Type("text").Name("split-name").Placeholder("Item name").Required(true).OnChange(p.ValueTo(&p.splitLines[i].Item.Name)),
+										app.Input().Class("product").Type("number").Min(0.01).Step(0.01).Name("split-price").Placeholder("Single price").Required(true).OnChange(moneyTo(&p.splitLines[i].Item.Price)),
+										app.Input().Class("product").Type("number").Min(1).Step(1).Name("split-amount").Placeholder("Quantity").Required(true).OnChange(p.ValueTo(&p.splitLines[i].Item.Amount)),
+									)
+								}),
+								app.Div().Class("menu-btn menu-add-item").Body(
+									app.Button().Class("submit").Text("+").OnClick(p.addSplitLine),
+									app.If(len(p.splitLines) > 1, func() app.UI {
+										return app.Button().Class("submit").Text("-").OnClick(p.removeSplitLine)
+									}),
+								),
+								app.Div().Class("menu-btn").Body(
+									app.Button().Class("submit").Type("submit").Text("Pay All").OnClick(p.doSplit),
+								),
+							),
+						),
+					),
+				),
+				app.If(len(p.receipt.GroupID) > 0, func() app.UI {
+					return app.Div().Class("transactions").Body(
+						app.Span().Class("t-desc").Text("Receipt "+p.receipt.GroupID),
+						app.Range(p.receipt.Transactions).Slice(func(i int) app.UI {
+							t := p.receipt.Transactions[i]
+							return app.Div().Class("transaction").Body(
+								app.Div().Class("t-details").Body(
+									app.Div().Class("t-title").Body(
+										app.Span().Text(t.ReceiverID),
+									),
+									app.Range(t.ProductsServices).Slice(func(n int) app.UI {
+										return app.Div().Class("t-time").Body(
+											app.Span().Text(t.ProductsServices[n].Name + " " + strconv.Itoa(t.ProductsServices[n].Amount) + " x " + t.ProductsServices[n].Price.gubi()),
+										)
+									}),
+									app.Range(t.Taxes).Slice(func(n int) app.UI {
+										return app.Div().Class("t-time").Body(
+											app.Span().Text(strings.ToUpper(t.Taxes[n].Type) + " " + t.Taxes[n].CountryCode + " " + t.Taxes[n].Amount.gubi()),
+										)
+									}),
+								),
+								app.Div().Class("t-price").Body(
+									app.Span().Text(t.TotalCost.gubi()),
+								),
+							).Style("height", "auto").Style("pointer-events", "none")
+						}),
+						app.Div().Class("transaction").Body(
+							app.Div().Class("t-details").Body(
+								app.Div().Class("t-title").Body(
+									app.Span().Text("Total"),
+								),
+							),
+							app.Div().Class("t-price").Body(
+								app.Span().Text(p.receipt.Total.gubi()),
+							),
+						).Style("pointer-events", "none"),
+						app.Div().Class("menu-btn").Body(
+							app.Button().Class("submit").Text("Done").OnClick(p.closeReceipt),
+						),
+					)
+				}),
+				app.Div().Class("card").Body(
+					app.Div().Class("upper-row").Body(
+						app.Div().Class("card-item").Body(
+							app.Span().Class("span-header").Text("Pay Invoice"),
+							app.Form().ID("invoice-form").Body(
+								app.Input().ID("invoice-id").Class("product").Type("text").Name("invoice-id").Placeholder("Invoice ID").Value(p.invoiceID).Required(true).OnChange(p.ValueTo(&p.invoiceID)),
+								app.Div().Class("menu-btn").Body(
+									app.Button().Class("submit").Type("submit").Text("Open").OnClick(p.openInvoice),
+								),
+							),
+						),
+					),
+				),
+				app.If(len(p.invoice.ID) > 0, func() app.UI {
+					return app.Div().Class("transactions").Body(
+						app.Span().Class("t-desc").Text("Invoice from "+p.invoice.MerchantID),
+						app.Range(p.invoice.Items).Slice(func(i int) app.UI {
+							return app.Div().Class("transaction").Body(
+								app.Div().Class("t-details").Body(
+									app.Div().Class("t-title").Body(
+										app.Span().Text(p.invoice.Items[i].Name),
+									),
+									app.Div().Class("t-time").Body(
+										app.Span().Text(strconv.Itoa(p.invoice.Items[i].Amount)+" x "+p.invoice.Items[i].Price.gubi()),
+									),
+								),
+								app.Div().Class("t-price").Body(
+									app.Span().Text(p.invoice.Items[i].Price.times(p.invoice.Items[i].Amount).gubi()),
+								),
+							).Style("pointer-events", "none")
+						}),
+						app.Range(p.invoice.Taxes).Slice(func(i int) app.UI {
+							return app.Div().Class("transaction").Body(
+								app.Div().Class("t-details").Body(
+									app.Div().Class("t-title").Body(
+										app.Span().Text(strings.ToUpper(p.invoice.Taxes[i].Type)+" "+(p.invoice.Taxes[i].Rate*100).String()+"%"),
+									),
+								),
+								app.Div().Class("t-price").Body(
+									app.Span().Text(p.invoice.Taxes[i].Amount.gubi()),
+								),
+							).Style("pointer-events", "none")
+						}),
+						app.Div().Class("transaction").Body(
+							app.Div().Class("t-details").Body(
+								app.Div().Class("t-title").Body(
+									app.Span().Text("Total"),
+								),
+								app.Div().Class("t-time").Body(
+									app.Span().Text("Expires "+p.invoice.ExpiresAt.Local().Format("2006-01-02 15:04")),
+								),
+							),
+							app.Div().Class("t-price").Body(
+								app.Span().Text(p.invoice.Total.gubi()),
+							),
+						).Style("pointer-events", "none"),
+						app.Div().Class("menu-btn").Body(
+							app.Button().Class("submit").Type("submit").Text("Approve").OnClick(p.approveInvoice),
+						),
+					)
+				}),
 			),
 		),
 	)
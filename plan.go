@@ -1,40 +1,137 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"log"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/maxence-charriere/go-app/v10/pkg/app"
-	shell "github.com/stateless-minds/go-ipfs-api"
 )
 
 const dbPlan = "plan"
 
+// ErrIntervalChange is returned when the billing interval of a plan with
+// subscribers is changed.
+var ErrIntervalChange = errors.New("the plan has subscribers, its billing interval cannot change")
+
+// Billing intervals of a plan.
+const (
+	IntervalMonth = "month"
+	IntervalYear  = "year"
+)
+
 // plan is a component that holds cyber-gubi. A component is a
 // customizable, independent, and reusable UI element. It is created by
 // embedding app.Compo into a struct.
 type plan struct {
 	app.Compo
-	sh           *shell.Shell
+	store        Store
 	loggedIn     bool
 	userID       string
 	businessName string
-	price        int
-	plan         Plan
+	plans        []Plan
+	plan         Plan // Plan being edited, empty for a new one
+	tier         string
+	interval     string
+	price        Money
+	description  string
+	items        string
+	limit        int
 }
 
+// Plan is a tier of the catalog of a business, such as basic or family,
+// billed monthly or yearly.
 type Plan struct {
-	ID        string `mapstructure:"_id" json:"_id" validate:"uuid_rfc4122"`               // Unique identifier for the transaction
-	Name      string `mapstructure:"name" json:"name" validate:"uuid_rfc4122"`             // Business name
-	Price     int    `mapstructure:"price" json:"price" validate:"uuid_rfc4122"`           // Monthly recurring price
-	CreatedBy string `mapstructure:"created_by" json:"created_by" validate:"uuid_rfc4122"` // User ID of business who created it
+	ID          string    `mapstructure:"_id" json:"_id" validate:"uuid_rfc4122"`                   // Unique identifier for the transaction
+	Name        string    `mapstructure:"name" json:"name" validate:"uuid_rfc4122"`                 // Business name
+	Tier        string    `mapstructure:"tier" json:"tier" validate:"uuid_rfc4122"`                 // Name of the tier, such as basic or family
+	Interval    string    `mapstructure:"interval" json:"interval" validate:"uuid_rfc4122"`         // Billing interval, month or year
+	Description string    `mapstructure:"description" json:"description" validate:"uuid_rfc4122"`   // What the tier offers
+	Items       []string  `mapstructure:"items" json:"items" validate:"uuid_rfc4122"`               // Products or services included
+	Limit       int       `mapstructure:"limit" json:"limit" validate:"uuid_rfc4122"`               // Uses included per billing interval, 0 for unlimited
+	Price       Money     `mapstructure:"price" json:"price" validate:"uuid_rfc4122"`               // Recurring price per billing interval
+	CreatedBy   string    `mapstructure:"created_by" json:"created_by" validate:"uuid_rfc4122"`     // User ID of business who created it
+	PriceChange time.Time `mapstructure:"price_change" json:"price_change" validate:"uuid_rfc4122"` // Time the price was last changed
+}
+
+// title returns the name of the business and of the tier.
+func (p Plan) title() string {
+	if len(p.Tier) == 0 {
+		return p.Name
+	}
+	return p.Name + " - " + p.Tier
+}
+
+// per returns the price with its billing interval for display.
+func (p Plan) per() string {
+	return p.Price.gubi() + " / " + intervalOf(p.Interval)
+}
+
+// usage returns the usage limit for display.
+func (p Plan) usage() string {
+	if p.Limit == 0 {
+		return "Unlimited use"
+	}
+	return "Up to " + strconv.Itoa(p.Limit) + " uses a " + intervalOf(p.Interval)
+}
+
+// monthly returns the price of the subscription per month, rounded down to
+// the cent.
+func (s Subscription) monthly() Money {
+	if intervalOf(s.Interval) == IntervalYear {
+		return s.Price.share(1, 12)
+	}
+	return s.Price
+}
+
+// intervalOf returns the billing interval, plans made before tiers being
+// monthly.
+func intervalOf(interval string) string {
+	if interval == IntervalYear {
+		return IntervalYear
+	}
+	return IntervalMonth
+}
+
+// nextPeriod returns the end of the billing interval that starts at t.
+func nextPeriod(interval string, t time.Time) time.Time {
+	if intervalOf(interval) == IntervalYear {
+		return t.AddDate(1, 0, 0)
+	}
+	return t.AddDate(0, 1, 0)
+}
+
+// subscribed reports whether the plan has a subscriber.
+func subscribed(store Store, planID string) (bool, error) {
+	subscriptions, err := store.Subscriptions()
+	if err != nil {
+		return false, err
+	}
+
+	for _, s := range subscriptions {
+		if s.PlanID == planID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// sortPlans orders plans by business, and the tiers of a business by price.
+func sortPlans(plans []Plan) {
+	sort.SliceStable(plans, func(a, b int) bool {
+		if plans[a].Name != plans[b].Name {
+			return plans[a].Name < plans[b].Name
+		}
+		return plans[a].Price < plans[b].Price
+	})
 }
 
 func (p *plan) OnMount(ctx app.Context) {
-	sh := shell.NewShell("localhost:5001")
-	p.sh = sh
+	p.store = newStore()
 
 	ctx.GetState("loggedIn", &p.loggedIn)
 	if !p.loggedIn {
@@ -43,9 +140,59 @@ func (p *plan) OnMount(ctx app.Context) {
 
 	ctx.GetState("userID", &p.userID)
 
-	ctx.ObserveState("plan", &p.plan)
-
 	ctx.ObserveState("businessName", &p.businessName)
+
+	p.interval = IntervalMonth
+	p.getPlans(ctx)
+}
+
+// getPlans loads the catalog of the business.
+func (p *plan) getPlans(ctx app.Context) {
+	ctx.Async(func() {
+		plans, err := p.store.PlansBy(p.userID)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		sortPlans(plans)
+
+		ctx.Dispatch(func(ctx app.Context) {
+			p.plans = plans
+		})
+	})
+}
+
+// editPlan fills the form with the plan the button is for.
+func (p *plan) editPlan(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+	n, err := strconv.Atoi(ctx.JSSrc().Get("value").String())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	p.plan = p.plans[n]
+	p.tier = p.plan.Tier
+	p.interval = intervalOf(p.plan.Interval)
+	p.price = p.plan.Price
+	p.description = p.plan.Description
+	p.items = strings.Join(p.plan.Items, "\n")
+	p.limit = p.plan.Limit
+}
+
+// newPlan empties the form for a new tier.
+func (p *plan) newPlan(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+	p.resetForm()
+}
+
+func (p *plan) resetForm() {
+	p.plan = Plan{}
+	p.tier = ""
+	p.interval = IntervalMonth
+	p.price = 0
+	p.description = ""
+	p.items = ""
+	p.limit = 0
 }
 
 func (p *plan) createPlan(ctx app.Context, e app.Event) {
@@ -57,36 +204,62 @@ func (p *plan) createPlan(ctx app.Context, e app.Event) {
 }
 
 func (p *plan) storePLan(ctx app.Context) {
+	items := []string{}
+	for _, item := range strings.Split(p.items, "\n") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+
+	created := len(p.plan.ID) == 0
+
+	plan := Plan{
+		ID:          p.plan.ID,
+		Name:        p.businessName,
+		Tier:        strings.TrimSpace(p.tier),
+		Interval:    intervalOf(p.interval),
+		Description: strings.TrimSpace(p.description),
+		Items:       items,
+		Limit:       p.limit,
+		Price:       p.price,
+		CreatedBy:   p.plan.CreatedBy,
+		PriceChange: p.plan.PriceChange,
+	}
+	if created {
+		plan.ID = uuid.NewString()
+		plan.CreatedBy = p.userID
+	} else if p.price != p.plan.Price {
+		// the subscribers are told and pay the new price from a later
+		// renewal
+		plan.PriceChange = time.Now()
+	}
+
 	ctx.Async(func() {
-		var plan Plan
-		if (p.plan == Plan{}) {
-			plan = Plan{
-				ID:        uuid.NewString(),
-				Name:      p.businessName,
-				Price:     p.price * 100,
-				CreatedBy: p.userID,
+		if !created && plan.Interval != intervalOf(p.plan.Interval) {
+			// renewals would charge the price of the new interval for the
+			// old one
+			found, err := subscribed(p.store, plan.ID)
+			if err != nil {
+				log.Fatal(err)
 			}
-		} else {
-			plan = Plan{
-				ID:        p.plan.ID,
-				Name:      p.businessName,
-				Price:     p.price * 100,
-				CreatedBy: p.plan.CreatedBy,
+			if found {
+				ctx.Dispatch(func(ctx app.Context) {
+					ctx.Notifications().New(app.Notification{
+						Title: "Error",
+						Body:  ErrIntervalChange.Error(),
+					})
+				})
+				return
 			}
 		}
 
-		planJSON, err := json.Marshal(plan)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		err = p.sh.OrbitDocsPut(dbPlan, planJSON)
+		err := p.store.PutPlan(plan)
 		if err != nil {
 			log.Fatal(err)
 		}
 
 		ctx.Dispatch(func(ctx app.Context) {
-			if (p.plan == Plan{}) {
+			if created {
 				ctx.Notifications().New(app.Notification{
 					Title: "Success",
 					Body:  "Plan created successfully!",
@@ -94,16 +267,47 @@ func (p *plan) storePLan(ctx app.Context) {
 			} else {
 				ctx.Notifications().New(app.Notification{
 					Title: "Success",
-					Body:  "Plan updated successfully!",
+					Body:  "Plan updated successfully! Subscribers pay a higher price from their first renewal after " + strconv.Itoa(int(priceNotice.Hours()/24)) + " days.",
 				})
 			}
-			ctx.Navigate("/wallet")
+			p.resetForm()
+			p.getPlans(ctx)
+		})
+	})
+}
+
+// deletePlan withdraws the plan the button is for. Its subscriptions are not
+// renewed anymore and end with the time paid for.
+func (p *plan) deletePlan(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+	n, err := strconv.Atoi(ctx.JSSrc().Get("value").String())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	id := p.plans[n].ID
+
+	ctx.Async(func() {
+		err := p.store.DeletePlan(id)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx.Dispatch(func(ctx app.Context) {
+			ctx.Notifications().New(app.Notification{
+				Title: "Success",
+				Body:  "Plan deleted. Its subscriptions end with the time paid for.",
+			})
+			if p.plan.ID == id {
+				p.resetForm()
+			}
+			p.getPlans(ctx)
 		})
 	})
 }
 
-// The Render method is where the component appearance is defined. Here, a
-// create plan form is displayed.
+// The Render method is where the component appearance is defined. Here, the
+// plan catalog and a plan form are displayed.
 func (p *plan) Render() app.UI {
 	return app.Div().Class("container").Body(
 		app.Div().Class("mobile").Body(
@@ -112,7 +316,7 @@ func (p *plan) Render() app.UI {
 				app.Div().Class("header-summary").Body(
 					app.Span().Class("logo").Text("cyber-gubi"),
 					app.Div().Class("summary-text").Body(
-						app.Span().Text("Plan"),
+						app.Span().Text("Plans"),
 					),
 				),
 			),
@@ -120,33 +324,89 @@ func (p *plan) Render() app.UI {
 				app.Div().Class("card").Body(
 					app.Div().Class("upper-row").Body(
 						app.Div().Class("card-item").Body(
-							app.If(p.plan == Plan{}, func() app.UI {
+							app.If(len(p.plan.ID) == 0, func() app.UI {
 								return app.Span().Class("span-header").Text("Create Plan")
 							}).Else(func() app.UI {
 								return app.Span().Class("span-header").Text("Update Plan")
 							}),
 							app.Form().ID("plan-form").Body(
 								app.Div().ID("plan").Body(
-									app.If(p.plan == Plan{}, func() app.UI {
-										return app.Div().Body(
-											app.Input().ID("plan-price").Class("product").Type("number").Min(1).Name("plan-price").Placeholder("Monthly amount").Required(true).OnChange(p.ValueTo(&p.price)),
-										)
+									app.Input().ID("plan-tier").Class("product").Type("text").Name("plan-tier").Placeholder("Tier, such as basic or family").Required(true).Value(p.tier).OnChange(p.ValueTo(&p.tier)),
+									app.Select().ID("plan-interval").Name("plan-interval").OnChange(p.ValueTo(&p.interval)).Body(
+										app.Option().Value(IntervalMonth).Text("Monthly").Selected(p.interval == IntervalMonth),
+										app.Option().Value(IntervalYear).Text("Yearly").Selected(p.interval == IntervalYear),
+									),
+									app.If(p.price == 0, func() app.UI {
+										return app.Input().ID("plan-price").Class("product").Type("number").Min(0.01).Step(0.01).Name("plan-price").Placeholder("Amount per interval").Required(true).OnChange(moneyTo(&p.price))
 									}).Else(func() app.UI {
-										return app.Div().Body(
-											app.Input().ID("plan-price").Class("product").Type("number").Min(1).Name("plan-price").Placeholder(strconv.Itoa(p.plan.Price / 100)).Required(true).OnChange(p.ValueTo(&p.price)),
-										)
+										return app.Input().ID("plan-price").Class("product").Type("number").Min(0.01).Step(0.01).Name("plan-price").Value(p.price.String()).Required(true).OnChange(moneyTo(&p.price))
 									}),
+									app.Textarea().ID("plan-description").Class("product").Name("plan-description").Placeholder("Description").Text(p.description).OnChange(p.ValueTo(&p.description)),
+									app.Textarea().ID("plan-items").Class("product").Name("plan-items").Placeholder("Included items, one per line").Text(p.items).OnChange(p.ValueTo(&p.items)),
+									app.Input().ID("plan-limit").Class("product").Type("number").Min(0).Step(1).Name("plan-limit").Placeholder("Uses per interval, empty for unlimited").Value(p.limitValue()).OnChange(p.ValueTo(&p.limit)),
 								),
 								app.Div().Class("drawer drawer-pay").Body(
 									app.Div().Class("menu-btn").Body(
 										app.Button().Class("submit").Type("submit").Text("Submit").OnClick(p.createPlan),
+										app.If(len(p.plan.ID) > 0, func() app.UI {
+											return app.Button().Class("submit").Text("New").OnClick(p.newPlan)
+										}),
 									),
 								),
 							),
 						),
 					),
 				),
+				app.Div().Class("subscriptions c-sub").Body(
+					app.Span().Class("s-desc").Text("Catalog"),
+					app.If(len(p.plans) == 0, func() app.UI {
+						return app.Div().Class("subscription").Body(
+							app.Span().Class("empty").Text("No plans yet"),
+						).Style("pointer-events", "none")
+					}),
+					app.Range(p.plans).Slice(func(i int) app.UI {
+						return app.Div().Class("subscription").Body(
+							app.Div().Class("s-details").Body(
+								app.Div().Class("s-title").Body(
+									app.Span().Text(p.plans[i].title()),
+								),
+								renderTier(p.plans[i]),
+								app.Div().Class("menu-btn menu-sub").Body(
+									app.Button().Class("submit submit-sub").Text("Edit").Value(i).OnClick(p.editPlan),
+									app.Button().Class("submit submit-sub").Text("Delete").Value(i).OnClick(p.deletePlan),
+								),
+							),
+							app.Div().Class("s-price").Body(
+								app.Span().Text(p.plans[i].per()),
+							),
+						)
+					}),
+				),
 			),
 		),
 	)
 }
+
+func (p *plan) limitValue() string {
+	if p.limit == 0 {
+		return ""
+	}
+	return strconv.Itoa(p.limit)
+}
+
+// renderTier shows what a plan offers.
+func renderTier(plan Plan) app.UI {
+	return app.Div().Class("s-time s-tier").Body(
+		app.If(len(plan.Description) > 0, func() app.UI {
+			return app.Span().Text(plan.Description)
+		}),
+		app.If(len(plan.Items) > 0, func() app.UI {
+			return app.Ul().Body(
+				app.Range(plan.Items).Slice(func(i int) app.UI {
+					return app.Li().Text(plan.Items[i])
+				}),
+			)
+		}),
+		app.Span().Text(plan.usage()),
+	)
+}
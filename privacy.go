@@ -33,6 +33,7 @@ func (p *privacy) Render() app.UI {
 							app.Span().Class("span-docs").Text("4. It is stored encrypted as public data on IPFS."),
 							app.Span().Class("span-docs").Text("5. You can delete your account and biometrics data anytime."),
 							app.Span().Class("span-docs").Text("6. All user content generated on the platform is public and not owned by anyone."),
+							app.Span().Class("span-docs").Text("7. You can download all the data kept under your wallet from the menu anytime."),
 						),
 					),
 				),
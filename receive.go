@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/maxence-charriere/go-app/v10/pkg/app"
+)
+
+// paymentScheme is the URI scheme of payment requests.
+const paymentScheme = "gubi"
+
+var ErrInvalidPaymentRequest = errors.New("invalid payment request")
+
+// PaymentRequest is what a merchant asks to be paid at the counter. It is
+// shown as a QR code holding a URI such as
+//
+//	gubi:pay?amount=12.99&invoice=<invoice id>&to=<receiver id>
+//
+// The amount is the price before tax, as taxes are added as for any other
+// payment. An invoice, when given, sets the bill instead of the amount.
+type PaymentRequest struct {
+	ReceiverID string
+	Amount     Money  // Price in cents, 0 to let the payer enter it
+	InvoiceID  string // Invoice to pay, if any
+}
+
+// uri returns the request in the gubi:pay URI scheme.
+func (r PaymentRequest) uri() string {
+	q := url.Values{}
+	q.Set("to", r.ReceiverID)
+	if r.Amount > 0 {
+		q.Set("amount", r.Amount.String())
+	}
+	if len(r.InvoiceID) > 0 {
+		q.Set("invoice", r.InvoiceID)
+	}
+
+	u := url.URL{Scheme: paymentScheme, Opaque: "pay", RawQuery: q.Encode()}
+	return u.String()
+}
+
+// parsePaymentRequest reads a gubi:pay URI.
+func parsePaymentRequest(s string) (PaymentRequest, error) {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil || u.Scheme != paymentScheme || u.Opaque != "pay" {
+		return PaymentRequest{}, ErrInvalidPaymentRequest
+	}
+
+	q := u.Query()
+	r := PaymentRequest{
+		ReceiverID: q.Get("to"),
+		InvoiceID:  q.Get("invoice"),
+	}
+
+	if _, err := uuid.Parse(r.ReceiverID); err != nil {
+		return PaymentRequest{}, ErrInvalidPaymentRequest
+	}
+	if len(r.InvoiceID) > 0 {
+		if _, err := uuid.Parse(r.InvoiceID); err != nil {
+			return PaymentRequest{}, ErrInvalidPaymentRequest
+		}
+	}
+
+	if amount := q.Get("amount"); len(amount) > 0 {
+		r.Amount, err = parseMoney(amount)
+		if err != nil || r.Amount <= 0 {
+			return PaymentRequest{}, ErrInvalidPaymentRequest
+		}
+	}
+
+	return r, nil
+}
+
+// qrCode draws text as a QR code with the qrcode-generator script and
+// returns it as an image URL.
+func qrCode(text string) string {
+	qr := app.Window().Call("qrcode", 0, "M")
+	qr.Call("addData", text)
+	qr.Call("make")
+	return qr.Call("createDataURL", 6, 4).String()
+}
+
+// receive is a component that shows a payment request as a QR code for the
+// payer to scan. A component is a customizable, independent, and reusable
+// UI element. It is created by embedding app.Compo into a struct.
+type receive struct {
+	app.Compo
+	store       Store
+	ledger      *ledger
+	loggedIn    bool
+	userID      string
+	userBalance UserBalance
+	amount      Money
+	invoiceID   string
+	invoices    []Invoice
+	request     PaymentRequest
+	qr          string
+}
+
+func (r *receive) OnMount(ctx app.Context) {
+	r.store = newStore()
+	r.ledger = newLedger(r.store, signingKey(ctx))
+
+	ctx.GetState("loggedIn", &r.loggedIn)
+	if !r.loggedIn {
+		ctx.Navigate("/auth")
+	}
+
+	ctx.GetState("userID", &r.userID)
+	ctx.GetState("balance", &r.userBalance)
+
+	r.getInvoices(ctx)
+}
+
+// getInvoices loads the invoices of the merchant that can still be paid.
+func (r *receive) getInvoices(ctx app.Context) {
+	ctx.Async(func() {
+		all, err := r.store.InvoicesBy(r.userID)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		state, err := r.ledger.state()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		invoices := []Invoice{}
+		for _, inv := range all {
+			if invoiceStatus(state, inv, time.Now()) == InvoiceOpen {
+				invoices = append(invoices, inv)
+			}
+		}
+
+		sort.Slice(invoices, func(a, b int) bool {
+			return invoices[a].CreatedAt.After(invoices[b].CreatedAt)
+		})
+
+		ctx.Dispatch(func(ctx app.Context) {
+			r.invoices = invoices
+		})
+	})
+}
+
+func (r *receive) showCode(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+
+	valid := app.Window().GetElementByID("receive-form").Call("reportValidity").Bool()
+	if !valid {
+		return
+	}
+
+	r.request = PaymentRequest{
+		ReceiverID: r.userID,
+		Amount:     r.amount,
+		InvoiceID:  r.invoiceID,
+	}
+	if len(r.invoiceID) > 0 {
+		r.request.Amount = 0
+	}
+	r.qr = qrCode(r.request.uri())
+}
+
+func (r *receive) clearCode(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+	r.request = PaymentRequest{}
+	r.qr = ""
+}
+
+// The Render method is where the component appearance is defined. Here, a
+// payment request is displayed.
+func (r *receive) Render() app.UI {
+	return app.Div().Class("container").Body(
+		app.Div().Class("mobile").Body(
+			app.Div().Class("header").Body(
+				newNav(),
+				app.Div().Class("header-summary").Body(
+					app.Span().Class("logo").Text("cyber-gubi"),
+					app.Div().Class("summary-text").Body(
+						app.Span().Text("Balance"),
+					),
+					app.Div().Class("summary-balance").Body(
+						app.Span().Text(r.userBalance.Balance.gubi()),
+					),
+				),
+			),
+			app.Div().ID("content").Body(
+				app.If(len(r.qr) == 0, func() app.UI {
+					return app.Div().Class("card").Body(
+						app.Div().Class("upper-row").Body(
+							app.Div().Class("card-item").Body(
+								app.Span().Class("span-header").Text("Receive Payment"),
+								app.Form().ID("receive-form").Body(
+									app.Input().ID("receive-amount").Class("product").Type("number").Min(0.01).Step(0.01).Name("receive-amount").Placeholder("Amount before tax, empty for any").OnChange(moneyTo(&r.amount)),
+									app.Label().For("receive-invoice").Text("Invoice:"),
+									app.Select().ID("receive-invoice").Name("receive-invoice").OnChange(r.ValueTo(&r.invoiceID)).Body(
+										app.Option().Value("").Text("No invoice"),
+										app.Range(r.invoices).Slice(func(i int) app.UI {
+											return app.Option().Value(r.invoices[i].ID).Text(r.invoices[i].Total.gubi() + " - " + r.invoices[i].ID)
+										}),
+									),
+									app.Div().Class("menu-btn").Body(
+										app.Button().Class("submit").Type("submit").Text("Show QR").OnClick(r.showCode),
+									),
+								),
+							),
+						),
+					)
+				}).Else(func() app.UI {
+					return app.Div().Class("card").Body(
+						app.Div().Class("upper-row").Body(
+							app.Div().Class("card-item").Body(
+								app.Span().Class("span-header").Text("Scan to Pay"),
+								app.Img().Class("qr").Src(r.qr).Alt(r.request.uri()),
+								app.If(len(r.request.InvoiceID) > 0, func() app.UI {
+									return app.Span().Class("span-body").Text("Invoice " + r.request.InvoiceID)
+								}).ElseIf(r.request.Amount > 0, func() app.UI {
+									return app.Span().Class("span-body").Text(r.request.Amount.gubi() + " before tax")
+								}),
+								app.Div().Class("menu-btn").Body(
+									app.Button().Class("submit").Text("Done").OnClick(r.clearCode),
+								),
+							),
+						),
+					)
+				}),
+			),
+		),
+	)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotRefundable = errors.New("transaction cannot be refunded")
+	ErrEmptyRefund   = errors.New("no line selected for refund")
+	ErrOverRefund    = errors.New("refund exceeds the quantity left to refund")
+)
+
+// refundsOf returns the refunds already made on a transaction.
+func refundsOf(store Store, original Transaction) ([]Transaction, error) {
+	all, err := store.Transactions(original.ReceiverID)
+	if err != nil {
+		return nil, err
+	}
+
+	// a transaction can be stored by several peers
+	seen := map[string]bool{}
+	refunds := []Transaction{}
+	for _, t := range all {
+		if t.RefundOf == original.ID && !seen[t.ID] {
+			seen[t.ID] = true
+			refunds = append(refunds, t)
+		}
+	}
+
+	return refunds, nil
+}
+
+// refundable returns the quantity of every line of a transaction, by item
+// ID, that was not refunded yet.
+func refundable(store Store, original Transaction) (map[string]int, error) {
+	refunds, err := refundsOf(store, original)
+	if err != nil {
+		return nil, err
+	}
+
+	left := map[string]int{}
+	for _, ps := range original.ProductsServices {
+		left[ps.ID] += ps.Amount
+	}
+	for _, r := range refunds {
+		for _, ps := range r.ProductsServices {
+			left[ps.ID] -= ps.Amount
+		}
+	}
+
+	return left, nil
+}
+
+// refundTaxes returns the share of the taxes of a transaction that goes back
+// with net cents of its price, when before cents were refunded already. The
+// shares are taken on the running total, so the roundings never add up to
+// more than was collected and a full refund gives back all of it.
+func refundTaxes(original Transaction, before, net Money) []TaxLine {
+	total := Sale{Items: original.ProductsServices}.net()
+
+	taxes := []TaxLine{}
+	for _, tax := range original.Taxes {
+		line := tax
+		line.Amount = tax.Amount.share(int64(before+net), int64(total)) - tax.Amount.share(int64(before), int64(total))
+		if line.Amount > 0 {
+			taxes = append(taxes, line)
+		}
+	}
+
+	return taxes
+}
+
+// newRefund returns the refund of the given quantities of the lines of a
+// sale, by item ID, and the postings that settle it. The seller pays back
+// the price less the tax it never got, and every country pays back its
+// share of the tax, so the buyer gets back what they paid for those lines.
+func newRefund(store Store, original Transaction, sellerID string, quantities map[string]int, id string, now time.Time) (Transaction, []Posting, error) {
+	if original.ReceiverID != sellerID || len(original.RefundOf) > 0 || isSystemAccount(original.SenderID) || isSystemAccount(original.ReceiverID) {
+		return Transaction{}, nil, ErrNotRefundable
+	}
+
+	deleted, err := closed(store, original.SenderID)
+	if err != nil {
+		return Transaction{}, nil, err
+	}
+	if deleted {
+		return Transaction{}, nil, ErrAccountClosed
+	}
+
+	left, err := refundable(store, original)
+	if err != nil {
+		return Transaction{}, nil, err
+	}
+
+	items := []ProductService{}
+	for _, ps := range original.ProductsServices {
+		quantity := quantities[ps.ID]
+		if quantity <= 0 {
+			continue
+		}
+		if quantity > left[ps.ID] {
+			return Transaction{}, nil, ErrOverRefund
+		}
+
+		ps.Amount = quantity
+		items = append(items, ps)
+	}
+	if len(items) == 0 {
+		return Transaction{}, nil, ErrEmptyRefund
+	}
+
+	var before Money
+	for _, ps := range original.ProductsServices {
+		before += ps.Price.times(ps.Amount - left[ps.ID])
+	}
+
+	net := Sale{Items: items}.net()
+	taxes := refundTaxes(original, before, net)
+
+	// the postings of the sale turned around
+	postings := salePostings(original.SenderID, original.ReceiverID, net, taxes)
+	for i := range postings {
+		postings[i].Amount = -postings[i].Amount
+	}
+
+	transaction := Transaction{
+		ID:               id,
+		SenderID:         original.ReceiverID,
+		ReceiverID:       original.SenderID,
+		RefundOf:         original.ID,
+		ProductsServices: items,
+		Taxes:            taxes,
+		TotalCost:        saleTotal(net, taxes),
+		Timestamp:        now,
+		Date:             periodOf(now),
+	}
+
+	return transaction, postings, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNewRefund(t *testing.T) {
+	now := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	sale := Transaction{
+		ID:         "sale",
+		SenderID:   "alice",
+		ReceiverID: "bob",
+		ProductsServices: []ProductService{
+			{ID: "a", Name: "bread", Price: 100, Amount: 3},
+			{ID: "b", Name: "milk", Price: 200, Amount: 1},
+		},
+		Taxes:     []TaxLine{{CountryCode: "DE", Type: "vat", Amount: 95}},
+		TotalCost: 595,
+	}
+
+	tests := []struct {
+		name       string
+		original   Transaction
+		seller     string
+		refunded   []map[string]int // refunds made before
+		quantities map[string]int
+		wantErr    error
+		wantTax    Money
+		wantTotal  Money
+	}{
+		{"whole sale", sale, "bob", nil, map[string]int{"a": 3, "b": 1}, nil, 95, 595},
+		{"one line", sale, "bob", nil, map[string]int{"b": 1}, nil, 38, 238},
+		{"part of a line", sale, "bob", nil, map[string]int{"a": 1}, nil, 19, 119},
+		{"rest after a partial refund", sale, "bob", []map[string]int{{"a": 1}}, map[string]int{"a": 2, "b": 1}, nil, 76, 476},
+		{"more than left", sale, "bob", []map[string]int{{"a": 2}}, map[string]int{"a": 2}, ErrOverRefund, 0, 0},
+		{"more than sold", sale, "bob", nil, map[string]int{"b": 2}, ErrOverRefund, 0, 0},
+		{"nothing selected", sale, "bob", nil, map[string]int{"a": 0, "c": 1}, ErrEmptyRefund, 0, 0},
+		{"by someone else than the seller", sale, "carol", nil, map[string]int{"a": 1}, ErrNotRefundable, 0, 0},
+		{"of a refund", Transaction{ID: "r", SenderID: "bob", ReceiverID: "alice", RefundOf: "sale"}, "alice", nil, map[string]int{"a": 1}, ErrNotRefundable, 0, 0},
+		{"of an income", Transaction{ID: "i", SenderID: accountEmission, ReceiverID: "alice"}, "alice", nil, map[string]int{"a": 1}, ErrNotRefundable, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryStore()
+			for i, quantities := range tt.refunded {
+				refund, _, err := newRefund(store, tt.original, tt.seller, quantities, "before"+strconv.Itoa(i), now)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := store.PutTransaction(refund); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			refund, postings, err := newRefund(store, tt.original, tt.seller, tt.quantities, "refund", now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("newRefund() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			var tax Money
+			for _, line := range refund.Taxes {
+				tax += line.Amount
+			}
+			if tax != tt.wantTax || refund.TotalCost != tt.wantTotal {
+				t.Errorf("newRefund() tax %v total %v, want %v %v", tax, refund.TotalCost, tt.wantTax, tt.wantTotal)
+			}
+			if refund.RefundOf != sale.ID || refund.SenderID != "bob" || refund.ReceiverID != "alice" {
+				t.Errorf("newRefund() = %+v, want a refund of the sale from bob to alice", refund)
+			}
+
+			want := []Posting{{"alice", tt.wantTotal}, {"bob", tax - tt.wantTotal}, {countryAccount("DE"), -tax}}
+			if !slices.Equal(postings, want) {
+				t.Errorf("newRefund() postings = %v, want %v", postings, want)
+			}
+		})
+	}
+}
+
+func TestRefundTaxesAddUp(t *testing.T) {
+	sale := Transaction{
+		ProductsServices: []ProductService{{ID: "a", Price: 100, Amount: 7}},
+		Taxes:            []TaxLine{{CountryCode: "DE", Amount: 33}, {CountryCode: "DE", Region: "BY", Amount: 5}},
+	}
+
+	tests := []struct {
+		name  string
+		steps []Money
+	}{
+		{"one by one", []Money{100, 100, 100, 100, 100, 100, 100}},
+		{"uneven", []Money{300, 100, 300}},
+		{"all at once", []Money{700}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paid := map[string]Money{}
+			var before Money
+			for _, net := range tt.steps {
+				for _, line := range refundTaxes(sale, before, net) {
+					paid[line.Region] += line.Amount
+				}
+				before += net
+			}
+
+			// the shares never round up to more than was collected, and
+			// the last one gives back the rest
+			if paid[""] != 33 || paid["BY"] != 5 {
+				t.Errorf("refunded taxes = %v, want 33 and 5", paid)
+			}
+		})
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+const dbRenewal = "renewal"
+
+// renewalGrace is how long an auto-renewing subscription stays active after
+// its end date while the renewal cannot be charged.
+const renewalGrace = 7 * 24 * time.Hour
+
+// priceNotice is how long before a renewal the subscriber is told about a
+// higher price of the plan for it to be charged.
+const priceNotice = 14 * 24 * time.Hour
+
+// States of a renewal.
+const (
+	RenewalPaid   = "paid"
+	RenewalFailed = "failed"
+)
+
+// Renewal records the charge of a billing interval of an auto-renewing
+// subscription.
+// Failed charges are retried until the grace period is over, and the record
+// is kept after the subscription ends as the history of its charges.
+type Renewal struct {
+	ID             string    `mapstructure:"_id" json:"_id" validate:"uuid_rfc4122"`                         // Unique identifier for the renewal, also the ID of its transaction
+	SubscriptionID string    `mapstructure:"subscription_id" json:"subscription_id" validate:"uuid_rfc4122"` // Subscription renewed
+	PlanID         string    `mapstructure:"plan_id" json:"plan_id" validate:"uuid_rfc4122"`                 // Plan id
+	UserID         string    `mapstructure:"user_id" json:"user_id" validate:"uuid_rfc4122"`                 // User id of the subscriber
+	MerchantID     string    `mapstructure:"merchant_id" json:"merchant_id" validate:"uuid_rfc4122"`         // User id of the business that sells the plan
+	Due            time.Time `mapstructure:"due" json:"due" validate:"uuid_rfc4122"`                         // Start of the interval renewed
+	Price          Money     `mapstructure:"price" json:"price" validate:"uuid_rfc4122"`                     // Price charged in cents
+	State          string    `mapstructure:"state" json:"state" validate:"uuid_rfc4122"`                     // paid or failed
+	Attempts       int       `mapstructure:"attempts" json:"attempts" validate:"uuid_rfc4122"`               // Number of charges tried
+	LastAttempt    time.Time `mapstructure:"last_attempt" json:"last_attempt" validate:"uuid_rfc4122"`       // Time of the last charge tried
+}
+
+// renewalID returns the ID of the renewal of a subscription due at a time.
+func renewalID(subscriptionID string, due time.Time) string {
+	return "renewal:" + subscriptionID + ":" + strconv.FormatInt(due.Unix(), 10)
+}
+
+// subscribeTransactionID returns the ID of the charge that starts a
+// subscription.
+func subscribeTransactionID(subscriptionID string) string {
+	return "subscribe:" + subscriptionID
+}
+
+// active reports whether the subscription gives access at now. An
+// auto-renewing subscription stays active during the grace period, and a
+// paused one is not active until it is resumed.
+func (s Subscription) active(now time.Time) bool {
+	if s.paused() {
+		return false
+	}
+	if now.Before(s.EndDate) {
+		return true
+	}
+	return s.AutoRenew && now.Before(s.EndDate.Add(renewalGrace))
+}
+
+// due reports whether the subscription has an interval to renew at now.
+func (s Subscription) due(now time.Time) bool {
+	return s.AutoRenew && !now.Before(s.EndDate) && s.active(now)
+}
+
+// priceAt returns the price of the renewal of the subscription due at a
+// time. A lower price of the plan is charged from the next renewal on, and
+// a higher one only once the subscriber was told ahead of time.
+func (s Subscription) priceAt(plan Plan, due time.Time) Money {
+	if plan.Price <= s.Price || !plan.PriceChange.Add(priceNotice).After(due) {
+		return plan.Price
+	}
+	return s.Price
+}
+
+// nextPrice returns the new price of the plan of the subscription and the
+// date of the first renewal charged at it.
+func (s Subscription) nextPrice(plan Plan) (Money, time.Time) {
+	due := s.EndDate
+	for s.priceAt(plan, due) != plan.Price {
+		due = nextPeriod(s.Interval, due)
+	}
+	return plan.Price, due
+}
+
+// PriceNotice tells a subscriber that the plan they renew changed its price.
+type PriceNotice struct {
+	SubscriptionID string
+	PlanName       string
+	Price          Money     // New price in cents
+	From           time.Time // Date of the first renewal charged at the new price
+}
+
+// priceNotices returns the price changes of the plans the user renews.
+func priceNotices(store Store, userID string) ([]PriceNotice, error) {
+	subscriptions, err := store.SubscriptionsBy(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	plans, err := store.Plans()
+	if err != nil {
+		return nil, err
+	}
+
+	byID := map[string]Plan{}
+	for _, p := range plans {
+		byID[p.ID] = p
+	}
+
+	// a subscription can be stored by several peers
+	seen := map[string]bool{}
+
+	notices := []PriceNotice{}
+	for _, s := range subscriptions {
+		plan, ok := byID[s.PlanID]
+		if s.UserID != userID || seen[s.ID] || !ok || !s.AutoRenew || plan.Price == s.Price {
+			continue
+		}
+		seen[s.ID] = true
+
+		price, from := s.nextPrice(plan)
+		notices = append(notices, PriceNotice{
+			SubscriptionID: s.ID,
+			PlanName:       plan.title(),
+			Price:          price,
+			From:           from,
+		})
+	}
+
+	return notices, nil
+}
+
+// renewSubscriptions charges every auto-renewing subscription of the user
+// that reached its end date, an interval at a time, and returns the renewals
+// tried. It runs whenever the subscriber comes online. A charge that fails
+// for lack of funds is tried again on every run until the grace period is
+// over, and then the subscription lapses like one that is not renewed.
+func renewSubscriptions(store Store, l *ledger, userID string, now time.Time) ([]Renewal, error) {
+	subscriptions, err := store.SubscriptionsBy(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	plans, err := plansByID(store)
+	if err != nil {
+		return nil, err
+	}
+
+	mine := []Subscription{}
+	for _, s := range subscriptions {
+		if s.UserID == userID {
+			mine = append(mine, s)
+		}
+	}
+
+	return renew(store, l, mine, plans, false, now)
+}
+
+// renewMandated charges the renewals of the subscribers of a business that
+// did not come online, under the mandates they signed, and returns the
+// renewals tried. It runs whenever the business comes online. A renewal the
+// mandate does not cover, such as one at a higher price, waits for the
+// subscriber.
+func renewMandated(store Store, l *ledger, merchantID string, now time.Time) ([]Renewal, error) {
+	subscriptions, err := store.Subscriptions()
+	if err != nil {
+		return nil, err
+	}
+
+	plans, err := plansByID(store)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := l.state()
+	if err != nil {
+		return nil, err
+	}
+
+	mandated := []Subscription{}
+	for _, s := range subscriptions {
+		m, ok := mandateAt(state.rules.mandates[s.ID], now)
+		if ok && !m.Revoked && m.MerchantID == merchantID && plans[s.PlanID].CreatedBy == merchantID {
+			mandated = append(mandated, s)
+		}
+	}
+
+	return renew(store, l, mandated, plans, true, now)
+}
+
+// plansByID maps every plan to its ID.
+func plansByID(store Store) (map[string]Plan, error) {
+	plans, err := store.Plans()
+	if err != nil {
+		return nil, err
+	}
+
+	byID := map[string]Plan{}
+	for _, p := range plans {
+		byID[p.ID] = p
+	}
+
+	return byID, nil
+}
+
+// renew charges the subscriptions that are due, an interval at a time, and
+// returns the renewals tried. The merchant makes mandated charges, and the
+// subscriber the others.
+func renew(store Store, l *ledger, subscriptions []Subscription, plans map[string]Plan, mandated bool, now time.Time) ([]Renewal, error) {
+	// a subscription can be stored by several peers
+	seen := map[string]bool{}
+
+	renewals := []Renewal{}
+	for _, s := range subscriptions {
+		if seen[s.ID] {
+			continue
+		}
+		seen[s.ID] = true
+
+		plan, ok := plans[s.PlanID]
+		if !ok {
+			// the plan was withdrawn, the subscription ends
+			continue
+		}
+		if intervalOf(plan.Interval) != intervalOf(s.Interval) {
+			// the price of the plan is not for the interval the subscriber
+			// agreed to, it is not charged
+			continue
+		}
+
+		for s.due(now) {
+			s.Price = s.priceAt(plan, s.EndDate)
+
+			renewal, err := chargeRenewal(store, l, s, plan, mandated, now)
+			if errors.Is(err, ErrMandate) {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			renewals = append(renewals, renewal)
+
+			if renewal.State != RenewalPaid {
+				break
+			}
+
+			s.EndDate = nextPeriod(s.Interval, s.EndDate)
+			err = store.PutSubscription(s)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return renewals, nil
+}
+
+// chargeRenewal charges the interval of a subscription that starts at its end
+// date. A charge that was already made is not made again.
+func chargeRenewal(store Store, l *ledger, s Subscription, plan Plan, mandated bool, now time.Time) (Renewal, error) {
+	id := renewalID(s.ID, s.EndDate)
+
+	renewal, err := store.Renewal(id)
+	if errors.Is(err, ErrNotFound) {
+		renewal = Renewal{
+			ID:             id,
+			SubscriptionID: s.ID,
+			PlanID:         s.PlanID,
+			UserID:         s.UserID,
+			MerchantID:     plan.CreatedBy,
+			Due:            s.EndDate,
+			Price:          s.Price,
+		}
+	} else if err != nil {
+		return Renewal{}, err
+	}
+
+	if renewal.State == RenewalPaid {
+		return renewal, nil
+	}
+
+	renewal.Attempts++
+	renewal.LastAttempt = now
+
+	_, err = chargePlan(store, l, mandated, id, s.UserID, plan, renewal.Price, now)
+	if errors.Is(err, ErrInsufficientFunds) {
+		renewal.State = RenewalFailed
+		return renewal, store.PutRenewal(renewal)
+	} else if err != nil {
+		return Renewal{}, err
+	}
+
+	renewal.State = RenewalPaid
+	return renewal, store.PutRenewal(renewal)
+}
+
+// planSale returns the sale of an interval of a plan to a subscriber and its
+// taxes.
+func planSale(store Store, subscriberID string, plan Plan, price Money, at time.Time) (Sale, []TaxLine, error) {
+	subscriber, err := store.User(subscriberID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return Sale{}, nil, err
+	}
+
+	merchant, err := store.User(plan.CreatedBy)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return Sale{}, nil, err
+	}
+
+	engine, err := newTaxEngine(store)
+	if err != nil {
+		return Sale{}, nil, err
+	}
+
+	sale := newSale(subscriber, merchant, []ProductService{
+		{
+			ID:     plan.ID,
+			Name:   plan.title(),
+			Price:  price,
+			Amount: 1,
+		},
+	}, at)
+
+	return sale, engine.taxLines(sale), nil
+}
+
+// chargePlan charges a subscriber the price of an interval of a plan with
+// the taxes of the sale, and stores the transaction. A mandated charge is
+// made by the merchant under the mandate of the subscriber.
+func chargePlan(store Store, l *ledger, mandated bool, transactionID, subscriberID string, plan Plan, price Money, at time.Time) (Transaction, error) {
+	sale, taxes, err := planSale(store, subscriberID, plan, price, at)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	postings := salePostings(subscriberID, plan.CreatedBy, sale.net(), taxes)
+	if mandated {
+		_, err = l.postMandated(transactionID, plan.CreatedBy, postings)
+	} else {
+		_, err = l.post(transactionID, postings)
+	}
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	transaction := Transaction{
+		ID:               transactionID,
+		SenderID:         subscriberID,
+		ReceiverID:       plan.CreatedBy,
+		ProductsServices: sale.Items,
+		Taxes:            taxes,
+		TotalCost:        saleTotal(sale.net(), taxes),
+		Timestamp:        at,
+		Date:             periodOf(at),
+	}
+
+	err = store.PutTransaction(transaction)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	return transaction, syncCountryWallets(store, l, taxes)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRenewSubscriptions(t *testing.T) {
+	subscriberKey, merchantKey := testKey("subscriber"), testKey("merchant")
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		plan      Plan
+		end       time.Duration // end date of the subscription from now
+		autoRenew bool
+		interval  string
+		runs      int
+		states    []string // of the renewals tried on the last run
+		attempts  int
+		charged   Money
+		renewed   bool
+	}{
+		{
+			name:      "not due",
+			plan:      Plan{Price: 1000},
+			end:       24 * time.Hour,
+			autoRenew: true,
+			runs:      1,
+			states:    []string{},
+		},
+		{
+			name:      "due",
+			plan:      Plan{Price: 1000},
+			end:       -24 * time.Hour,
+			autoRenew: true,
+			runs:      1,
+			states:    []string{RenewalPaid},
+			attempts:  1,
+			charged:   1190,
+			renewed:   true,
+		},
+		{
+			name:      "run again",
+			plan:      Plan{Price: 1000},
+			end:       -24 * time.Hour,
+			autoRenew: true,
+			runs:      2,
+			states:    []string{},
+			attempts:  1,
+			charged:   1190,
+			renewed:   true,
+		},
+		{
+			name:   "not renewing",
+			plan:   Plan{Price: 1000},
+			end:    -24 * time.Hour,
+			runs:   1,
+			states: []string{},
+		},
+		{
+			name:      "past the grace period",
+			plan:      Plan{Price: 1000},
+			end:       -renewalGrace - time.Hour,
+			autoRenew: true,
+			runs:      1,
+			states:    []string{},
+		},
+		{
+			name:      "not enough funds",
+			plan:      Plan{Price: 200000},
+			end:       -24 * time.Hour,
+			autoRenew: true,
+			runs:      1,
+			states:    []string{RenewalFailed},
+			attempts:  1,
+		},
+		{
+			name:      "retried",
+			plan:      Plan{Price: 200000},
+			end:       -24 * time.Hour,
+			autoRenew: true,
+			runs:      3,
+			states:    []string{RenewalFailed},
+			attempts:  3,
+		},
+		{
+			name:      "plan of another interval",
+			plan:      Plan{Price: 1000, Interval: IntervalYear},
+			end:       -24 * time.Hour,
+			autoRenew: true,
+			runs:      1,
+			states:    []string{},
+		},
+		{
+			name:      "higher price without notice",
+			plan:      Plan{Price: 1500, PriceChange: now.Add(-24 * time.Hour)},
+			end:       -time.Hour,
+			autoRenew: true,
+			runs:      1,
+			states:    []string{RenewalPaid},
+			attempts:  1,
+			charged:   1190,
+			renewed:   true,
+		},
+		{
+			name:      "higher price after notice",
+			plan:      Plan{Price: 1500, PriceChange: now.Add(-30 * 24 * time.Hour)},
+			end:       -time.Hour,
+			autoRenew: true,
+			runs:      1,
+			states:    []string{RenewalPaid},
+			attempts:  1,
+			charged:   1785,
+			renewed:   true,
+		},
+		{
+			name:      "lower price",
+			plan:      Plan{Price: 500, PriceChange: now.Add(-time.Hour)},
+			end:       -time.Hour,
+			autoRenew: true,
+			runs:      1,
+			states:    []string{RenewalPaid},
+			attempts:  1,
+			charged:   595,
+			renewed:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryStore()
+			subscriberID := testUser(t, store, subscriberKey, "")
+			merchantID := testUser(t, store, merchantKey, "DE1")
+			testIncome(t, store, subscriberKey, subscriberID)
+
+			plan := tt.plan
+			plan.ID, plan.Name, plan.CreatedBy = "plan", "gym", merchantID
+			if err := store.PutPlan(plan); err != nil {
+				t.Fatal(err)
+			}
+
+			end := now.Add(tt.end).Truncate(time.Second)
+			subscription := Subscription{
+				ID:        "s1",
+				PlanID:    plan.ID,
+				UserID:    subscriberID,
+				Price:     1000,
+				StartDate: end.AddDate(0, -1, 0),
+				EndDate:   end,
+				Interval:  IntervalMonth,
+				AutoRenew: tt.autoRenew,
+			}
+			if err := store.PutSubscription(subscription); err != nil {
+				t.Fatal(err)
+			}
+
+			var renewals []Renewal
+			for range tt.runs {
+				var err error
+				renewals, err = renewSubscriptions(store, newLedger(store, subscriberKey), subscriberID, now)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			states := []string{}
+			for _, r := range renewals {
+				states = append(states, r.State)
+			}
+			if len(states) != len(tt.states) || (len(states) > 0 && states[0] != tt.states[0]) {
+				t.Errorf("renewals = %v, want %v", states, tt.states)
+			}
+
+			stored, err := store.Renewal(renewalID(subscription.ID, end))
+			if tt.attempts > 0 && (err != nil || stored.Attempts != tt.attempts) {
+				t.Errorf("renewal attempts = %v, %v, want %v", stored.Attempts, err, tt.attempts)
+			}
+
+			balance, err := newLedger(store, subscriberKey).balance(subscriberID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if charged := 100000 - balance; charged != tt.charged {
+				t.Errorf("charged %v, want %v", charged, tt.charged)
+			}
+
+			subscriptions, err := store.SubscriptionsBy(subscriberID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if renewed := subscriptions[0].EndDate.After(end); renewed != tt.renewed {
+				t.Errorf("renewed = %v, want %v", renewed, tt.renewed)
+			}
+		})
+	}
+}
+
+func TestRenewMandated(t *testing.T) {
+	subscriberKey, merchantKey := testKey("subscriber"), testKey("merchant")
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		price   Money // of the plan at the renewal
+		signer  string
+		revoked bool
+		charged Money
+	}{
+		{"under the mandate", 1000, "subscriber", false, 1190},
+		{"revoked", 1000, "subscriber", true, 0},
+		{"above the mandate", 1500, "subscriber", false, 0},
+		{"signed by the merchant", 1000, "merchant", false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryStore()
+			subscriberID := testUser(t, store, subscriberKey, "")
+			merchantID := testUser(t, store, merchantKey, "DE1")
+			testIncome(t, store, subscriberKey, subscriberID)
+
+			plan := Plan{ID: "plan", Name: "gym", Price: 1000, CreatedBy: merchantID, Interval: IntervalMonth}
+			if err := store.PutPlan(plan); err != nil {
+				t.Fatal(err)
+			}
+
+			end := now.Add(-time.Hour).Truncate(time.Second)
+			subscription := Subscription{
+				ID:        "s1",
+				PlanID:    plan.ID,
+				UserID:    subscriberID,
+				Price:     1000,
+				StartDate: end.AddDate(0, -1, 0),
+				EndDate:   end,
+				Interval:  IntervalMonth,
+				AutoRenew: !tt.revoked,
+			}
+
+			key := subscriberKey
+			if tt.signer == "merchant" {
+				key = merchantKey
+			}
+			if err := putSubscription(store, newLedger(store, key), subscription); err != nil {
+				t.Fatal(err)
+			}
+			// the subscriber turned auto-renew off on another peer that
+			// still renews
+			subscription.AutoRenew = true
+			if err := store.PutSubscription(subscription); err != nil {
+				t.Fatal(err)
+			}
+
+			// the price rose long before the renewal
+			plan.Price, plan.PriceChange = tt.price, end.AddDate(0, -1, 0)
+			if err := store.PutPlan(plan); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := renewMandated(store, newLedger(store, merchantKey), merchantID, time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			// charging it again moves no more money
+			if _, err := renewMandated(store, newLedger(store, merchantKey), merchantID, time.Now()); err != nil {
+				t.Fatal(err)
+			}
+
+			balance, err := newLedger(store, merchantKey).balance(subscriberID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if charged := 100000 - balance; charged != tt.charged {
+				t.Errorf("charged %v, want %v", charged, tt.charged)
+			}
+		})
+	}
+}
+
+func TestChargePlanOnce(t *testing.T) {
+	subscriberKey, merchantKey := testKey("subscriber"), testKey("merchant")
+
+	store := newMemoryStore()
+	subscriberID := testUser(t, store, subscriberKey, "")
+	merchantID := testUser(t, store, merchantKey, "DE1")
+	testIncome(t, store, subscriberKey, subscriberID)
+
+	plan := Plan{ID: "plan", Name: "gym", Price: 1000, CreatedBy: merchantID}
+
+	// a subscription submitted again charges the same transaction
+	for range 2 {
+		if _, err := chargePlan(store, newLedger(store, subscriberKey), false, subscribeTransactionID("s1"), subscriberID, plan, plan.Price, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	balance, err := newLedger(store, subscriberKey).balance(subscriberID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 100000-1190 {
+		t.Errorf("balance = %v, want one charge of 11.90", balance)
+	}
+}
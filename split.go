@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrEmptySplit = errors.New("split payment has no lines")
+
+// SplitLine is an item of a split payment and the receiver it is paid to.
+type SplitLine struct {
+	ReceiverID string
+	Item       ProductService
+}
+
+// Receipt groups the transactions of a split payment, one per receiver.
+type Receipt struct {
+	GroupID      string
+	Transactions []Transaction
+	Total        Money // What the buyer paid in cents
+}
+
+// splitTransactionID returns the ID of the transaction of a receiver in a
+// split payment.
+func splitTransactionID(groupID, receiverID string) string {
+	return groupID + ":" + receiverID
+}
+
+// entryTransactionID returns the ID of the journal transaction that settled
+// a transaction. The transactions of a split payment share the one of their
+// group.
+func (t Transaction) entryTransactionID() string {
+	if len(t.GroupID) > 0 {
+		return t.GroupID
+	}
+	return t.ID
+}
+
+// splitPayment prices the lines of a payment to several receivers, with the
+// taxes of the jurisdiction of each seller. It returns one transaction per
+// receiver, in the order the receivers first appear, and the postings that
+// settle all of them in a single journal entry, so either every receiver is
+// paid or none is. The entry debits the buyer once and lists every seller
+// before its taxes, so that a refund takes back only the taxes of its
+// seller.
+func splitPayment(store Store, engine *taxEngine, groupID, buyerID string, lines []SplitLine, now time.Time) ([]Transaction, []Posting, error) {
+	receivers := []string{}
+	items := map[string][]ProductService{}
+	for _, line := range lines {
+		if _, ok := items[line.ReceiverID]; !ok {
+			receivers = append(receivers, line.ReceiverID)
+		}
+		items[line.ReceiverID] = append(items[line.ReceiverID], line.Item)
+	}
+	if len(receivers) == 0 {
+		return nil, nil, ErrEmptySplit
+	}
+
+	buyer, err := store.User(buyerID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, nil, err
+	}
+
+	transactions := []Transaction{}
+	postings := []Posting{}
+	var total Money
+	for _, receiverID := range receivers {
+		deleted, err := closed(store, receiverID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if deleted {
+			return nil, nil, ErrAccountClosed
+		}
+
+		seller, err := store.User(receiverID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, nil, err
+		}
+
+		sale := newSale(buyer, seller, items[receiverID], now)
+
+		taxes := engine.taxLines(sale)
+		transactions = append(transactions, Transaction{
+			ID:               splitTransactionID(groupID, receiverID),
+			SenderID:         buyerID,
+			ReceiverID:       receiverID,
+			GroupID:          groupID,
+			ProductsServices: sale.Items,
+			Taxes:            taxes,
+			TotalCost:        saleTotal(sale.net(), taxes),
+			Timestamp:        now,
+			Date:             periodOf(now),
+		})
+		// the buyer is debited once for all the sales
+		paid := salePostings(buyerID, receiverID, sale.net(), taxes)
+		total -= paid[0].Amount
+		for _, p := range paid[1:] {
+			if p.Amount != 0 {
+				postings = append(postings, p)
+			}
+		}
+	}
+
+	return transactions, append([]Posting{{AccountID: buyerID, Amount: -total}}, postings...), nil
+}
+
+// newReceipt groups the transactions of a split payment.
+func newReceipt(groupID string, transactions []Transaction) Receipt {
+	receipt := Receipt{GroupID: groupID, Transactions: transactions}
+	for _, t := range transactions {
+		receipt.Total += t.TotalCost
+	}
+	return receipt
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsMonths is the number of months the statistics report month by month.
+const statsMonths = 12
+
+// PeriodStats sums up the economy of one month.
+type PeriodStats struct {
+	Period        string           `json:"period"`
+	Income        Money            `json:"income"`         // Basic income of the month in cents
+	Emissions     Money            `json:"emissions"`      // Cents issued by the emission account
+	Burns         Money            `json:"burns"`          // Cents taken out of circulation
+	Volume        Money            `json:"volume"`         // Cents paid between users
+	Transactions  int              `json:"transactions"`   // Number of payments between users
+	ActiveWallets int              `json:"active_wallets"` // Users that paid or got paid
+	Taxes         map[string]Money `json:"taxes"`          // Tax collected per country in cents
+}
+
+// EconomyStats is the state of the economy reported by the statistics API.
+type EconomyStats struct {
+	Supply        Money            `json:"supply"`         // Cents in circulation, emissions less burns
+	Velocity      float64          `json:"velocity"`       // Volume of the last statsMonths months over the supply
+	Wallets       int              `json:"wallets"`        // Wallets ever opened
+	ActiveWallets int              `json:"active_wallets"` // Wallets active this month
+	Taxes         map[string]Money `json:"taxes"`          // Tax collected per country since the start
+	CountryFunds  map[string]Money `json:"country_funds"`  // Balance of the country wallets
+	Months        []PeriodStats    `json:"months"`         // Last months, oldest first
+	UpdatedAt     time.Time        `json:"updated_at"`
+}
+
+// statsService computes the statistics of the economy from the replayed
+// journal, so they show the money that moved rather than what the
+// transaction records claim. A month keeps changing while the income missed
+// by users can still be credited to it, so only the months past that window
+// are kept and the others are summed up again on every update.
+type statsService struct {
+	store  Store
+	ledger *ledger
+	// catchUpMonths is how many months back the wallets credit the income
+	// missed.
+	catchUpMonths int
+	mu            sync.Mutex
+	closed        map[string]PeriodStats
+}
+
+func newStatsService(store Store, catchUpMonths int) *statsService {
+	return &statsService{
+		store: store,
+		// the statistics only read the journal, they sign nothing
+		ledger:        newLedger(store, nil),
+		catchUpMonths: catchUpMonths,
+		closed:        map[string]PeriodStats{},
+	}
+}
+
+// periodStats sums up the journal entries settled in a month.
+func periodStats(period string, entries []JournalEntry, income Income) PeriodStats {
+	ps := PeriodStats{
+		Period: period,
+		Income: income.Amount,
+		Taxes:  map[string]Money{},
+	}
+
+	active := map[string]bool{}
+	for _, e := range entries {
+		payment := len(e.Reverses) == 0
+		for _, p := range e.Postings {
+			switch {
+			case p.AccountID == accountEmission:
+				ps.Emissions -= p.Amount
+				payment = false
+			case p.AccountID == accountBurn:
+				ps.Burns += p.Amount
+				payment = false
+			case isCountryAccount(p.AccountID):
+				// the tax of a refund is paid back by the country
+				ps.Taxes[strings.TrimPrefix(p.AccountID, countryAccount(""))] += p.Amount
+			}
+		}
+		if !payment {
+			continue
+		}
+
+		ps.Transactions++
+		for _, p := range e.Postings {
+			if isSystemAccount(p.AccountID) {
+				continue
+			}
+			active[accountOwner(p.AccountID)] = true
+			// money leaving an escrow was counted when it was locked
+			if _, escrow := parseEscrowAccount(p.AccountID); p.Amount < 0 && !escrow {
+				ps.Volume -= p.Amount
+			}
+		}
+	}
+	ps.ActiveWallets = len(active)
+
+	return ps
+}
+
+// settledPeriod reports whether a month can no longer change at now. Users
+// who did not log in are paid the income they missed up to catchUpMonths
+// later, into the month it was for.
+func settledPeriod(period string, now time.Time, catchUpMonths int) bool {
+	start, err := periodStart(period)
+	if err != nil {
+		return false
+	}
+
+	month, err := periodStart(periodOf(now))
+	if err != nil {
+		return false
+	}
+
+	return start.Before(month.AddDate(0, -catchUpMonths, 0))
+}
+
+// month returns the statistics of a period from its entries, from the cache
+// when it is settled.
+func (s *statsService) month(period string, entries []JournalEntry, now time.Time) (PeriodStats, error) {
+	settled := settledPeriod(period, now, s.catchUpMonths)
+
+	s.mu.Lock()
+	ps, ok := s.closed[period]
+	s.mu.Unlock()
+	if ok && settled {
+		return ps, nil
+	}
+
+	income, _, err := finalizedIncome(s.store, period, now)
+	if err != nil {
+		return PeriodStats{}, err
+	}
+
+	ps = periodStats(period, entries, income)
+
+	if settled {
+		s.mu.Lock()
+		s.closed[period] = ps
+		s.mu.Unlock()
+	}
+
+	return ps, nil
+}
+
+// firstPeriod returns the start of the first month income was paid for,
+// from the emissions in the journal and from the incomes indexed before
+// proposals.
+func (s *statsService) firstPeriod(byPeriod map[string][]JournalEntry, now time.Time) (time.Time, error) {
+	incomes, err := s.store.Incomes()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	periods := []string{}
+	for period := range byPeriod {
+		periods = append(periods, period)
+	}
+	for _, inc := range incomes {
+		periods = append(periods, inc.Period)
+	}
+
+	first, err := periodStart(periodOf(now))
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, period := range periods {
+		start, err := periodStart(period)
+		if err == nil && start.Before(first) {
+			first = start
+		}
+	}
+
+	return first, nil
+}
+
+// stats returns the state of the economy at now.
+func (s *statsService) stats(now time.Time) (EconomyStats, error) {
+	state, err := s.ledger.state()
+	if err != nil {
+		return EconomyStats{}, err
+	}
+
+	byPeriod := map[string][]JournalEntry{}
+	for _, e := range state.settled {
+		period := periodOf(e.Timestamp)
+		byPeriod[period] = append(byPeriod[period], e)
+	}
+
+	first, err := s.firstPeriod(byPeriod, now)
+	if err != nil {
+		return EconomyStats{}, err
+	}
+
+	es := EconomyStats{
+		Supply:       -state.balances[accountEmission] - state.balances[accountBurn],
+		Taxes:        map[string]Money{},
+		CountryFunds: map[string]Money{},
+		Months:       []PeriodStats{},
+		UpdatedAt:    now,
+	}
+
+	months := []PeriodStats{}
+	for t := first; !t.After(now); t = t.AddDate(0, 1, 0) {
+		ps, err := s.month(periodOf(t), byPeriod[periodOf(t)], now)
+		if err != nil {
+			return EconomyStats{}, err
+		}
+
+		for country, amount := range ps.Taxes {
+			es.Taxes[country] += amount
+		}
+		months = append(months, ps)
+	}
+
+	if len(months) > statsMonths {
+		months = months[len(months)-statsMonths:]
+	}
+	es.Months = months
+
+	var volume Money
+	for _, ps := range months {
+		volume += ps.Volume
+	}
+	if es.Supply > 0 {
+		es.Velocity = float64(volume) / float64(es.Supply)
+	}
+	if len(months) > 0 {
+		es.ActiveWallets = months[len(months)-1].ActiveWallets
+	}
+
+	for accountID, balance := range state.balances {
+		_, escrow := parseEscrowAccount(accountID)
+		switch {
+		case isCountryAccount(accountID):
+			es.CountryFunds[strings.TrimPrefix(accountID, countryAccount(""))] = balance
+		case !isSystemAccount(accountID) && !escrow:
+			es.Wallets++
+		}
+	}
+
+	return es, nil
+}
+
+// handle registers the statistics endpoint.
+func (s *statsService) handle(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/economy", s.serveStats)
+}
+
+func (s *statsService) serveStats(w http.ResponseWriter, r *http.Request) {
+	es, err := s.stats(time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, es)
+}
+
+// sortedCountries returns the countries of a tax map by code.
+func sortedCountries(taxes map[string]Money) []string {
+	countries := make([]string, 0, len(taxes))
+	for country := range taxes {
+		countries = append(countries, country)
+	}
+	sort.Strings(countries)
+	return countries
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+
+	shell "github.com/stateless-minds/go-ipfs-api"
+)
+
+// nodeAddress is the API address of the local IPFS node.
+const nodeAddress = "localhost:5001"
+
+// ErrNotFound is returned by a Store when the requested document does not
+// exist.
+var ErrNotFound = errors.New("not found")
+
+// Store is the persistence layer used by the components. It hides the
+// OrbitDB document stores behind typed methods so that the business logic
+// does not depend on a running IPFS node.
+type Store interface {
+	// OwnUser returns the user registered on this device.
+	OwnUser() (User, error)
+	// User returns the public record of any user.
+	User(id string) (User, error)
+	// Users returns every registered user.
+	Users() ([]User, error)
+	PutUser(user User) error
+	DeleteUser(id string) error
+
+	Device(address string) (UserDevice, error)
+	PutDevice(device UserDevice) error
+
+	Balance(userID string) (UserBalance, error)
+	Balances() ([]UserBalance, error)
+	PutBalance(balance UserBalance) error
+	DeleteBalance(userID string) error
+
+	// Transactions returns every transaction where the user is either the
+	// sender or the receiver.
+	Transactions(userID string) ([]Transaction, error)
+	// TransactionsIn returns every transaction of a period, as in
+	// Transaction.Date.
+	TransactionsIn(period string) ([]Transaction, error)
+	PutTransaction(transaction Transaction) error
+
+	PaymentIntent(id string) (PaymentIntent, error)
+	// PaymentIntents returns the intents submitted by the user.
+	PaymentIntents(senderID string) ([]PaymentIntent, error)
+	PutPaymentIntent(intent PaymentIntent) error
+
+	Journal() ([]JournalEntry, error)
+	PutJournalEntry(entry JournalEntry) error
+
+	Plans() ([]Plan, error)
+	PlansBy(userID string) ([]Plan, error)
+	PutPlan(plan Plan) error
+	DeletePlan(id string) error
+
+	Subscriptions() ([]Subscription, error)
+	SubscriptionsBy(userID string) ([]Subscription, error)
+	PutSubscription(subscription Subscription) error
+	DeleteSubscription(id string) error
+	// DeleteExpiredSubscriptions removes the subscriptions that are not
+	// active anymore, except those paused or waiting for a refund.
+	DeleteExpiredSubscriptions() error
+
+	Renewal(id string) (Renewal, error)
+	// Renewals returns the renewals where the user is either the subscriber
+	// or the merchant.
+	Renewals(userID string) ([]Renewal, error)
+	PutRenewal(renewal Renewal) error
+
+	Mandates() ([]Mandate, error)
+	PutMandate(mandate Mandate) error
+
+	KeyRegistrations() ([]KeyRegistration, error)
+	PutKeyRegistration(registration KeyRegistration) error
+
+	Incomes() ([]Income, error)
+	PutIncome(income Income) error
+	// IncomeProposals returns the proposals made for the income of a period.
+	IncomeProposals(period string) ([]IncomeProposal, error)
+	PutIncomeProposal(proposal IncomeProposal) error
+
+	CountryWallet(countryCode string) (CountryWallet, error)
+	CountryWallets() ([]CountryWallet, error)
+	PutCountryWallet(wallet CountryWallet) error
+
+	Invoice(id string) (Invoice, error)
+	// InvoicesBy returns the invoices issued by a merchant.
+	InvoicesBy(merchantID string) ([]Invoice, error)
+	PutInvoice(invoice Invoice) error
+
+	Escrow(id string) (Escrow, error)
+	// Escrows returns the escrows where the user is either the buyer or the
+	// seller.
+	Escrows(userID string) ([]Escrow, error)
+	PutEscrow(escrow Escrow) error
+
+	// Tombstone returns the record left by a deleted account.
+	Tombstone(userID string) (Tombstone, error)
+	Tombstones() ([]Tombstone, error)
+	PutTombstone(tombstone Tombstone) error
+
+	// Purge removes every document from the given database. It is meant
+	// for development resets only.
+	Purge(db string) error
+}
+
+// newStore returns the store used by the components. It is a variable so
+// that it can be pointed at newMemoryStore when running without a node.
+var newStore = func() Store {
+	return newOrbitStore(shell.NewShell(nodeAddress))
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/maxence-charriere/go-app/v10/pkg/app"
+)
+
+// subscriber is the part of the subscription and supplier components that
+// shows the subscriptions of the user and changes them. Both embed it.
+type subscriber struct {
+	store         Store
+	ledger        *ledger
+	userID        string
+	userBalance   UserBalance
+	plans         []Plan
+	subscriptions []Subscription
+	renewals      []Renewal
+	pending       map[string]string // plan ID to the subscription being bought
+}
+
+func (s *subscriber) getSubscriptions(ctx app.Context) {
+	ctx.Async(func() {
+		subscriptions, err := s.store.SubscriptionsBy(s.userID)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx.Dispatch(func(ctx app.Context) {
+			s.subscriptions = subscriptions
+		})
+	})
+}
+
+func (s *subscriber) deleteExpiredSubscriptions(ctx app.Context) {
+	ctx.Async(func() {
+		_, err := renewSubscriptions(s.store, s.ledger, s.userID, time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = s.store.DeleteExpiredSubscriptions()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx.Dispatch(func(ctx app.Context) {
+			s.getSubscriptions(ctx)
+			s.getRenewals(ctx)
+		})
+	})
+}
+
+// storeSubscription stores the subscription with the mandate for its
+// renewals.
+func (s *subscriber) storeSubscription(subscription Subscription) error {
+	return putSubscription(s.store, s.ledger, subscription)
+}
+
+func (s *subscriber) getRenewals(ctx app.Context) {
+	ctx.Async(func() {
+		all, err := s.store.Renewals(s.userID)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		renewals := []Renewal{}
+		for _, r := range all {
+			if r.UserID == s.userID {
+				renewals = append(renewals, r)
+			}
+		}
+
+		sort.Slice(renewals, func(a, b int) bool {
+			return renewals[a].LastAttempt.After(renewals[b].LastAttempt)
+		})
+
+		ctx.Dispatch(func(ctx app.Context) {
+			s.renewals = renewals
+		})
+	})
+}
+
+// toggleAutoRenew turns the renewal of a subscription on or off.
+func (s *subscriber) toggleAutoRenew(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+	n, err := strconv.Atoi(ctx.JSSrc().Get("value").String())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	subscription := s.subscriptions[n]
+	subscription.AutoRenew = !subscription.AutoRenew
+
+	err = s.storeSubscription(subscription)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s.subscriptions[n] = subscription
+}
+
+// changeSubscription stores the subscription the button is for as changed
+// by change.
+func (s *subscriber) changeSubscription(ctx app.Context, e app.Event, change func(Subscription, time.Time) (Subscription, error), done string) {
+	e.PreventDefault()
+	n, err := strconv.Atoi(ctx.JSSrc().Get("value").String())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	subscription, err := change(s.subscriptions[n], time.Now())
+	if err != nil {
+		ctx.Notifications().New(app.Notification{
+			Title: "Error",
+			Body:  err.Error(),
+		})
+		return
+	}
+
+	err = s.storeSubscription(subscription)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s.subscriptions[n] = subscription
+
+	ctx.Notifications().New(app.Notification{
+		Title: "Success",
+		Body:  done,
+	})
+}
+
+func (s *subscriber) doPause(ctx app.Context, e app.Event) {
+	s.changeSubscription(ctx, e, pauseSubscription, "Subscription paused.")
+}
+
+func (s *subscriber) doResume(ctx app.Context, e app.Event) {
+	s.changeSubscription(ctx, e, resumeSubscription, "Subscription resumed.")
+}
+
+func (s *subscriber) doCancel(ctx app.Context, e app.Event) {
+	s.changeSubscription(ctx, e, func(sub Subscription, now time.Time) (Subscription, error) {
+		return cancelSubscription(sub, false, now)
+	}, "Subscription cancelled. It runs until the end of the time paid for.")
+}
+
+func (s *subscriber) doCancelRefund(ctx app.Context, e app.Event) {
+	s.changeSubscription(ctx, e, func(sub Subscription, now time.Time) (Subscription, error) {
+		return cancelSubscription(sub, true, now)
+	}, "Subscription cancelled. The unused time is paid back by the business.")
+}
+
+// renderSubscribed shows the state of a subscription and what can be done
+// with it.
+func (s *subscriber) renderSubscribed(n int, plan Plan) app.UI {
+	now := time.Now()
+	sub := s.subscriptions[n]
+	price, from := sub.nextPrice(plan)
+
+	return app.Div().Class("menu-btn menu-sub menu-subscribed").Body(
+		app.If(sub.paused(), func() app.UI {
+			return app.Button().Class("submit submit-sub").Type("submit").Text("Paused").Disabled(true)
+		}).ElseIf(sub.due(now), func() app.UI {
+			return app.Button().Class("submit submit-sub").Type("submit").Text("Payment due").Disabled(true)
+		}).ElseIf(sub.cancelled(), func() app.UI {
+			return app.Button().Class("submit submit-sub").Type("submit").Text("Ends " + sub.EndDate.Format("2006-01-02")).Disabled(true)
+		}).Else(func() app.UI {
+			return app.Button().Class("submit submit-sub").Type("submit").Text("Subscribed").Disabled(true)
+		}),
+		app.If(!sub.cancelled(), func() app.UI {
+			return app.Div().Body(
+				app.If(sub.AutoRenew, func() app.UI {
+					return app.Button().Class("submit submit-sub").Text("Auto-renew on").Value(n).OnClick(s.toggleAutoRenew)
+				}).Else(func() app.UI {
+					return app.Button().Class("submit submit-sub").Text("Auto-renew off").Value(n).OnClick(s.toggleAutoRenew)
+				}),
+				app.If(sub.paused(), func() app.UI {
+					return app.Button().Class("submit submit-sub").Text("Resume").Value(n).OnClick(s.doResume)
+				}).ElseIf(!sub.due(now), func() app.UI {
+					return app.Button().Class("submit submit-sub").Text("Pause").Value(n).OnClick(s.doPause)
+				}),
+				app.Button().Class("submit submit-sub").Text("Cancel").Value(n).OnClick(s.doCancel),
+				app.Button().Class("submit submit-sub").Text("Cancel and refund").Value(n).OnClick(s.doCancelRefund),
+			)
+		}),
+		app.If(sub.AutoRenew && price != sub.Price, func() app.UI {
+			return app.Span().Class("s-notice").Text("Renews at " + price.gubi() + " from " + from.Format("2006-01-02"))
+		}),
+	)
+}
+
+// planName returns the name and tier of a plan, or its ID once it was
+// withdrawn.
+func (s *subscriber) planName(planID string) string {
+	for _, p := range s.plans {
+		if p.ID == planID {
+			return p.title()
+		}
+	}
+	return planID
+}
+
+func (s *subscriber) doSubscribe(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+	pid := ctx.JSSrc().Get("value").String()
+	planID, err := strconv.Atoi(pid)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	plan := s.plans[planID]
+
+	for _, sub := range s.subscriptions {
+		if sub.PlanID == plan.ID && !sub.expired(time.Now()) {
+			ctx.Notifications().New(app.Notification{
+				Title: "Error",
+				Body:  "Already subscribed to this plan.",
+			})
+			return
+		}
+	}
+
+	// a retry of a subscription that did not go through keeps its ID, so it
+	// is charged once however often it is clicked
+	if s.pending == nil {
+		s.pending = map[string]string{}
+	}
+	id, ok := s.pending[plan.ID]
+	if !ok {
+		id = uuid.NewString()
+		s.pending[plan.ID] = id
+	}
+
+	subscription := Subscription{
+		ID:        id,
+		PlanID:    plan.ID,
+		UserID:    s.userID,
+		Price:     plan.Price,
+		StartDate: time.Now(),
+		EndDate:   nextPeriod(plan.Interval, time.Now()),
+		Interval:  intervalOf(plan.Interval),
+	}
+
+	// move the money with the taxes of the sale
+	transaction, err := chargePlan(s.store, s.ledger, false, subscribeTransactionID(subscription.ID), s.userID, plan, plan.Price, time.Now())
+	if errors.Is(err, ErrInsufficientFunds) {
+		ctx.Notifications().New(app.Notification{
+			Title: "Error",
+			Body:  "Not enough funds.",
+		})
+		return
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	// store subscription
+	err = s.storeSubscription(subscription)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	delete(s.pending, plan.ID)
+	s.userBalance.Balance = s.userBalance.Balance - transaction.TotalCost
+	s.subscriptions = append(s.subscriptions, subscription)
+	ctx.Update()
+
+	ctx.Notifications().New(app.Notification{
+		Title: "Success",
+		Body:  "Subscription successful!",
+	})
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Entity types of the parties of a sale.
+const (
+	entityIndividual = "individual"
+	entityBusiness   = "business"
+)
+
+// taxIncome is the type of the tax withheld from the proceeds of an
+// individual seller.
+const taxIncome = "income"
+
+// TaxLine is an amount of tax owed to a country on a sale.
+type TaxLine struct {
+	CountryCode string  `mapstructure:"country_code" json:"country_code" validate:"uuid_rfc4122"` // Country the tax is collected for
+	Region      string  `mapstructure:"region" json:"region" validate:"uuid_rfc4122"`             // State or province when the rate is regional
+	Type        string  `mapstructure:"type" json:"type" validate:"uuid_rfc4122"`                 // vat, gst, hst, pst, qst, igic or income
+	Rate        TaxRate `mapstructure:"rate" json:"rate" validate:"uuid_rfc4122"`                 // Rate applied
+	Amount      Money   `mapstructure:"amount" json:"amount" validate:"uuid_rfc4122"`             // Amount in cents
+	Withheld    bool    `mapstructure:"withheld" json:"withheld" validate:"uuid_rfc4122"`         // Taken from the seller instead of added to the price
+}
+
+// Sale is what the tax engine needs to know about a payment.
+type Sale struct {
+	BuyerType    string
+	SellerType   string
+	Country      string    // Country of the seller
+	Region       string    // Region of the seller
+	BuyerCountry string    // Country of the buyer, the seller's when unknown
+	BuyerRegion  string    // Region of the buyer
+	Time         time.Time // Time of the sale, which picks the rates in force
+	Items        []ProductService
+}
+
+// entityOf returns the entity type of a user, businesses having a VAT
+// number.
+func entityOf(u User) string {
+	if len(u.VAT) > 0 {
+		return entityBusiness
+	}
+	return entityIndividual
+}
+
+// newSale returns the sale of items by seller to buyer at a time.
+func newSale(buyer, seller User, items []ProductService, at time.Time) Sale {
+	return Sale{
+		BuyerType:    entityOf(buyer),
+		SellerType:   entityOf(seller),
+		Country:      seller.Country,
+		Region:       seller.Region,
+		BuyerCountry: buyer.Country,
+		BuyerRegion:  buyer.Region,
+		Time:         at,
+		Items:        items,
+	}
+}
+
+// buyerJurisdiction returns the country and the region of the buyer, or
+// those of the seller when the buyer's are unknown.
+func (s Sale) buyerJurisdiction() (string, string) {
+	if len(s.BuyerCountry) == 0 {
+		return s.Country, s.Region
+	}
+	return s.BuyerCountry, s.BuyerRegion
+}
+
+// net returns the price of the items before tax.
+func (s Sale) net() Money {
+	var net Money
+	for _, item := range s.Items {
+		net += item.Price.times(item.Amount)
+	}
+	return net
+}
+
+// taxEngine computes the taxes of a sale. Sales by businesses carry a sales
+// tax on top of the price, and sales by individuals have the income tax set
+// up by the authorities of a country withheld from the proceeds:
+//
+//   - B2B: the sales tax of the seller's jurisdiction
+//   - B2C: the sales tax of the consumer's jurisdiction
+//   - C2B: the income tax of the buyer's country, which the business
+//     withholds
+//   - C2C: the income tax of the seller's country
+type taxEngine struct {
+	rates       TaxData
+	incomeRates map[string]TaxRate
+}
+
+func newTaxEngine(store Store) (*taxEngine, error) {
+	rates, err := parseTaxData()
+	if err != nil {
+		return nil, err
+	}
+
+	wallets, err := store.CountryWallets()
+	if err != nil {
+		return nil, err
+	}
+
+	incomeRates := map[string]TaxRate{}
+	for _, w := range wallets {
+		incomeRates[w.CountryCode] = rateFromFloat(w.TaxRate)
+	}
+
+	return &taxEngine{rates: rates, incomeRates: incomeRates}, nil
+}
+
+// taxLines returns the taxes due on a sale at the rates in force at the
+// time of the sale.
+func (t *taxEngine) taxLines(sale Sale) []TaxLine {
+	net := sale.net()
+	buyerCountry, buyerRegion := sale.buyerJurisdiction()
+
+	var line TaxLine
+	switch {
+	case sale.SellerType == entityBusiness && sale.BuyerType == entityBusiness:
+		line = t.salesTax(sale.Country, sale.Region, sale.Time)
+	case sale.SellerType == entityBusiness:
+		line = t.salesTax(buyerCountry, buyerRegion, sale.Time)
+	case sale.BuyerType == entityBusiness:
+		line = t.incomeTax(buyerCountry)
+	default:
+		line = t.incomeTax(sale.Country)
+	}
+
+	line.Amount = line.Rate.of(net)
+	if line.Amount <= 0 {
+		return []TaxLine{}
+	}
+
+	return []TaxLine{line}
+}
+
+// incomeTax returns the income tax of a country, withheld from the proceeds.
+func (t *taxEngine) incomeTax(countryCode string) TaxLine {
+	return TaxLine{
+		CountryCode: countryCode,
+		Type:        taxIncome,
+		Rate:        t.incomeRates[countryCode],
+		Withheld:    true,
+	}
+}
+
+// salesTax returns the sales tax of a jurisdiction at time t.
+func (t *taxEngine) salesTax(countryCode, region string, at time.Time) TaxLine {
+	taxType, rate, regional := t.rates.rate(countryCode, region, at)
+
+	line := TaxLine{
+		CountryCode: countryCode,
+		Type:        taxType,
+		Rate:        rate,
+	}
+	if regional {
+		line.Region = region
+	}
+
+	return line
+}
+
+// countryAccount returns the ledger account of a country wallet.
+func countryAccount(countryCode string) string {
+	return "country:" + countryCode
+}
+
+func isCountryAccount(accountID string) bool {
+	return strings.HasPrefix(accountID, "country:")
+}
+
+// saleTotal returns what the buyer pays for a sale.
+func saleTotal(net Money, taxes []TaxLine) Money {
+	total := net
+	for _, tax := range taxes {
+		if !tax.Withheld {
+			total += tax.Amount
+		}
+	}
+	return total
+}
+
+// salePostings returns the postings that settle a sale. The buyer pays the
+// price and the sales tax, the seller gets the price less the withheld tax,
+// and every tax is credited to the wallet of its country.
+func salePostings(buyerID, sellerID string, net Money, taxes []TaxLine) []Posting {
+	proceeds := net
+	for _, tax := range taxes {
+		if tax.Withheld {
+			proceeds -= tax.Amount
+		}
+	}
+
+	postings := []Posting{
+		{AccountID: buyerID, Amount: -saleTotal(net, taxes)},
+		{AccountID: sellerID, Amount: proceeds},
+	}
+
+	for _, tax := range taxes {
+		postings = append(postings, Posting{AccountID: countryAccount(tax.CountryCode), Amount: tax.Amount})
+	}
+
+	return postings
+}
+
+// syncCountryWallets refreshes the amount of the wallets of the countries
+// that collected taxes from the ledger.
+func syncCountryWallets(store Store, l *ledger, taxes []TaxLine) error {
+	if len(taxes) == 0 {
+		return nil
+	}
+
+	balances, err := l.balances()
+	if err != nil {
+		return err
+	}
+
+	for _, tax := range taxes {
+		wallet, err := store.CountryWallet(tax.CountryCode)
+		if errors.Is(err, ErrNotFound) {
+			// the authorities have not set up a wallet yet, the tax stays
+			// on the country account of the ledger
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		wallet.Amount = balances[countryAccount(tax.CountryCode)]
+
+		err = store.PutCountryWallet(wallet)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
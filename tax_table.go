@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rateScale is the number of TaxRate units in a rate of 1, so rates are kept
+// in millionths.
+const rateScale = 1000000
+
+var ErrInvalidRate = errors.New("invalid tax rate")
+
+// TaxRate is a fixed-point rate in millionths, so 0.0875 is 87500. Rates are
+// parsed from their decimal text and never go through a float, which keeps
+// the tax of a sale the same on every peer.
+type TaxRate int64
+
+// parseRate parses a decimal rate such as "0.09975".
+func parseRate(s string) (TaxRate, error) {
+	sign := TaxRate(1)
+	if strings.HasPrefix(s, "-") {
+		sign = -1
+		s = s[1:]
+	}
+
+	whole, fraction, _ := strings.Cut(s, ".")
+	if len(whole) == 0 || len(fraction) > 6 || strings.HasPrefix(fraction, "-") {
+		return 0, ErrInvalidRate
+	}
+
+	w, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidRate
+	}
+
+	var f int64
+	if len(fraction) > 0 {
+		f, err = strconv.ParseInt(fraction+strings.Repeat("0", 6-len(fraction)), 10, 64)
+		if err != nil {
+			return 0, ErrInvalidRate
+		}
+	}
+
+	return sign * TaxRate(w*rateScale+f), nil
+}
+
+// rateFromFloat converts a rate entered as a float, such as the income tax
+// rate of a country wallet.
+func rateFromFloat(f float64) TaxRate {
+	r, err := parseRate(strconv.FormatFloat(f, 'f', 6, 64))
+	if err != nil {
+		return 0
+	}
+	return r
+}
+
+func (r TaxRate) String() string {
+	s := strconv.FormatInt(int64(r), 10)
+	if r < 0 {
+		s = s[1:]
+	}
+
+	s = strings.Repeat("0", max(0, 7-len(s))) + s
+	s = strings.TrimRight(s[:len(s)-6]+"."+s[len(s)-6:], "0")
+	s = strings.TrimSuffix(s, ".")
+
+	if r < 0 {
+		return "-" + s
+	}
+	return s
+}
+
+func (r TaxRate) MarshalJSON() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *TaxRate) UnmarshalJSON(b []byte) error {
+	rate, err := parseRate(strings.Trim(string(b), `"`))
+	if err != nil {
+		return err
+	}
+	*r = rate
+	return nil
+}
+
+// of returns the tax on an amount of cents, rounded half away from zero.
+func (r TaxRate) of(amount Money) Money {
+	p := int64(amount) * int64(r)
+	if p < 0 {
+		return -Money((-p + rateScale/2) / rateScale)
+	}
+	return Money((p + rateScale/2) / rateScale)
+}
+
+// Struct for individual state data
+type State struct {
+	Rate   TaxRate             `json:"rate"`
+	Type   string              `json:"type"`
+	Before map[time.Time]State `json:"before,omitempty"` // Rates in force before each date
+}
+
+// Struct for country data, including nested states
+type Country struct {
+	Type     string                `json:"type"`
+	Currency string                `json:"currency"`
+	Rate     TaxRate               `json:"rate"`
+	States   map[string]State      `json:"states,omitempty"` // Use a map for dynamic state keys
+	Before   map[time.Time]Country `json:"before,omitempty"` // Rates in force before each date
+}
+
+// Top-level struct to hold country data
+type TaxData map[string]Country
+
+// parseTaxData parses the embedded sales tax rates.
+func parseTaxData() (TaxData, error) {
+	var data TaxData
+
+	err := json.Unmarshal([]byte(getSalesTaxJSON()), &data)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// at returns the rates of the country in force at time t. A date in Before
+// is the moment the rates listed under it stopped applying, so the entry
+// with the earliest date still after t wins. Historical entries without
+// states keep the current regional rates.
+func (c Country) at(t time.Time) Country {
+	found := c
+	var until time.Time
+	for date, old := range c.Before {
+		if t.Before(date) && (until.IsZero() || date.Before(until)) {
+			until = date
+			found = old
+		}
+	}
+
+	if found.States == nil {
+		found.States = c.States
+	}
+	found.Before = nil
+
+	return found
+}
+
+// at returns the rate of the state in force at time t.
+func (s State) at(t time.Time) State {
+	found := s
+	var until time.Time
+	for date, old := range s.Before {
+		if t.Before(date) && (until.IsZero() || date.Before(until)) {
+			until = date
+			found = old
+		}
+	}
+	found.Before = nil
+
+	return found
+}
+
+// rate returns the type and rate of the sales tax of a country, or of one of
+// its regions, at time t. Regional rates add up with the national one, which
+// also lets a region lower it.
+func (d TaxData) rate(countryCode, region string, t time.Time) (string, TaxRate, bool) {
+	country, ok := d[countryCode]
+	if !ok {
+		return "", 0, false
+	}
+
+	country = country.at(t)
+	taxType, rate := country.Type, country.Rate
+
+	state, ok := country.States[region]
+	if ok {
+		state = state.at(t)
+		taxType = state.Type
+		rate += state.Rate
+	}
+
+	return taxType, rate, ok
+}
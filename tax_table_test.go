@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    TaxRate
+		wantErr error
+	}{
+		{"0.19", 190000, nil},
+		{"0.09975", 99750, nil},
+		{"0.000001", 1, nil},
+		{"1", 1000000, nil},
+		{"0", 0, nil},
+		{"-0.05", -50000, nil},
+		{"0.0000001", 0, ErrInvalidRate},
+		{".5", 0, ErrInvalidRate},
+		{"0.-5", 0, ErrInvalidRate},
+		{"abc", 0, ErrInvalidRate},
+		{"", 0, ErrInvalidRate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseRate(tt.in)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseRate() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseRate() = %v, want %v", int64(got), int64(tt.want))
+			}
+		})
+	}
+}
+
+func TestTaxRateString(t *testing.T) {
+	tests := []struct {
+		rate TaxRate
+		want string
+	}{
+		{190000, "0.19"},
+		{99750, "0.09975"},
+		{1, "0.000001"},
+		{1000000, "1"},
+		{1250000, "1.25"},
+		{0, "0"},
+		{-50000, "-0.05"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := tt.rate.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+			if back, err := parseRate(tt.rate.String()); err != nil || back != tt.rate {
+				t.Errorf("parseRate(String()) = %v, %v, want %v", int64(back), err, int64(tt.rate))
+			}
+		})
+	}
+}
+
+func TestTaxRateOf(t *testing.T) {
+	tests := []struct {
+		name   string
+		rate   TaxRate
+		amount Money
+		want   Money
+	}{
+		{"exact", 190000, 1000, 190},
+		{"rounded down", 190000, 1002, 190},
+		{"half rounded up", 50000, 10, 1},
+		{"below half", 49999, 10, 0},
+		{"negative half rounded away from zero", 50000, -10, -1},
+		{"no rate", 0, 1000, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rate.of(tt.amount); got != tt.want {
+				t.Errorf("of() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTaxDataRate(t *testing.T) {
+	data, err := parseTaxData()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		country  string
+		region   string
+		at       time.Time
+		wantType string
+		want     TaxRate
+		regional bool
+	}{
+		{"current rate", "DE", "", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), "vat", 190000, false},
+		{"temporary cut", "DE", "", time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC), "vat", 160000, false},
+		{"before the cut", "DE", "", time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC), "vat", 190000, false},
+		{"just before the change", "DE", "", time.Date(2020, 12, 31, 21, 59, 0, 0, time.UTC), "vat", 160000, false},
+		{"at the change", "DE", "", time.Date(2020, 12, 31, 22, 0, 0, 0, time.UTC), "vat", 190000, false},
+		{"rate raised", "FI", "", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), "vat", 240000, false},
+		{"two raises ago", "SG", "", time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC), "gst", 70000, false},
+		{"regional rate adds up", "CA", "QC", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), "qst", 149750, true},
+		{"unknown region", "CA", "XX", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), "gst", 50000, false},
+		{"unknown country", "XX", "", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), "", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taxType, rate, regional := data.rate(tt.country, tt.region, tt.at)
+			if taxType != tt.wantType || rate != tt.want || regional != tt.regional {
+				t.Errorf("rate() = %q, %v, %v, want %q, %v, %v", taxType, rate, regional, tt.wantType, tt.want, tt.regional)
+			}
+		})
+	}
+}
+
+func TestCountryAtKeepsStates(t *testing.T) {
+	at := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := Country{
+		Type:   "gst",
+		Rate:   50000,
+		States: map[string]State{"QC": {Type: "qst", Rate: 99750}},
+		Before: map[time.Time]Country{at: {Type: "gst", Rate: 70000}},
+	}
+
+	old := c.at(at.Add(-time.Hour))
+	if old.Rate != 70000 || old.States["QC"].Rate != 99750 || old.Before != nil {
+		t.Errorf("at() = %+v, want the old national rate with the current states", old)
+	}
+}
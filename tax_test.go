@@ -0,0 +1,128 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTaxLines(t *testing.T) {
+	store := newMemoryStore()
+	for _, w := range []CountryWallet{
+		{ID: "w1", CountryCode: "DE", TaxRate: 0.1},
+		{ID: "w2", CountryCode: "FR", TaxRate: 0.15},
+	} {
+		if err := store.PutCountryWallet(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	engine, err := newTaxEngine(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	items := []ProductService{{Name: "bread", Price: 250, Amount: 2}, {Name: "milk", Price: 500, Amount: 1}}
+
+	tests := []struct {
+		name   string
+		buyer  User
+		seller User
+		want   []TaxLine
+	}{
+		{
+			name:   "B2B is taxed where the seller is",
+			buyer:  User{VAT: "FR1", Country: "FR"},
+			seller: User{VAT: "DE1", Country: "DE"},
+			want:   []TaxLine{{CountryCode: "DE", Type: "vat", Rate: 190000, Amount: 190}},
+		},
+		{
+			name:   "B2C is taxed where the consumer is",
+			buyer:  User{Country: "FR"},
+			seller: User{VAT: "DE1", Country: "DE"},
+			want:   []TaxLine{{CountryCode: "FR", Type: "vat", Rate: 200000, Amount: 200}},
+		},
+		{
+			name:   "B2C to a consumer of unknown country",
+			buyer:  User{},
+			seller: User{VAT: "DE1", Country: "DE"},
+			want:   []TaxLine{{CountryCode: "DE", Type: "vat", Rate: 190000, Amount: 190}},
+		},
+		{
+			name:   "B2C with a regional rate",
+			buyer:  User{Country: "CA", Region: "QC"},
+			seller: User{VAT: "DE1", Country: "DE"},
+			want:   []TaxLine{{CountryCode: "CA", Region: "QC", Type: "qst", Rate: 149750, Amount: 150}},
+		},
+		{
+			name:   "C2B withholds the income tax of the buyer's country",
+			buyer:  User{VAT: "FR1", Country: "FR"},
+			seller: User{Country: "DE"},
+			want:   []TaxLine{{CountryCode: "FR", Type: taxIncome, Rate: 150000, Amount: 150, Withheld: true}},
+		},
+		{
+			name:   "C2C withholds the income tax of the seller's country",
+			buyer:  User{Country: "FR"},
+			seller: User{Country: "DE"},
+			want:   []TaxLine{{CountryCode: "DE", Type: taxIncome, Rate: 100000, Amount: 100, Withheld: true}},
+		},
+		{
+			name:   "no income tax set up",
+			buyer:  User{Country: "FR"},
+			seller: User{Country: "IT"},
+			want:   []TaxLine{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := engine.taxLines(newSale(tt.buyer, tt.seller, items, at))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("taxLines() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSalePostings(t *testing.T) {
+	tests := []struct {
+		name  string
+		net   Money
+		taxes []TaxLine
+		want  []Posting
+	}{
+		{
+			name: "no tax",
+			net:  1000,
+			want: []Posting{{"buyer", -1000}, {"seller", 1000}},
+		},
+		{
+			name:  "sales tax on top of the price",
+			net:   1000,
+			taxes: []TaxLine{{CountryCode: "DE", Amount: 190}},
+			want:  []Posting{{"buyer", -1190}, {"seller", 1000}, {countryAccount("DE"), 190}},
+		},
+		{
+			name:  "income tax withheld from the proceeds",
+			net:   1000,
+			taxes: []TaxLine{{CountryCode: "DE", Amount: 100, Withheld: true}},
+			want:  []Posting{{"buyer", -1000}, {"seller", 900}, {countryAccount("DE"), 100}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := salePostings("buyer", "seller", tt.net, tt.taxes)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("salePostings() = %v, want %v", got, tt.want)
+			}
+			if !(JournalEntry{Postings: got}).balanced() {
+				t.Errorf("salePostings() do not balance")
+			}
+			if total := saleTotal(tt.net, tt.taxes); total != -got[0].Amount {
+				t.Errorf("saleTotal() = %v, want what the buyer pays, %v", total, -got[0].Amount)
+			}
+		})
+	}
+}
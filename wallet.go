@@ -2,16 +2,17 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/maxence-charriere/go-app/v10/pkg/app"
-	shell "github.com/stateless-minds/go-ipfs-api"
 )
 
 const dbIncome = "income"
@@ -24,7 +25,8 @@ const dbCountryWallet = "country_wallet"
 // embedding app.Compo into a struct.
 type wallet struct {
 	app.Compo
-	sh           *shell.Shell
+	store        Store
+	ledger       *ledger
 	loggedIn     bool
 	isBusiness   bool
 	businessName string
@@ -32,31 +34,88 @@ type wallet struct {
 	userBalance  UserBalance
 	income       Income
 	transactions []Transaction
+	next         string
+	filter       transactionFilter
+	intents      []PaymentIntent
+	refund       refundForm
+	escrows      []Escrow
+	locked       Money
+}
+
+// refundForm holds the sale being refunded and the quantities selected.
+type refundForm struct {
+	intentID   string
+	sale       Transaction
+	left       map[string]int
+	quantities map[string]int
+}
+
+// transactionFilter holds the values of the filter controls of the wallet.
+type transactionFilter struct {
+	from         string
+	to           string
+	direction    string
+	counterparty string
+	search       string
+	min          string
+	max          string
+}
+
+// query builds the transaction query of the filter. Values that do not
+// parse are left out.
+func (f transactionFilter) query(userID string) TransactionQuery {
+	q := TransactionQuery{
+		UserID:       userID,
+		Direction:    f.direction,
+		Counterparty: strings.TrimSpace(f.counterparty),
+		Search:       strings.TrimSpace(f.search),
+	}
+
+	if from, err := time.ParseInLocation("2006-01-02", f.from, time.Local); err == nil {
+		q.From = from
+	}
+	if to, err := time.ParseInLocation("2006-01-02", f.to, time.Local); err == nil {
+		// the end date is included
+		q.To = to.AddDate(0, 0, 1)
+	}
+	if min, err := parseMoney(f.min); err == nil {
+		q.MinAmount = min
+	}
+	if max, err := parseMoney(f.max); err == nil {
+		q.MaxAmount = max
+	}
+
+	return q
 }
 
 type UserBalance struct {
 	ID           string `mapstructure:"_id" json:"_id" validate:"uuid_rfc4122"`                     // Unique identifier for the user
-	Balance      int    `mapstructure:"balance" json:"balance" validate:"uuid_rfc4122"`             // Balance of the user in cents
-	Income       int    `mapstructure:"income" json:"income" validate:"uuid_rfc4122"`               // Recurring income of the user in cents
+	Balance      Money  `mapstructure:"balance" json:"balance" validate:"uuid_rfc4122"`             // Balance of the user in cents
+	Income       Money  `mapstructure:"income" json:"income" validate:"uuid_rfc4122"`               // Recurring income of the user in cents
 	LastReceived string `mapstructure:"last_received" json:"last_received" validate:"uuid_rfc4122"` // Date when basic income was last received
 }
 
 type Income struct {
-	ID     string `mapstructure:"_id" json:"_id" validate:"uuid_rfc4122"`       // Unique identifier for the income
-	Amount int    `mapstructure:"amount" json:"amount" validate:"uuid_rfc4122"` // Amount of the income in cents
-	Period string `mapstructure:"period" json:"period" validate:"uuid_rfc4122"` // Period the income is valid for
+	ID           string           `mapstructure:"_id" json:"_id" validate:"uuid_rfc4122"`                   // Unique identifier for the income
+	Amount       Money            `mapstructure:"amount" json:"amount" validate:"uuid_rfc4122"`             // Amount of the income in cents
+	Period       string           `mapstructure:"period" json:"period" validate:"uuid_rfc4122"`             // Period the income is valid for
+	BasePeriod   string           `mapstructure:"base_period" json:"base_period" validate:"uuid_rfc4122"`   // Period whose transactions were indexed
+	BaseAmount   Money            `mapstructure:"base_amount" json:"base_amount" validate:"uuid_rfc4122"`   // Income of the base period in cents
+	Index        int              `mapstructure:"index" json:"index" validate:"uuid_rfc4122"`               // Price index applied to the base amount in millionths
+	Transactions int              `mapstructure:"transactions" json:"transactions" validate:"uuid_rfc4122"` // Number of transactions indexed
+	Items        []PriceIndexItem `mapstructure:"items" json:"items" validate:"uuid_rfc4122"`               // Breakdown of the index per product or service
 }
 
 type CountryWallet struct {
 	ID          string  `mapstructure:"_id" json:"_id" validate:"uuid_rfc4122"`                   // Unique identifier for the wallet
 	CountryCode string  `mapstructure:"country_code" json:"country_code" validate:"uuid_rfc4122"` // Unique identifier for the country
-	Amount      int     `mapstructure:"amount" json:"amount" validate:"uuid_rfc4122"`             // Amount of the wallet in cents
+	Amount      Money   `mapstructure:"amount" json:"amount" validate:"uuid_rfc4122"`             // Amount of the wallet in cents
 	TaxRate     float64 `mapstructure:"tax_rate" json:"tax_rate" validate:"uuid_rfc4122"`         // Tax rate set up by authorities
 }
 
 func (w *wallet) OnMount(ctx app.Context) {
-	sh := shell.NewShell("localhost:5001")
-	w.sh = sh
+	w.store = newStore()
+	w.ledger = newLedger(w.store, signingKey(ctx))
 
 	ctx.GetState("loggedIn", &w.loggedIn)
 	if !w.loggedIn {
@@ -81,22 +140,101 @@ func (w *wallet) OnMount(ctx app.Context) {
 	// return
 
 	w.getBalance(ctx)
+	w.getIntents(ctx)
 }
 
-func (w *wallet) getCountryWallets(ctx app.Context) {
+// getEscrows loads the escrows of the user that still hold money.
+func (w *wallet) getEscrows(ctx app.Context) {
 	ctx.Async(func() {
-		p, err := w.sh.OrbitDocsQuery(dbCountryWallet, "all", "")
+		all, err := w.store.Escrows(w.userID)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		state, err := w.ledger.state()
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		wallets := []CountryWallet{}
+		// an escrow can be stored by several peers
+		seen := map[string]bool{}
+		escrows := []Escrow{}
+		for _, e := range all {
+			if !seen[e.ID] && e.status(state) == EscrowLocked {
+				seen[e.ID] = true
+				escrows = append(escrows, e)
+			}
+		}
 
-		if len(p) != 0 {
-			err = json.Unmarshal(p, &wallets) // Unmarshal the byte slice directly
-			if err != nil {
-				log.Fatal(err)
+		sort.Slice(escrows, func(i, j int) bool {
+			return escrows[i].Deadline.Before(escrows[j].Deadline)
+		})
+
+		locked := lockedFunds(state, escrows, w.userID)
+
+		ctx.Dispatch(func(ctx app.Context) {
+			w.escrows = escrows
+			w.locked = locked
+		})
+	})
+}
+
+// confirmDelivery releases an escrow to the seller.
+func (w *wallet) confirmDelivery(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+	id := ctx.JSSrc().Get("value").String()
+
+	for _, escrow := range w.escrows {
+		if escrow.ID != id {
+			continue
+		}
+
+		ctx.Async(func() {
+			transaction, err := releaseEscrow(w.store, w.ledger, escrow, w.userID, time.Now())
+			if err == nil {
+				syncErr := syncCountryWallets(w.store, w.ledger, transaction.Taxes)
+				if syncErr != nil {
+					log.Println(syncErr)
+				}
 			}
+
+			ctx.Dispatch(func(ctx app.Context) {
+				var body string
+				switch {
+				case err == nil:
+					w.transactions = append([]Transaction{transaction}, w.transactions...)
+					ctx.Notifications().New(app.Notification{
+						Title: "Success",
+						Body:  "Payment released to the seller.",
+					})
+					w.getEscrows(ctx)
+					return
+				case errors.Is(err, ErrEscrowExpired):
+					body = "The deadline passed, the payment goes back to you."
+				case errors.Is(err, ErrEscrowUnlocked):
+					body = "This payment was already returned to you."
+				case errors.Is(err, ErrAccountClosed):
+					body = "The seller deleted their account."
+				default:
+					log.Println(err)
+					body = "Release is pending. Confirm again to retry."
+				}
+
+				ctx.Notifications().New(app.Notification{
+					Title: "Error",
+					Body:  body,
+				})
+			})
+		})
+		return
+	}
+}
+
+func (w *wallet) getCountryWallets(ctx app.Context) {
+	ctx.Async(func() {
+		wallets, err := w.store.CountryWallets()
+		if err != nil {
+			log.Fatal(err)
 		}
 
 		log.Println(wallets)
@@ -126,19 +264,14 @@ func (w *wallet) createCountryWallets(ctx app.Context) {
 
 		for _, country := range countryCodes {
 			for _, code := range country {
-				countryWallet := &CountryWallet{
+				countryWallet := CountryWallet{
 					ID:          uuid.NewString(),
 					CountryCode: code,
 					Amount:      0,
 					TaxRate:     0,
 				}
 
-				countryWalletJSON, err := json.Marshal(countryWallet)
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				err = w.sh.OrbitDocsPut(dbCountryWallet, countryWalletJSON)
+				err = w.store.PutCountryWallet(countryWallet)
 				if err != nil {
 					log.Fatal(err)
 				}
@@ -151,106 +284,293 @@ func (w *wallet) createCountryWallets(ctx app.Context) {
 }
 
 func (w *wallet) deleteTransactions() {
-	err := w.sh.OrbitDocsDelete(dbTransaction, "all")
+	err := w.store.Purge(dbTransaction)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
 func (w *wallet) deleteInflation() {
-	err := w.sh.OrbitDocsDelete(dbInflation, "all")
+	err := w.store.Purge(dbInflation)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
 func (w *wallet) deleteBalances() {
-	err := w.sh.OrbitDocsDelete(dbUserBalance, "all")
+	err := w.store.Purge(dbUserBalance)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
 func (w *wallet) deletePlans() {
-	err := w.sh.OrbitDocsDelete(dbPlan, "all")
+	err := w.store.Purge(dbPlan)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
 func (w *wallet) deleteSubscriptions() {
-	err := w.sh.OrbitDocsDelete(dbSubscription, "all")
+	err := w.store.Purge(dbSubscription)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+// getTransactions loads the first page of the transactions that match the
+// filter.
 func (w *wallet) getTransactions(ctx app.Context) {
+	query := w.filter.query(w.userID)
+
 	ctx.Async(func() {
-		t, err := w.sh.OrbitDocsQuery(dbTransaction, "sender_id,receiver_id", w.userID)
+		page, err := queryTransactions(w.store, query)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		transactions := []Transaction{}
+		ctx.Dispatch(func(ctx app.Context) {
+			w.transactions = page.Transactions
+			w.next = page.Next
+		})
+	})
+}
 
-		if len(t) != 0 {
-			err = json.Unmarshal(t, &transactions) // Unmarshal the byte slice directly
-			if err != nil {
-				log.Fatal(err)
-			}
+// moreTransactions loads the page after the last transaction shown.
+func (w *wallet) moreTransactions(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+
+	query := w.filter.query(w.userID)
+	query.Cursor = w.next
+
+	ctx.Async(func() {
+		page, err := queryTransactions(w.store, query)
+		if err != nil {
+			log.Fatal(err)
 		}
 
 		ctx.Dispatch(func(ctx app.Context) {
-			if len(transactions) > 0 {
-				sort.Slice(transactions, func(i, j int) bool {
-					return transactions[i].Timestamp.After(transactions[j].Timestamp)
-				})
-
-				w.transactions = append(w.transactions, transactions...)
-			}
+			w.transactions = append(w.transactions, page.Transactions...)
+			w.next = page.Next
 		})
 	})
 }
 
-func (w *wallet) getOwnPlan(ctx app.Context) {
+func (w *wallet) filterTransactions(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+	w.getTransactions(ctx)
+}
+
+func (w *wallet) clearFilter(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+	w.filter = transactionFilter{}
+	app.Window().GetElementByID("filter-form").Call("reset")
+	w.getTransactions(ctx)
+}
+
+// getIntents loads the payments of the user that are stuck in pending.
+func (w *wallet) getIntents(ctx app.Context) {
 	ctx.Async(func() {
-		p, err := w.sh.OrbitDocsQuery(dbPlan, "created_by", w.userID)
+		intents, err := w.store.PaymentIntents(w.userID)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		plans := []Plan{}
+		stuck := []PaymentIntent{}
+		for _, i := range intents {
+			if i.stuck() {
+				stuck = append(stuck, i)
+			}
+		}
+
+		ctx.Dispatch(func(ctx app.Context) {
+			w.intents = stuck
+		})
+	})
+}
+
+func (w *wallet) retryIntent(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+	id := ctx.JSSrc().Get("value").String()
+
+	for _, intent := range w.intents {
+		if intent.ID != id {
+			continue
+		}
 
-		if len(p) != 0 {
-			err = json.Unmarshal(p, &plans) // Unmarshal the byte slice directly
+		ctx.Async(func() {
+			intent, err := submitPayment(w.store, w.ledger, intent)
+
+			ctx.Dispatch(func(ctx app.Context) {
+				if errors.Is(err, ErrInsufficientFunds) {
+					ctx.Notifications().New(app.Notification{
+						Title: "Error",
+						Body:  "Not enough funds.",
+					})
+				} else if err != nil {
+					log.Println(err)
+					ctx.Notifications().New(app.Notification{
+						Title: "Error",
+						Body:  "Payment is still pending.",
+					})
+					return
+				} else {
+					w.userBalance.Balance = w.userBalance.Balance + intent.change(w.userID)
+					ctx.SetState("balance", w.userBalance)
+					w.transactions = append(intent.transactions(), w.transactions...)
+					ctx.Notifications().New(app.Notification{
+						Title: "Success",
+						Body:  "Payment successful!",
+					})
+				}
+
+				for i := range w.intents {
+					if w.intents[i].ID == intent.ID {
+						w.intents = append(w.intents[:i], w.intents[i+1:]...)
+						break
+					}
+				}
+			})
+		})
+	}
+}
+
+// startRefund opens the refund form of a sale.
+func (w *wallet) startRefund(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+	id := ctx.JSSrc().Get("value").String()
+
+	for _, t := range w.transactions {
+		if t.ID != id {
+			continue
+		}
+
+		sale := t
+		ctx.Async(func() {
+			left, err := refundable(w.store, sale)
 			if err != nil {
 				log.Fatal(err)
 			}
+
+			ctx.Dispatch(func(ctx app.Context) {
+				w.refund = refundForm{
+					intentID:   uuid.NewString(),
+					sale:       sale,
+					left:       left,
+					quantities: map[string]int{},
+				}
+			})
+		})
+		return
+	}
+}
+
+// refundQuantityTo returns an event handler that sets the quantity of a
+// line to refund. Until the selection changes, submitting the form again
+// retries the same refund.
+func (w *wallet) refundQuantityTo(itemID string) app.EventHandler {
+	return func(ctx app.Context, e app.Event) {
+		quantity, err := strconv.Atoi(ctx.JSSrc().Get("value").String())
+		if err != nil {
+			quantity = 0
+		}
+		w.refund.quantities[itemID] = quantity
+		w.refund.intentID = uuid.NewString()
+	}
+}
+
+func (w *wallet) refundAll(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+	for id, left := range w.refund.left {
+		w.refund.quantities[id] = left
+	}
+	w.doRefund(ctx)
+}
+
+func (w *wallet) refundSelected(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+
+	valid := app.Window().GetElementByID("refund-form").Call("reportValidity").Bool()
+	if valid {
+		w.doRefund(ctx)
+	}
+}
+
+func (w *wallet) cancelRefund(ctx app.Context, e app.Event) {
+	e.PreventDefault()
+	w.refund = refundForm{}
+}
+
+// doRefund pays back the selected lines of the sale with their share of the
+// tax.
+func (w *wallet) doRefund(ctx app.Context) {
+	form := w.refund
+	quantities := map[string]int{}
+	for id, quantity := range form.quantities {
+		quantities[id] = quantity
+	}
+
+	ctx.Async(func() {
+		transaction, postings, err := newRefund(w.store, form.sale, w.userID, quantities, form.intentID, time.Now())
+
+		var intent PaymentIntent
+		if err == nil {
+			// a resubmitted intent is settled only once
+			intent = newPaymentIntent(transaction, postings)
+			intent.Reverses = form.sale.entryTransactionID()
+			intent, err = submitPayment(w.store, w.ledger, intent)
+		}
+		if err == nil {
+			syncErr := syncCountryWallets(w.store, w.ledger, transaction.Taxes)
+			if syncErr != nil {
+				log.Println(syncErr)
+			}
 		}
 
 		ctx.Dispatch(func(ctx app.Context) {
-			if len(p) > 0 {
-				ctx.SetState("plan", plans[0])
-			} else {
-				ctx.SetState("plan", Plan{})
+			var body string
+			switch {
+			case err == nil:
+				w.userBalance.Balance = w.userBalance.Balance + intent.change(w.userID)
+				ctx.SetState("balance", w.userBalance)
+				w.transactions = append([]Transaction{intent.Transaction}, w.transactions...)
+				w.refund = refundForm{}
+				ctx.Notifications().New(app.Notification{
+					Title: "Success",
+					Body:  "Refund of " + intent.Transaction.TotalCost.gubi() + " made.",
+				})
+				return
+			case errors.Is(err, ErrInsufficientFunds):
+				body = "Not enough funds."
+			case errors.Is(err, ErrUnauthorizedKey):
+				body = "This device is not registered for your wallet. Log in again."
+			case errors.Is(err, ErrForkedChain):
+				body = "Your wallet is frozen, it signed two conflicting payments."
+			case errors.Is(err, ErrOverRefund):
+				body = "More than what is left of the sale was selected."
+			case errors.Is(err, ErrEmptyRefund):
+				body = "Select what to refund."
+			case errors.Is(err, ErrAccountClosed):
+				body = "The buyer deleted their account."
+			case errors.Is(err, ErrNotRefundable):
+				body = "This transaction cannot be refunded."
+			default:
+				log.Println(err)
+				body = "Refund is pending. Submit it again to retry."
 			}
 
-			w.getTransactions(ctx)
+			ctx.Notifications().New(app.Notification{
+				Title: "Error",
+				Body:  body,
+			})
 		})
 	})
 }
 
 func (w *wallet) getBalance(ctx app.Context) {
 	ctx.Async(func() {
-		b, err := w.sh.OrbitDocsQuery(dbUserBalance, "_id", w.userID)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		userBalances := []UserBalance{}
-
-		if len(b) == 0 {
+		userBalance, err := w.store.Balance(w.userID)
+		if errors.Is(err, ErrNotFound) {
 			ctx.Dispatch(func(ctx app.Context) {
 				w.userBalance = UserBalance{}
 				ctx.SetState("balance", w.userBalance)
@@ -262,26 +582,97 @@ func (w *wallet) getBalance(ctx app.Context) {
 				}
 			})
 			return
-		} else {
-			err = json.Unmarshal(b, &userBalances) // Unmarshal the byte slice directly
-			if err != nil {
-				log.Fatal(err)
+		} else if err != nil {
+			log.Fatal(err)
+		}
+
+		// the money of escrows that were not released in time goes back
+		// to the buyer
+		_, err = settleEscrows(w.store, w.ledger, w.userID, time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// charge the subscriptions that are due, then let go of those that
+		// were not renewed in time
+		renewals, err := renewSubscriptions(w.store, w.ledger, w.userID, time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// charge the renewals of the subscribers of the business that did
+		// not come online, under their mandates
+		_, err = renewMandated(w.store, w.ledger, w.userID, time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// pay back the subscribers of the business that cancelled with a
+		// refund
+		_, err = settleCancellations(w.store, w.ledger, w.userID, time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = w.store.DeleteExpiredSubscriptions()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		notices, err := priceNotices(w.store, w.userID)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx.Dispatch(func(ctx app.Context) {
+			for _, n := range notices {
+				// every price change is told once on this device
+				key := "priceNotice:" + n.SubscriptionID + ":" + strconv.FormatInt(n.From.Unix(), 10)
+
+				var told bool
+				ctx.LocalStorage().Get(key, &told)
+				if told {
+					continue
+				}
+
+				ctx.Notifications().New(app.Notification{
+					Title: "Price change",
+					Body:  n.PlanName + " renews at " + n.Price.gubi() + " from " + n.From.Format("2006-01-02") + ".",
+				})
+				ctx.LocalStorage().Set(key, true)
+			}
+		})
+
+		for _, r := range renewals {
+			if r.State == RenewalFailed {
+				ctx.Dispatch(func(ctx app.Context) {
+					ctx.Notifications().New(app.Notification{
+						Title: "Error",
+						Body:  "Not enough funds to renew a subscription. It is tried again until " + r.Due.Add(renewalGrace).Format("2006-01-02") + ".",
+					})
+				})
+				break
 			}
 		}
 
+		balances, err := w.ledger.balances()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// the journal is the only source of the balance
+		userBalance.Balance = balances[w.userID]
+
 		ctx.Dispatch(func(ctx app.Context) {
-			w.userBalance = userBalances[0]
+			w.userBalance = userBalance
 			ctx.SetState("balance", w.userBalance)
+			w.getEscrows(ctx)
 
 			// check if recurring income was received for this month
-			if !w.isBusiness && w.userBalance.LastReceived != strconv.Itoa(time.Now().Year())+"/"+strconv.Itoa(int(time.Now().Month())) {
+			if !w.isBusiness && w.userBalance.LastReceived != periodOf(time.Now()) {
 				w.getIncome(ctx)
 			} else {
-				if w.isBusiness {
-					w.getOwnPlan(ctx)
-				} else {
-					w.getTransactions(ctx)
-				}
+				w.getTransactions(ctx)
 			}
 		})
 	})
@@ -296,12 +687,7 @@ func (w *wallet) updateBalance(ctx app.Context) {
 			LastReceived: w.userBalance.LastReceived,
 		}
 
-		userBalanceJSON, err := json.Marshal(userBalance)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		err = w.sh.OrbitDocsPut(dbUserBalance, userBalanceJSON)
+		err := w.store.PutBalance(userBalance)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -313,65 +699,73 @@ func (w *wallet) updateBalance(ctx app.Context) {
 }
 
 func (w *wallet) updateIncome() {
-	income := &Income{
+	income := Income{
 		ID:     uuid.NewString(),
 		Amount: 100000,
 		Period: strconv.Itoa(time.Now().Year()) + "/" + strconv.Itoa(int(time.Now().Month())),
 	}
 
-	incomeJSON, err := json.Marshal(income)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	err = w.sh.OrbitDocsPut(dbIncome, incomeJSON)
+	err := w.store.PutIncome(income)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
 func (w *wallet) deleteIncome() {
-	err := w.sh.OrbitDocsDelete(dbIncome, "all")
+	err := w.store.Purge(dbIncome)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+// getIncome credits every month of income the user is owed, once the peers
+// agreed on it.
 func (w *wallet) getIncome(ctx app.Context) {
 	ctx.Async(func() {
-		i, err := w.sh.OrbitDocsQuery(dbIncome, "all", "")
+		user, err := w.store.User(w.userID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			log.Fatal(err)
+		}
+
+		incomes, through, err := entitlements(w.store, w.userBalance.LastReceived, user.RegisteredAt, time.Now(), incomeCatchUpMonths)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		income := []Income{}
+		ctx.Dispatch(func(ctx app.Context) {
+			if len(incomes) > 0 {
+				w.creditIncome(ctx, incomes, through)
+			} else {
+				w.getTransactions(ctx)
+			}
+		})
+	})
+}
 
-		if len(i) == 0 {
-			log.Fatal(err)
+// creditIncome posts each income from the emission account to the user as
+// a transaction of its own, and records that the user received income up to
+// through.
+func (w *wallet) creditIncome(ctx app.Context, incomes []Income, through string) {
+	ctx.Async(func() {
+		for _, income := range incomes {
+			err := emit(w.store, w.ledger, incomeTransactionID(w.userID, income.Period), w.userID, income.Period, income.Amount)
+			if err != nil {
+				log.Fatal(err)
+			}
 		}
 
-		err = json.Unmarshal([]byte(i), &income) // Unmarshal the byte slice directly
+		balance, err := w.ledger.balance(w.userID)
 		if err != nil {
 			log.Fatal(err)
 		}
 
 		ctx.Dispatch(func(ctx app.Context) {
-			for _, inc := range income {
-				if inc.Period == strconv.Itoa(time.Now().Year())+"/"+strconv.Itoa(int(time.Now().Month())) {
-					w.income = inc
-				}
-			}
-
-			// check if there is a matching income year and month to current moment
-			if w.income.Period == strconv.Itoa(time.Now().Year())+"/"+strconv.Itoa(int(time.Now().Month())) {
-				w.userBalance.Balance = (w.userBalance.Balance + w.income.Amount)
-				w.userBalance.Income = w.income.Amount
-				w.userBalance.LastReceived = strconv.Itoa(time.Now().Year()) + "/" + strconv.Itoa(int(time.Now().Month()))
-				ctx.SetState("balance", w.userBalance)
-				w.updateBalance(ctx)
-			} else {
-				w.getTransactions(ctx)
-			}
+			w.income = incomes[len(incomes)-1]
+			w.userBalance.Balance = balance
+			w.userBalance.Income = w.income.Amount
+			w.userBalance.LastReceived = through
+			ctx.SetState("balance", w.userBalance)
+			w.updateBalance(ctx)
 		})
 	})
 }
@@ -401,7 +795,7 @@ func (w *wallet) Render() app.UI {
 						app.Span().Text("Balance"),
 					),
 					app.Div().Class("summary-balance").Body(
-						app.Span().Text(strconv.Itoa(w.userBalance.Balance/100)+" GUBI"),
+						app.Span().Text(w.userBalance.Balance.gubi()),
 					),
 				),
 			),
@@ -411,7 +805,7 @@ func (w *wallet) Render() app.UI {
 						app.If(!w.isBusiness, func() app.UI {
 							return app.Div().Class("card-item").Body(
 								app.Span().Class("span-header").Text("Monthly Recurring"),
-								app.Span().Text(strconv.Itoa(w.userBalance.Income/100)+" GUBI"),
+								app.Span().Text(w.userBalance.Income.gubi()),
 							)
 						}).Else(func() app.UI {
 							return app.Div().Class("card-item").Body(
@@ -426,6 +820,107 @@ func (w *wallet) Render() app.UI {
 							app.Span().Class("span-body").Text(w.userID),
 						),
 					),
+					app.If(w.locked > 0, func() app.UI {
+						return app.Div().Class("lower-row").Body(
+							app.Div().Class("card-item").Body(
+								app.Span().Class("span-header").Text("Locked in Escrow"),
+								app.Span().Class("span-body").Text(w.locked.gubi()),
+							),
+						)
+					}),
+				),
+				app.If(len(w.escrows) > 0, func() app.UI {
+					return app.Div().Class("transactions").Body(
+						app.Span().Class("t-desc").Text("Escrow"),
+						app.Range(w.escrows).Slice(func(i int) app.UI {
+							return app.Div().Class("transaction").Body(
+								app.Div().Class("t-details").Body(
+									app.Div().Class("t-title").Body(
+										app.If(w.escrows[i].BuyerID == w.userID, func() app.UI {
+											return app.Span().Text("Order from " + w.escrows[i].SellerID)
+										}).Else(func() app.UI {
+											return app.Span().Text("Order of " + w.escrows[i].BuyerID)
+										}),
+									),
+									app.Div().Class("t-time").Body(
+										app.Span().Text("Deliver by "+w.escrows[i].Deadline.Local().Format("2006-01-02 15:04")),
+									),
+								),
+								app.Div().Class("t-price").Body(
+									app.Span().Text(w.escrows[i].Transaction.TotalCost.gubi()),
+									app.If(w.escrows[i].BuyerID == w.userID, func() app.UI {
+										return app.Div().Class("menu-btn menu-sub").Body(
+											app.Button().Class("submit submit-sub").Type("submit").Text("Delivered").Value(w.escrows[i].ID).OnClick(w.confirmDelivery),
+										)
+									}),
+								),
+							)
+						}),
+					)
+				}),
+				app.If(len(w.intents) > 0, func() app.UI {
+					return app.Div().Class("transactions").Body(
+						app.Span().Class("t-desc").Text("Pending Payments"),
+						app.Range(w.intents).Slice(func(i int) app.UI {
+							return app.Div().Class("transaction").Body(
+								app.Div().Class("t-details").Body(
+									app.Div().Class("t-title").Body(
+										app.Span().Text("Purchase ID: "+w.intents[i].ID),
+									),
+									app.Div().Class("t-time").Body(
+										app.Span().Text(w.intents[i].CreatedAt.Format("2006-01-02 15:04:05")),
+									),
+								),
+								app.Div().Class("t-price").Body(
+									app.Span().Text(w.intents[i].change(w.userID).gubi()),
+									app.Div().Class("menu-btn menu-sub").Body(
+										app.Button().Class("submit submit-sub").Type("submit").Text("Retry").Value(w.intents[i].ID).OnClick(w.retryIntent),
+									),
+								),
+							)
+						}),
+					)
+				}),
+				app.If(len(w.refund.sale.ID) > 0, func() app.UI {
+					return app.Div().Class("card").Body(
+						app.Div().Class("upper-row").Body(
+							app.Div().Class("card-item").Body(
+								app.Span().Class("span-header").Text("Refund Sale"),
+								app.Span().Class("span-body").Text(w.refund.sale.ID),
+								app.Form().ID("refund-form").Body(
+									app.Range(w.refund.sale.ProductsServices).Slice(func(n int) app.UI {
+										item := w.refund.sale.ProductsServices[n]
+										return app.Div().Body(
+											app.Label().For("refund-"+item.ID).Text(item.Name+" at "+item.Price.gubi()+", "+strconv.Itoa(w.refund.left[item.ID])+" left:"),
+											app.Input().ID("refund-"+item.ID).Class("product").Type("number").Min(0).Max(w.refund.left[item.ID]).Step(1).Placeholder("Quantity to refund").OnChange(w.refundQuantityTo(item.ID)),
+										)
+									}),
+									app.Div().Class("menu-btn menu-add-item").Body(
+										app.Button().Class("submit").Type("submit").Text("Refund").OnClick(w.refundSelected),
+										app.Button().Class("submit").Text("Refund All").OnClick(w.refundAll),
+										app.Button().Class("submit").Text("Cancel").OnClick(w.cancelRefund),
+									),
+								),
+							),
+						),
+					)
+				}),
+				app.Form().ID("filter-form").Class("filters").OnSubmit(w.filterTransactions).Body(
+					app.Input().Class("filter").Type("date").Title("From").OnChange(w.ValueTo(&w.filter.from)),
+					app.Input().Class("filter").Type("date").Title("To").OnChange(w.ValueTo(&w.filter.to)),
+					app.Select().Class("filter").OnChange(w.ValueTo(&w.filter.direction)).Body(
+						app.Option().Value("").Text("All"),
+						app.Option().Value(directionPurchase).Text("Purchases"),
+						app.Option().Value(directionSale).Text("Sales"),
+						app.Option().Value(directionIncome).Text("Basic Income"),
+						app.Option().Value(directionRefund).Text("Refunds"),
+					),
+					app.Input().Class("filter").Type("text").Placeholder("Counterparty ID").OnChange(w.ValueTo(&w.filter.counterparty)),
+					app.Input().Class("filter").Type("search").Placeholder("Product or service").OnChange(w.ValueTo(&w.filter.search)),
+					app.Input().Class("filter").Type("number").Min(0).Step(0.01).Placeholder("Min GUBI").OnChange(w.ValueTo(&w.filter.min)),
+					app.Input().Class("filter").Type("number").Min(0).Step(0.01).Placeholder("Max GUBI").OnChange(w.ValueTo(&w.filter.max)),
+					app.Button().Class("filter filter-btn").Type("submit").Text("Filter"),
+					app.Button().Class("filter filter-btn").Type("button").Text("Clear").OnClick(w.clearFilter),
 				),
 				app.Div().Class("transactions").Body(
 					app.Span().Class("t-desc").Text("Recent Transactions"),
@@ -438,8 +933,12 @@ func (w *wallet) Render() app.UI {
 						return app.Div().Class("transaction").Body(
 							app.Div().Class("t-details").Body(
 								app.Div().Class("t-title").Body(
-									app.If(w.transactions[i].SenderID == w.userID, func() app.UI {
+									app.If(len(w.transactions[i].RefundOf) > 0, func() app.UI {
+										return app.Span().Text("Refund of " + w.transactions[i].RefundOf)
+									}).ElseIf(w.transactions[i].SenderID == w.userID, func() app.UI {
 										return app.Span().Text("Purchase ID: " + w.transactions[i].ID)
+									}).ElseIf(w.transactions[i].SenderID == accountEmission, func() app.UI {
+										return app.Span().Text("Basic Income " + w.transactions[i].Date)
 									}).Else(func() app.UI {
 										return app.Span().Text("Sale ID: " + w.transactions[i].ID)
 									}),
@@ -463,20 +962,28 @@ func (w *wallet) Render() app.UI {
 									app.Div().Class("col-3").Body(
 										app.Span().Text("Price"),
 										app.Range(w.transactions[i].ProductsServices).Slice(func(n int) app.UI {
-											return app.Span().Text(w.transactions[i].ProductsServices[n].Price / 100)
+											return app.Span().Text(w.transactions[i].ProductsServices[n].Price.String())
 										}),
 									),
 								),
 							).OnMouseOver(w.showTransactionDetails).OnMouseLeave(w.hideTransactionDetails),
 							app.Div().Class("t-price").Body(
 								app.If(w.transactions[i].SenderID == w.userID, func() app.UI {
-									return app.Span().Text("-" + strconv.Itoa(w.transactions[i].TotalCost/100) + " GUBI")
+									return app.Span().Text((-w.transactions[i].TotalCost).gubi())
 								}).Else(func() app.UI {
-									return app.Span().Text("+" + strconv.Itoa(w.transactions[i].TotalCost/100) + " GUBI")
+									return app.Span().Text(w.transactions[i].TotalCost.signed())
+								}),
+								app.If(w.transactions[i].direction(w.userID) == directionSale, func() app.UI {
+									return app.Div().Class("menu-btn menu-sub").Body(
+										app.Button().Class("submit submit-sub").Type("submit").Text("Refund").Value(w.transactions[i].ID).OnClick(w.startRefund),
+									)
 								}),
 							),
 						)
 					}),
+					app.If(len(w.next) > 0, func() app.UI {
+						return app.Button().Class("filter filter-btn").Type("button").Text("Load more").OnClick(w.moreTransactions)
+					}),
 				),
 				app.Div().Class("menu-btn").Body(
 					app.Button().Class("submit").Type("submit").Text("Make a payment").OnClick(w.goToPayments),
@@ -20,32 +20,20 @@ function startVideo() {
 }
 
 window.addEventListener('descriptorsFetched', (event) => {
-    const jsonData = event.detail.descriptors;
-    
-    // Parse the JSON string into an object
-    const parsedData = JSON.parse(jsonData);
-    
-    // Initialize an object to hold all reference descriptors
-    const referenceDescriptors = {};
-
-    // Iterate over each object in the parsed data
-    Object.keys(parsedData).forEach(key => {
-        // console.log(`Key: ${key}, Values: ${parsedData[key]}`);
-        // Extract values from the current object and store them in referenceDescriptors
-        referenceDescriptors[key] = parsedData[key];
-    });
-
-    console.log(referenceDescriptors); // This will log an array of arrays
-    initializeFaceRecognition(referenceDescriptors);
+    // Only templates of the enrolled faces are stored, live faces are
+    // matched against them by window.matchFace
+    const enrolledFaces = JSON.parse(event.detail.faces);
+
+    console.log(enrolledFaces); // This will log the names of the enrolled faces
+    initializeFaceRecognition(enrolledFaces);
 });
 
-async function initializeFaceRecognition(referenceDescriptors) {
+async function initializeFaceRecognition(enrolledFaces) {
     const video = document.getElementById("video");
     const canvas = document.getElementById("canvas");
     const registerButton = window.parent.document.getElementById('register-btn');
     const loginButton = window.parent.document.getElementById('login-btn');
     const confidenceThreshold = 0.70;
-    const distanceThreshold = 0.6; // Adjust as needed
     const numDescriptorsToCollect = 10; // Number of descriptors to collect
     let collectedDescriptors = []; // Array to store descriptors
     let isCollecting = false; // Flag to indicate if collecting is in progress
@@ -109,15 +97,6 @@ async function initializeFaceRecognition(referenceDescriptors) {
     // Load anti-spoofing model
     const spoofModel = await tf.loadGraphModel('/web/models/anti-spoofing.json');
 
-    // Function to calculate Euclidean distance
-    function calculateDistance(descriptor1, descriptor2) {
-        if (!descriptor1 || !descriptor2) {
-            console.warn("One or both descriptors are null/undefined in calculateDistance");
-            return Infinity; // Or some other large value
-        }
-        return faceapi.euclideanDistance(descriptor1, descriptor2);
-    }
-
     const videoWidth = video.videoWidth;
     const videoHeight = video.videoHeight;
     const displaySize = { width: videoWidth, height: videoHeight };
@@ -247,40 +226,35 @@ async function initializeFaceRecognition(referenceDescriptors) {
 
         if (detection.detection.score > confidenceThreshold && isRealFace) { // Check confidence
             if (!loginSuccessful && challengeSuccess) { // ADDED challengeSuccess check
-                Object.keys(referenceDescriptors).forEach(key => {
-                    // for (const refDescriptor of referenceDescriptors) {
-                        // console.log("refDescriptor: ", referenceDescriptors[key]);
-                        // console.log("detection.descriptor: ", detection.descriptor);
-                        const distance = calculateDistance(referenceDescriptors[key], detection.descriptor);
-                        if (distance < distanceThreshold) {
-                            // **CRITICAL: CLEAR INTERVAL FIRST**
-                            clearInterval(intervalId);
-                            console.log("Face recognition stopped after successful login.");
-
-                            loginSuccessful = true; // ADDED: Set loginSuccessful
-
-                            drawBox.options.label = 'Matched face';
-                            drawBox.draw(canvas);
-
-                            const obj = {
-                                [key]: referenceDescriptors[key]
-                              };
-
-                            // Dispatch login event with the matched reference descriptor
-                            const loginEvent = new CustomEvent('click', {
-                                detail: {
-                                    descriptor: JSON.stringify(obj), // Send only the matched descriptor
-                                }
-                            });
-
-                            loginButton.dispatchEvent(loginEvent);
-
-                            console.log("Login event dispatched!", loginEvent.detail);
-
-                            // break; // Exit the for...of loop
-                        }
-                    // }
-                })
+                if (enrolledFaces.length > 0) {
+                    const liveDescriptor = Array.from(detection.descriptor);
+                    const key = window.parent.matchFace(JSON.stringify(liveDescriptor));
+                    if (key) {
+                        // **CRITICAL: CLEAR INTERVAL FIRST**
+                        clearInterval(intervalId);
+                        console.log("Face recognition stopped after successful login.");
+
+                        loginSuccessful = true; // ADDED: Set loginSuccessful
+
+                        drawBox.options.label = 'Matched face';
+                        drawBox.draw(canvas);
+
+                        const obj = {
+                            [key]: liveDescriptor
+                        };
+
+                        // Dispatch login event with the live descriptor of the matched face
+                        const loginEvent = new CustomEvent('click', {
+                            detail: {
+                                descriptor: JSON.stringify(obj),
+                            }
+                        });
+
+                        loginButton.dispatchEvent(loginEvent);
+
+                        console.log("Login event dispatched!", loginEvent.detail);
+                    }
+                }
             }
 
             // New face detected
@@ -371,3 +345,57 @@ async function initializeFaceRecognition(referenceDescriptors) {
 
 
 
+// Payment requests are QR codes holding a gubi:pay URI. The payment page
+// opens the camera through startScan and gets the decoded URI back through
+// window.paymentScanned
+let scanStream = null;
+
+function startScan() {
+    const video = document.getElementById("scan-video");
+    const canvas = document.getElementById("scan-canvas");
+
+    if (!video || !canvas) {
+        console.error('Scan video or canvas element not found!');
+        return;
+    }
+
+    navigator.mediaDevices.getUserMedia({ video: { facingMode: "environment" } })
+        .then(stream => {
+            scanStream = stream;
+            video.srcObject = stream;
+            video.setAttribute("playsinline", true); // Keep iOS from going full screen
+            video.play();
+            requestAnimationFrame(scanFrame);
+        })
+        .catch(err => console.error(err));
+
+    function scanFrame() {
+        if (!scanStream) {
+            return; // Scan stopped
+        }
+
+        if (video.readyState === video.HAVE_ENOUGH_DATA) {
+            canvas.width = video.videoWidth;
+            canvas.height = video.videoHeight;
+            const ctx = canvas.getContext("2d", { willReadFrequently: true });
+            ctx.drawImage(video, 0, 0, canvas.width, canvas.height);
+
+            const image = ctx.getImageData(0, 0, canvas.width, canvas.height);
+            const code = jsQR(image.data, image.width, image.height, { inversionAttempts: "dontInvert" });
+            if (code && code.data.startsWith("gubi:")) {
+                stopScan();
+                window.paymentScanned(code.data);
+                return;
+            }
+        }
+
+        requestAnimationFrame(scanFrame);
+    }
+}
+
+function stopScan() {
+    if (scanStream) {
+        scanStream.getTracks().forEach(track => track.stop());
+        scanStream = null;
+    }
+}
@@ -1,15 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
-	mathRand "math/rand"
 	"net"
 	"net/http"
-	"strconv"
+	"net/url"
 	"strings"
 	"time"
 
@@ -29,8 +32,12 @@ const dbUserDevice = "user_device"
 // embedding app.Compo into a struct.
 type auth struct {
 	app.Compo
-	sh                     *shell.Shell
-	webAuthn               *webauthn.WebAuthn
+	sh                     *shell.Shell // used for the peer identity only
+	store                  Store
+	key                    ed25519.PrivateKey
+	reenroll               bool
+	loginFace              string
+	loginDescriptor        []float32
 	descriptorJSON         string
 	userDevice             UserDevice
 	currentUser            User
@@ -67,14 +74,16 @@ type UserDevice struct {
 }
 
 type User struct {
-	ID            []byte                `mapstructure:"_id" json:"_id" validate:"uuid_rfc4122"`                       // Unique identifier for the user (should be a byte array)
-	Name          string                `mapstructure:"name" json:"name" validate:"uuid_rfc4122"`                     // Username or identifier for the user
-	DisplayName   string                `mapstructure:"display_name" json:"display_name" validate:"uuid_rfc4122"`     // Display name for the user
-	CredentialIDs []webauthn.Credential `mapstructure:"credential_ids" json:"credential_ids" validate:"uuid_rfc4122"` // List of credential IDs associated with the user
-	Descriptor    map[string][]float32  `mapstructure:"descriptor" json:"descriptor" validate:"uuid_rfc4122"`         // Face descriptor for the user
-	VAT           string                `mapstructure:"vat" json:"vat" validate:"uuid_rfc4122"`                       // VAT when company
-	Country       string                `mapstructure:"country" json:"country" validate:"uuid_rfc4122"`
-	Region        string                `mapstructure:"region" json:"region" validate:"uuid_rfc4122"` // Country
+	ID            []byte                  `mapstructure:"_id" json:"_id" validate:"uuid_rfc4122"`                       // Unique identifier for the user (should be a byte array)
+	Name          string                  `mapstructure:"name" json:"name" validate:"uuid_rfc4122"`                     // Username or identifier for the user
+	DisplayName   string                  `mapstructure:"display_name" json:"display_name" validate:"uuid_rfc4122"`     // Display name for the user
+	CredentialIDs []webauthn.Credential   `mapstructure:"credential_ids" json:"credential_ids" validate:"uuid_rfc4122"` // List of credential IDs associated with the user
+	Templates     map[string]FaceTemplate `mapstructure:"templates" json:"templates" validate:"uuid_rfc4122"`           // Face templates of the user or of the associates
+	Descriptor    map[string][]float32    `mapstructure:"descriptor" json:"descriptor" validate:"uuid_rfc4122"`         // Raw face descriptors of users enrolled before templates, dropped on their next login
+	VAT           string                  `mapstructure:"vat" json:"vat" validate:"uuid_rfc4122"`                       // VAT when company
+	Country       string                  `mapstructure:"country" json:"country" validate:"uuid_rfc4122"`
+	Region        string                  `mapstructure:"region" json:"region" validate:"uuid_rfc4122"`               // Country
+	RegisteredAt  time.Time               `mapstructure:"registered_at" json:"registered_at" validate:"uuid_rfc4122"` // Time the server registered the user, from which income is owed
 }
 
 // Define your own struct that matches the CredentialCreation structure
@@ -131,6 +140,7 @@ type ResponseGet struct {
 	ClientDataJSON    string `json:"clientDataJSON"`
 	AuthenticatorData string `json:"authenticatorData"`
 	Signature         string `json:"signature"`
+	UserHandle        string `json:"userHandle,omitempty"`
 }
 
 // Implementing the webauthn.User interface
@@ -170,30 +180,27 @@ func (a *auth) OnMount(ctx app.Context) {
 		a.notificationPermission = ctx.Notifications().RequestPermission()
 	}
 
-	sh := shell.NewShell("localhost:5001")
+	sh := shell.NewShell(nodeAddress)
 	a.sh = sh
+	a.store = newStore()
+	a.key = signingKey(ctx)
+
+	// only templates of the enrolled faces are stored, so the face
+	// recognition in web/script.js matches live faces through here
+	app.Window().Set("matchFace", app.FuncOf(func(this app.Value, args []app.Value) interface{} {
+		var descriptor []float32
+		if len(args) == 0 || json.Unmarshal([]byte(args[0].String()), &descriptor) != nil {
+			return ""
+		}
+		name, _ := a.currentUser.matchFace(descriptor)
+		return name
+	}))
 
 	a.findCountry(ctx)
 
 	// a.deleteUsers()
 	// return
 
-	wconfig := &webauthn.Config{
-		RPDisplayName: "cyber-gubi",                      // Display Name for your site
-		RPID:          "localhost",                       // Generally the FQDN for your site
-		RPOrigins:     []string{"http://localhost:8000"}, // Allowed origins for WebAuthn requests
-	}
-
-	var err error
-
-	if a.webAuthn, err = webauthn.New(wconfig); err != nil {
-		ctx.Notifications().New(app.Notification{
-			Title: "Webauthn instantiate error",
-			Body:  err.Error(),
-		})
-		log.Fatal(err)
-	}
-
 	a.fetchUser(ctx)
 
 	ctx.ObserveState("entity", &a.entity)
@@ -201,6 +208,7 @@ func (a *auth) OnMount(ctx app.Context) {
 	ctx.ObserveState("termsAccepted", &a.termsAccepted).
 		OnChange(func() {
 			if a.entity == "individual" {
+				// the server refuses a face that has a wallet already
 				a.beginRegistration(ctx)
 			}
 		})
@@ -293,34 +301,17 @@ func extractIP(addr string) (string, error) {
 
 func (a *auth) getIncome(ctx app.Context) {
 	ctx.Async(func() {
-		i, err := a.sh.OrbitDocsQuery(dbIncome, "all", "")
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		income := []Income{}
-
-		if len(i) == 0 {
-			log.Fatal(err)
-		}
-
-		err = json.Unmarshal([]byte(i), &income) // Unmarshal the byte slice directly
+		done, err := proposed(a.store, nextPeriodOf(time.Now()), a.key.Public().(ed25519.PublicKey))
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		ctx.Dispatch(func(ctx app.Context) {
-			doIndexer := true
-			for _, inc := range income {
-				if inc.Period == strconv.Itoa(time.Now().Year())+"/"+strconv.Itoa(int(time.Now().Month()+1)) {
-					doIndexer = false
-				}
-			}
-
-			if doIndexer {
-				a.sh.RunInflationIndexer()
+		if !done {
+			_, err := runInflationIndexer(a.store, a.key, time.Now())
+			if err != nil {
+				log.Fatal(err)
 			}
-		})
+		}
 	})
 }
 
@@ -371,20 +362,118 @@ func (a *auth) doLogin(ctx app.Context, e app.Event) {
 		log.Fatal(err)
 	}
 
-	for name := range descriptor {
-		if len(a.currentUser.Descriptor[name]) > 0 {
+	for name, live := range descriptor {
+		matched, ok := a.currentUser.matchFace(live)
+		if ok && matched == name {
 			ctx.SetState("userID", string(a.currentUser.ID))
 			if len(a.currentUser.VAT) > 0 {
 				ctx.SetState("isBusiness", true)
 				ctx.SetState("businessName", a.currentUser.Name)
 				ctx.SetState("associateName", name)
 			}
-			a.beginLogin(ctx, string(a.currentUser.CredentialIDs[0].ID))
+			// the face is enrolled again only once the login is verified
+			a.loginFace, a.loginDescriptor = name, live
+			a.beginLogin(ctx, string(a.currentUser.ID))
 		}
 	}
 }
 
+// renewTemplates turns the raw descriptors of users enrolled before
+// templates into templates, and enrolls the face that logged in again under
+// a new salt when the user asked for it or its template is outdated. It runs
+// after the server verified the login, and completes it.
+func (a *auth) renewTemplates(ctx app.Context) {
+	ctx.GetState("reenroll", &a.reenroll)
+	name, live := a.loginFace, a.loginDescriptor
+	outdated := len(name) > 0 && a.currentUser.Templates[name].outdated()
+	if !a.reenroll && !outdated && len(a.currentUser.Descriptor) == 0 {
+		a.completeLogin(ctx)
+		return
+	}
+
+	reenroll := a.reenroll && len(name) > 0
+	ctx.Async(func() {
+		// the login updated the record on the server
+		user, err := a.store.User(string(a.currentUser.ID))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for legacyName, legacy := range user.Descriptor {
+			user.enrollFace(legacyName, legacy)
+		}
+		if reenroll || outdated {
+			user.enrollFace(name, live)
+		}
+
+		err = a.store.PutUser(user)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx.Dispatch(func(ctx app.Context) {
+			a.currentUser = user
+			if reenroll {
+				ctx.DelState("reenroll")
+				ctx.Notifications().New(app.Notification{
+					Title: "Success",
+					Body:  "Your face has been enrolled again. The old template is revoked.",
+				})
+			}
+			a.completeLogin(ctx)
+		})
+	})
+}
+
+// registerDevice registers the key of this device with the assertion of the
+// login, unless a registration already leads to it.
+func (a *auth) registerDevice(userID string, nonce []byte, data LoginData) error {
+	ring, err := loadKeyring(a.store)
+	if err != nil {
+		return err
+	}
+
+	pub := a.key.Public().(ed25519.PublicKey)
+	if ring.signs(userID, pub) {
+		return nil
+	}
+
+	decode := func(s string) []byte {
+		b, _ := base64.RawURLEncoding.DecodeString(s)
+		return b
+	}
+
+	r := KeyRegistration{
+		UserID:            userID,
+		Kind:              KeySigning,
+		PublicKey:         pub,
+		Nonce:             nonce,
+		SignerCredential:  decode(data.RawID),
+		AuthenticatorData: decode(data.Response.AuthenticatorData),
+		ClientDataJSON:    decode(data.Response.ClientDataJSON),
+		Signature:         decode(data.Response.Signature),
+	}
+	r.ID = r.hash()
+
+	return a.store.PutKeyRegistration(r)
+}
+
+// completeLogin opens the wallet once the login is verified.
+func (a *auth) completeLogin(ctx app.Context) {
+	a.loginFace, a.loginDescriptor = "", nil
+	ctx.Notifications().New(app.Notification{
+		Title: "Success",
+		Body:  "Login successful!",
+	})
+	ctx.SetState("loggedIn", true)
+	// redirect to wallet
+	ctx.Navigate("/wallet")
+}
+
 func daysRemainingInMonth(date time.Time) int {
+	// periods are months in UTC
+	date = date.UTC()
+
 	// Calculate the first day of the next month
 	firstDayOfNextMonth := time.Date(date.Year(), date.Month()+1, 1, 0, 0, 0, 0, date.Location())
 
@@ -404,14 +493,13 @@ func daysRemainingInMonth(date time.Time) int {
 }
 
 func (a *auth) fetchUser(ctx app.Context) {
-	descriptor := map[string][]float32{}
-	var descriptorJSON []byte
+	var facesJSON []byte
 	err := a.getUser(ctx)
 	if err != nil {
 		log.Println(err)
-		descriptorJSON, err = json.Marshal(descriptor)
+		facesJSON, err = json.Marshal([]string{})
 	} else {
-		descriptorJSON, err = json.Marshal(a.currentUser.Descriptor)
+		facesJSON, err = json.Marshal(a.currentUser.faceNames())
 	}
 
 	if err != nil {
@@ -422,7 +510,7 @@ func (a *auth) fetchUser(ctx app.Context) {
 	app.Window().Get("parent").Get("window").Call("dispatchEvent", // Target the iframe's window
 		app.Window().Get("CustomEvent").New("descriptorsFetched", map[string]interface{}{
 			"detail": map[string]interface{}{
-				"descriptors": string(descriptorJSON),
+				"faces": string(facesJSON),
 			},
 		}),
 	)
@@ -434,26 +522,16 @@ func (a *auth) fetchUser(ctx app.Context) {
 }
 
 func (a *auth) alreadyRegistered() (bool, error) {
-	d, err := a.sh.OrbitDocsGet(dbUserDevice, "mac")
-	if err != nil {
+	userDevice, err := a.store.Device("mac")
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	} else if err != nil {
 		return false, err
 	}
 
-	var userDevice []UserDevice
-
-	err = json.Unmarshal([]byte(d), &userDevice) // Unmarshal the byte slice directly
-	if err != nil {
-		return false, err
-	}
+	a.userDevice = userDevice
 
-	if len(userDevice) > 0 {
-		a.userDevice = userDevice[0]
-		if userDevice[0].Registered {
-			return true, nil
-		}
-	}
-
-	return false, nil
+	return userDevice.Registered, nil
 }
 
 func (a *auth) flagRegistered(ctx app.Context) {
@@ -464,12 +542,7 @@ func (a *auth) flagRegistered(ctx app.Context) {
 			Registered: true,
 		}
 
-		deviceJSON, err := json.Marshal(userDevice) // Unmarshal the byte slice directly
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		err = a.sh.OrbitDocsPut(dbUserDevice, deviceJSON)
+		err := a.store.PutDevice(userDevice)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -477,51 +550,27 @@ func (a *auth) flagRegistered(ctx app.Context) {
 }
 
 func (a *auth) getUser(ctx app.Context) error {
-	res, err := a.sh.OrbitDocsQueryEnc(dbUser, "own", "")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// sanitize json
-	res1 := strings.ReplaceAll(string(res), "\\", "")
-
-	res2 := strings.ReplaceAll(res1, `""`, `"`)
-
-	res3 := strings.ReplaceAll(res2, `"[`, `[`)
-
-	res4 := strings.ReplaceAll(res3, `:",`, `:"",`)
-
-	res5 := strings.ReplaceAll(res4, `]"`, `]`)
-
-	res6 := strings.ReplaceAll(res5, `"{`, `{`)
-
-	res7 := strings.ReplaceAll(res6, `}"`, `}`)
-
-	users := []User{}
-
-	if len(res) == 0 {
-		return errors.New("no user found")
-	}
-
-	err = json.Unmarshal([]byte(res7), &users)
+	user, err := a.store.OwnUser()
 	if err != nil {
 		return err
 	}
 
-	a.currentUser = users[0]
+	a.currentUser = user
 	ctx.SetState("currentUser", a.currentUser)
 
 	return nil
 }
 
 func (a *auth) deleteUsers() {
-	err := a.sh.OrbitDocsDelete(dbUser, "all")
+	err := a.store.Purge(dbUser)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func (a *auth) createUser(ctx app.Context, userID, credentialID string) {
+// createUser adds the face template and the business details to the user
+// the server registered with the verified credential.
+func (a *auth) createUser(ctx app.Context, userID string, finish registrationFinish) {
 	ctx.Async(func() {
 		var descriptor []float32
 		err := json.Unmarshal([]byte(a.descriptorJSON), &descriptor)
@@ -529,36 +578,36 @@ func (a *auth) createUser(ctx app.Context, userID, credentialID string) {
 			log.Fatal(err)
 		}
 
-		descriptorMap := make(map[string][]float32)
-		if len(a.associateName) == 0 {
-			// pseudonymous for individuals
-			descriptorMap["user"] = descriptor
-		} else {
-			descriptorMap[a.associateName] = descriptor
-			ctx.SetState("associateName", &a.associateName)
+		user, err := a.store.User(userID)
+		if err != nil {
+			log.Fatal(err)
 		}
 
-		user := User{
-			Name:        a.businessName,
-			DisplayName: a.businessName,
-			ID:          protocol.URLEncodedBase64(userID),
-			CredentialIDs: []webauthn.Credential{
-				{
-					ID: []byte(credentialID),
-				},
-			},
-			Descriptor: descriptorMap,
-			VAT:        a.vat,
-			Country:    a.country,
-			Region:     a.region,
+		// the first key of the user signs itself, the other peers check that
+		// the user ID is derived from it. It registers the credential, whose
+		// logins register the keys of other devices.
+		pub := a.key.Public().(ed25519.PublicKey)
+		err = a.store.PutKeyRegistration(newKeyRegistration(userID, KeySigning, nil, pub, a.key))
+		if err != nil {
+			log.Fatal(err)
 		}
 
-		userJSON, err := json.Marshal(user)
+		err = a.store.PutKeyRegistration(newKeyRegistration(userID, KeyCredential, finish.CredentialID, finish.PublicKey, a.key))
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		err = a.sh.OrbitDocsPutEnc(dbUser, userJSON)
+		user.VAT = a.vat
+		user.Country = a.country
+		user.Region = a.region
+
+		// the server enrolled the face of an individual
+		if len(a.associateName) > 0 {
+			user.enrollFace(a.associateName, descriptor)
+			ctx.SetState("associateName", &a.associateName)
+		}
+
+		err = a.store.PutUser(user)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -566,6 +615,7 @@ func (a *auth) createUser(ctx app.Context, userID, credentialID string) {
 		ctx.Dispatch(func(ctx app.Context) {
 			a.currentUser = user
 			a.flagRegistered(ctx)
+			a.beginLogin(ctx, userID)
 		})
 	})
 }
@@ -577,14 +627,9 @@ func (a *auth) updateUser(ctx app.Context) {
 		if err != nil {
 			log.Fatal(err)
 		}
-		a.currentUser.Descriptor[a.newAssociateName] = descriptor
+		a.currentUser.enrollFace(a.newAssociateName, descriptor)
 
-		userJSON, err := json.Marshal(a.currentUser)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		err = a.sh.OrbitDocsPutEnc(dbUser, userJSON)
+		err = a.store.PutUser(a.currentUser)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -601,121 +646,85 @@ func (a *auth) updateUser(ctx app.Context) {
 }
 
 func (a *auth) checkForDuplicates(ctx app.Context) bool {
-	res, err := a.sh.OrbitDocsQueryEnc(dbUser, "all", "")
+	users, err := a.store.Users()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	users := []map[string]interface{}{}
-
-	if len(res) != 0 {
-		err = json.Unmarshal([]byte(res), &users)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}
-
-	duplicates := false
-
-	if len(users) > 0 {
-		for _, usrs := range users {
-			for k, v := range usrs {
-				if k == "name" || k == "display_name" {
-					if v == a.businessName {
-						ctx.Notifications().New(app.Notification{
-							Title: "Registration error",
-							Body:  "Business with this name already exists.",
-						})
-						duplicates = true
-						break
-					}
-				} else if k == "vat" {
-					if v == a.vat {
-						ctx.Notifications().New(app.Notification{
-							Title: "Registration error",
-							Body:  "Business with this VAT number already exists.",
-						})
-						duplicates = true
-						break
-					}
-				}
-			}
+	for _, u := range users {
+		if u.Name == a.businessName || u.DisplayName == a.businessName {
+			ctx.Notifications().New(app.Notification{
+				Title: "Registration error",
+				Body:  "Business with this name already exists.",
+			})
+			return true
+		} else if u.VAT == a.vat {
+			ctx.Notifications().New(app.Notification{
+				Title: "Registration error",
+				Body:  "Business with this VAT number already exists.",
+			})
+			return true
 		}
 	}
 
-	return duplicates
+	return false
 }
 
 func (a *auth) beginRegistration(ctx app.Context) {
-	// RelyingParty instance
-	relyingParty := RelyingParty{
-		Name: a.webAuthn.Config.RPDisplayName,
-		ID:   a.webAuthn.Config.RPID,
-	}
-
-	userID := uuid.NewString()
+	// the ID is derived from the key of this device, which becomes the first
+	// key of the user
+	userID := userIDOf(a.key.Public().(ed25519.PublicKey))
 
-	us := User{
-		ID: []byte(userID),
+	us := ceremonyUser{
+		ID: userID,
 	}
 
 	if len(a.businessName) > 0 {
 		us.Name = a.businessName
 		us.DisplayName = a.businessName
+	} else {
+		err := json.Unmarshal([]byte(a.descriptorJSON), &us.Face)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	rp := app.ValueOf(map[string]interface{}{
-		"name": relyingParty.Name,
-		"id":   relyingParty.ID,
-	})
-
-	usr := app.ValueOf(map[string]interface{}{
-		"name":        us.Name,
-		"displayName": us.DisplayName,
-	})
-
-	usID := app.Window().Get("Uint8Array").New(len(us.ID))
+	ctx.Async(func() {
+		var start registrationStart
+		err := postCeremony("/webauthn/register/begin", "", us, &start)
 
-	usr.Set("id", usID)
+		ctx.Dispatch(func(ctx app.Context) {
+			if err != nil {
+				ctx.Notifications().New(app.Notification{
+					Title: "Registration error",
+					Body:  err.Error(),
+				})
+				return
+			}
 
-	as := app.ValueOf(map[string]interface{}{
-		"authenticatorAttachment": "platform",
-		"userVerification":        "required",
-		"residentKey":             "required",
+			a.createCredential(ctx, userID, start)
+		})
 	})
+}
 
-	// Create pubKeyCredParams as an array in JavaScript
-	pubKeyCredParams := app.Window().Get("Array").New()
-
-	// Add parameters to the pubKeyCredParams array
-	param1 := app.Window().Get("Object").New()
-	param1.Set("type", "public-key")
-	param1.Set("alg", -7) // Example algorithm identifier for ES256
-	pubKeyCredParams.Call("push", param1)
+func (a *auth) createCredential(ctx app.Context, userID string, start registrationStart) {
+	options := start.Options.Response
 
-	param2 := app.Window().Get("Object").New()
-	param2.Set("type", "public-key")
-	param2.Set("alg", -257) // Example algorithm identifier for RS256
-	pubKeyCredParams.Call("push", param2)
+	b, err := json.Marshal(options)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Generate a random challenge
-	// Create a new random source seeded with the current time
-	r := mathRand.New(mathRand.NewSource(time.Now().UnixNano()))
-	challengeByteArray := make([]byte, 32)
-	r.Read(challengeByteArray)
-	challenge := app.Window().Get("Uint8Array").New(len(challengeByteArray)) // Generate a random challenge
-	// Fill the Uint8Array with the byte values
-	for i, b := range challengeByteArray {
-		challenge.SetIndex(i, b)
+	// binary fields travel as base64url and must be handed over as buffers
+	publicKey := app.Window().Get("JSON").Call("parse", string(b))
+	publicKey.Set("challenge", jsBytes(options.Challenge))
+	publicKey.Get("user").Set("id", jsBytes([]byte(userID)))
+	for i, c := range options.CredentialExcludeList {
+		publicKey.Get("excludeCredentials").Index(i).Set("id", jsBytes(c.CredentialID))
 	}
 
 	obj := app.Window().Get("Object").New()
-	obj.Set("challenge", challenge)
-	obj.Set("rp", rp)
-	obj.Set("user", usr)
-	obj.Set("pubKeyCredParams", pubKeyCredParams)
-	obj.Set("authenticatorSelection", as)
-	obj.Set("publicKey", obj)
+	obj.Set("publicKey", publicKey)
 
 	// Access the navigator object
 	promise := app.Window().Get("navigator").Get("credentials").Call("create", obj)
@@ -724,14 +733,38 @@ func (a *auth) beginRegistration(ctx app.Context) {
 	promise.Call("then", app.FuncOf(func(this app.Value, args []app.Value) interface{} {
 		if len(args) > 0 {
 			cred := args[0] // The PublicKeyCredential object
-			// Get the credentialId
-			credentialID := cred.Get("id").String()
-			a.createUser(ctx, userID, credentialID)
-			ctx.SetState("userID", userID)
-			if len(a.vat) > 0 {
-				ctx.SetState("isBusiness", true)
+			response := cred.Get("response")
+			data := RegistrationData{
+				ID:    cred.Get("id").String(),
+				RawID: base64URL(cred.Get("rawId")),
+				Type:  cred.Get("type").String(),
+				Response: ResponseCreate{
+					ClientDataJSON:    base64URL(response.Get("clientDataJSON")),
+					AttestationObject: base64URL(response.Get("attestationObject")),
+				},
 			}
-			a.beginLogin(ctx, credentialID)
+
+			ctx.Async(func() {
+				// the server stores the user with the verified credential
+				var finish registrationFinish
+				err := postCeremony("/webauthn/register/finish", start.Session, data, &finish)
+
+				ctx.Dispatch(func(ctx app.Context) {
+					if err != nil {
+						ctx.Notifications().New(app.Notification{
+							Title: "Registration error",
+							Body:  err.Error(),
+						})
+						return
+					}
+
+					a.createUser(ctx, userID, finish)
+					ctx.SetState("userID", userID)
+					if len(a.vat) > 0 {
+						ctx.SetState("isBusiness", true)
+					}
+				})
+			})
 		} else {
 			ctx.Notifications().New(app.Notification{
 				Title: "Registration error",
@@ -768,39 +801,46 @@ func (a *auth) beginRegistration(ctx app.Context) {
 	}))
 }
 
-func (a *auth) beginLogin(ctx app.Context, credentialID string) {
-	// Generate a random challenge
-	// Create a new random source seeded with the current time
-	r := mathRand.New(mathRand.NewSource(time.Now().UnixNano()))
-	challengeByteArray := make([]byte, 32)
-	r.Read(challengeByteArray)
-	challenge := app.Window().Get("Uint8Array").New(len(challengeByteArray)) // Generate a random challenge
-	// Fill the Uint8Array with the byte values
-	for i, b := range challengeByteArray {
-		challenge.SetIndex(i, b)
-	}
+func (a *auth) beginLogin(ctx app.Context, userID string) {
+	ctx.Async(func() {
+		var start loginStart
+		us := ceremonyUser{
+			ID:         userID,
+			SigningKey: a.key.Public().(ed25519.PublicKey),
+		}
+		err := postCeremony("/webauthn/login/begin", "", us, &start)
+
+		ctx.Dispatch(func(ctx app.Context) {
+			if err != nil {
+				ctx.Notifications().New(app.Notification{
+					Title: "Login error",
+					Body:  err.Error(),
+				})
+				return
+			}
 
-	// Create the allowCredentials array
-	allowCredentials := app.Window().Get("Array").New(0) // Start with an empty array
+			a.getAssertion(ctx, userID, start)
+		})
+	})
+}
 
-	// Create the credential descriptor object
-	credDescriptor := app.Window().Get("Object").New()
-	credDescriptor.Set("type", "public-key")
+func (a *auth) getAssertion(ctx app.Context, userID string, start loginStart) {
+	options := start.Options.Response
 
-	// Convert credentialID to Uint8Array (if it isn't already)
-	// Assuming credentialID is a *string* representation of the ID, if not then this conversion is not needed
-	encoder := app.Window().Get("TextEncoder").New()
-	credentialIDUint8Array := encoder.Call("encode", credentialID)
-	credDescriptor.Set("id", credentialIDUint8Array)
+	b, err := json.Marshal(options)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// binary fields travel as base64url and must be handed over as buffers
+	publicKey := app.Window().Get("JSON").Call("parse", string(b))
+	publicKey.Set("challenge", jsBytes(options.Challenge))
+	for i, c := range options.AllowedCredentials {
+		publicKey.Get("allowCredentials").Index(i).Set("id", jsBytes(c.CredentialID))
+	}
 
-	// Add the credential descriptor to the allowCredentials array
-	allowCredentials.Call("push", credDescriptor)
 	obj := app.Window().Get("Object").New()
-	obj.Set("challenge", challenge)
-	obj.Set("rpId", "localhost")
-	obj.Set("userVerification", "required")
-	obj.Set("allowCredentials:", allowCredentials)
-	obj.Set("publicKey", obj)
+	obj.Set("publicKey", publicKey)
 
 	// Access the navigator object
 	promise := app.Window().Get("navigator").Get("credentials").Call("get", obj)
@@ -808,19 +848,44 @@ func (a *auth) beginLogin(ctx app.Context, credentialID string) {
 	// Step 3: Handle the promise response
 	promise.Call("then", app.FuncOf(func(this app.Value, args []app.Value) interface{} {
 		if len(args) > 0 {
-			ctx.Notifications().New(app.Notification{
-				Title: "Success",
-				Body:  "Login successful!",
+			cred := args[0] // The PublicKeyCredential object
+			response := cred.Get("response")
+			data := LoginData{
+				ID:    cred.Get("id").String(),
+				RawID: base64URL(cred.Get("rawId")),
+				Type:  cred.Get("type").String(),
+				Response: ResponseGet{
+					ClientDataJSON:    base64URL(response.Get("clientDataJSON")),
+					AuthenticatorData: base64URL(response.Get("authenticatorData")),
+					Signature:         base64URL(response.Get("signature")),
+					UserHandle:        base64URL(response.Get("userHandle")),
+				},
+			}
+
+			ctx.Async(func() {
+				// the login counts only once the server verified the signature
+				err := postCeremony("/webauthn/login/finish", start.Session, data, nil)
+				if err == nil {
+					err = a.registerDevice(userID, start.Nonce, data)
+				}
+
+				ctx.Dispatch(func(ctx app.Context) {
+					if err != nil {
+						ctx.Notifications().New(app.Notification{
+							Title: "Login error",
+							Body:  err.Error(),
+						})
+						return
+					}
+
+					a.renewTemplates(ctx)
+				})
 			})
-			ctx.SetState("loggedIn", true)
-			// redirect to wallet
-			ctx.Navigate("/wallet")
 		} else {
 			ctx.Notifications().New(app.Notification{
 				Title: "Login error",
 				Body:  "No credential returned.",
 			})
-			log.Fatal("No credential returned")
 		}
 		return nil
 	})).Call("catch", app.FuncOf(func(this app.Value, p []app.Value) interface{} {
@@ -852,6 +917,56 @@ func (a *auth) beginLogin(ctx app.Context, credentialID string) {
 	}))
 }
 
+// postCeremony sends a step of a ceremony to the server and decodes its
+// answer into v.
+func postCeremony(path, session string, body, v any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	u := app.Window().URL()
+	u.Path = path
+	u.RawQuery = url.Values{"session": {session}}.Encode()
+
+	r, err := http.Post(u.String(), "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode >= http.StatusBadRequest {
+		msg, _ := io.ReadAll(r.Body)
+		return errors.New(strings.TrimSpace(string(msg)))
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+// jsBytes copies bytes into a new Uint8Array.
+func jsBytes(b []byte) app.Value {
+	arr := app.Window().Get("Uint8Array").New(len(b))
+	app.CopyBytesToJS(arr, b)
+	return arr
+}
+
+// base64URL encodes an ArrayBuffer the way the server expects it.
+func base64URL(buf app.Value) string {
+	if !buf.Truthy() {
+		return ""
+	}
+
+	arr := app.Window().Get("Uint8Array").New(buf)
+	b := make([]byte, arr.Length())
+	app.CopyBytesToGo(b, arr)
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
 // The Render method is where the component appearance is defined. Here, a
 // webauthn is displayed.
 func (a *auth) Render() app.UI {